@@ -2,8 +2,11 @@ package client
 
 import (
 	"context"
+	"sync"
 	"time"
 
+	"assignment/lib/codec"
+	"assignment/lib/compression"
 	"assignment/lib/connection"
 	"assignment/lib/entity"
 	"assignment/lib/log"
@@ -11,31 +14,158 @@ import (
 	"github.com/pkg/errors"
 )
 
-// DefaultTimeout is the default timeout for establishing
-// a connection to the server.
-const DefaultTimeout = time.Second * 30
+const (
+	// DefaultTimeout is the default timeout for establishing
+	// a connection to the server.
+	DefaultTimeout = time.Second * 30
+	// DefaultConfirmTimeout is the default timeout for receiving the
+	// confirm of a published message from the server.
+	DefaultConfirmTimeout = time.Second * 10
+)
+
+var (
+	// ErrEmptyRetained is returned when publishing an empty retained
+	// message, which would clear the retained message of the topic.
+	ErrEmptyRetained = errors.New("empty retained message")
+	// ErrNacked is returned when the server doesn't accept a
+	// published message, wrapped with the reason.
+	ErrNacked = errors.New("message not accepted")
+	// ErrConfirmTimeout is returned when the server doesn't confirm
+	// a published message in time.
+	ErrConfirmTimeout = errors.New("confirm timed out")
+	// ErrConnectionClosed is returned for the published messages the
+	// server didn't confirm before the connection closed.
+	ErrConnectionClosed = errors.New("connection closed")
+	// ErrNoCredit is returned when the server granted no credits for
+	// publishing more messages. Publishing can be retried once the
+	// server handled the messages published before.
+	ErrNoCredit = errors.New("no credit")
+)
+
+// SubscriberCountCallback is called when the number of subscribers
+// connected to the server changes.
+type SubscriberCountCallback func(count int)
+
+// GoAwayCallback is called when the server is about to close the
+// connection.
+type GoAwayCallback func(reason string)
 
 // Client is an interface for publishing messages to the server. it
-// will also log all messages received from the server.
+// will also log all messages received from the server. The publish
+// methods wait until the server confirms the message, and fail with
+// ErrNacked if the server didn't accept it. The server grants credits
+// for publishing, the publish methods wait for credits while they're
+// exhausted and fail with ErrNoCredit if none are granted in time.
 type Client interface {
 	// Start establishes a connection with the server and starts
 	// listening to messages. Given channel is closed when connection.
 	Start(port int, connectionClosed chan struct{}) error
 	// SetMessageReceiver sets the message receiver callback.
 	SetMessageReceiver(receiver connection.MessageReceiver)
-	// Publish publishes a message to the server.
-	Publish(message string) error
+	// SetSubscriberCountCallback sets the callback called when
+	// the number of connected subscribers changes.
+	SetSubscriberCountCallback(callback SubscriberCountCallback)
+	// SetGoAwayCallback sets the callback called when the server
+	// is about to close the connection.
+	SetGoAwayCallback(callback GoAwayCallback)
+	// Publish publishes a text message to the topic.
+	Publish(topic string, message string) error
+	// PublishMessage publishes a message with an arbitrary
+	// payload to the topic set on the message.
+	PublishMessage(message entity.Message) error
+	// PublishAsync publishes a text message to the topic without
+	// waiting for the server to confirm it.
+	PublishAsync(topic string, message string) (*Confirm, error)
+	// PublishMessageAsync publishes the message without waiting for
+	// the server to confirm it, the returned Confirm is resolved once
+	// the server confirms or nacks it. It fails with ErrNoCredit
+	// instead of waiting while the credits are exhausted.
+	PublishMessageAsync(message entity.Message) (*Confirm, error)
+	// PublishWithTTL publishes a text message to the topic that
+	// expires after the time-to-live, so that the server discards it
+	// instead of delivering it late.
+	PublishWithTTL(topic string, message string, ttl time.Duration) error
+	// PublishRetained publishes a text message to the topic and
+	// makes the server retain it as the last message of the topic,
+	// which new subscribers of the topic receive when subscribing.
+	PublishRetained(topic string, message string) error
+	// ClearRetained clears the retained message of the topic.
+	ClearRetained(topic string) error
+	// PublishValue encodes the value with the client codec
+	// and publishes it to the topic.
+	PublishValue(topic string, value interface{}) error
+	// Request publishes a request with a raw payload to the topic
+	// and waits until a subscriber replies or the context is done.
+	Request(ctx context.Context, topic string, payload []byte) (entity.Message, error)
+	// RequestMessage publishes the message as a request to the
+	// topic set on the message and waits until a subscriber
+	// replies or the context is done.
+	RequestMessage(ctx context.Context, message entity.Message) (entity.Message, error)
+	// SetCodec sets the codec used by PublishValue. JSON
+	// is used by default.
+	SetCodec(codec codec.Codec)
+	// SetCompression sets the compression configuration, must be
+	// called before Start. Compression is disabled for the connection
+	// in both directions by default (compression.None), any other
+	// algorithm compresses the published messages with it and accepts
+	// compressed messages.
+	SetCompression(config compression.Config)
+	// SetProducerID sets the producer ID of the published messages
+	// that don't have one, must be called before publishing. The
+	// server drops the messages of a producer it accepted before, by
+	// their sequence number if it's set and their ID otherwise, and
+	// confirms them as duplicates. Retries after ErrConfirmTimeout
+	// must publish the same message again for it to be deduplicated.
+	SetProducerID(producerID string)
 	// Close closes the connection with the server.
 	Close() error
 }
 
 type client struct {
-	stream connection.ReadWriteStream
+	// mutex guards the callbacks.
+	mutex                   sync.RWMutex
+	messageReceiver         connection.MessageReceiver
+	subscriberCountCallback SubscriberCountCallback
+	goAwayCallback          GoAwayCallback
+
+	// replyTo is the reply topic of the requests of the client.
+	replyTo string
+	// requestMutex guards the pending requests, the channels the
+	// replies are delivered to by correlation ID.
+	requestMutex    sync.Mutex
+	pendingRequests map[string]chan entity.Message
+	// confirmMutex guards the pending confirms of the published
+	// messages, keyed by the message IDs.
+	confirmMutex    sync.Mutex
+	pendingConfirms map[string]*Confirm
+	confirmTimeout  time.Duration
+	// creditMutex guards the credit limit granted by the server and
+	// the number of messages sent, publishing is not limited until
+	// the server grants credits. creditAvailable is signalled when
+	// credits are available.
+	creditMutex     sync.Mutex
+	creditLimit     uint64
+	sentMessages    uint64
+	creditAvailable chan struct{}
+
+	stream      connection.ReadWriteStream
+	handshake   connection.Handshake
+	codec       codec.Codec
+	compression compression.Config
+	producerID  string
 }
 
 // New constructs a new publisher client.
 func New() Client {
-	return &client{}
+	return &client{
+		replyTo:         entity.NewReplyTopic(),
+		pendingRequests: make(map[string]chan entity.Message),
+		pendingConfirms: make(map[string]*Confirm),
+		confirmTimeout:  DefaultConfirmTimeout,
+		creditAvailable: make(chan struct{}, 1),
+		codec:           codec.JSON,
+		compression:     compression.DefaultConfig(),
+	}
 }
 
 func (c *client) Start(port int, connectionClosed chan struct{}) error {
@@ -46,6 +176,7 @@ func (c *client) Start(port int, connectionClosed chan struct{}) error {
 	}
 
 	c.stream.SetConnClosedCallback(func() {
+		c.failPendingConfirms()
 		connectionClosed <- struct{}{}
 	})
 
@@ -54,38 +185,391 @@ func (c *client) Start(port int, connectionClosed chan struct{}) error {
 }
 
 func (c *client) SetMessageReceiver(receiver connection.MessageReceiver) {
-	c.stream.SetMessageReceiver(receiver)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.messageReceiver = receiver
+}
+
+func (c *client) SetSubscriberCountCallback(callback SubscriberCountCallback) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.subscriberCountCallback = callback
+}
+
+func (c *client) SetGoAwayCallback(callback GoAwayCallback) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.goAwayCallback = callback
+}
+
+func (c *client) SetCompression(config compression.Config) {
+	c.compression = config
+}
+
+func (c *client) SetProducerID(producerID string) {
+	c.producerID = producerID
 }
 
 func (c *client) setupReadWriteStream(port int) (connection.ReadWriteStream, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
 	defer cancel()
 
-	conn, err := connection.Connect(ctx, port)
+	config := connection.DefaultClientConfig()
+	if c.compression.Algorithm == compression.None {
+		// Don't accept compressed messages either.
+		config.Capabilities &^= connection.CompressionCapabilities
+	}
+
+	conn, err := connection.ConnectWithConfig(ctx, port, config)
 	if err != nil {
 		return nil, errors.Wrap(err, "connect")
 	}
+	c.handshake = conn.Handshake()
 
 	log.Trace("Accepting stream...")
-	return conn.AcceptReadWriteStream(ctx, c.handleMessage)
+	return conn.AcceptReadWriteStream(ctx,
+		compression.Receiver(c.handleMessage, logDecompressError, c.compression.MaxSize), c.handleControl)
+}
+
+func (c *client) Publish(topic string, message string) error {
+	textMessage := entity.NewTextMessage(message)
+	textMessage.Topic = topic
+	return c.PublishMessage(textMessage)
+}
+
+func (c *client) PublishAsync(topic string, message string) (*Confirm, error) {
+	textMessage := entity.NewTextMessage(message)
+	textMessage.Topic = topic
+	return c.PublishMessageAsync(textMessage)
 }
 
-func (c *client) Publish(message string) error {
-	if err := c.stream.SendMessage(entity.Message{
-		Text: message,
-	}); err != nil {
-		return errors.Wrap(err, "send message")
+func (c *client) PublishWithTTL(topic string, message string, ttl time.Duration) error {
+	textMessage := entity.NewTextMessage(message)
+	textMessage.Topic = topic
+	textMessage.ExpiresAt = textMessage.Timestamp.Add(ttl)
+	return c.PublishMessage(textMessage)
+}
+
+func (c *client) PublishRetained(topic string, message string) error {
+	if message == "" {
+		// Retained messages without payload clear the retained message.
+		return errors.Wrap(ErrEmptyRetained, "publish retained")
 	}
+	textMessage := entity.NewTextMessage(message)
+	textMessage.Topic = topic
+	textMessage.Retain = true
+	return c.PublishMessage(textMessage)
+}
 
-	log.Infof("Message %q successfully published", message)
-	return nil
+func (c *client) ClearRetained(topic string) error {
+	message := entity.NewMessage(codec.ContentTypeRaw, nil)
+	message.Topic = topic
+	message.Retain = true
+	return c.PublishMessage(message)
+}
+
+func (c *client) PublishMessage(message entity.Message) error {
+	confirm, err := c.publish(message, c.confirmTimeout)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-confirm.Done():
+		return confirm.Err()
+	case <-time.After(c.confirmTimeout):
+		c.removePendingConfirm(confirm.MessageID())
+		return ErrConfirmTimeout
+	}
+}
+
+func (c *client) PublishMessageAsync(message entity.Message) (*Confirm, error) {
+	return c.publish(message, 0)
+}
+
+// publish sends the message once a credit is available, waiting for
+// credits up to the credit timeout, and returns its pending confirm.
+func (c *client) publish(message entity.Message, creditTimeout time.Duration) (*Confirm, error) {
+	if err := entity.ValidateTopic(message.Topic); err != nil {
+		return nil, errors.Wrap(err, "validate topic")
+	}
+	if message.ID == "" {
+		message.ID = entity.NewID()
+	}
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now().UTC().Round(0)
+	}
+	if message.ProducerID == "" {
+		message.ProducerID = c.producerID
+	}
+
+	if c.handshake.SupportsCompression(c.compression.Algorithm) {
+		var err error
+		if message, err = compression.Compress(message, c.compression); err != nil {
+			return nil, errors.Wrap(err, "compress message")
+		}
+	}
+
+	if err := c.waitCredit(creditTimeout); err != nil {
+		return nil, err
+	}
+
+	// The confirm is pending before the message is sent, so that it
+	// can't arrive first.
+	confirm := newConfirm(message.ID)
+	c.confirmMutex.Lock()
+	c.pendingConfirms[message.ID] = confirm
+	c.confirmMutex.Unlock()
+
+	if err := c.stream.SendMessage(message); err != nil {
+		c.removePendingConfirm(message.ID)
+		c.refundCredit()
+		return nil, errors.Wrap(err, "send message")
+	}
+
+	log.Infof("Message %s successfully published to topic %q: %s",
+		message.ID, message.Topic, message)
+	return confirm, nil
+}
+
+// waitCredit takes the credit for sending a message, waiting up to
+// the timeout while the credits are exhausted.
+func (c *client) waitCredit(timeout time.Duration) error {
+	if c.takeCredit() {
+		return nil
+	}
+	if timeout <= 0 {
+		return ErrNoCredit
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.creditAvailable:
+			if c.takeCredit() {
+				return nil
+			}
+		case <-timer.C:
+			return ErrNoCredit
+		}
+	}
+}
+
+// takeCredit takes a credit, it returns false if the credits are
+// exhausted.
+func (c *client) takeCredit() bool {
+	c.creditMutex.Lock()
+	defer c.creditMutex.Unlock()
+
+	if c.creditLimit != 0 && c.sentMessages >= c.creditLimit {
+		return false
+	}
+	c.sentMessages++
+	if c.creditLimit == 0 || c.sentMessages < c.creditLimit {
+		// Wake up the next waiter.
+		c.signalCredit()
+	}
+	return true
+}
+
+// refundCredit returns the credit of a message that wasn't sent.
+func (c *client) refundCredit() {
+	c.creditMutex.Lock()
+	defer c.creditMutex.Unlock()
+
+	c.sentMessages--
+	c.signalCredit()
+}
+
+// grantCredit raises the credit limit to the limit granted by the
+// server. Limits are absolute, so that grants can't be counted twice.
+func (c *client) grantCredit(creditLimit uint64) {
+	c.creditMutex.Lock()
+	defer c.creditMutex.Unlock()
+
+	if creditLimit > c.creditLimit {
+		c.creditLimit = creditLimit
+		c.signalCredit()
+	}
+}
+
+// signalCredit signals that credits are available, it must be called
+// with the credit mutex held.
+func (c *client) signalCredit() {
+	select {
+	case c.creditAvailable <- struct{}{}:
+	default:
+		// Already signalled.
+	}
+}
+
+func (c *client) removePendingConfirm(messageID string) {
+	c.confirmMutex.Lock()
+	defer c.confirmMutex.Unlock()
+	delete(c.pendingConfirms, messageID)
+}
+
+// handleConfirm resolves the pending confirms of the messages.
+// Confirms of messages that timed out are dropped.
+// Duplicates are confirmed like accepted messages.
+func (c *client) handleConfirm(control entity.Control) {
+	var err error
+	if control.NackReason != 0 || control.Text != "" {
+		err = &NackError{Reason: control.NackReason, Text: control.Text}
+	}
+	// The server doesn't count the messages it nacks for lack of
+	// credits, so neither does the client.
+	noCredit := control.NackReason == entity.NackNoCredit
+
+	for _, messageID := range control.MessageIDs {
+		if noCredit {
+			c.refundCredit()
+		}
+		c.confirmMutex.Lock()
+		confirm, ok := c.pendingConfirms[messageID]
+		delete(c.pendingConfirms, messageID)
+		c.confirmMutex.Unlock()
+
+		if !ok {
+			log.Warnf("Confirm of unknown message %s dropped", messageID)
+			continue
+		}
+		confirm.resolve(err, control.Duplicate)
+	}
+}
+
+// failPendingConfirms fails the confirms of the messages the server
+// didn't confirm before the connection closed.
+func (c *client) failPendingConfirms() {
+	c.confirmMutex.Lock()
+	defer c.confirmMutex.Unlock()
+
+	for messageID, confirm := range c.pendingConfirms {
+		confirm.resolve(ErrConnectionClosed, false)
+		delete(c.pendingConfirms, messageID)
+	}
+}
+
+func (c *client) PublishValue(topic string, value interface{}) error {
+	message, err := codec.Encode(c.codec, value)
+	if err != nil {
+		return errors.Wrap(err, "encode value")
+	}
+	message.Topic = topic
+	return c.PublishMessage(message)
+}
+
+func (c *client) Request(ctx context.Context, topic string, payload []byte) (entity.Message, error) {
+	message := entity.NewMessage(codec.ContentTypeRaw, payload)
+	message.Topic = topic
+	return c.RequestMessage(ctx, message)
+}
+
+func (c *client) RequestMessage(ctx context.Context, message entity.Message) (entity.Message, error) {
+	if message.ID == "" {
+		message.ID = entity.NewID()
+	}
+	message.ReplyTo = c.replyTo
+	message.CorrelationID = message.ID
+
+	reply := make(chan entity.Message, 1)
+	c.requestMutex.Lock()
+	c.pendingRequests[message.CorrelationID] = reply
+	c.requestMutex.Unlock()
+	defer func() {
+		c.requestMutex.Lock()
+		delete(c.pendingRequests, message.CorrelationID)
+		c.requestMutex.Unlock()
+	}()
+
+	if err := c.PublishMessage(message); err != nil {
+		return entity.Message{}, errors.Wrap(err, "publish request")
+	}
+
+	select {
+	case message := <-reply:
+		return message, nil
+	case <-ctx.Done():
+		return entity.Message{}, errors.Wrap(ctx.Err(), "wait for reply")
+	}
+}
+
+func (c *client) SetCodec(codec codec.Codec) {
+	c.codec = codec
+}
+
+func logDecompressError(err error, message entity.Message) {
+	log.Errorf("Error decompressing message %s, message skipped: %s", message.ID, err.Error())
 }
 
 func (c *client) handleMessage(message entity.Message) {
-	log.Infof("Received message: %q", message.Text)
+	if message.Topic == c.replyTo {
+		c.handleReply(message)
+		return
+	}
+
+	c.mutex.RLock()
+	messageReceiver := c.messageReceiver
+	c.mutex.RUnlock()
+
+	if messageReceiver != nil {
+		messageReceiver(message)
+		return
+	}
+	log.Infof("Received message %s: %s", message.ID, message)
+}
+
+// handleReply delivers the reply to the pending request with the same
+// correlation ID, replies to expired requests are dropped.
+func (c *client) handleReply(reply entity.Message) {
+	c.requestMutex.Lock()
+	pending, ok := c.pendingRequests[reply.CorrelationID]
+	delete(c.pendingRequests, reply.CorrelationID)
+	c.requestMutex.Unlock()
+
+	if !ok {
+		log.Warnf("Reply %s to unknown request %s dropped", reply.ID, reply.CorrelationID)
+		return
+	}
+	pending <- reply
+}
+
+// handleControl handles the control received from the server. The
+// callbacks are called without the mutex held, so that they can use
+// the client.
+func (c *client) handleControl(control entity.Control) {
+	switch control.Type {
+	case entity.ControlSubscriberCount:
+		log.Infof("%d subscriber(s) currently connected", control.SubscriberCount)
+		c.mutex.RLock()
+		subscriberCountCallback := c.subscriberCountCallback
+		c.mutex.RUnlock()
+
+		if subscriberCountCallback != nil {
+			subscriberCountCallback(control.SubscriberCount)
+		}
+	case entity.ControlGoAway:
+		log.Warnf("Server is closing the connection: %s", control.Text)
+		c.mutex.RLock()
+		goAwayCallback := c.goAwayCallback
+		c.mutex.RUnlock()
+
+		if goAwayCallback != nil {
+			goAwayCallback(control.Text)
+		}
+	case entity.ControlConfirm:
+		c.handleConfirm(control)
+	case entity.ControlCredit:
+		log.Tracef("Credit limit raised to %d", control.CreditLimit)
+		c.grantCredit(control.CreditLimit)
+	default:
+		log.Infof("Received %s", control)
+	}
 }
 
 func (c *client) Close() error {
+	c.failPendingConfirms()
 	if c.stream == nil {
 		return nil
 	}
@@ -7,10 +7,14 @@ import (
 	"time"
 
 	"assignment/lib/certificate"
+	"assignment/lib/codec"
 	"assignment/lib/connection"
+	"assignment/lib/connection/mocks"
 	"assignment/lib/entity"
 	"assignment/lib/testutil"
 
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -30,19 +34,33 @@ func TestClient(t *testing.T) {
 	serverMessageCollector := testutil.NewMessageCollector()
 	go func() {
 		// Start the listener and wait until publisher client connects.
-		serverConn, err := listener.Accept(context.Background())
+		quicConn, err := listener.Accept(context.Background())
 		require.NoError(t, err)
+		serverConn := connection.New(quicConn)
+		require.NoError(t, serverConn.AcceptHandshake(context.Background()))
 
-		serverStream, err := connection.New(serverConn).OpenReadWriteStream(
-			context.Background(), serverMessageCollector.Add)
+		// Collect and confirm the messages of the publisher.
+		var serverStream connection.ReadWriteStream
+		serverStreamOpened := make(chan struct{})
+		serverStream, err = serverConn.OpenReadWriteStream(context.Background(),
+			func(message entity.Message) {
+				serverMessageCollector.Add(message)
+				<-serverStreamOpened
+				require.NoError(t, serverStream.SendControl(
+					entity.NewConfirmControl(message.ID)))
+			}, nil)
 		require.NoError(t, err)
+		close(serverStreamOpened)
 
 		// TODO: do not use time.Sleep() in tests, find a better way
 		time.Sleep(time.Millisecond * 500)
 
-		// Send message to the publisher and wait until it sends a message back.
+		// Send the subscriber count and a message to the publisher
+		// and wait until it sends a message back.
+		require.NoError(t, serverStream.SendControl(
+			entity.NewSubscriberCountControl(2)))
 		require.NoError(t, serverStream.SendMessage(
-			entity.Message{Text: "Hello from Server!"}))
+			entity.NewTextMessage("Hello from Server!")))
 		serverSentMessage.Done()
 		publisherSentMessage.Wait()
 
@@ -55,10 +73,14 @@ func TestClient(t *testing.T) {
 	require.NoError(t, client.Start(8085, connectionClosedCh))
 	publisherMessageCollector := testutil.NewMessageCollector()
 	client.SetMessageReceiver(publisherMessageCollector.Add)
+	subscriberCount := make(chan int, 1)
+	client.SetSubscriberCountCallback(func(count int) {
+		subscriberCount <- count
+	})
 
 	// Wait until until server sends a message and send a message back.
 	serverSentMessage.Wait()
-	require.NoError(t, client.Publish("Hello from Publisher!"))
+	require.NoError(t, client.Publish("news", "Hello from Publisher!"))
 
 	// TODO: do not use time.Sleep() in tests, find a better way
 	time.Sleep(time.Millisecond * 200)
@@ -68,11 +90,363 @@ func TestClient(t *testing.T) {
 	<-connectionClosedCh
 	require.NoError(t, client.Close())
 
-	// Make sure that server and publisher exchanged messages.
-	require.Equal(t, []entity.Message{
-		{Text: "Hello from Server!"},
-	}, publisherMessageCollector.Get())
-	require.Equal(t, []entity.Message{
-		{Text: "Hello from Publisher!"},
-	}, serverMessageCollector.Get())
+	// Make sure that the publisher has been informed of the subscriber
+	// count separately, and that server and publisher exchanged messages.
+	require.Equal(t, 2, <-subscriberCount)
+	require.Equal(t, []string{"Hello from Server!"}, publisherMessageCollector.GetTexts())
+	require.Equal(t, []string{"Hello from Publisher!"}, serverMessageCollector.GetTexts())
+}
+
+func TestClient_PublishValue(t *testing.T) {
+	type value struct {
+		Name string
+	}
+
+	var (
+		ctrl       = gomock.NewController(t)
+		streamMock = mocks.NewMockReadWriteStream(ctrl)
+		c          = New().(*client)
+	)
+	c.stream = streamMock
+	c.SetCodec(codec.Gob)
+
+	streamMock.EXPECT().SendMessage(gomock.Any()).
+		DoAndReturn(func(message entity.Message) error {
+			require.Equal(t, codec.ContentTypeGob, message.ContentType)
+			require.Equal(t, "news", message.Topic)
+
+			var got value
+			require.NoError(t, codec.Decode(message, &got))
+			require.Equal(t, value{Name: "test"}, got)
+			confirm(c, message)
+			return nil
+		}).Times(1)
+	require.NoError(t, c.PublishValue("news", value{Name: "test"}))
+
+	// Values the codec can't encode should not be sent.
+	c.SetCodec(codec.Raw)
+	require.True(t, errors.Is(c.PublishValue("news", value{}), codec.ErrUnsupportedType))
+
+	// Messages without a topic should not be sent.
+	c.SetCodec(codec.JSON)
+	require.True(t, errors.Is(c.PublishValue("", value{}), entity.ErrInvalidTopic))
+}
+
+func TestClient_Request(t *testing.T) {
+	var (
+		ctrl       = gomock.NewController(t)
+		streamMock = mocks.NewMockReadWriteStream(ctrl)
+		c          = New().(*client)
+	)
+	c.stream = streamMock
+	receivedMessages := testutil.NewMessageCollector()
+	c.SetMessageReceiver(receivedMessages.Add)
+
+	// Reply to the first request only.
+	var replied bool
+	streamMock.EXPECT().SendMessage(gomock.Any()).
+		DoAndReturn(func(request entity.Message) error {
+			require.Equal(t, "rpc", request.Topic)
+			require.Equal(t, c.replyTo, request.ReplyTo)
+			require.Equal(t, request.ID, request.CorrelationID)
+			if !replied {
+				replied = true
+				reply, err := entity.NewReply(request, entity.NewTextMessage("pong"))
+				require.NoError(t, err)
+				go c.handleMessage(reply)
+			}
+			confirm(c, request)
+			return nil
+		}).Times(2)
+
+	reply, err := c.Request(context.Background(), "rpc", []byte("ping"))
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(reply.Payload))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err = c.Request(ctx, "rpc", []byte("ping"))
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	require.Empty(t, c.pendingRequests)
+
+	// Late replies are dropped, other messages go to the receiver.
+	late, err := entity.NewReply(entity.Message{
+		ReplyTo:       c.replyTo,
+		CorrelationID: entity.NewID(),
+	}, entity.NewTextMessage("late"))
+	require.NoError(t, err)
+	c.handleMessage(late)
+	c.handleMessage(entity.NewTextMessage("message"))
+	require.Equal(t, []string{"message"}, receivedMessages.GetTexts())
+}
+
+func TestClient_PublishRetained_and_ClearRetained(t *testing.T) {
+	var (
+		ctrl       = gomock.NewController(t)
+		streamMock = mocks.NewMockReadWriteStream(ctrl)
+		c          = New().(*client)
+	)
+	c.stream = streamMock
+
+	gomock.InOrder(
+		streamMock.EXPECT().SendMessage(gomock.Any()).
+			DoAndReturn(func(message entity.Message) error {
+				require.Equal(t, "weather", message.Topic)
+				require.Equal(t, "sunny", message.Text())
+				require.True(t, message.Retain)
+				confirm(c, message)
+				return nil
+			}).Times(1),
+		streamMock.EXPECT().SendMessage(gomock.Any()).
+			DoAndReturn(func(message entity.Message) error {
+				require.Equal(t, "weather", message.Topic)
+				require.Empty(t, message.Payload)
+				require.True(t, message.Retain)
+				confirm(c, message)
+				return nil
+			}).Times(1),
+	)
+	require.NoError(t, c.PublishRetained("weather", "sunny"))
+	require.NoError(t, c.ClearRetained("weather"))
+
+	// Empty retained messages would clear the retained message.
+	require.True(t, errors.Is(c.PublishRetained("weather", ""), ErrEmptyRetained))
+}
+
+func TestClient_PublishWithTTL(t *testing.T) {
+	var (
+		ctrl       = gomock.NewController(t)
+		streamMock = mocks.NewMockReadWriteStream(ctrl)
+		c          = New().(*client)
+	)
+	c.stream = streamMock
+
+	streamMock.EXPECT().SendMessage(gomock.Any()).
+		DoAndReturn(func(message entity.Message) error {
+			require.Equal(t, "prices", message.Topic)
+			require.Equal(t, message.Timestamp.Add(time.Second), message.ExpiresAt)
+			confirm(c, message)
+			return nil
+		}).Times(1)
+	require.NoError(t, c.PublishWithTTL("prices", "42", time.Second))
+}
+
+func TestClient_PublishMessage_confirms(t *testing.T) {
+	tests := map[string]struct {
+		confirm bool
+		nack    entity.NackReason
+		wantErr error
+	}{
+		"confirmed": {
+			confirm: true,
+		},
+		"nacked": {
+			confirm: true,
+			nack:    entity.NackQueueFull,
+			wantErr: ErrNacked,
+		},
+		"not_confirmed": {
+			wantErr: ErrConfirmTimeout,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var (
+				ctrl       = gomock.NewController(t)
+				streamMock = mocks.NewMockReadWriteStream(ctrl)
+				c          = New().(*client)
+			)
+			c.stream = streamMock
+			c.confirmTimeout = time.Millisecond * 50
+
+			streamMock.EXPECT().SendMessage(gomock.Any()).
+				DoAndReturn(func(message entity.Message) error {
+					switch {
+					case tc.nack != 0:
+						nack(c, message, tc.nack, errors.New("queue full"))
+					case tc.confirm:
+						confirm(c, message)
+					}
+					return nil
+				}).Times(1)
+
+			err := c.Publish("news", "message")
+			if tc.wantErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.True(t, errors.Is(err, tc.wantErr), err)
+			}
+			if tc.nack != 0 {
+				var nackErr *NackError
+				require.True(t, errors.As(err, &nackErr), err)
+				require.Equal(t, tc.nack, nackErr.Reason)
+				require.Contains(t, err.Error(), "queue full")
+			}
+			require.Empty(t, c.pendingConfirms)
+		})
+	}
+}
+
+func TestClient_PublishAsync(t *testing.T) {
+	var (
+		ctrl       = gomock.NewController(t)
+		streamMock = mocks.NewMockReadWriteStream(ctrl)
+		c          = New().(*client)
+	)
+	c.stream = streamMock
+	streamMock.EXPECT().SendMessage(gomock.Any()).Return(nil).Times(2)
+	streamMock.EXPECT().CloseStream().Return(nil).Times(1)
+
+	confirmed, err := c.PublishAsync("news", "confirmed")
+	require.NoError(t, err)
+	pending, err := c.PublishAsync("news", "pending")
+	require.NoError(t, err)
+
+	c.handleControl(entity.NewConfirmControl(confirmed.MessageID()))
+	require.NoError(t, confirmed.Wait(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	err = pending.Wait(ctx)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	// Messages not confirmed before closing fail.
+	require.NoError(t, c.Close())
+	<-pending.Done()
+	require.True(t, errors.Is(pending.Err(), ErrConnectionClosed))
+}
+
+func TestClient_SetProducerID(t *testing.T) {
+	var (
+		ctrl       = gomock.NewController(t)
+		streamMock = mocks.NewMockReadWriteStream(ctrl)
+		c          = New().(*client)
+	)
+	c.stream = streamMock
+	c.SetProducerID("producer")
+
+	var sent []entity.Message
+	streamMock.EXPECT().SendMessage(gomock.Any()).
+		DoAndReturn(func(message entity.Message) error {
+			sent = append(sent, message)
+			return nil
+		}).Times(2)
+
+	first, err := c.PublishAsync("news", "first")
+	require.NoError(t, err)
+	message := entity.NewTextMessage("second")
+	message.Topic = "news"
+	message.ProducerID = "other"
+	second, err := c.PublishMessageAsync(message)
+	require.NoError(t, err)
+	require.Len(t, sent, 2)
+	require.Equal(t, "producer", sent[0].ProducerID)
+	require.Equal(t, "other", sent[1].ProducerID)
+
+	// Duplicates are confirmed like accepted messages.
+	c.handleControl(entity.NewDuplicateConfirmControl(first.MessageID()))
+	require.NoError(t, first.Wait(context.Background()))
+	require.True(t, first.Duplicate())
+	c.handleControl(entity.NewConfirmControl(second.MessageID()))
+	require.NoError(t, second.Wait(context.Background()))
+	require.False(t, second.Duplicate())
+}
+
+func TestClient_credits(t *testing.T) {
+	var (
+		ctrl       = gomock.NewController(t)
+		streamMock = mocks.NewMockReadWriteStream(ctrl)
+		c          = New().(*client)
+	)
+	c.stream = streamMock
+	c.confirmTimeout = time.Millisecond * 50
+	streamMock.EXPECT().SendMessage(gomock.Any()).
+		DoAndReturn(func(message entity.Message) error {
+			confirm(c, message)
+			return nil
+		}).Times(3)
+
+	c.handleControl(entity.NewCreditControl(2))
+	for i := 0; i < 2; i++ {
+		_, err := c.PublishAsync("news", "message")
+		require.NoError(t, err)
+	}
+	_, err := c.PublishAsync("news", "message")
+	require.True(t, errors.Is(err, ErrNoCredit), err)
+	err = c.Publish("news", "message")
+	require.True(t, errors.Is(err, ErrNoCredit), err)
+
+	// Publishing waits until the server grants credits.
+	c.confirmTimeout = time.Second
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		c.handleControl(entity.NewCreditControl(3))
+	}()
+	require.NoError(t, c.Publish("news", "message"))
+}
+
+func TestClient_credits_nacked(t *testing.T) {
+	var (
+		ctrl       = gomock.NewController(t)
+		streamMock = mocks.NewMockReadWriteStream(ctrl)
+		c          = New().(*client)
+	)
+	c.stream = streamMock
+	c.confirmTimeout = time.Millisecond * 50
+	gomock.InOrder(
+		streamMock.EXPECT().SendMessage(gomock.Any()).
+			DoAndReturn(func(message entity.Message) error {
+				// The reason is told by the code, whatever the text.
+				nack(c, message, entity.NackNoCredit, errors.New("out of credit"))
+				return nil
+			}).Times(1),
+		streamMock.EXPECT().SendMessage(gomock.Any()).
+			DoAndReturn(func(message entity.Message) error {
+				confirm(c, message)
+				return nil
+			}).Times(1),
+	)
+
+	c.handleControl(entity.NewCreditControl(1))
+	err := c.Publish("news", "message")
+	require.True(t, errors.Is(err, ErrNacked), err)
+	// The credit of the nacked message is refunded.
+	require.NoError(t, c.Publish("news", "message"))
+}
+
+// confirm confirms the message to the client like the server does.
+func confirm(c *client, message entity.Message) {
+	go c.handleControl(entity.NewConfirmControl(message.ID))
+}
+
+// nack nacks the message to the client like the server does.
+func nack(c *client, message entity.Message, reason entity.NackReason, err error) {
+	go c.handleControl(entity.NewNackControl(message.ID, reason, err))
+}
+
+func TestClient_handleControl_callbacks(t *testing.T) {
+	c := New().(*client)
+	done := make(chan struct{}, 2)
+	// Callbacks can use the client.
+	c.SetSubscriberCountCallback(func(int) {
+		c.SetSubscriberCountCallback(nil)
+		done <- struct{}{}
+	})
+	c.SetGoAwayCallback(func(string) {
+		c.SetGoAwayCallback(nil)
+		done <- struct{}{}
+	})
+
+	go func() {
+		c.handleControl(entity.NewSubscriberCountControl(1))
+		c.handleControl(entity.NewGoAwayControl("Server is shutting down"))
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			require.Fail(t, "callback deadlocked")
+		}
+	}
 }
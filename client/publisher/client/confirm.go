@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"assignment/lib/entity"
+
+	"github.com/pkg/errors"
+)
+
+// NackError is the error of a published message the server didn't
+// accept, it wraps ErrNacked.
+type NackError struct {
+	// Reason is the reason the server didn't accept the message, e.g.
+	// entity.NackQueueFull if publishing it again may succeed.
+	Reason entity.NackReason
+	// Text is the human readable reason.
+	Text string
+}
+
+func (e *NackError) Error() string {
+	return e.Text + ": " + ErrNacked.Error()
+}
+
+func (e *NackError) Unwrap() error {
+	return ErrNacked
+}
+
+// Confirm is the pending confirm of a published message, resolved
+// once the server accepts or nacks the message.
+type Confirm struct {
+	messageID string
+	done      chan struct{}
+	once      sync.Once
+	err       error
+	duplicate bool
+}
+
+func newConfirm(messageID string) *Confirm {
+	return &Confirm{messageID: messageID, done: make(chan struct{})}
+}
+
+// MessageID returns the ID of the published message.
+func (c *Confirm) MessageID() string {
+	return c.messageID
+}
+
+// Done returns a channel that's closed once the confirm is resolved.
+func (c *Confirm) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns nil if the server accepted the message, a *NackError
+// wrapping ErrNacked with the reason if it didn't, or
+// ErrConnectionClosed if the connection closed before the server
+// confirmed it. It must be called once Done is closed.
+func (c *Confirm) Err() error {
+	return c.err
+}
+
+// Duplicate returns true if the server dropped the message as a
+// duplicate of a message of the producer it accepted before. It must
+// be called once Done is closed.
+func (c *Confirm) Duplicate() bool {
+	return c.duplicate
+}
+
+// Wait waits until the confirm is resolved or the context is done,
+// and returns the result of the confirm.
+func (c *Confirm) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "wait for confirm")
+	}
+}
+
+// resolve resolves the confirm, only the first result is kept.
+func (c *Confirm) resolve(err error, duplicate bool) {
+	c.once.Do(func() {
+		c.err = err
+		c.duplicate = duplicate
+		close(c.done)
+	})
+}
@@ -13,14 +13,23 @@ import (
 	"assignment/lib/log"
 )
 
+const (
+	// defaultTopic is the topic messages are published to unless
+	// specified otherwise.
+	defaultTopic = "default"
+	// producerIDEnv is the environment variable of the producer ID,
+	// unset to publish without deduplication.
+	producerIDEnv = "PUBLISHER_PRODUCER_ID"
+)
+
 func main() {
-	// Resolve port from command line arguments.
+	// Resolve port and topic from command line arguments.
 	args := os.Args[1:]
 	if len(args) == 0 {
 		panic("missing port argument")
 	}
-	if len(args) > 1 {
-		panic("mismatching number of arguments, expected 1 (port)")
+	if len(args) > 2 {
+		panic("mismatching number of arguments, expected 1 (port) or 2 (port and topic)")
 	}
 
 	port, err := strconv.Atoi(args[0])
@@ -28,9 +37,15 @@ func main() {
 		panic(fmt.Sprintf("error parsing port: %v", err))
 	}
 
+	topic := defaultTopic
+	if len(args) > 1 {
+		topic = args[1]
+	}
+
 	// Set up the publisher client.
 	connectionClosed := make(chan struct{})
 	client := client.New()
+	client.SetProducerID(os.Getenv(producerIDEnv))
 	if err := client.Start(port, connectionClosed); err != nil {
 		panic(fmt.Sprintf("error starting publisher client: %v", err))
 	}
@@ -38,14 +53,14 @@ func main() {
 	go func() {
 		// Set up console reader for publishing messages.
 		reader := bufio.NewReader(os.Stdin)
-		log.Info("ENTER MESSAGES TO THE CONSOLE TO PUBLISH")
+		log.Infof("ENTER MESSAGES TO THE CONSOLE TO PUBLISH TO TOPIC %q", topic)
 
 		for {
 			text, _ := reader.ReadString('\n')
 			text = strings.Replace(text, "\n", "", -1)
 
-			if err := client.Publish(text); err != nil {
-				panic(fmt.Sprintf("error publishing message: %v", err))
+			if err := client.Publish(topic, text); err != nil {
+				log.Errorf("Error publishing message: %s", err.Error())
 			}
 		}
 	}()
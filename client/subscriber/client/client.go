@@ -2,42 +2,214 @@ package client
 
 import (
 	"context"
+	"sync"
 	"time"
 
+	"assignment/lib/codec"
+	"assignment/lib/compression"
 	"assignment/lib/connection"
 	"assignment/lib/entity"
+	"assignment/lib/filter"
 	"assignment/lib/log"
 
 	"github.com/pkg/errors"
+	"go.uber.org/multierr"
 )
 
-// DefaultTimeout is the default timeout for establishing
-// a connection to the servec.
-const DefaultTimeout = time.Hour
+const (
+	// DefaultTimeout is the default timeout for establishing
+	// a connection to the servec.
+	DefaultTimeout = time.Hour
+	// DefaultCommandTimeout is the default timeout for receiving
+	// the result of a command from the server.
+	DefaultCommandTimeout = time.Second * 10
+)
+
+var (
+	// ErrCommandFailed is returned when the server rejects a command.
+	ErrCommandFailed = errors.New("command failed")
+	// ErrCommandTimeout is returned when the server doesn't send the
+	// result of a command in time.
+	ErrCommandTimeout = errors.New("command timed out")
+	// ErrNotStarted is returned when sending replies, acks or
+	// replays before the client is started.
+	ErrNotStarted = errors.New("client not started")
+)
+
+// GoAwayCallback is called when the server is about to close the
+// connection.
+type GoAwayCallback func(reason string)
 
 // Client represents subscriber client that receives messages
 // from the servec. The receiver will log all received messages.
 type Client interface {
 	// Start establishes a connection with the server and
 	// begins listening to messages. Given channel is closed
-	// when connection is closed by the servec.
-	Start(port int, connectionClosed chan struct{}) error
+	// when connection is closed by the servec. A non-empty session
+	// ID resumes the session of that ID on the server: the messages
+	// published to its subscriptions while the client was
+	// disconnected are delivered first, in order, as long as the
+	// session didn't expire.
+	Start(port int, sessionID string, connectionClosed chan struct{}) error
 	// SetMessageReceiver sets the message receiver callback.
 	SetMessageReceiver(receiver connection.MessageReceiver)
+	// SetGoAwayCallback sets the callback called when the server
+	// is about to close the connection.
+	SetGoAwayCallback(callback GoAwayCallback)
+	// SetGapCallback sets the callback called when the client missed
+	// messages of a publisher, before the message after them is
+	// received. The server numbers the messages of each publisher it
+	// sends on the connection, so gaps are the messages it dropped
+	// for the client, e.g. from its full queue. Gaps are always
+	// logged. Messages are numbered in the order they're sent, and
+	// a message of a higher priority is sent before the earlier
+	// ones of lower priorities of the same publisher, so the numbers
+	// don't tell the publish order across priorities.
+	SetGapCallback(callback GapCallback)
+	// Subscribe subscribes to messages published to the topics
+	// matching the topic filter. Filters can contain single-level
+	// (+) and multi-level (#) wildcards, e.g. "orders/+/created" or
+	// "metrics/#". Topics subscribed to before Start are declared
+	// to the server when connecting, afterwards the command waits
+	// for the server to confirm it.
+	Subscribe(filter string) error
+	// SubscribeWithFilter subscribes to messages published to the
+	// topics matching the topic filter whose headers match the
+	// header filter expression, e.g. `region == "eu" && priority >= 3`.
+	// Subscribing again to the same topic filter replaces its
+	// header filter.
+	SubscribeWithFilter(topicFilter, headerFilter string) error
+	// SubscribeWithOptions subscribes to messages published to the
+	// topics matching the topic filter with the given options, see
+	// SubscribeOptions.
+	SubscribeWithOptions(topicFilter string, options SubscribeOptions) error
+	// Unsubscribe unsubscribes from the topic filter.
+	Unsubscribe(filter string) error
+	// Pause makes the server hold back messages until Resume is
+	// called. Messages exceeding the server queue meanwhile are
+	// dropped.
+	Pause() error
+	// Resume resumes the delivery of messages after Pause.
+	Resume() error
+	// Reply replies to the request with a raw payload, the reply is
+	// routed back to the publisher waiting for it.
+	Reply(request entity.Message, payload []byte) error
+	// ReplyMessage replies to the request with the message.
+	ReplyMessage(request entity.Message, reply entity.Message) error
+	// EnableAcks switches to acknowledged delivery: the server sends
+	// at most prefetch messages that were not acknowledged with Ack,
+	// the server default if zero, and redelivers the messages not
+	// acknowledged in time or before reconnecting, marked as
+	// redelivered. It can't be disabled.
+	EnableAcks(prefetch int) error
+	// Ack acknowledges the messages received in acknowledged
+	// delivery. Acks are not confirmed by the server.
+	Ack(messages ...entity.Message) error
+	// ReplayFromOffset makes the server send the messages of its
+	// durable log published to the topics matching the topic filter,
+	// from the offset on. Offsets are counted per topic from 1 and
+	// carried by the messages, so a subscriber resumes from the
+	// offset after the last message it handled. Replayed messages are
+	// received with the live ones, topic by topic.
+	ReplayFromOffset(topicFilter string, offset uint64) error
+	// ReplaySince is like ReplayFromOffset, but replays the messages
+	// logged since the time.
+	ReplaySince(topicFilter string, since time.Time) error
+	// SetCompression sets the compression configuration, must be
+	// called before Start. By default (compression.None) the server
+	// decompresses messages before sending them to the subscriber,
+	// any other algorithm accepts compressed messages.
+	SetCompression(config compression.Config)
 	// Close closes the connection with the servec.
 	Close() error
 }
 
+// SubscribeOptions are the options of a subscription.
+type SubscribeOptions struct {
+	// HeaderFilter is the filter expression messages headers must
+	// match, e.g. `region == "eu"`. Empty matches all messages.
+	HeaderFilter string
+	// Group is the name of the subscriber group to join. Each message
+	// is delivered to one member of a group only, so that replicas of
+	// a worker share the messages. Empty receives all messages.
+	Group string
+	// GroupKey is the header whose value picks the group member
+	// receiving a message, so that messages with the same value go to
+	// the same member. Empty picks the members round-robin. All
+	// members of a group must use the same key.
+	GroupKey string
+}
+
+// control returns the subscribe control of the topic filters with the
+// options.
+func (o SubscribeOptions) control(topicFilters ...string) entity.Control {
+	control := entity.NewGroupSubscribeControl(o.Group, o.GroupKey, topicFilters...)
+	control.Filter = o.HeaderFilter
+	return control
+}
+
 type client struct {
-	readStream connection.ReadStream
+	// mutex guards the callbacks, the subscription state, the
+	// control stream and the pending commands.
+	mutex          sync.RWMutex
+	goAwayCallback GoAwayCallback
+	gapCallback    GapCallback
+	// filters maps the topic filters to their subscription options.
+	filters map[string]SubscribeOptions
+	paused  bool
+	// acks is set in acknowledged delivery, consumerID identifies
+	// the client across reconnects so that the server redelivers the
+	// messages it didn't acknowledge.
+	acks       bool
+	prefetch   int
+	consumerID string
+	// sessionID identifies the session resumed on connecting, empty
+	// without session.
+	sessionID string
+	// controlStream is the stream for sending commands and replies
+	// to the server and receiving the command results, nil until the
+	// client is started.
+	controlStream connection.ReadWriteStream
+	// pendingCommands are the commands waiting for their results,
+	// keyed by the command IDs.
+	pendingCommands map[uint64]chan entity.Control
+	lastCommandID   uint64
+	// commandMutex serializes the commands, so that the subscription
+	// state is updated in the order the server applies them.
+	commandMutex   sync.Mutex
+	commandTimeout time.Duration
+
+	readStream  connection.ReadStream
+	compression compression.Config
+	// sequences detect the gaps in the messages received on the
+	// connection, guarded by mutex.
+	sequences *sequenceTracker
 }
 
 // New constructs a new subscriber client.
 func New() Client {
-	return &client{}
+	return &client{
+		filters:         make(map[string]SubscribeOptions),
+		pendingCommands: make(map[uint64]chan entity.Control),
+		commandTimeout:  DefaultCommandTimeout,
+		compression:     compression.DefaultConfig(),
+		consumerID:      entity.NewID(),
+		sequences:       newSequenceTracker(DefaultMaxSequenceStreams),
+	}
 }
 
-func (c *client) Start(port int, connectionClosed chan struct{}) error {
+func (c *client) Start(port int, sessionID string, connectionClosed chan struct{}) error {
+	if sessionID != "" {
+		if err := entity.ValidateSessionID(sessionID); err != nil {
+			return errors.Wrap(err, "validate session ID")
+		}
+	}
+	c.mutex.Lock()
+	c.sessionID = sessionID
+	// Messages are numbered per connection.
+	c.sequences = newSequenceTracker(DefaultMaxSequenceStreams)
+	c.mutex.Unlock()
+
 	var err error
 	c.readStream, err = c.setupReadStream(port)
 	if err != nil {
@@ -53,32 +225,376 @@ func (c *client) Start(port int, connectionClosed chan struct{}) error {
 }
 
 func (c *client) SetMessageReceiver(receiver connection.MessageReceiver) {
-	c.readStream.SetMessageReceiver(receiver)
+	c.readStream.SetMessageReceiver(c.detectGaps(compression.Receiver(receiver, logDecompressError, c.compression.MaxSize)))
+}
+
+func (c *client) SetGapCallback(callback GapCallback) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.gapCallback = callback
+}
+
+// detectGaps wraps the message receiver to report the messages missed
+// before each received message.
+func (c *client) detectGaps(receiver connection.MessageReceiver) connection.MessageReceiver {
+	return func(message entity.Message) {
+		c.mutex.RLock()
+		sequences, gapCallback := c.sequences, c.gapCallback
+		c.mutex.RUnlock()
+
+		if gap, ok := sequences.check(message); ok {
+			log.Warnf("Missed %s", gap)
+			if gapCallback != nil {
+				gapCallback(gap)
+			}
+		}
+		receiver(message)
+	}
+}
+
+func (c *client) SetGoAwayCallback(callback GoAwayCallback) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.goAwayCallback = callback
+}
+
+func (c *client) Subscribe(filter string) error {
+	return c.SubscribeWithFilter(filter, "")
+}
+
+func (c *client) SubscribeWithFilter(topicFilter, headerFilter string) error {
+	return c.SubscribeWithOptions(topicFilter, SubscribeOptions{HeaderFilter: headerFilter})
+}
+
+func (c *client) SubscribeWithOptions(topicFilter string, options SubscribeOptions) error {
+	if err := entity.ValidateTopicFilter(topicFilter); err != nil {
+		return errors.Wrap(err, "validate topic filter")
+	}
+	if options.HeaderFilter != "" {
+		if _, err := filter.Parse(options.HeaderFilter); err != nil {
+			return errors.Wrap(err, "parse header filter")
+		}
+	}
+	if err := entity.ValidateGroup(options.Group, options.GroupKey); err != nil {
+		return errors.Wrap(err, "validate group")
+	}
+
+	return c.command(options.control(topicFilter), func() {
+		c.filters[topicFilter] = options
+	})
+}
+
+func (c *client) Unsubscribe(filter string) error {
+	return c.command(entity.NewUnsubscribeControl(filter), func() {
+		delete(c.filters, filter)
+	})
+}
+
+func (c *client) Pause() error {
+	return c.command(entity.NewPauseControl(), func() {
+		c.paused = true
+	})
+}
+
+func (c *client) Resume() error {
+	return c.command(entity.NewResumeControl(), func() {
+		c.paused = false
+	})
+}
+
+func (c *client) Reply(request entity.Message, payload []byte) error {
+	return c.ReplyMessage(request, entity.NewMessage(codec.ContentTypeRaw, payload))
+}
+
+func (c *client) ReplyMessage(request entity.Message, reply entity.Message) error {
+	reply, err := entity.NewReply(request, reply)
+	if err != nil {
+		return errors.Wrap(err, "address reply")
+	}
+	if reply.ID == "" {
+		reply.ID = entity.NewID()
+	}
+	if reply.Timestamp.IsZero() {
+		reply.Timestamp = time.Now().UTC().Round(0)
+	}
+
+	c.mutex.RLock()
+	controlStream := c.controlStream
+	c.mutex.RUnlock()
+
+	if controlStream == nil {
+		return ErrNotStarted
+	}
+	if err := controlStream.SendMessage(reply); err != nil {
+		return errors.Wrap(err, "send reply")
+	}
+
+	log.Infof("Reply %s to request %s sent: %s", reply.ID, request.ID, reply)
+	return nil
+}
+
+func (c *client) EnableAcks(prefetch int) error {
+	if prefetch < 0 {
+		return errors.Errorf("negative prefetch %d", prefetch)
+	}
+	return c.command(entity.NewAckModeControl(c.consumerID, prefetch), func() {
+		c.acks = true
+		c.prefetch = prefetch
+	})
+}
+
+func (c *client) Ack(messages ...entity.Message) error {
+	messageIDs := make([]string, len(messages))
+	for i, message := range messages {
+		messageIDs[i] = message.ID
+	}
+
+	c.mutex.RLock()
+	controlStream := c.controlStream
+	c.mutex.RUnlock()
+
+	if controlStream == nil {
+		return ErrNotStarted
+	}
+	if err := controlStream.SendControl(entity.NewAckControl(messageIDs...)); err != nil {
+		return errors.Wrap(err, "send ack")
+	}
+	return nil
+}
+
+func (c *client) ReplayFromOffset(topicFilter string, offset uint64) error {
+	return c.replay(entity.NewReplayControl(offset, time.Time{}, topicFilter))
+}
+
+func (c *client) ReplaySince(topicFilter string, since time.Time) error {
+	return c.replay(entity.NewReplayControl(0, since, topicFilter))
+}
+
+// replay sends the replay command, replays are not declared when
+// connecting so the client must be started.
+func (c *client) replay(control entity.Control) error {
+	for _, topicFilter := range control.Topics {
+		if err := entity.ValidateTopicFilter(topicFilter); err != nil {
+			return errors.Wrap(err, "validate topic filter")
+		}
+	}
+
+	c.mutex.RLock()
+	started := c.controlStream != nil
+	c.mutex.RUnlock()
+
+	if !started {
+		return ErrNotStarted
+	}
+	return c.command(control, func() {})
+}
+
+// command sends the command to the server and waits for its result if
+// the client is started, and applies the command to the client state
+// if it succeeded.
+func (c *client) command(control entity.Control, apply func()) error {
+	c.commandMutex.Lock()
+	defer c.commandMutex.Unlock()
+
+	c.mutex.RLock()
+	controlStream := c.controlStream
+	c.mutex.RUnlock()
+
+	if controlStream != nil {
+		if err := c.sendCommand(controlStream, control); err != nil {
+			return errors.Wrapf(err, "%s", control)
+		}
+	}
+
+	c.mutex.Lock()
+	apply()
+	c.mutex.Unlock()
+	return nil
+}
+
+// sendCommand sends the command and waits for its result.
+func (c *client) sendCommand(controlStream connection.WriteStream, control entity.Control) error {
+	result := make(chan entity.Control, 1)
+	c.mutex.Lock()
+	c.lastCommandID++
+	control.CommandID = c.lastCommandID
+	c.pendingCommands[control.CommandID] = result
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pendingCommands, control.CommandID)
+		c.mutex.Unlock()
+	}()
+
+	if err := controlStream.SendControl(control); err != nil {
+		return errors.Wrap(err, "send command")
+	}
+
+	select {
+	case reply := <-result:
+		if reply.Text != "" {
+			return errors.Wrap(ErrCommandFailed, reply.Text)
+		}
+		return nil
+	case <-time.After(c.commandTimeout):
+		return ErrCommandTimeout
+	}
+}
+
+func (c *client) SetCompression(config compression.Config) {
+	c.compression = config
+}
+
+// SetTypedReceiver sets a message receiver callback on the client that
+// decodes message payloads into values of type T with the codec matching
+// the message content type. Messages that can't be decoded are logged
+// and skipped.
+func SetTypedReceiver[T any](c Client, receiver func(value T, message entity.Message)) {
+	c.SetMessageReceiver(codec.Receiver(receiver, logDecodeError))
+}
+
+func logDecodeError(err error, message entity.Message) {
+	log.Errorf("Error decoding message %s, message skipped: %s", message.ID, err.Error())
+}
+
+func logDecompressError(err error, message entity.Message) {
+	log.Errorf("Error decompressing message %s, message skipped: %s", message.ID, err.Error())
 }
 
 func (c *client) setupReadStream(port int) (connection.ReadStream, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
 	defer cancel()
 
-	conn, err := connection.Connect(ctx, port)
+	config := connection.DefaultClientConfig()
+	if c.compression.Algorithm == compression.None {
+		// Let the server decompress the messages instead.
+		config.Capabilities &^= connection.CompressionCapabilities
+	}
+
+	conn, err := connection.ConnectWithConfig(ctx, port, config)
 	if err != nil {
 		return nil, errors.Wrap(err, "connect")
 	}
 
+	if err := c.setupControlStream(ctx, conn); err != nil {
+		return nil, errors.Wrap(err, "setup control stream")
+	}
+
 	log.Trace("Accepting read stream and waiting for messages...")
-	return conn.AcceptReadStream(ctx, c.handleMessage)
+	return conn.AcceptReadStream(ctx,
+		c.detectGaps(compression.Receiver(c.handleMessage, logDecompressError, c.compression.MaxSize)), c.handleControl)
+}
+
+// setupControlStream opens the control stream and declares the
+// subscriptions made so far, one subscribe command per options.
+// The subscribe command without header filter is sent even without
+// any topic filters, so that the server can accept the stream. In
+// acknowledged delivery, the ack mode is declared before the
+// subscriptions so that their retained messages are tracked too, and
+// the session is resumed before the subscriptions so that its queued
+// messages are delivered first. The results of these commands are
+// only logged if they failed.
+func (c *client) setupControlStream(ctx context.Context, conn connection.Connection) error {
+	controlStream, err := conn.OpenReadWriteStream(ctx, nil, c.handleControl)
+	if err != nil {
+		return errors.Wrap(err, "open control stream")
+	}
+
+	c.commandMutex.Lock()
+	defer c.commandMutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	topicFilters := map[SubscribeOptions][]string{{}: nil}
+	for topicFilter, options := range c.filters {
+		topicFilters[options] = append(topicFilters[options], topicFilter)
+	}
+	var commands []entity.Control
+	if c.acks || c.sessionID != "" {
+		commands = append(commands, entity.NewSubscribeControl())
+	}
+	if c.acks {
+		commands = append(commands, entity.NewAckModeControl(c.consumerID, c.prefetch))
+	}
+	if c.sessionID != "" {
+		commands = append(commands, entity.NewSessionControl(c.sessionID))
+	}
+	commands = append(commands, entity.NewSubscribeControl(topicFilters[SubscribeOptions{}]...))
+	delete(topicFilters, SubscribeOptions{})
+	for options, filters := range topicFilters {
+		commands = append(commands, options.control(filters...))
+	}
+	if c.paused {
+		commands = append(commands, entity.NewPauseControl())
+	}
+
+	for _, command := range commands {
+		c.lastCommandID++
+		command.CommandID = c.lastCommandID
+		if err := controlStream.SendControl(command); err != nil {
+			return errors.Wrapf(err, "send %s", command)
+		}
+	}
+
+	c.controlStream = controlStream
+	return nil
 }
 
 func (c *client) handleMessage(message entity.Message) {
-	log.Infof("Received message: %q", message.Text)
+	log.Infof("Received message %s: %s", message.ID, message)
+}
+
+// handleControl handles the control received from the server. The
+// callbacks are called without the mutex held, so that they can use
+// the client.
+func (c *client) handleControl(control entity.Control) {
+	switch control.Type {
+	case entity.ControlWelcome:
+		log.Infof("Server says: %s", control.Text)
+	case entity.ControlGoAway:
+		log.Warnf("Server is closing the connection: %s", control.Text)
+		c.mutex.RLock()
+		goAwayCallback := c.goAwayCallback
+		c.mutex.RUnlock()
+
+		if goAwayCallback != nil {
+			goAwayCallback(control.Text)
+		}
+	case entity.ControlResult:
+		c.mutex.RLock()
+		result, ok := c.pendingCommands[control.CommandID]
+		c.mutex.RUnlock()
+
+		// The result channel is buffered for the only result of the
+		// command, so sending never blocks.
+		if ok {
+			result <- control
+		} else if control.Text != "" {
+			log.Errorf("Command %d failed: %s", control.CommandID, control.Text)
+		}
+	default:
+		log.Infof("Received %s", control)
+	}
 }
 
 func (c *client) Close() error {
-	if c.readStream == nil {
-		return nil
+	c.mutex.RLock()
+	controlStream := c.controlStream
+	c.mutex.RUnlock()
+
+	var merr error
+	if controlStream != nil {
+		merr = multierr.Append(merr, errors.Wrap(
+			controlStream.CloseStream(),
+			"close control stream",
+		))
+	}
+	if c.readStream != nil {
+		merr = multierr.Append(merr, errors.Wrap(
+			c.readStream.CloseStream(),
+			"close read stream",
+		))
 	}
-	return errors.Wrap(
-		c.readStream.CloseStream(),
-		"close read stream",
-	)
+	return merr
 }
@@ -2,15 +2,21 @@ package client
 
 import (
 	"context"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"assignment/lib/certificate"
+	"assignment/lib/codec"
 	"assignment/lib/connection"
+	"assignment/lib/connection/mocks"
 	"assignment/lib/entity"
+	"assignment/lib/filter"
 	"assignment/lib/testutil"
 
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -22,48 +28,307 @@ func TestClient(t *testing.T) {
 	var serverMessageSent sync.WaitGroup
 	var subscriberReceivedMessage sync.WaitGroup
 	serverMessageSent.Add(1)
-	subscriberReceivedMessage.Add(1)
+	subscriberReceivedMessage.Add(2)
 
 	// Set up the server.
 	listener, err := connection.StartListener(8086, tlsConfig)
 	require.NoError(t, err)
+	serverControlCollector := testutil.NewControlCollector()
 
 	go func() {
 		// Start the listener and wait until subscriber client connects.
-		serverConn, err := listener.Accept(context.Background())
+		quicConn, err := listener.Accept(context.Background())
 		require.NoError(t, err)
+		serverConn := connection.New(quicConn)
+		require.NoError(t, serverConn.AcceptHandshake(context.Background()))
 
-		serverStream, err := connection.New(serverConn).OpenWriteStream(
+		serverStream, err := serverConn.OpenWriteStream(
 			context.Background())
 		require.NoError(t, err)
 
+		// Accept the control stream, collect the subscriber commands
+		// and send back their results. Unsubscribing fails.
+		var controlStream connection.ReadWriteStream
+		controlStreamAccepted := make(chan struct{})
+		controlStream, err = serverConn.AcceptReadWriteStream(context.Background(), nil,
+			func(control entity.Control) {
+				serverControlCollector.Add(control)
+				<-controlStreamAccepted
+
+				var err error
+				if control.Type == entity.ControlUnsubscribe {
+					err = errors.New("not subscribed")
+				}
+				require.NoError(t, controlStream.SendControl(
+					entity.NewResultControl(control.CommandID, err)))
+			})
+		require.NoError(t, err)
+		close(controlStreamAccepted)
+
 		// TODO: do not use time.Sleep() in tests, find a better way
 		time.Sleep(time.Millisecond * 500)
 
-		// Send message to the subscriver and wait until it receives it.
+		// Send message and go-away to the subscriber and wait until
+		// it receives them.
 		require.NoError(t, serverStream.SendMessage(
-			entity.Message{Text: "Hello from Server!"}))
+			entity.NewTextMessage("Hello from Server!")))
+		require.NoError(t, serverStream.SendControl(
+			entity.NewGoAwayControl("Server is shutting down")))
 		serverMessageSent.Done()
 		subscriberReceivedMessage.Wait()
 
+		// Wait until the subscriber sent all of its commands.
+		require.Eventually(t, func() bool {
+			return len(serverControlCollector.Get()) == 7
+		}, time.Second, time.Millisecond*10)
+
 		require.NoError(t, serverStream.CloseStream())
 	}()
 
 	client := New()
+	require.NoError(t, client.Subscribe("news"))
+	require.NoError(t, client.SubscribeWithFilter("orders/#", `region == "eu"`))
 	connectionClosedCh := make(chan struct{})
-	require.NoError(t, client.Start(8086, connectionClosedCh))
+	goAwayReason := make(chan string, 1)
+	client.SetGoAwayCallback(func(reason string) {
+		goAwayReason <- reason
+		subscriberReceivedMessage.Done()
+	})
+	require.NoError(t, client.Start(8086, "", connectionClosedCh))
 	subscriberMessageCollector := testutil.NewMessageCollector()
 	client.SetMessageReceiver(func(message entity.Message) {
 		subscriberMessageCollector.Add(message)
 		subscriberReceivedMessage.Done()
 	})
+	require.NoError(t, client.Subscribe("sports"))
+	require.NoError(t, client.SubscribeWithOptions("jobs/#",
+		SubscribeOptions{Group: "workers", GroupKey: "customer"}))
+	require.NoError(t, client.Pause())
+	require.NoError(t, client.Resume())
+	err = client.Unsubscribe("weather")
+	require.True(t, errors.Is(err, ErrCommandFailed), err)
+	require.Contains(t, err.Error(), "not subscribed")
 
 	// Wait until server sends the message and shuts down.
 	<-connectionClosedCh
 	require.NoError(t, client.Close())
 
-	// Make sure the subscriber received the message.
-	require.Equal(t, []entity.Message{
-		{Text: "Hello from Server!"},
-	}, subscriberMessageCollector.Get())
+	// Make sure the subscriber received the message and the go-away.
+	require.Equal(t, []string{"Hello from Server!"}, subscriberMessageCollector.GetTexts())
+	require.Equal(t, "Server is shutting down", <-goAwayReason)
+
+	// Make sure the subscriber declared its topics and sent its
+	// commands with increasing command IDs.
+	require.Equal(t, []entity.Control{
+		withCommandID(entity.NewSubscribeControl("news"), 1),
+		withCommandID(entity.NewFilteredSubscribeControl(`region == "eu"`, "orders/#"), 2),
+		withCommandID(entity.NewSubscribeControl("sports"), 3),
+		withCommandID(entity.NewGroupSubscribeControl("workers", "customer", "jobs/#"), 4),
+		withCommandID(entity.NewPauseControl(), 5),
+		withCommandID(entity.NewResumeControl(), 6),
+		withCommandID(entity.NewUnsubscribeControl("weather"), 7),
+	}, serverControlCollector.Get())
+}
+
+func withCommandID(control entity.Control, commandID uint64) entity.Control {
+	control.CommandID = commandID
+	return control
+}
+
+func TestClient_SubscribeWithOptions_errors(t *testing.T) {
+	tests := map[string]struct {
+		topicFilter string
+		options     SubscribeOptions
+		wantErr     error
+	}{
+		"invalid_topic_filter": {
+			topicFilter: "orders/#/created",
+			options:     SubscribeOptions{HeaderFilter: `region == "eu"`},
+			wantErr:     entity.ErrInvalidTopicFilter,
+		},
+		"invalid_header_filter": {
+			topicFilter: "orders/#",
+			options:     SubscribeOptions{HeaderFilter: `region = "eu"`},
+			wantErr:     filter.ErrInvalidFilter,
+		},
+		"group_key_without_group": {
+			topicFilter: "orders/#",
+			options:     SubscribeOptions{GroupKey: "customer"},
+			wantErr:     entity.ErrInvalidGroup,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := New().SubscribeWithOptions(tc.topicFilter, tc.options)
+			require.True(t, errors.Is(err, tc.wantErr), err)
+		})
+	}
+}
+
+func TestSetTypedReceiver(t *testing.T) {
+	type value struct {
+		Name string
+	}
+
+	c := &receiverClient{}
+	var received []value
+	SetTypedReceiver(c, func(v value, _ entity.Message) {
+		received = append(received, v)
+	})
+
+	message, err := codec.Encode(codec.JSON, value{Name: "test"})
+	require.NoError(t, err)
+	c.receiver(message)
+	// Messages that can't be decoded should be skipped.
+	c.receiver(entity.NewMessage(codec.ContentTypeJSON, []byte("{")))
+
+	require.Equal(t, []value{{Name: "test"}}, received)
+}
+
+// receiverClient is a client that only stores the message receiver.
+type receiverClient struct {
+	Client
+	receiver connection.MessageReceiver
+}
+
+func (c *receiverClient) SetMessageReceiver(receiver connection.MessageReceiver) {
+	c.receiver = receiver
+}
+
+func TestClient_Reply(t *testing.T) {
+	request := entity.NewTextMessage("ping")
+	request.ReplyTo = entity.NewReplyTopic()
+	request.CorrelationID = request.ID
+
+	// Replies can't be sent before the client is started.
+	c := New().(*client)
+	require.True(t, errors.Is(c.Reply(request, []byte("pong")), ErrNotStarted))
+
+	ctrl := gomock.NewController(t)
+	controlStreamMock := mocks.NewMockReadWriteStream(ctrl)
+	c.controlStream = controlStreamMock
+	controlStreamMock.EXPECT().SendMessage(gomock.Any()).
+		DoAndReturn(func(reply entity.Message) error {
+			require.Equal(t, request.ReplyTo, reply.Topic)
+			require.Equal(t, request.CorrelationID, reply.CorrelationID)
+			require.Equal(t, codec.ContentTypeRaw, reply.ContentType)
+			require.Equal(t, []byte("pong"), reply.Payload)
+			return nil
+		}).Times(1)
+	require.NoError(t, c.Reply(request, []byte("pong")))
+
+	// Messages that are not requests can't be replied to.
+	err := c.Reply(entity.NewTextMessage("not a request"), []byte("pong"))
+	require.True(t, errors.Is(err, entity.ErrNotRequest), err)
+}
+
+func TestClient_EnableAcks_and_Ack(t *testing.T) {
+	message := entity.NewTextMessage("message")
+
+	// Acks can't be sent before the client is started.
+	c := New().(*client)
+	require.True(t, errors.Is(c.Ack(message), ErrNotStarted))
+	require.Error(t, c.EnableAcks(-1))
+	require.NoError(t, c.Subscribe("orders/#"))
+	require.NoError(t, c.EnableAcks(10))
+
+	// The ack mode is declared before the subscriptions when
+	// connecting.
+	ctrl := gomock.NewController(t)
+	controlStreamMock := mocks.NewMockReadWriteStream(ctrl)
+	connMock := mocks.NewMockConnection(ctrl)
+	connMock.EXPECT().OpenReadWriteStream(gomock.Any(), nil, gomock.Any()).
+		Return(controlStreamMock, nil).Times(1)
+	var sent []entity.Control
+	controlStreamMock.EXPECT().SendControl(gomock.Any()).
+		DoAndReturn(func(control entity.Control) error {
+			sent = append(sent, control)
+			return nil
+		}).Times(4)
+	require.NoError(t, c.setupControlStream(context.Background(), connMock))
+	require.NoError(t, c.Ack(message))
+
+	require.Equal(t, []entity.Control{
+		withCommandID(entity.NewSubscribeControl(), 1),
+		withCommandID(entity.NewAckModeControl(c.consumerID, 10), 2),
+		withCommandID(entity.NewSubscribeControl("orders/#"), 3),
+		entity.NewAckControl(message.ID),
+	}, sent)
+}
+
+func TestClient_ReplayFromOffset_and_ReplaySince(t *testing.T) {
+	// Replays can't be requested before the client is started.
+	c := New().(*client)
+	require.True(t, errors.Is(c.ReplayFromOffset("orders/#", 1), ErrNotStarted))
+	require.True(t, errors.Is(c.ReplayFromOffset("orders/#/", 1), entity.ErrInvalidTopicFilter))
+
+	ctrl := gomock.NewController(t)
+	controlStreamMock := mocks.NewMockReadWriteStream(ctrl)
+	c.controlStream = controlStreamMock
+	var sent []entity.Control
+	controlStreamMock.EXPECT().SendControl(gomock.Any()).
+		DoAndReturn(func(control entity.Control) error {
+			sent = append(sent, control)
+			go c.handleControl(entity.NewResultControl(control.CommandID, nil))
+			return nil
+		}).Times(2)
+
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, c.ReplayFromOffset("orders/#", 42))
+	require.NoError(t, c.ReplaySince("orders/+", since))
+	require.Equal(t, []entity.Control{
+		withCommandID(entity.NewReplayControl(42, time.Time{}, "orders/#"), 1),
+		withCommandID(entity.NewReplayControl(0, since, "orders/+"), 2),
+	}, sent)
+}
+
+func TestClient_Start_session(t *testing.T) {
+	c := New().(*client)
+	err := c.Start(8086, strings.Repeat("s", entity.MaxSessionIDLength+1), make(chan struct{}))
+	require.True(t, errors.Is(err, entity.ErrInvalidSessionID), err)
+
+	// The session is resumed after the ack mode and before the
+	// subscriptions when connecting.
+	c.sessionID = "session"
+	require.NoError(t, c.Subscribe("orders/#"))
+	require.NoError(t, c.EnableAcks(10))
+	ctrl := gomock.NewController(t)
+	controlStreamMock := mocks.NewMockReadWriteStream(ctrl)
+	connMock := mocks.NewMockConnection(ctrl)
+	connMock.EXPECT().OpenReadWriteStream(gomock.Any(), nil, gomock.Any()).
+		Return(controlStreamMock, nil).Times(1)
+	var sent []entity.Control
+	controlStreamMock.EXPECT().SendControl(gomock.Any()).
+		DoAndReturn(func(control entity.Control) error {
+			sent = append(sent, control)
+			return nil
+		}).Times(4)
+	require.NoError(t, c.setupControlStream(context.Background(), connMock))
+
+	require.Equal(t, []entity.Control{
+		withCommandID(entity.NewSubscribeControl(), 1),
+		withCommandID(entity.NewAckModeControl(c.consumerID, 10), 2),
+		withCommandID(entity.NewSessionControl("session"), 3),
+		withCommandID(entity.NewSubscribeControl("orders/#"), 4),
+	}, sent)
+}
+
+func TestClient_handleControl_callbacks(t *testing.T) {
+	c := New().(*client)
+	done := make(chan string, 1)
+	// Callbacks can use the client.
+	c.SetGoAwayCallback(func(reason string) {
+		c.SetGapCallback(func(Gap) {})
+		c.SetGoAwayCallback(nil)
+		done <- reason
+	})
+
+	go c.handleControl(entity.NewGoAwayControl("Server is shutting down"))
+	select {
+	case reason := <-done:
+		require.Equal(t, "Server is shutting down", reason)
+	case <-time.After(time.Second):
+		require.Fail(t, "go-away callback deadlocked")
+	}
 }
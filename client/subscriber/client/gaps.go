@@ -0,0 +1,112 @@
+package client
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"assignment/lib/entity"
+)
+
+// DefaultMaxSequenceStreams is the default number of publishers whose
+// last sequence numbers are tracked, the least recently active ones
+// are forgotten first.
+const DefaultMaxSequenceStreams = 10000
+
+// Gap is a run of messages of a publisher the client missed, e.g.
+// because the server dropped them from its full queue.
+type Gap struct {
+	PublisherID string
+	// From and To are the first and the last missed sequence numbers.
+	From uint64
+	To   uint64
+}
+
+// Missed returns the number of missed messages.
+func (g Gap) Missed() uint64 {
+	return g.To - g.From + 1
+}
+
+func (g Gap) String() string {
+	return fmt.Sprintf("%d messages %d-%d of publisher %s", g.Missed(), g.From, g.To, g.PublisherID)
+}
+
+// GapCallback is called when the client detects missed messages.
+type GapCallback func(gap Gap)
+
+// sequenceStream is the last sequence number of a publisher.
+type sequenceStream struct {
+	publisherID string
+	last        uint64
+}
+
+// sequenceTracker detects the gaps in the sequence numbers of the
+// messages of each publisher received on a connection. The server
+// numbers them per connection from 1, in the order it sends them.
+type sequenceTracker struct {
+	mutex sync.Mutex
+	// maxStreams bounds the number of streams, recent lists the
+	// streams most recently active first. Once streams were forgotten,
+	// new streams start at their first message, since they may be
+	// forgotten ones.
+	maxStreams int
+	streams    map[string]*list.Element
+	recent     *list.List
+	forgotten  bool
+}
+
+func newSequenceTracker(maxStreams int) *sequenceTracker {
+	if maxStreams <= 0 {
+		maxStreams = DefaultMaxSequenceStreams
+	}
+	return &sequenceTracker{
+		maxStreams: maxStreams,
+		streams:    make(map[string]*list.Element),
+		recent:     list.New(),
+	}
+}
+
+// check records the sequence number of the message, it returns the gap
+// before the message if messages were missed since the last one of its
+// publisher. Unnumbered messages are never gaps.
+func (t *sequenceTracker) check(message entity.Message) (Gap, bool) {
+	if message.PublisherID == "" || message.PublisherSequence == 0 {
+		return Gap{}, false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stream := t.stream(message.PublisherID, message.PublisherSequence)
+	if message.PublisherSequence <= stream.last {
+		return Gap{}, false
+	}
+	gap := Gap{
+		PublisherID: message.PublisherID,
+		From:        stream.last + 1,
+		To:          message.PublisherSequence - 1,
+	}
+	stream.last = message.PublisherSequence
+	return gap, gap.From <= gap.To
+}
+
+// stream returns the stream of the publisher and marks it as the most
+// recently active one, it must be called with the mutex held.
+func (t *sequenceTracker) stream(publisherID string, sequence uint64) *sequenceStream {
+	if element, ok := t.streams[publisherID]; ok {
+		t.recent.MoveToFront(element)
+		return element.Value.(*sequenceStream)
+	}
+
+	if len(t.streams) >= t.maxStreams {
+		oldest := t.recent.Remove(t.recent.Back()).(*sequenceStream)
+		delete(t.streams, oldest.publisherID)
+		t.forgotten = true
+	}
+	stream := &sequenceStream{publisherID: publisherID}
+	if t.forgotten {
+		stream.last = sequence - 1
+	}
+	t.streams[publisherID] = t.recent.PushFront(stream)
+	return stream
+}
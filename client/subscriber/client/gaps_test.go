@@ -0,0 +1,119 @@
+package client
+
+import (
+	"testing"
+
+	"assignment/lib/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSequencedMessage(publisherID string, sequence uint64) entity.Message {
+	message := entity.NewTextMessage("Hello")
+	message.Topic = "news"
+	message.PublisherID = publisherID
+	message.PublisherSequence = sequence
+	return message
+}
+
+func TestSequenceTracker_check(t *testing.T) {
+	tests := map[string]struct {
+		maxStreams int
+		messages   []entity.Message
+		want       []Gap
+	}{
+		"in_order": {
+			messages: []entity.Message{
+				newSequencedMessage("a", 1),
+				newSequencedMessage("a", 2),
+				newSequencedMessage("a", 3),
+			},
+		},
+		"gap": {
+			messages: []entity.Message{
+				newSequencedMessage("a", 1),
+				newSequencedMessage("a", 4),
+				newSequencedMessage("a", 6),
+			},
+			want: []Gap{
+				{PublisherID: "a", From: 2, To: 3},
+				{PublisherID: "a", From: 5, To: 5},
+			},
+		},
+		"gap_before_first_message": {
+			messages: []entity.Message{newSequencedMessage("a", 3)},
+			want:     []Gap{{PublisherID: "a", From: 1, To: 2}},
+		},
+		"streams_per_publisher": {
+			messages: []entity.Message{
+				newSequencedMessage("a", 1),
+				newSequencedMessage("b", 1),
+				newSequencedMessage("a", 2),
+				newSequencedMessage("b", 2),
+			},
+		},
+		"late": {
+			messages: []entity.Message{
+				newSequencedMessage("a", 1),
+				newSequencedMessage("a", 2),
+				newSequencedMessage("a", 1),
+				newSequencedMessage("a", 3),
+			},
+		},
+		"unnumbered": {
+			messages: []entity.Message{
+				newSequencedMessage("a", 1),
+				entity.NewTextMessage("Hello"),
+				newSequencedMessage("a", 0),
+				newSequencedMessage("a", 2),
+			},
+		},
+		"forgotten_stream": {
+			// The stream of a is forgotten for b, so it starts again.
+			maxStreams: 1,
+			messages: []entity.Message{
+				newSequencedMessage("a", 1),
+				newSequencedMessage("b", 1),
+				newSequencedMessage("a", 5),
+				newSequencedMessage("a", 7),
+			},
+			want: []Gap{{PublisherID: "a", From: 6, To: 6}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			tracker := newSequenceTracker(tc.maxStreams)
+			var got []Gap
+			for _, message := range tc.messages {
+				if gap, ok := tracker.check(message); ok {
+					got = append(got, gap)
+				}
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestClient_SetGapCallback(t *testing.T) {
+	c := New().(*client)
+	var gaps []Gap
+	c.SetGapCallback(func(gap Gap) {
+		gaps = append(gaps, gap)
+	})
+
+	var received []uint64
+	receiver := c.detectGaps(func(message entity.Message) {
+		received = append(received, message.PublisherSequence)
+	})
+	for _, sequence := range []uint64{1, 2, 5} {
+		receiver(newSequencedMessage("a", sequence))
+	}
+
+	// Gaps are reported before the message after them is received.
+	require.Equal(t, []uint64{1, 2, 5}, received)
+	require.Equal(t, []Gap{{PublisherID: "a", From: 3, To: 4}}, gaps)
+	assert.Equal(t, uint64(2), gaps[0].Missed())
+	assert.Equal(t, "2 messages 3-4 of publisher a", gaps[0].String())
+}
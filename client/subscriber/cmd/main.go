@@ -11,25 +11,40 @@ import (
 	"assignment/lib/log"
 )
 
+const (
+	// defaultTopic is the topic subscribed to unless specified otherwise.
+	defaultTopic = "default"
+	// sessionIDEnv is the environment variable of the session ID,
+	// unset to subscribe without session.
+	sessionIDEnv = "SUBSCRIBER_SESSION_ID"
+)
+
 func main() {
-	// Resolve port from command line arguments.
+	// Resolve port and topics from command line arguments.
 	args := os.Args[1:]
 	if len(args) == 0 {
 		panic("missing port argument")
 	}
-	if len(args) > 1 {
-		panic("mismatching number of arguments, expected 1 (port)")
-	}
 
 	port, err := strconv.Atoi(args[0])
 	if err != nil {
 		panic(fmt.Sprintf("error parsing port: %v", err))
 	}
 
+	topics := args[1:]
+	if len(topics) == 0 {
+		topics = []string{defaultTopic}
+	}
+
 	// Set up the subscriber client.
 	connectionClosed := make(chan struct{})
 	client := client.New()
-	if err := client.Start(port, connectionClosed); err != nil {
+	for _, topic := range topics {
+		if err := client.Subscribe(topic); err != nil {
+			panic(fmt.Sprintf("error subscribing to topic %q: %v", topic, err))
+		}
+	}
+	if err := client.Start(port, os.Getenv(sessionIDEnv), connectionClosed); err != nil {
 		panic(fmt.Sprintf("error starting subscriber client: %v", err))
 	}
 
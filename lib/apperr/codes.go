@@ -4,4 +4,10 @@ const (
 	// ErrCodeClosedByClient is the error code returned with the
 	// error when client closes the connection.
 	ErrCodeClosedByClient = 1
+	// ErrCodeFrameTooLarge is the error code returned when the
+	// peer sends a frame larger than the maximum frame size.
+	ErrCodeFrameTooLarge = 2
+	// ErrCodeProtocolMismatch is the error code returned when the
+	// peers fail to agree on the protocol version or capabilities.
+	ErrCodeProtocolMismatch = 3
 )
@@ -0,0 +1,168 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"sync"
+
+	"assignment/lib/entity"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ContentTypeJSON is the content type of JSON encoded payloads.
+	ContentTypeJSON = "application/json"
+	// ContentTypeGob is the content type of gob encoded payloads.
+	ContentTypeGob = "application/x-gob"
+	// ContentTypeRaw is the content type of raw binary payloads.
+	ContentTypeRaw = "application/octet-stream"
+)
+
+var (
+	// ErrUnknownCodec is returned when there is no codec registered
+	// for the content type of a message.
+	ErrUnknownCodec = errors.New("unknown codec")
+	// ErrUnsupportedType is returned when a codec can't encode or
+	// decode a value of the given type.
+	ErrUnsupportedType = errors.New("unsupported type")
+)
+
+// Codec encodes values to message payloads and decodes them back.
+type Codec interface {
+	// ContentType returns the content type of the encoded payloads.
+	// It identifies the codec in the messages it encodes.
+	ContentType() string
+	// Marshal encodes the value.
+	Marshal(value interface{}) ([]byte, error)
+	// Unmarshal decodes the data into the value pointed to.
+	Unmarshal(data []byte, value interface{}) error
+}
+
+var (
+	// JSON encodes values with encoding/json.
+	JSON Codec = jsonCodec{}
+	// Gob encodes values with encoding/gob.
+	Gob Codec = gobCodec{}
+	// Raw passes byte slices and strings through as is.
+	Raw Codec = rawCodec{contentType: ContentTypeRaw}
+	// Text passes byte slices and strings through as plain text.
+	Text Codec = rawCodec{contentType: entity.ContentTypeText}
+)
+
+var registry = struct {
+	sync.RWMutex
+	codecs map[string]Codec
+}{
+	codecs: map[string]Codec{
+		ContentTypeJSON:        JSON,
+		ContentTypeGob:         Gob,
+		ContentTypeRaw:         Raw,
+		entity.ContentTypeText: Text,
+	},
+}
+
+// Register registers the codec for its content type, replacing any
+// codec previously registered for the same content type.
+func Register(codec Codec) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.codecs[codec.ContentType()] = codec
+}
+
+// ForContentType returns the codec registered for the content type.
+func ForContentType(contentType string) (Codec, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	codec, ok := registry.codecs[contentType]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownCodec, "content type %q", contentType)
+	}
+	return codec, nil
+}
+
+// Encode encodes the value with the codec into a new message.
+func Encode(codec Codec, value interface{}) (entity.Message, error) {
+	payload, err := codec.Marshal(value)
+	if err != nil {
+		return entity.Message{}, errors.Wrapf(err, "marshal %s", codec.ContentType())
+	}
+	return entity.NewMessage(codec.ContentType(), payload), nil
+}
+
+// Decode decodes the message payload into the value pointed to with
+// the codec matching the message content type.
+func Decode(message entity.Message, value interface{}) error {
+	codec, err := ForContentType(message.ContentType)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(
+		codec.Unmarshal(message.Payload, value),
+		"unmarshal %s", codec.ContentType())
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string {
+	return ContentTypeGob
+}
+
+func (gobCodec) Marshal(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+type rawCodec struct {
+	contentType string
+}
+
+func (c rawCodec) ContentType() string {
+	return c.contentType
+}
+
+func (rawCodec) Marshal(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, errors.Wrapf(ErrUnsupportedType, "%T", value)
+	}
+}
+
+func (rawCodec) Unmarshal(data []byte, value interface{}) error {
+	switch v := value.(type) {
+	case *[]byte:
+		*v = data
+	case *string:
+		*v = string(data)
+	default:
+		return errors.Wrapf(ErrUnsupportedType, "%T", value)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package codec
+
+import (
+	"testing"
+
+	"assignment/lib/entity"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testValue struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func TestCodec_Encode_and_Decode(t *testing.T) {
+	value := testValue{Name: "test", Count: 3, Tags: []string{"a", "b"}}
+
+	for _, codec := range []Codec{JSON, Gob} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			message, err := Encode(codec, value)
+			require.NoError(t, err)
+			require.Equal(t, codec.ContentType(), message.ContentType)
+			require.NotEmpty(t, message.ID)
+
+			// Make sure the codec survives the wire encoding.
+			message, err = entity.MessageFromBytes(message.Bytes())
+			require.NoError(t, err)
+
+			var got testValue
+			require.NoError(t, Decode(message, &got))
+			require.Equal(t, value, got)
+		})
+	}
+}
+
+func TestCodec_raw(t *testing.T) {
+	for _, codec := range []Codec{Raw, Text} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			message, err := Encode(codec, "Hello, World!")
+			require.NoError(t, err)
+
+			var text string
+			require.NoError(t, Decode(message, &text))
+			require.Equal(t, "Hello, World!", text)
+
+			var data []byte
+			require.NoError(t, Decode(message, &data))
+			require.Equal(t, []byte("Hello, World!"), data)
+
+			_, err = Encode(codec, 123)
+			require.True(t, errors.Is(err, ErrUnsupportedType))
+			require.True(t, errors.Is(Decode(message, &testValue{}), ErrUnsupportedType))
+		})
+	}
+}
+
+func TestCodec_Decode_unknown_codec(t *testing.T) {
+	message := entity.NewMessage("application/unknown", []byte("data"))
+	var data []byte
+	require.True(t, errors.Is(Decode(message, &data), ErrUnknownCodec))
+}
+
+func TestCodec_Register(t *testing.T) {
+	codec := rawCodec{contentType: "application/test"}
+	Register(codec)
+
+	got, err := ForContentType("application/test")
+	require.NoError(t, err)
+	require.Equal(t, codec, got)
+}
+
+func TestReceiver(t *testing.T) {
+	var (
+		received []testValue
+		failed   []entity.Message
+		receiver = Receiver(
+			func(value testValue, _ entity.Message) {
+				received = append(received, value)
+			},
+			func(_ error, message entity.Message) {
+				failed = append(failed, message)
+			},
+		)
+		value = testValue{Name: "test"}
+	)
+
+	message, err := Encode(JSON, value)
+	require.NoError(t, err)
+	receiver(message)
+
+	invalid := entity.NewMessage(ContentTypeJSON, []byte("{"))
+	receiver(invalid)
+
+	assert.Equal(t, []testValue{value}, received)
+	assert.Equal(t, []entity.Message{invalid}, failed)
+}
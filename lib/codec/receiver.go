@@ -0,0 +1,23 @@
+package codec
+
+import (
+	"assignment/lib/entity"
+)
+
+// Receiver returns a message receiver callback that decodes message
+// payloads into values of type T with the codec matching the message
+// content type. Messages that fail to decode are passed to the error
+// handler instead.
+func Receiver[T any](
+	receiver func(value T, message entity.Message),
+	errorHandler func(err error, message entity.Message),
+) func(message entity.Message) {
+	return func(message entity.Message) {
+		var value T
+		if err := Decode(message, &value); err != nil {
+			errorHandler(err, message)
+			return
+		}
+		receiver(value, message)
+	}
+}
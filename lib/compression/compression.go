@@ -0,0 +1,218 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+
+	"assignment/lib/entity"
+
+	"github.com/pkg/errors"
+)
+
+// Algorithm is a payload compression algorithm.
+type Algorithm string
+
+const (
+	// None disables compression.
+	None Algorithm = "none"
+	// Gzip compresses payloads with gzip.
+	Gzip Algorithm = "gzip"
+	// Flate compresses payloads with deflate.
+	Flate Algorithm = "deflate"
+)
+
+const (
+	// DefaultThreshold is the default payload size in bytes below which
+	// messages are sent uncompressed.
+	DefaultThreshold = 1024
+	// DefaultMaxSize is the default maximum size of a decompressed
+	// payload, the default maximum message size of the connections.
+	DefaultMaxSize = 64 * 1024 * 1024
+)
+
+var (
+	// ErrUnknownAlgorithm is returned for unsupported compression algorithms.
+	ErrUnknownAlgorithm = errors.New("unknown compression algorithm")
+	// ErrPayloadTooLarge is returned when a payload decompresses to more
+	// than the maximum size.
+	ErrPayloadTooLarge = errors.New("decompressed payload too large")
+)
+
+// Config contains the compression configuration.
+type Config struct {
+	// Algorithm is the algorithm used to compress outgoing messages.
+	Algorithm Algorithm
+	// Threshold is the payload size in bytes below which
+	// messages are sent uncompressed.
+	Threshold int
+	// MaxSize is the maximum size of a decompressed payload in bytes,
+	// DefaultMaxSize if not positive.
+	MaxSize int
+}
+
+// DefaultConfig returns the default compression configuration, which
+// doesn't compress messages.
+func DefaultConfig() Config {
+	return Config{
+		Algorithm: None,
+		Threshold: DefaultThreshold,
+		MaxSize:   DefaultMaxSize,
+	}
+}
+
+// Algorithms returns all supported compression algorithms.
+func Algorithms() []Algorithm {
+	return []Algorithm{Gzip, Flate}
+}
+
+// ParseAlgorithm parses the algorithm name.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch algorithm := Algorithm(name); algorithm {
+	case None, Gzip, Flate:
+		return algorithm, nil
+	default:
+		return "", errors.Wrapf(ErrUnknownAlgorithm, "%q", name)
+	}
+}
+
+// Compress compresses the message payload with the configured algorithm
+// and flags the message with the content encoding header. Messages that
+// are already compressed or smaller than the threshold are returned as is.
+func Compress(message entity.Message, config Config) (entity.Message, error) {
+	if config.Algorithm == None || config.Algorithm == "" {
+		return message, nil
+	}
+	if IsCompressed(message) || len(message.Payload) < config.Threshold {
+		return message, nil
+	}
+
+	var buffer bytes.Buffer
+	writer, err := newWriter(&buffer, config.Algorithm)
+	if err != nil {
+		return entity.Message{}, err
+	}
+	if _, err := writer.Write(message.Payload); err != nil {
+		return entity.Message{}, errors.Wrap(err, "compress payload")
+	}
+	if err := writer.Close(); err != nil {
+		return entity.Message{}, errors.Wrap(err, "compress payload")
+	}
+
+	message.Payload = buffer.Bytes()
+	message.Headers = withHeader(message.Headers,
+		entity.HeaderContentEncoding, string(config.Algorithm))
+	return message, nil
+}
+
+// Decompress decompresses the message payload if the message is
+// compressed and removes the content encoding header. Payloads that
+// decompress to more than maxSize bytes, DefaultMaxSize if not positive,
+// fail with ErrPayloadTooLarge, so that small payloads can't expand to
+// exhaust the memory.
+func Decompress(message entity.Message, maxSize int) (entity.Message, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if !IsCompressed(message) {
+		return message, nil
+	}
+
+	algorithm := Encoding(message)
+	reader, err := newReader(bytes.NewReader(message.Payload), algorithm)
+	if err != nil {
+		return entity.Message{}, err
+	}
+	defer reader.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return entity.Message{}, errors.Wrapf(err, "decompress %s payload", algorithm)
+	}
+	if len(payload) > maxSize {
+		return entity.Message{}, errors.Wrapf(ErrPayloadTooLarge,
+			"%s payload exceeds the limit of %d bytes", algorithm, maxSize)
+	}
+
+	message.Payload = payload
+	message.Headers = withoutHeader(message.Headers, entity.HeaderContentEncoding)
+	return message, nil
+}
+
+// IsCompressed returns true if the message payload is compressed.
+func IsCompressed(message entity.Message) bool {
+	return Encoding(message) != ""
+}
+
+// Encoding returns the algorithm the message payload is compressed with.
+func Encoding(message entity.Message) Algorithm {
+	return Algorithm(message.Headers[entity.HeaderContentEncoding])
+}
+
+func newWriter(w io.Writer, algorithm Algorithm) (io.WriteCloser, error) {
+	switch algorithm {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Flate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	default:
+		return nil, errors.Wrapf(ErrUnknownAlgorithm, "%q", algorithm)
+	}
+}
+
+func newReader(r io.Reader, algorithm Algorithm) (io.ReadCloser, error) {
+	switch algorithm {
+	case Gzip:
+		reader, err := gzip.NewReader(r)
+		return reader, errors.Wrap(err, "read gzip header")
+	case Flate:
+		return flate.NewReader(r), nil
+	default:
+		return nil, errors.Wrapf(ErrUnknownAlgorithm, "%q", algorithm)
+	}
+}
+
+// withHeader returns a copy of the headers with the header set, so that
+// messages shared with other goroutines are never modified.
+func withHeader(headers map[string]string, key, value string) map[string]string {
+	copied := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		copied[k] = v
+	}
+	copied[key] = value
+	return copied
+}
+
+// withoutHeader returns a copy of the headers without the header.
+func withoutHeader(headers map[string]string, key string) map[string]string {
+	copied := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if k != key {
+			copied[k] = v
+		}
+	}
+	if len(copied) == 0 {
+		return nil
+	}
+	return copied
+}
+
+// Receiver returns a message receiver callback that decompresses
+// messages before passing them to the receiver. Messages that fail
+// to decompress, or decompress to more than maxSize bytes, are passed
+// to the error handler instead.
+func Receiver(
+	receiver func(message entity.Message),
+	errorHandler func(err error, message entity.Message),
+	maxSize int,
+) func(message entity.Message) {
+	return func(message entity.Message) {
+		decompressed, err := Decompress(message, maxSize)
+		if err != nil {
+			errorHandler(err, message)
+			return
+		}
+		receiver(decompressed)
+	}
+}
@@ -0,0 +1,126 @@
+package compression
+
+import (
+	"bytes"
+	"testing"
+
+	"assignment/lib/entity"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompress_and_Decompress(t *testing.T) {
+	for _, algorithm := range Algorithms() {
+		t.Run(string(algorithm), func(t *testing.T) {
+			message := entity.NewTextMessage(string(bytes.Repeat([]byte("Hello, World! "), 100)))
+			message.Headers = map[string]string{"region": "eu"}
+
+			compressed, err := Compress(message, Config{Algorithm: algorithm, Threshold: 10})
+			require.NoError(t, err)
+			require.True(t, IsCompressed(compressed))
+			require.Equal(t, algorithm, Encoding(compressed))
+			require.Less(t, len(compressed.Payload), len(message.Payload))
+			// The original message should not be modified.
+			require.False(t, IsCompressed(message))
+
+			// Compressing again should not double compress.
+			again, err := Compress(compressed, Config{Algorithm: algorithm, Threshold: 10})
+			require.NoError(t, err)
+			require.Equal(t, compressed, again)
+
+			decompressed, err := Decompress(compressed, 0)
+			require.NoError(t, err)
+			require.Equal(t, message, decompressed)
+		})
+	}
+}
+
+func TestCompress_skipped(t *testing.T) {
+	message := entity.NewTextMessage("Hello, World!")
+
+	tests := map[string]Config{
+		"below_threshold": {Algorithm: Gzip, Threshold: 1024},
+		"no_algorithm":    {Algorithm: None},
+		"zero_value":      {},
+	}
+
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := Compress(message, config)
+			require.NoError(t, err)
+			require.Equal(t, message, got)
+		})
+	}
+}
+
+func TestDecompress_errors(t *testing.T) {
+	message := entity.NewTextMessage("not compressed")
+
+	message.Headers = map[string]string{entity.HeaderContentEncoding: "unknown"}
+	_, err := Decompress(message, 0)
+	require.True(t, errors.Is(err, ErrUnknownAlgorithm))
+
+	message.Headers = map[string]string{entity.HeaderContentEncoding: string(Gzip)}
+	_, err = Decompress(message, 0)
+	require.Error(t, err)
+}
+
+func TestDecompress_too_large(t *testing.T) {
+	for _, algorithm := range Algorithms() {
+		t.Run(string(algorithm), func(t *testing.T) {
+			// A few kilobytes of zeros expand to over a megabyte.
+			message := entity.NewMessage("application/octet-stream", make([]byte, 1024*1024+1))
+			compressed, err := Compress(message, Config{Algorithm: algorithm})
+			require.NoError(t, err)
+			require.Less(t, len(compressed.Payload), 10*1024)
+
+			_, err = Decompress(compressed, 1024*1024)
+			require.True(t, errors.Is(err, ErrPayloadTooLarge))
+
+			decompressed, err := Decompress(compressed, 1024*1024+1)
+			require.NoError(t, err)
+			require.Equal(t, message, decompressed)
+		})
+	}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	for _, algorithm := range append(Algorithms(), None) {
+		got, err := ParseAlgorithm(string(algorithm))
+		require.NoError(t, err)
+		assert.Equal(t, algorithm, got)
+	}
+
+	_, err := ParseAlgorithm("brotli")
+	require.True(t, errors.Is(err, ErrUnknownAlgorithm))
+}
+
+func TestReceiver(t *testing.T) {
+	var (
+		received []entity.Message
+		failed   []entity.Message
+		receiver = Receiver(
+			func(message entity.Message) {
+				received = append(received, message)
+			},
+			func(_ error, message entity.Message) {
+				failed = append(failed, message)
+			},
+			0,
+		)
+		message = entity.NewTextMessage("Hello, World!")
+	)
+
+	compressed, err := Compress(message, Config{Algorithm: Gzip})
+	require.NoError(t, err)
+	receiver(compressed)
+
+	invalid := entity.NewTextMessage("not compressed")
+	invalid.Headers = map[string]string{entity.HeaderContentEncoding: string(Gzip)}
+	receiver(invalid)
+
+	assert.Equal(t, []entity.Message{message}, received)
+	assert.Equal(t, []entity.Message{invalid}, failed)
+}
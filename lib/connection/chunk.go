@@ -0,0 +1,274 @@
+package connection
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+
+	"assignment/lib/log"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaxMessageSize is the default maximum size of a message
+	// reassembled from chunks.
+	DefaultMaxMessageSize = 64 * 1024 * 1024
+	// DefaultMaxPendingSize is the default maximum total size of the
+	// messages being reassembled at the same time on a stream.
+	DefaultMaxPendingSize = 128 * 1024 * 1024
+	// DefaultReassemblyTimeout is the default maximum time to wait for
+	// the next chunk of a message before the message is dropped.
+	DefaultReassemblyTimeout = time.Second * 30
+	// chunkHeaderSize is the size of the chunk header: 8 bytes for the
+	// transfer ID, 4 bytes for the total message size and 4 bytes for
+	// the offset of the chunk data within the message.
+	chunkHeaderSize = 16
+)
+
+var (
+	// ErrMessageTooLarge is returned when a message exceeds the
+	// maximum message size.
+	ErrMessageTooLarge = errors.New("message too large")
+	// ErrReassemblyLimit is returned when reassembling a message would
+	// exceed the memory limit of the stream.
+	ErrReassemblyLimit = errors.New("reassembly memory limit exceeded")
+	// ErrMalformedChunk is returned when a chunk doesn't fit into the
+	// message it belongs to.
+	ErrMalformedChunk = errors.New("malformed chunk")
+)
+
+// ReassemblyConfig contains the limits for reassembling messages
+// received in chunks.
+type ReassemblyConfig struct {
+	// MaxMessageSize is the maximum size of a reassembled message.
+	MaxMessageSize int
+	// MaxPendingSize is the maximum total size of the messages being
+	// reassembled at the same time.
+	MaxPendingSize int
+	// Timeout is the maximum time to wait for the next chunk of
+	// a message, the message is dropped once it passes.
+	Timeout time.Duration
+}
+
+// DefaultReassemblyConfig returns the default reassembly limits.
+func DefaultReassemblyConfig() ReassemblyConfig {
+	return ReassemblyConfig{
+		MaxMessageSize: DefaultMaxMessageSize,
+		MaxPendingSize: DefaultMaxPendingSize,
+		Timeout:        DefaultReassemblyTimeout,
+	}
+}
+
+// chunk is a part of an encoded message too large to fit into
+// a single frame.
+type chunk struct {
+	// transferID identifies the message the chunk belongs to.
+	transferID uint64
+	// totalSize is the size of the whole encoded message.
+	totalSize uint32
+	// offset is the position of the data within the message.
+	offset uint32
+	data   []byte
+}
+
+func (c chunk) bytes() []byte {
+	buffer := make([]byte, chunkHeaderSize+len(c.data))
+	binary.BigEndian.PutUint64(buffer[:8], c.transferID)
+	binary.BigEndian.PutUint32(buffer[8:12], c.totalSize)
+	binary.BigEndian.PutUint32(buffer[12:16], c.offset)
+	copy(buffer[chunkHeaderSize:], c.data)
+	return buffer
+}
+
+func chunkFromBytes(b []byte) (chunk, error) {
+	if len(b) < chunkHeaderSize {
+		return chunk{}, errors.Wrapf(ErrMalformedChunk, "chunk size %d", len(b))
+	}
+
+	return chunk{
+		transferID: binary.BigEndian.Uint64(b[:8]),
+		totalSize:  binary.BigEndian.Uint32(b[8:12]),
+		offset:     binary.BigEndian.Uint32(b[12:16]),
+		data:       b[chunkHeaderSize:],
+	}, nil
+}
+
+// splitMessage splits the encoded message into chunks small enough
+// for each chunk to fit into a single frame.
+func splitMessage(transferID uint64, payload []byte, maxFrameSize int) ([]chunk, error) {
+	if len(payload) > math.MaxUint32 {
+		return nil, errors.Wrapf(ErrMessageTooLarge, "message size %d", len(payload))
+	}
+	chunkSize := maxFrameSize - chunkHeaderSize
+	if chunkSize <= 0 {
+		return nil, errors.Wrapf(ErrFrameTooLarge,
+			"frame size limit of %d can't fit a chunk", maxFrameSize)
+	}
+
+	chunks := make([]chunk, 0, (len(payload)+chunkSize-1)/chunkSize)
+	for offset := 0; offset < len(payload); offset += chunkSize {
+		end := min(offset+chunkSize, len(payload))
+		chunks = append(chunks, chunk{
+			transferID: transferID,
+			totalSize:  uint32(len(payload)),
+			offset:     uint32(offset),
+			data:       payload[offset:end],
+		})
+	}
+	return chunks, nil
+}
+
+// transfer is a message being reassembled.
+type transfer struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+// reassembler reassembles messages from chunks. The memory of a
+// message is reserved when its first chunk arrives, so the limits
+// hold regardless of the pace of the peer.
+type reassembler struct {
+	mutex       sync.Mutex
+	config      ReassemblyConfig
+	transfers   map[uint64]*transfer
+	pendingSize int
+	// timer drops the expired messages once the earliest one expires,
+	// so that their memory is released even if the peer stops sending.
+	timer  *time.Timer
+	closed bool
+}
+
+func newReassembler(config ReassemblyConfig) *reassembler {
+	return &reassembler{
+		config:    config,
+		transfers: make(map[uint64]*transfer),
+	}
+}
+
+func (r *reassembler) setConfig(config ReassemblyConfig) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.config = config
+}
+
+// close drops the messages being reassembled and stops the timer.
+func (r *reassembler) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closed = true
+	for id := range r.transfers {
+		r.drop(id)
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+// add adds the chunk to its message and returns the encoded message
+// once the last chunk is received. Messages that turn out invalid are
+// dropped as a whole, and so are the messages whose next chunk didn't
+// arrive in time.
+func (r *reassembler) add(c chunk, now time.Time) ([]byte, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	defer r.schedule(now)
+
+	r.dropExpired(now)
+
+	t, ok := r.transfers[c.transferID]
+	if !ok {
+		if c.offset != 0 {
+			// Most likely the rest of a message dropped before.
+			return nil, errors.Wrapf(ErrMalformedChunk,
+				"chunk at offset %d of unknown transfer %d", c.offset, c.transferID)
+		}
+		if uint64(c.totalSize) > uint64(r.config.MaxMessageSize) {
+			return nil, errors.Wrapf(ErrMessageTooLarge,
+				"message size %d exceeds the limit of %d", c.totalSize, r.config.MaxMessageSize)
+		}
+		if r.pendingSize+int(c.totalSize) > r.config.MaxPendingSize {
+			return nil, errors.Wrapf(ErrReassemblyLimit,
+				"%d bytes pending, message size %d", r.pendingSize, c.totalSize)
+		}
+
+		t = &transfer{data: make([]byte, 0, c.totalSize)}
+		r.transfers[c.transferID] = t
+		r.pendingSize += int(c.totalSize)
+	}
+
+	if int(c.totalSize) != cap(t.data) || int(c.offset) != len(t.data) ||
+		len(c.data) > cap(t.data)-len(t.data) {
+		r.drop(c.transferID)
+		return nil, errors.Wrapf(ErrMalformedChunk,
+			"chunk of %d bytes at offset %d doesn't fit transfer %d",
+			len(c.data), c.offset, c.transferID)
+	}
+
+	t.data = append(t.data, c.data...)
+	t.expiresAt = now.Add(r.config.Timeout)
+	if len(t.data) < cap(t.data) {
+		return nil, nil
+	}
+
+	r.drop(c.transferID)
+	return t.data, nil
+}
+
+// evict drops the expired messages, it's run by the timer.
+func (r *reassembler) evict() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	r.dropExpired(now)
+	r.schedule(now)
+}
+
+// schedule sets the timer to the expiry of the earliest message, it
+// must be called with the mutex held.
+func (r *reassembler) schedule(now time.Time) {
+	if r.closed {
+		return
+	}
+
+	var earliest time.Time
+	for _, t := range r.transfers {
+		if earliest.IsZero() || t.expiresAt.Before(earliest) {
+			earliest = t.expiresAt
+		}
+	}
+	if earliest.IsZero() {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		return
+	}
+
+	// The message expires once the time is after its expiry.
+	delay := earliest.Sub(now) + time.Millisecond
+	if r.timer == nil {
+		r.timer = time.AfterFunc(delay, r.evict)
+		return
+	}
+	r.timer.Reset(delay)
+}
+
+func (r *reassembler) dropExpired(now time.Time) {
+	for id, t := range r.transfers {
+		if now.After(t.expiresAt) {
+			log.Warnf("Reassembly of transfer %d timed out after %d of %d bytes, message dropped",
+				id, len(t.data), cap(t.data))
+			r.drop(id)
+		}
+	}
+}
+
+func (r *reassembler) drop(transferID uint64) {
+	if t, ok := r.transfers[transferID]; ok {
+		r.pendingSize -= cap(t.data)
+		delete(r.transfers, transferID)
+	}
+}
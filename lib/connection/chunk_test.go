@@ -0,0 +1,175 @@
+package connection
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunk_encoding(t *testing.T) {
+	c := chunk{transferID: 42, totalSize: 10, offset: 5, data: []byte("Hello")}
+	got, err := chunkFromBytes(c.bytes())
+	require.NoError(t, err)
+	require.Equal(t, c, got)
+
+	_, err = chunkFromBytes(c.bytes()[:chunkHeaderSize-1])
+	require.True(t, errors.Is(err, ErrMalformedChunk))
+}
+
+func TestChunk_splitMessage_and_reassemble(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 10)
+	chunks, err := splitMessage(1, payload, chunkHeaderSize+30)
+	require.NoError(t, err)
+	require.Len(t, chunks, 4)
+
+	r := newReassembler(DefaultReassemblyConfig())
+	now := time.Now()
+	for i, c := range chunks {
+		got, err := r.add(c, now)
+		require.NoError(t, err)
+		if i < len(chunks)-1 {
+			require.Nil(t, got)
+			continue
+		}
+		require.Equal(t, payload, got)
+	}
+	require.Empty(t, r.transfers)
+	require.Zero(t, r.pendingSize)
+
+	_, err = splitMessage(1, payload, chunkHeaderSize)
+	require.True(t, errors.Is(err, ErrFrameTooLarge))
+}
+
+func TestChunk_reassemble_interleaved(t *testing.T) {
+	payload1 := bytes.Repeat([]byte("a"), 50)
+	payload2 := bytes.Repeat([]byte("b"), 50)
+	chunks1, err := splitMessage(1, payload1, chunkHeaderSize+20)
+	require.NoError(t, err)
+	chunks2, err := splitMessage(2, payload2, chunkHeaderSize+20)
+	require.NoError(t, err)
+
+	r := newReassembler(DefaultReassemblyConfig())
+	now := time.Now()
+	var got [][]byte
+	for i := range chunks1 {
+		for _, c := range []chunk{chunks1[i], chunks2[i]} {
+			message, err := r.add(c, now)
+			require.NoError(t, err)
+			if message != nil {
+				got = append(got, message)
+			}
+		}
+	}
+	require.Equal(t, [][]byte{payload1, payload2}, got)
+}
+
+func TestChunk_reassemble_errors(t *testing.T) {
+	config := ReassemblyConfig{
+		MaxMessageSize: 100,
+		MaxPendingSize: 150,
+		Timeout:        time.Minute,
+	}
+	now := time.Now()
+
+	tests := map[string]struct {
+		chunks  []chunk
+		wantErr error
+	}{
+		"message_too_large": {
+			chunks: []chunk{
+				{transferID: 1, totalSize: 101, data: []byte("a")},
+			},
+			wantErr: ErrMessageTooLarge,
+		},
+		"pending_limit_exceeded": {
+			chunks: []chunk{
+				{transferID: 1, totalSize: 100, data: []byte("a")},
+				{transferID: 2, totalSize: 100, data: []byte("b")},
+			},
+			wantErr: ErrReassemblyLimit,
+		},
+		"unknown_transfer": {
+			chunks: []chunk{
+				{transferID: 1, totalSize: 10, offset: 5, data: []byte("a")},
+			},
+			wantErr: ErrMalformedChunk,
+		},
+		"offset_gap": {
+			chunks: []chunk{
+				{transferID: 1, totalSize: 10, data: []byte("a")},
+				{transferID: 1, totalSize: 10, offset: 2, data: []byte("b")},
+			},
+			wantErr: ErrMalformedChunk,
+		},
+		"data_exceeds_total_size": {
+			chunks: []chunk{
+				{transferID: 1, totalSize: 2, data: []byte("abc")},
+			},
+			wantErr: ErrMalformedChunk,
+		},
+		"total_size_changed": {
+			chunks: []chunk{
+				{transferID: 1, totalSize: 10, data: []byte("a")},
+				{transferID: 1, totalSize: 20, offset: 1, data: []byte("b")},
+			},
+			wantErr: ErrMalformedChunk,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := newReassembler(config)
+			var err error
+			for _, c := range tc.chunks {
+				if _, err = r.add(c, now); err != nil {
+					break
+				}
+			}
+			require.True(t, errors.Is(err, tc.wantErr))
+		})
+	}
+}
+
+func TestChunk_reassemble_timeout(t *testing.T) {
+	r := newReassembler(ReassemblyConfig{
+		MaxMessageSize: 100,
+		MaxPendingSize: 100,
+		Timeout:        time.Second,
+	})
+	now := time.Now()
+
+	_, err := r.add(chunk{transferID: 1, totalSize: 100, data: []byte("a")}, now)
+	require.NoError(t, err)
+
+	// The expired message is dropped and its memory is released
+	// for the next one.
+	later := now.Add(time.Second * 2)
+	_, err = r.add(chunk{transferID: 2, totalSize: 100, data: []byte("b")}, later)
+	require.NoError(t, err)
+	require.Len(t, r.transfers, 1)
+
+	_, err = r.add(chunk{transferID: 1, totalSize: 100, offset: 1, data: []byte("a")}, later)
+	require.True(t, errors.Is(err, ErrMalformedChunk))
+}
+
+func TestChunk_reassemble_timeout_without_chunks(t *testing.T) {
+	r := newReassembler(ReassemblyConfig{
+		MaxMessageSize: 100,
+		MaxPendingSize: 100,
+		Timeout:        time.Millisecond * 10,
+	})
+	defer r.close()
+
+	_, err := r.add(chunk{transferID: 1, totalSize: 100, data: []byte("a")}, time.Now())
+	require.NoError(t, err)
+
+	// The expired message is dropped even though no chunk arrives.
+	require.Eventually(t, func() bool {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		return len(r.transfers) == 0 && r.pendingSize == 0
+	}, time.Second, time.Millisecond)
+}
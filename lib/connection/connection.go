@@ -35,23 +35,33 @@ type Connection interface {
 	AcceptReadStream(
 		ctx context.Context,
 		messageReceiver MessageReceiver,
+		controlReceiver ControlReceiver,
 	) (ReadStream, error)
 	// OpenReadWriteStream opens a new bidirectional stream
 	// for sending and receiving messages.
 	OpenReadWriteStream(
 		ctx context.Context,
 		messageReceiver MessageReceiver,
+		controlReceiver ControlReceiver,
 	) (ReadWriteStream, error)
 	// AcceptReadWriteStream accepts a new bidirectional
 	// stream for sending and receiving messages.
 	AcceptReadWriteStream(
 		ctx context.Context,
 		messageReceiver MessageReceiver,
+		controlReceiver ControlReceiver,
 	) (ReadWriteStream, error)
+	// AcceptHandshake waits for the client to advertise the protocol
+	// parameters it supports and accepts or rejects them. The
+	// connection is closed if the handshake fails.
+	AcceptHandshake(ctx context.Context) error
+	// Handshake returns the negotiated protocol parameters.
+	Handshake() Handshake
 }
 
 type connection struct {
-	conn quic.Connection
+	conn      quic.Connection
+	handshake Handshake
 }
 
 // New constructs a new connection.
@@ -67,47 +77,111 @@ func (c *connection) OpenWriteStream(ctx context.Context) (WriteStream, error) {
 		return nil, errors.Wrap(err, "open unidirectional stream")
 	}
 
-	return NewWriteStream(c.conn, str), nil
+	return NewWriteStream(c.conn, str, c.handshake.Capabilities), nil
 }
 
 func (c *connection) AcceptReadStream(
 	ctx context.Context,
 	messageReceiver MessageReceiver,
+	controlReceiver ControlReceiver,
 ) (ReadStream, error) {
 	str, err := c.conn.AcceptUniStream(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "accept unidirectional stream")
 	}
 
-	return NewReadStream(c.conn, str, messageReceiver), nil
+	return NewReadStream(c.conn, str, messageReceiver, controlReceiver), nil
 }
 
 func (c *connection) OpenReadWriteStream(
 	ctx context.Context,
 	messageReceiver MessageReceiver,
+	controlReceiver ControlReceiver,
 ) (ReadWriteStream, error) {
 	str, err := c.conn.OpenStreamSync(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "open stream")
 	}
 
-	return NewReadWriteStream(c.conn, str, messageReceiver), nil
+	return NewReadWriteStream(c.conn, str, c.handshake.Capabilities,
+		messageReceiver, controlReceiver), nil
 }
 
 func (c *connection) AcceptReadWriteStream(
 	ctx context.Context,
 	messageReceiver MessageReceiver,
+	controlReceiver ControlReceiver,
 ) (ReadWriteStream, error) {
 	str, err := c.conn.AcceptStream(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "accept stream")
 	}
 
-	return NewReadWriteStream(c.conn, str, messageReceiver), nil
+	return NewReadWriteStream(c.conn, str, c.handshake.Capabilities,
+		messageReceiver, controlReceiver), nil
 }
 
-// Connect dials the server on the given port and returns the connection.
+func (c *connection) AcceptHandshake(ctx context.Context) error {
+	handshake, err := serverHandshake(ctx, c.conn, localHello(SupportedCapabilities))
+	if err != nil {
+		closeWithHandshakeError(c.conn, err)
+		return errors.Wrap(err, "server handshake")
+	}
+
+	c.handshake = handshake
+	return nil
+}
+
+func (c *connection) Handshake() Handshake {
+	return c.handshake
+}
+
+// ClientConfig contains the configuration of a client connection.
+type ClientConfig struct {
+	// Capabilities are the optional protocol features
+	// advertised to the server.
+	Capabilities Capabilities
+}
+
+// DefaultClientConfig returns the default client connection
+// configuration with all supported capabilities.
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		Capabilities: SupportedCapabilities,
+	}
+}
+
+// Connect dials the server on the given port with the default
+// configuration, negotiates the protocol parameters and returns
+// the connection.
 func Connect(ctx context.Context, port int) (Connection, error) {
+	return ConnectWithConfig(ctx, port, DefaultClientConfig())
+}
+
+// ConnectWithConfig dials the server on the given port, negotiates the
+// protocol parameters and returns the connection.
+func ConnectWithConfig(ctx context.Context, port int, config ClientConfig) (Connection, error) {
+	conn, err := dial(ctx, port)
+	if err != nil {
+		return nil, err
+	}
+
+	// Agree on the protocol parameters with the server.
+	log.Trace("Negotiating protocol parameters...")
+	handshake, err := clientHandshake(ctx, conn, localHello(config.Capabilities))
+	if err != nil {
+		closeWithHandshakeError(conn, err)
+		return nil, errors.Wrap(err, "client handshake")
+	}
+	log.Tracef("Negotiated protocol version %d", handshake.Version)
+
+	return &connection{
+		conn:      conn,
+		handshake: handshake,
+	}, nil
+}
+
+func dial(ctx context.Context, port int) (quic.Connection, error) {
 	// Set up UDP connection.
 	log.Trace("Setting up UDP connection...")
 	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: 0})
@@ -121,13 +195,17 @@ func Connect(ctx context.Context, port int) (Connection, error) {
 	// Dial the server.
 	address := fmt.Sprintf("localhost:%d", port)
 	log.Tracef("Dialing the server on address %q...", address)
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{ALPNProtocol},
+	}
 	conn, err := transport.Dial(
-		ctx, &net.UDPAddr{Port: port}, &tls.Config{InsecureSkipVerify: true}, &quic.Config{
+		ctx, &net.UDPAddr{Port: port}, tlsConfig, &quic.Config{
 			MaxIdleTimeout: DefaultIdleTimeout,
 		})
 	if err != nil {
 		return nil, errors.Wrapf(err, "dial %q", address)
 	}
 
-	return New(conn), nil
+	return conn, nil
 }
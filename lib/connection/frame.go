@@ -0,0 +1,100 @@
+package connection
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaxFrameSize is the default maximum size of a frame payload.
+	DefaultMaxFrameSize = 1024 * 1024
+	// frameHeaderSize is the size of the frame header: 4 bytes for the
+	// payload length followed by 1 byte for the frame type.
+	frameHeaderSize = 5
+)
+
+// ErrFrameTooLarge is returned when a frame exceeds the maximum frame size.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// FrameType identifies the kind of data carried by a frame.
+type FrameType uint8
+
+const (
+	// FrameTypeMessage is the frame type for application messages.
+	FrameTypeMessage FrameType = iota + 1
+	// FrameTypeHandshake is the frame type for protocol negotiation.
+	FrameTypeHandshake
+	// FrameTypeChunk is the frame type for a part of a message too
+	// large to fit into a single frame.
+	FrameTypeChunk
+	// FrameTypeControl is the frame type for controls exchanged
+	// separately from the application messages.
+	FrameTypeControl
+)
+
+// frame is a single self-delimiting unit of data on a stream.
+type frame struct {
+	frameType FrameType
+	payload   []byte
+}
+
+// writeFrame writes the frame to the writer with a single write call,
+// so that frames from concurrent writers are never interleaved as long
+// as the writer itself is guarded.
+func writeFrame(w io.Writer, f frame, maxFrameSize int) error {
+	if len(f.payload) > maxFrameSize {
+		return errors.Wrapf(ErrFrameTooLarge,
+			"frame size %d exceeds the limit of %d", len(f.payload), maxFrameSize)
+	}
+
+	buffer := make([]byte, frameHeaderSize+len(f.payload))
+	binary.BigEndian.PutUint32(buffer[:4], uint32(len(f.payload)))
+	buffer[4] = byte(f.frameType)
+	copy(buffer[frameHeaderSize:], f.payload)
+
+	if _, err := w.Write(buffer); err != nil {
+		return errors.Wrap(err, "write frame")
+	}
+	return nil
+}
+
+// frameReader reassembles complete frames from a byte stream
+// regardless of how the underlying transport splits the bytes.
+type frameReader struct {
+	reader *bufio.Reader
+	header [frameHeaderSize]byte
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{
+		reader: bufio.NewReader(r),
+	}
+}
+
+// readFrame blocks until a complete frame is read. Frames with payload
+// larger than maxFrameSize are rejected with ErrFrameTooLarge. Errors
+// returned by the underlying reader are passed through unwrapped.
+func (r *frameReader) readFrame(maxFrameSize int) (frame, error) {
+	if _, err := io.ReadFull(r.reader, r.header[:]); err != nil {
+		return frame{}, err
+	}
+
+	size := binary.BigEndian.Uint32(r.header[:4])
+	if uint64(size) > uint64(maxFrameSize) {
+		return frame{}, errors.Wrapf(ErrFrameTooLarge,
+			"frame size %d exceeds the limit of %d", size, maxFrameSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, payload); err != nil {
+		return frame{}, err
+	}
+
+	return frame{
+		frameType: FrameType(r.header[4]),
+		payload:   payload,
+	}, nil
+}
@@ -0,0 +1,94 @@
+package connection
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame_writeFrame_and_readFrame(t *testing.T) {
+	frames := []frame{
+		{frameType: FrameTypeMessage, payload: []byte("Hello")},
+		{frameType: FrameTypeMessage, payload: []byte{}},
+		{frameType: FrameTypeMessage, payload: bytes.Repeat([]byte("a"), 4096)},
+	}
+
+	var buffer bytes.Buffer
+	for _, f := range frames {
+		require.NoError(t, writeFrame(&buffer, f, DefaultMaxFrameSize))
+	}
+
+	t.Run("frames_written_back_to_back", func(t *testing.T) {
+		reader := newFrameReader(bytes.NewReader(buffer.Bytes()))
+		for _, want := range frames {
+			got, err := reader.readFrame(DefaultMaxFrameSize)
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+		}
+
+		_, err := reader.readFrame(DefaultMaxFrameSize)
+		require.ErrorIs(t, err, io.EOF)
+	})
+	t.Run("frames_split_into_single_bytes", func(t *testing.T) {
+		reader := newFrameReader(&oneByteReader{data: buffer.Bytes()})
+		for _, want := range frames {
+			got, err := reader.readFrame(DefaultMaxFrameSize)
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+		}
+	})
+}
+
+func TestFrame_writeFrame_too_large(t *testing.T) {
+	var buffer bytes.Buffer
+	err := writeFrame(&buffer, frame{
+		frameType: FrameTypeMessage,
+		payload:   []byte("Hello, World!"),
+	}, 5)
+	require.True(t, errors.Is(err, ErrFrameTooLarge))
+	require.Zero(t, buffer.Len())
+}
+
+func TestFrame_readFrame_too_large(t *testing.T) {
+	var buffer bytes.Buffer
+	require.NoError(t, writeFrame(&buffer, frame{
+		frameType: FrameTypeMessage,
+		payload:   []byte("Hello, World!"),
+	}, DefaultMaxFrameSize))
+
+	_, err := newFrameReader(&buffer).readFrame(5)
+	require.True(t, errors.Is(err, ErrFrameTooLarge))
+}
+
+func TestFrame_readFrame_truncated(t *testing.T) {
+	var buffer bytes.Buffer
+	require.NoError(t, writeFrame(&buffer, frame{
+		frameType: FrameTypeMessage,
+		payload:   []byte("Hello, World!"),
+	}, DefaultMaxFrameSize))
+
+	truncated := buffer.Bytes()[:buffer.Len()-1]
+	_, err := newFrameReader(bytes.NewReader(truncated)).readFrame(DefaultMaxFrameSize)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+// oneByteReader returns at most a single byte per read call to
+// simulate the transport splitting frames at arbitrary positions.
+type oneByteReader struct {
+	data []byte
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
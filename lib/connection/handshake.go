@@ -0,0 +1,298 @@
+package connection
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"assignment/lib/apperr"
+	"assignment/lib/compression"
+
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// ALPNProtocol is the TLS application protocol identifier of the
+	// broker protocol. Peers that don't speak it are rejected during
+	// the TLS handshake.
+	ALPNProtocol = "assignment-broker"
+	// ProtocolVersion is the newest supported broker protocol version.
+	ProtocolVersion uint16 = 1
+	// MinProtocolVersion is the oldest supported broker protocol version.
+	MinProtocolVersion uint16 = 1
+	// SupportedCapabilities are the optional protocol features
+	// supported by this implementation.
+	SupportedCapabilities = CompressionCapabilities | CapabilityChunking
+	// DefaultHandshakeTimeout is the default timeout for the handshake
+	// when the context doesn't have a deadline.
+	DefaultHandshakeTimeout = time.Second * 30
+)
+
+const (
+	// helloSize is the size of the hello frame payload: 2 bytes for
+	// the version, 2 bytes for the minimum version and 4 bytes for
+	// the capabilities.
+	helloSize = 8
+	// handshakeReplySize is the size of the fixed part of the handshake
+	// reply payload: 1 byte for the status, 2 bytes for the negotiated
+	// version and 4 bytes for the negotiated capabilities. The status is
+	// followed by the rejection reason, if any.
+	handshakeReplySize = 7
+	// maxHandshakeFrameSize is the maximum size of a handshake frame.
+	maxHandshakeFrameSize = 1024
+)
+
+const (
+	handshakeAccepted uint8 = iota
+	handshakeRejected
+)
+
+// Capabilities is a set of optional protocol features supported
+// by a peer.
+type Capabilities uint32
+
+const (
+	// CapabilityGzip is set when the peer accepts gzip compressed payloads.
+	CapabilityGzip Capabilities = 1 << iota
+	// CapabilityFlate is set when the peer accepts deflate compressed payloads.
+	CapabilityFlate
+	// CapabilityChunking is set when the peer reassembles messages
+	// split into chunk frames.
+	CapabilityChunking
+)
+
+// CompressionCapabilities are the capabilities of all supported
+// compression algorithms.
+const CompressionCapabilities = CapabilityGzip | CapabilityFlate
+
+// Has returns true if all the given capabilities are set.
+func (c Capabilities) Has(capabilities Capabilities) bool {
+	return c&capabilities == capabilities
+}
+
+// CompressionCapability returns the capability required to exchange
+// payloads compressed with the given algorithm.
+func CompressionCapability(algorithm compression.Algorithm) Capabilities {
+	switch algorithm {
+	case compression.Gzip:
+		return CapabilityGzip
+	case compression.Flate:
+		return CapabilityFlate
+	default:
+		return 0
+	}
+}
+
+// SupportsCompression returns true if both peers accept payloads
+// compressed with the given algorithm.
+func (h Handshake) SupportsCompression(algorithm compression.Algorithm) bool {
+	capability := CompressionCapability(algorithm)
+	return capability != 0 && h.Capabilities.Has(capability)
+}
+
+// Handshake contains the protocol parameters negotiated by the peers.
+type Handshake struct {
+	// Version is the protocol version both peers speak.
+	Version uint16
+	// Capabilities are the optional features supported by both peers.
+	Capabilities Capabilities
+}
+
+// HandshakeError is returned when the peers fail to agree on
+// protocol parameters.
+type HandshakeError struct {
+	// Reason is the human readable reason of the rejection.
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake rejected: %s", e.Reason)
+}
+
+// hello is the first frame sent by the client to advertise the
+// protocol parameters it supports.
+type hello struct {
+	version      uint16
+	minVersion   uint16
+	capabilities Capabilities
+}
+
+// localHello returns the protocol parameters supported by this peer.
+func localHello(capabilities Capabilities) hello {
+	return hello{
+		version:      ProtocolVersion,
+		minVersion:   MinProtocolVersion,
+		capabilities: capabilities,
+	}
+}
+
+func (h hello) bytes() []byte {
+	buffer := make([]byte, helloSize)
+	binary.BigEndian.PutUint16(buffer[0:2], h.version)
+	binary.BigEndian.PutUint16(buffer[2:4], h.minVersion)
+	binary.BigEndian.PutUint32(buffer[4:8], uint32(h.capabilities))
+	return buffer
+}
+
+func helloFromBytes(b []byte) (hello, error) {
+	if len(b) < helloSize {
+		return hello{}, errors.New("hello frame too short")
+	}
+	return hello{
+		version:      binary.BigEndian.Uint16(b[0:2]),
+		minVersion:   binary.BigEndian.Uint16(b[2:4]),
+		capabilities: Capabilities(binary.BigEndian.Uint32(b[4:8])),
+	}, nil
+}
+
+// negotiate picks the newest protocol version and the capabilities
+// supported by both peers.
+func negotiate(local, remote hello) (Handshake, error) {
+	version := local.version
+	if remote.version < version {
+		version = remote.version
+	}
+	if version < local.minVersion || version < remote.minVersion {
+		return Handshake{}, &HandshakeError{
+			Reason: fmt.Sprintf(
+				"no common protocol version, supported versions are %d-%d, peer supports %d-%d",
+				local.minVersion, local.version, remote.minVersion, remote.version),
+		}
+	}
+
+	return Handshake{
+		Version:      version,
+		Capabilities: local.capabilities & remote.capabilities,
+	}, nil
+}
+
+func handshakeReplyBytes(handshake Handshake, err error) []byte {
+	buffer := make([]byte, handshakeReplySize)
+	buffer[0] = handshakeAccepted
+	if err != nil {
+		buffer[0] = handshakeRejected
+		buffer = append(buffer, rejectionReason(err)...)
+	}
+	binary.BigEndian.PutUint16(buffer[1:3], handshake.Version)
+	binary.BigEndian.PutUint32(buffer[3:7], uint32(handshake.Capabilities))
+	return buffer
+}
+
+func handshakeFromReplyBytes(b []byte) (Handshake, error) {
+	if len(b) < handshakeReplySize {
+		return Handshake{}, errors.New("handshake reply frame too short")
+	}
+	if b[0] != handshakeAccepted {
+		return Handshake{}, &HandshakeError{Reason: string(b[handshakeReplySize:])}
+	}
+	return Handshake{
+		Version:      binary.BigEndian.Uint16(b[1:3]),
+		Capabilities: Capabilities(binary.BigEndian.Uint32(b[3:7])),
+	}, nil
+}
+
+// clientHandshake opens the handshake stream, advertises the local
+// protocol parameters and waits for the server to accept them.
+func clientHandshake(ctx context.Context, conn quic.Connection, local hello) (Handshake, error) {
+	if protocol := conn.ConnectionState().TLS.NegotiatedProtocol; protocol != ALPNProtocol {
+		return Handshake{}, &HandshakeError{
+			Reason: fmt.Sprintf("unexpected application protocol %q", protocol),
+		}
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return Handshake{}, errors.Wrap(err, "open handshake stream")
+	}
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+
+	if err := writeFrame(stream, frame{
+		frameType: FrameTypeHandshake,
+		payload:   local.bytes(),
+	}, maxHandshakeFrameSize); err != nil {
+		return Handshake{}, errors.Wrap(err, "write hello")
+	}
+
+	reply, err := newFrameReader(stream).readFrame(maxHandshakeFrameSize)
+	if err != nil {
+		// The server might close the connection before the
+		// rejection reply reaches the client.
+		var appErr *quic.ApplicationError
+		if errors.As(err, &appErr) && appErr.ErrorCode == apperr.ErrCodeProtocolMismatch {
+			return Handshake{}, &HandshakeError{Reason: appErr.ErrorMessage}
+		}
+		return Handshake{}, errors.Wrap(err, "read handshake reply")
+	}
+	if reply.frameType != FrameTypeHandshake {
+		return Handshake{}, errors.Errorf("unexpected frame type %d", reply.frameType)
+	}
+
+	return handshakeFromReplyBytes(reply.payload)
+}
+
+// serverHandshake accepts the handshake stream, negotiates the protocol
+// parameters with the client and replies with the outcome.
+func serverHandshake(ctx context.Context, conn quic.Connection, local hello) (Handshake, error) {
+	if protocol := conn.ConnectionState().TLS.NegotiatedProtocol; protocol != ALPNProtocol {
+		return Handshake{}, &HandshakeError{
+			Reason: fmt.Sprintf("unexpected application protocol %q", protocol),
+		}
+	}
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return Handshake{}, errors.Wrap(err, "accept handshake stream")
+	}
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+
+	request, err := newFrameReader(stream).readFrame(maxHandshakeFrameSize)
+	if err != nil {
+		return Handshake{}, errors.Wrap(err, "read hello")
+	}
+	if request.frameType != FrameTypeHandshake {
+		return Handshake{}, &HandshakeError{
+			Reason: fmt.Sprintf("unexpected frame type %d", request.frameType),
+		}
+	}
+
+	remote, err := helloFromBytes(request.payload)
+	if err != nil {
+		return Handshake{}, &HandshakeError{Reason: err.Error()}
+	}
+
+	handshake, negotiationErr := negotiate(local, remote)
+	if err := writeFrame(stream, frame{
+		frameType: FrameTypeHandshake,
+		payload:   handshakeReplyBytes(handshake, negotiationErr),
+	}, maxHandshakeFrameSize); err != nil {
+		return Handshake{}, errors.Wrap(err, "write handshake reply")
+	}
+
+	return handshake, negotiationErr
+}
+
+func rejectionReason(err error) string {
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) {
+		return handshakeErr.Reason
+	}
+	return "handshake failed"
+}
+
+func setStreamDeadline(ctx context.Context, stream quic.Stream) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultHandshakeTimeout)
+	}
+	stream.SetDeadline(deadline)
+}
+
+// closeWithHandshakeError closes the connection after a failed handshake
+// with an error code the peer can tell apart from regular closing.
+func closeWithHandshakeError(conn quic.Connection, err error) {
+	conn.CloseWithError(apperr.ErrCodeProtocolMismatch, rejectionReason(err))
+}
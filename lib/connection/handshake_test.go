@@ -0,0 +1,109 @@
+package connection
+
+import (
+	"context"
+	"testing"
+
+	"assignment/lib/certificate"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshake_negotiate(t *testing.T) {
+	tests := map[string]struct {
+		local   hello
+		remote  hello
+		want    Handshake
+		wantErr bool
+	}{
+		"same_version": {
+			local:  hello{version: 1, minVersion: 1, capabilities: 0b011},
+			remote: hello{version: 1, minVersion: 1, capabilities: 0b110},
+			want:   Handshake{Version: 1, Capabilities: 0b010},
+		},
+		"remote_newer": {
+			local:  hello{version: 2, minVersion: 1},
+			remote: hello{version: 3, minVersion: 2},
+			want:   Handshake{Version: 2},
+		},
+		"remote_older": {
+			local:  hello{version: 3, minVersion: 1},
+			remote: hello{version: 2, minVersion: 1},
+			want:   Handshake{Version: 2},
+		},
+		"remote_too_new": {
+			local:   hello{version: 2, minVersion: 1},
+			remote:  hello{version: 4, minVersion: 3},
+			wantErr: true,
+		},
+		"remote_too_old": {
+			local:   hello{version: 4, minVersion: 3},
+			remote:  hello{version: 2, minVersion: 1},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := negotiate(tc.local, tc.remote)
+			if tc.wantErr {
+				var handshakeErr *HandshakeError
+				require.True(t, errors.As(err, &handshakeErr))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestHandshake_encoding(t *testing.T) {
+	h := hello{version: 3, minVersion: 2, capabilities: 0b101}
+	got, err := helloFromBytes(h.bytes())
+	require.NoError(t, err)
+	require.Equal(t, h, got)
+
+	_, err = helloFromBytes(h.bytes()[:helloSize-1])
+	require.Error(t, err)
+
+	handshake := Handshake{Version: 2, Capabilities: 0b100}
+	gotHandshake, err := handshakeFromReplyBytes(handshakeReplyBytes(handshake, nil))
+	require.NoError(t, err)
+	require.Equal(t, handshake, gotHandshake)
+
+	_, err = handshakeFromReplyBytes(handshakeReplyBytes(
+		Handshake{}, &HandshakeError{Reason: "test reason"}))
+	require.EqualError(t, err, "handshake rejected: test reason")
+}
+
+func TestHandshake_rejected(t *testing.T) {
+	tlsConfig, err := certificate.LoadTLSConfig(
+		"../../testdata/test_server.crt", "../../testdata/test_server.key")
+	require.NoError(t, err)
+
+	listener, err := StartListener(8087, tlsConfig)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		require.NoError(t, err)
+		serverErr <- New(conn).AcceptHandshake(context.Background())
+	}()
+
+	// Connect as a client that only speaks a newer protocol version.
+	conn, err := dial(context.Background(), 8087)
+	require.NoError(t, err)
+	_, err = clientHandshake(context.Background(), conn, hello{
+		version:    ProtocolVersion + 2,
+		minVersion: ProtocolVersion + 1,
+	})
+
+	var handshakeErr *HandshakeError
+	require.True(t, errors.As(err, &handshakeErr))
+	require.Contains(t, handshakeErr.Reason, "no common protocol version")
+	require.True(t, errors.As(<-serverErr, &handshakeErr))
+}
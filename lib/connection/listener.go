@@ -28,6 +28,10 @@ func StartListener(port int, tlsConfig *tls.Config) (QUICListener, error) {
 	// Set up QUIC transport.
 	transport := &quic.Transport{Conn: udpConn}
 
+	// Only accept clients that speak the broker protocol.
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{ALPNProtocol}
+
 	// Start the listener.
 	listener, err := transport.Listen(tlsConfig, &quic.Config{
 		MaxIdleTimeout: DefaultIdleTimeout,
@@ -37,49 +37,77 @@ func (m *MockConnection) EXPECT() *MockConnectionMockRecorder {
 	return m.recorder
 }
 
+// AcceptHandshake mocks base method.
+func (m *MockConnection) AcceptHandshake(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AcceptHandshake", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AcceptHandshake indicates an expected call of AcceptHandshake.
+func (mr *MockConnectionMockRecorder) AcceptHandshake(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcceptHandshake", reflect.TypeOf((*MockConnection)(nil).AcceptHandshake), arg0)
+}
+
 // AcceptReadStream mocks base method.
-func (m *MockConnection) AcceptReadStream(arg0 context.Context, arg1 connection.MessageReceiver) (connection.ReadStream, error) {
+func (m *MockConnection) AcceptReadStream(arg0 context.Context, arg1 connection.MessageReceiver, arg2 connection.ControlReceiver) (connection.ReadStream, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AcceptReadStream", arg0, arg1)
+	ret := m.ctrl.Call(m, "AcceptReadStream", arg0, arg1, arg2)
 	ret0, _ := ret[0].(connection.ReadStream)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // AcceptReadStream indicates an expected call of AcceptReadStream.
-func (mr *MockConnectionMockRecorder) AcceptReadStream(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockConnectionMockRecorder) AcceptReadStream(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcceptReadStream", reflect.TypeOf((*MockConnection)(nil).AcceptReadStream), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcceptReadStream", reflect.TypeOf((*MockConnection)(nil).AcceptReadStream), arg0, arg1, arg2)
 }
 
 // AcceptReadWriteStream mocks base method.
-func (m *MockConnection) AcceptReadWriteStream(arg0 context.Context, arg1 connection.MessageReceiver) (connection.ReadWriteStream, error) {
+func (m *MockConnection) AcceptReadWriteStream(arg0 context.Context, arg1 connection.MessageReceiver, arg2 connection.ControlReceiver) (connection.ReadWriteStream, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AcceptReadWriteStream", arg0, arg1)
+	ret := m.ctrl.Call(m, "AcceptReadWriteStream", arg0, arg1, arg2)
 	ret0, _ := ret[0].(connection.ReadWriteStream)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // AcceptReadWriteStream indicates an expected call of AcceptReadWriteStream.
-func (mr *MockConnectionMockRecorder) AcceptReadWriteStream(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockConnectionMockRecorder) AcceptReadWriteStream(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcceptReadWriteStream", reflect.TypeOf((*MockConnection)(nil).AcceptReadWriteStream), arg0, arg1, arg2)
+}
+
+// Handshake mocks base method.
+func (m *MockConnection) Handshake() connection.Handshake {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Handshake")
+	ret0, _ := ret[0].(connection.Handshake)
+	return ret0
+}
+
+// Handshake indicates an expected call of Handshake.
+func (mr *MockConnectionMockRecorder) Handshake() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcceptReadWriteStream", reflect.TypeOf((*MockConnection)(nil).AcceptReadWriteStream), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Handshake", reflect.TypeOf((*MockConnection)(nil).Handshake))
 }
 
 // OpenReadWriteStream mocks base method.
-func (m *MockConnection) OpenReadWriteStream(arg0 context.Context, arg1 connection.MessageReceiver) (connection.ReadWriteStream, error) {
+func (m *MockConnection) OpenReadWriteStream(arg0 context.Context, arg1 connection.MessageReceiver, arg2 connection.ControlReceiver) (connection.ReadWriteStream, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "OpenReadWriteStream", arg0, arg1)
+	ret := m.ctrl.Call(m, "OpenReadWriteStream", arg0, arg1, arg2)
 	ret0, _ := ret[0].(connection.ReadWriteStream)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // OpenReadWriteStream indicates an expected call of OpenReadWriteStream.
-func (mr *MockConnectionMockRecorder) OpenReadWriteStream(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockConnectionMockRecorder) OpenReadWriteStream(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OpenReadWriteStream", reflect.TypeOf((*MockConnection)(nil).OpenReadWriteStream), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OpenReadWriteStream", reflect.TypeOf((*MockConnection)(nil).OpenReadWriteStream), arg0, arg1, arg2)
 }
 
 // OpenWriteStream mocks base method.
@@ -134,6 +162,20 @@ func (mr *MockReadWriteStreamMockRecorder) CloseStream() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseStream", reflect.TypeOf((*MockReadWriteStream)(nil).CloseStream))
 }
 
+// SendControl mocks base method.
+func (m *MockReadWriteStream) SendControl(arg0 entity.Control) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendControl", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SendControl indicates an expected call of SendControl.
+func (mr *MockReadWriteStreamMockRecorder) SendControl(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendControl", reflect.TypeOf((*MockReadWriteStream)(nil).SendControl), arg0)
+}
+
 // SendMessage mocks base method.
 func (m *MockReadWriteStream) SendMessage(arg0 entity.Message) error {
 	m.ctrl.T.Helper()
@@ -160,6 +202,30 @@ func (mr *MockReadWriteStreamMockRecorder) SetConnClosedCallback(arg0 interface{
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetConnClosedCallback", reflect.TypeOf((*MockReadWriteStream)(nil).SetConnClosedCallback), arg0)
 }
 
+// SetControlReceiver mocks base method.
+func (m *MockReadWriteStream) SetControlReceiver(arg0 connection.ControlReceiver) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetControlReceiver", arg0)
+}
+
+// SetControlReceiver indicates an expected call of SetControlReceiver.
+func (mr *MockReadWriteStreamMockRecorder) SetControlReceiver(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetControlReceiver", reflect.TypeOf((*MockReadWriteStream)(nil).SetControlReceiver), arg0)
+}
+
+// SetMaxFrameSize mocks base method.
+func (m *MockReadWriteStream) SetMaxFrameSize(arg0 int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetMaxFrameSize", arg0)
+}
+
+// SetMaxFrameSize indicates an expected call of SetMaxFrameSize.
+func (mr *MockReadWriteStreamMockRecorder) SetMaxFrameSize(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMaxFrameSize", reflect.TypeOf((*MockReadWriteStream)(nil).SetMaxFrameSize), arg0)
+}
+
 // SetMessageReceiver mocks base method.
 func (m *MockReadWriteStream) SetMessageReceiver(arg0 connection.MessageReceiver) {
 	m.ctrl.T.Helper()
@@ -172,16 +238,16 @@ func (mr *MockReadWriteStreamMockRecorder) SetMessageReceiver(arg0 interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMessageReceiver", reflect.TypeOf((*MockReadWriteStream)(nil).SetMessageReceiver), arg0)
 }
 
-// SetReadBufferSize mocks base method.
-func (m *MockReadWriteStream) SetReadBufferSize(arg0 int) {
+// SetReassemblyConfig mocks base method.
+func (m *MockReadWriteStream) SetReassemblyConfig(arg0 connection.ReassemblyConfig) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "SetReadBufferSize", arg0)
+	m.ctrl.Call(m, "SetReassemblyConfig", arg0)
 }
 
-// SetReadBufferSize indicates an expected call of SetReadBufferSize.
-func (mr *MockReadWriteStreamMockRecorder) SetReadBufferSize(arg0 interface{}) *gomock.Call {
+// SetReassemblyConfig indicates an expected call of SetReassemblyConfig.
+func (mr *MockReadWriteStreamMockRecorder) SetReassemblyConfig(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetReadBufferSize", reflect.TypeOf((*MockReadWriteStream)(nil).SetReadBufferSize), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetReassemblyConfig", reflect.TypeOf((*MockReadWriteStream)(nil).SetReassemblyConfig), arg0)
 }
 
 // SetSendMessageTimeout mocks base method.
@@ -2,6 +2,7 @@ package connection
 
 import (
 	"sync"
+	"time"
 
 	"assignment/lib/apperr"
 	"assignment/lib/entity"
@@ -11,12 +12,21 @@ import (
 	"github.com/quic-go/quic-go"
 )
 
-// DefaultReadBufferSize is the default size of the read buffer.
-const DefaultReadBufferSize = 1024 * 1024
+// DefaultReceiveQueueSize is the number of received messages queued
+// while the message receiver is busy, the stream isn't read further
+// while the queue is full.
+const DefaultReceiveQueueSize = 64
 
 // MessageReceiver is the function callback for receiving messages.
+// Messages are received one by one in the order they were sent, apart
+// from the controls, which are received meanwhile.
 type MessageReceiver func(message entity.Message)
 
+// ControlReceiver is the function callback for receiving controls.
+// Controls are received one by one in the order they were sent, so
+// the receiver must not block.
+type ControlReceiver func(control entity.Control)
+
 // ConnClosedCallback is the type alias for callback function that
 // is called when the connection is closed.
 type ConnClosedCallback func()
@@ -26,10 +36,16 @@ type ConnClosedCallback func()
 type ReadStream interface {
 	// SetMessageReceiver sets the message receiver.
 	SetMessageReceiver(messageReceiver MessageReceiver)
+	// SetControlReceiver sets the control receiver.
+	SetControlReceiver(controlReceiver ControlReceiver)
 	// SetConnectionClosedCallback sets the connection closed callback.
 	SetConnClosedCallback(connClosedCallback ConnClosedCallback)
-	// SetReadBufferSize sets the read buffer size.
-	SetReadBufferSize(size int)
+	// SetMaxFrameSize sets the maximum size of a frame accepted
+	// from the stream.
+	SetMaxFrameSize(size int)
+	// SetReassemblyConfig sets the limits for reassembling messages
+	// received in chunks.
+	SetReassemblyConfig(config ReassemblyConfig)
 	// CloseStream closes the stream.
 	CloseStream() error
 }
@@ -37,27 +53,37 @@ type ReadStream interface {
 type readStream struct {
 	sync.RWMutex
 	messageReceiver    MessageReceiver
-	readBufferSize     int
-	buffer             []byte
+	controlReceiver    ControlReceiver
+	maxFrameSize       int
 	connClosedCallback ConnClosedCallback
+	reassembler        *reassembler
+	// messages are the received messages waiting for the message
+	// receiver, closed once the stream isn't read anymore.
+	messages chan entity.Message
 
 	stream quic.ReceiveStream
 	conn   quic.Connection
 }
 
-// NewReadStream constructs a new read stream.
+// NewReadStream constructs a new read stream. Controls are dropped
+// if the control receiver is nil.
 func NewReadStream(
 	conn quic.Connection,
 	stream quic.ReceiveStream,
 	messageReceiver MessageReceiver,
+	controlReceiver ControlReceiver,
 ) ReadStream {
 	rs := &readStream{
 		messageReceiver: messageReceiver,
-		readBufferSize:  DefaultReadBufferSize,
+		controlReceiver: controlReceiver,
+		maxFrameSize:    DefaultMaxFrameSize,
+		reassembler:     newReassembler(DefaultReassemblyConfig()),
+		messages:        make(chan entity.Message, DefaultReceiveQueueSize),
 		stream:          stream,
 		conn:            conn,
 	}
 
+	go rs.receiveMessages()
 	go rs.listen()
 	return rs
 }
@@ -68,16 +94,26 @@ func (s *readStream) SetMessageReceiver(messageReceiver MessageReceiver) {
 	s.messageReceiver = messageReceiver
 }
 
+func (s *readStream) SetControlReceiver(controlReceiver ControlReceiver) {
+	s.Lock()
+	defer s.Unlock()
+	s.controlReceiver = controlReceiver
+}
+
 func (s *readStream) SetConnClosedCallback(connClosedCallback ConnClosedCallback) {
 	s.Lock()
 	defer s.Unlock()
 	s.connClosedCallback = connClosedCallback
 }
 
-func (s *readStream) SetReadBufferSize(size int) {
+func (s *readStream) SetMaxFrameSize(size int) {
 	s.Lock()
 	defer s.Unlock()
-	s.readBufferSize = size
+	s.maxFrameSize = size
+}
+
+func (s *readStream) SetReassemblyConfig(config ReassemblyConfig) {
+	s.reassembler.setConfig(config)
 }
 
 func (s *readStream) CloseStream() error {
@@ -89,14 +125,24 @@ func (s *readStream) CloseStream() error {
 }
 
 func (s *readStream) listen() {
+	defer close(s.messages)
+	defer s.reassembler.close()
+
+	reader := newFrameReader(s.stream)
 	for {
-		s.syncBuffer()
-		size, err := s.stream.Read(s.buffer)
+		frame, err := reader.readFrame(s.getMaxFrameSize())
 		if err != nil {
+			if errors.Is(err, ErrFrameTooLarge) {
+				// The peer does not respect the frame limit, the rest
+				// of the stream can't be trusted to be aligned anymore.
+				log.Errorf("Error reading stream: %v", err)
+				s.stream.CancelRead(apperr.ErrCodeFrameTooLarge)
+				return
+			}
 			if apperr.IsConnectionClosedByPeerErr(err) {
 				// Connection closed by the server.
-				if s.connClosedCallback != nil {
-					go s.connClosedCallback()
+				if callback := s.getConnClosedCallback(); callback != nil {
+					go callback()
 				}
 				return
 			}
@@ -105,22 +151,93 @@ func (s *readStream) listen() {
 			return
 		}
 
-		s.handleMessage(size)
+		s.handleFrame(frame)
 	}
 }
 
-func (s *readStream) syncBuffer() {
-	s.Lock()
-	defer s.Unlock()
-	if len(s.buffer) != s.readBufferSize {
-		s.buffer = make([]byte, s.readBufferSize)
-	}
+func (s *readStream) getMaxFrameSize() int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.maxFrameSize
 }
 
-func (s *readStream) handleMessage(messageSize int) {
+func (s *readStream) getConnClosedCallback() ConnClosedCallback {
 	s.RLock()
 	defer s.RUnlock()
+	return s.connClosedCallback
+}
+
+func (s *readStream) handleFrame(f frame) {
+	switch f.frameType {
+	case FrameTypeMessage:
+		s.handleMessage(f.payload)
+	case FrameTypeChunk:
+		s.handleChunk(f.payload)
+	case FrameTypeControl:
+		s.handleControl(f.payload)
+	default:
+		log.Warnf("Unknown frame type %d received, frame skipped", f.frameType)
+	}
+}
 
-	message := entity.MessageFromBytes(s.buffer[:messageSize])
-	go s.messageReceiver(message)
+func (s *readStream) handleControl(payload []byte) {
+	control, err := entity.ControlFromBytes(payload)
+	if err != nil {
+		log.Warnf("Error decoding control, control skipped: %v", err)
+		return
+	}
+
+	s.RLock()
+	controlReceiver := s.controlReceiver
+	s.RUnlock()
+
+	if controlReceiver == nil {
+		log.Tracef("No control receiver set, %s skipped", control)
+		return
+	}
+	controlReceiver(control)
+}
+
+func (s *readStream) handleChunk(payload []byte) {
+	c, err := chunkFromBytes(payload)
+	if err != nil {
+		log.Warnf("Error decoding chunk, chunk skipped: %v", err)
+		return
+	}
+
+	message, err := s.reassembler.add(c, time.Now())
+	if err != nil {
+		log.Warnf("Error reassembling message, chunk skipped: %v", err)
+		return
+	}
+	if message != nil {
+		s.handleMessage(message)
+	}
+}
+
+func (s *readStream) handleMessage(payload []byte) {
+	message, err := entity.MessageFromBytes(payload)
+	if err != nil {
+		log.Warnf("Error decoding message, message skipped: %v", err)
+		return
+	}
+
+	s.messages <- message
+}
+
+// receiveMessages passes the received messages to the message receiver
+// one by one, so that they're received in order without holding back
+// the controls.
+func (s *readStream) receiveMessages() {
+	for message := range s.messages {
+		s.RLock()
+		messageReceiver := s.messageReceiver
+		s.RUnlock()
+
+		if messageReceiver == nil {
+			log.Tracef("No message receiver set, message %s skipped", message.ID)
+			continue
+		}
+		messageReceiver(message)
+	}
 }
@@ -2,12 +2,26 @@ package connection
 
 import (
 	"testing"
+	"time"
 
 	"assignment/lib/entity"
 
 	"github.com/stretchr/testify/require"
 )
 
+// newTestReadStream returns a read stream passing the messages of the
+// handled frames to the message receiver.
+func newTestReadStream(t *testing.T, messageReceiver MessageReceiver) *readStream {
+	str := &readStream{
+		messageReceiver: messageReceiver,
+		reassembler:     newReassembler(DefaultReassemblyConfig()),
+		messages:        make(chan entity.Message, DefaultReceiveQueueSize),
+	}
+	go str.receiveMessages()
+	t.Cleanup(func() { close(str.messages) })
+	return str
+}
+
 func TestReadStream_SetMessageReceiver(t *testing.T) {
 	str := &readStream{}
 	require.Nil(t, str.messageReceiver)
@@ -24,35 +38,90 @@ func TestReadStream_SetMessageReceiver(t *testing.T) {
 	require.Equal(t, 2, called)
 }
 
-func TestReadStream_SetReadBufferSize(t *testing.T) {
+func TestReadStream_SetMaxFrameSize(t *testing.T) {
 	str := &readStream{}
 	size := 1024
-	str.SetReadBufferSize(size)
-	require.Equal(t, size, str.readBufferSize)
+	str.SetMaxFrameSize(size)
+	require.Equal(t, size, str.maxFrameSize)
 }
 
-func TestReadStream_syncBuffer(t *testing.T) {
-	str := &readStream{
-		readBufferSize: 128,
-		buffer:         make([]byte, 0),
-	}
-	str.syncBuffer()
-	require.Equal(t, 128, len(str.buffer))
+func TestReadStream_handleFrame(t *testing.T) {
+	received := make(chan entity.Message, 1)
+	str := newTestReadStream(t, func(message entity.Message) {
+		received <- message
+	})
+
+	message := entity.NewTextMessage("Hello, World!")
+	str.handleFrame(frame{
+		frameType: FrameTypeMessage,
+		payload:   message.Bytes(),
+	})
+	require.Equal(t, message, <-received)
+
+	// Unknown frames should be skipped.
+	str.handleFrame(frame{
+		frameType: FrameType(255),
+		payload:   message.Bytes(),
+	})
+	require.Empty(t, received)
+
+	// Malformed messages should be skipped.
+	str.handleFrame(frame{
+		frameType: FrameTypeMessage,
+		payload:   []byte("Hello"),
+	})
+	require.Empty(t, received)
 }
 
-func TestReadStream_handleMessage(t *testing.T) {
-	str := &readStream{
-		readBufferSize: 13,
-		buffer:         []byte("Hello, World!"),
+func TestReadStream_handleFrame_chunks(t *testing.T) {
+	received := make(chan entity.Message, 1)
+	str := newTestReadStream(t, func(message entity.Message) {
+		received <- message
+	})
+
+	message := entity.NewTextMessage("Hello, World!")
+	chunks, err := splitMessage(1, message.Bytes(), chunkHeaderSize+10)
+	require.NoError(t, err)
+	for _, c := range chunks {
+		require.Empty(t, received)
+		str.handleFrame(frame{
+			frameType: FrameTypeChunk,
+			payload:   c.bytes(),
+		})
 	}
+	require.Equal(t, message, <-received)
+
+	// Malformed chunks should be skipped.
+	str.handleFrame(frame{
+		frameType: FrameTypeChunk,
+		payload:   []byte("Hello"),
+	})
+	require.Empty(t, received)
+}
+
+func TestReadStream_handleFrame_order(t *testing.T) {
+	received := make(chan entity.Message, 10)
+	str := newTestReadStream(t, func(message entity.Message) {
+		if message.Text() == "0" {
+			// A slow receiver must not let later messages overtake.
+			time.Sleep(10 * time.Millisecond)
+		}
+		received <- message
+	})
 
-	str.messageReceiver = func(message entity.Message) {
-		require.Equal(t, "Hello, World!", message.Text)
+	var want []string
+	for i := 0; i < 10; i++ {
+		text := string(rune('0' + i))
+		want = append(want, text)
+		str.handleFrame(frame{
+			frameType: FrameTypeMessage,
+			payload:   entity.NewTextMessage(text).Bytes(),
+		})
 	}
-	str.handleMessage(str.readBufferSize)
 
-	str.messageReceiver = func(message entity.Message) {
-		require.Equal(t, "Hello", message.Text)
+	var got []string
+	for range want {
+		got = append(got, (<-received).Text())
 	}
-	str.handleMessage(5)
+	require.Equal(t, want, got)
 }
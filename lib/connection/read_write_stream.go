@@ -29,14 +29,16 @@ type readWriteStream struct {
 func NewReadWriteStream(
 	conn quic.Connection,
 	stream quic.Stream,
+	capabilities Capabilities,
 	messageReceiver MessageReceiver,
+	controlReceiver ControlReceiver,
 ) ReadWriteStream {
 	return &readWriteStream{
 		conn:   conn,
 		stream: stream,
 
-		readStream:  NewReadStream(conn, stream, messageReceiver),
-		writeStream: NewWriteStream(conn, stream),
+		readStream:  NewReadStream(conn, stream, messageReceiver, controlReceiver),
+		writeStream: NewWriteStream(conn, stream, capabilities),
 	}
 }
 
@@ -44,18 +46,31 @@ func (s *readWriteStream) SetMessageReceiver(messageReceiver MessageReceiver) {
 	s.readStream.SetMessageReceiver(messageReceiver)
 }
 
+func (s *readWriteStream) SetControlReceiver(controlReceiver ControlReceiver) {
+	s.readStream.SetControlReceiver(controlReceiver)
+}
+
 func (s *readWriteStream) SetConnClosedCallback(connClosedCallback ConnClosedCallback) {
 	s.readStream.SetConnClosedCallback(connClosedCallback)
 }
 
-func (s *readWriteStream) SetReadBufferSize(size int) {
-	s.readStream.SetReadBufferSize(size)
+func (s *readWriteStream) SetMaxFrameSize(size int) {
+	s.readStream.SetMaxFrameSize(size)
+	s.writeStream.SetMaxFrameSize(size)
+}
+
+func (s *readWriteStream) SetReassemblyConfig(config ReassemblyConfig) {
+	s.readStream.SetReassemblyConfig(config)
 }
 
 func (s *readWriteStream) SendMessage(message entity.Message) error {
 	return s.writeStream.SendMessage(message)
 }
 
+func (s *readWriteStream) SendControl(control entity.Control) error {
+	return s.writeStream.SendControl(control)
+}
+
 func (s *readWriteStream) SetSendMessageTimeout(timeout time.Duration) {
 	s.writeStream.SetSendMessageTimeout(timeout)
 }
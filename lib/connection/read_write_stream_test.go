@@ -11,7 +11,7 @@ import (
 
 func TestReadWriteStream_SetMessageReceiver(t *testing.T) {
 	var (
-		message         = entity.Message{Text: "message"}
+		message         = entity.NewTextMessage("message")
 		messageReceiver = func(m entity.Message) {
 			require.Equal(t, message, m)
 		}
@@ -25,17 +25,20 @@ func TestReadWriteStream_SetMessageReceiver(t *testing.T) {
 	readStream.messageReceiver(message)
 }
 
-func TestReadWriteStream_SetReadBufferSize(t *testing.T) {
+func TestReadWriteStream_SetMaxFrameSize(t *testing.T) {
 	var (
 		size            = 123
 		readStream      = &readStream{}
+		writeStream     = &writeStream{}
 		readWriteStream = &readWriteStream{
-			readStream: readStream,
+			readStream:  readStream,
+			writeStream: writeStream,
 		}
 	)
 
-	readWriteStream.SetReadBufferSize(size)
-	require.Equal(t, size, readStream.readBufferSize)
+	readWriteStream.SetMaxFrameSize(size)
+	require.Equal(t, size, readStream.maxFrameSize)
+	require.Equal(t, size, writeStream.maxFrameSize)
 }
 
 func TestReadWriteStream_SetSendMessageTimeout(t *testing.T) {
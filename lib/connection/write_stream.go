@@ -1,9 +1,11 @@
 package connection
 
 import (
+	"sync"
 	"time"
 
 	"assignment/lib/apperr"
+	"assignment/lib/compression"
 	"assignment/lib/entity"
 
 	"github.com/pkg/errors"
@@ -12,47 +14,128 @@ import (
 
 // WriteStream provides functionality for writing messages to a stream.
 type WriteStream interface {
-	// SendMessage sends a message to the stream.
+	// SendMessage sends a message to the stream. Messages too large
+	// for a single frame are split into chunks if the peer supports it.
 	SendMessage(message entity.Message) error
+	// SendControl sends a control to the stream.
+	SendControl(control entity.Control) error
 	// SetSendMessageTimeout sets the timeout for sending a message.
 	SetSendMessageTimeout(timeout time.Duration)
+	// SetMaxFrameSize sets the maximum size of a frame written
+	// to the stream.
+	SetMaxFrameSize(size int)
 	// CloseStream closes the stream.
 	CloseStream() error
 }
 
 type writeStream struct {
-	conn    quic.Connection
-	stream  quic.SendStream
-	timeout time.Duration
+	// mutex guards the stream so that frames written
+	// concurrently are never interleaved.
+	mutex        sync.Mutex
+	conn         quic.Connection
+	stream       quic.SendStream
+	timeout      time.Duration
+	maxFrameSize int
+	// capabilities are the capabilities negotiated with the peer.
+	capabilities Capabilities
+	// nextTransferID is the ID of the next message sent in chunks.
+	nextTransferID uint64
 }
 
-// NewWriteStream constructs a new write stream.
+// NewWriteStream constructs a new write stream. Messages are adapted
+// to the capabilities negotiated with the peer before sending.
 // TODO: consider implementing a ping mechanism to check if the
 // connection is still alive.
-func NewWriteStream(conn quic.Connection, stream quic.SendStream) WriteStream {
+func NewWriteStream(
+	conn quic.Connection,
+	stream quic.SendStream,
+	capabilities Capabilities,
+) WriteStream {
 	return &writeStream{
-		conn:   conn,
-		stream: stream,
+		conn:         conn,
+		stream:       stream,
+		maxFrameSize: DefaultMaxFrameSize,
+		capabilities: capabilities,
 	}
 }
 
 func (s *writeStream) SendMessage(message entity.Message) error {
-	if s.timeout != 0 {
-		deadline := time.Now().Add(s.timeout)
-		s.stream.SetWriteDeadline(deadline)
+	// Compressed messages are usually forwarded as is, unless the
+	// peer can't decompress them.
+	if algorithm := compression.Encoding(message); algorithm != "" &&
+		!s.capabilities.Has(CompressionCapability(algorithm)) {
+		var err error
+		if message, err = compression.Decompress(message, DefaultMaxMessageSize); err != nil {
+			return errors.Wrap(err, "decompress message")
+		}
+	}
+
+	payload := message.Bytes()
+	transferID, maxFrameSize := s.reserveTransfer()
+	if len(payload) <= maxFrameSize || !s.capabilities.Has(CapabilityChunking) {
+		return errors.Wrap(s.writeFrame(frame{
+			frameType: FrameTypeMessage,
+			payload:   payload,
+		}), "write message")
 	}
 
-	_, err := s.stream.Write(message.Bytes())
+	chunks, err := splitMessage(transferID, payload, maxFrameSize)
 	if err != nil {
-		return errors.Wrap(err, "write message")
+		return errors.Wrap(err, "split message")
+	}
+	// The stream is released between the chunks, so that smaller
+	// messages are not held back by large ones.
+	for _, c := range chunks {
+		if err := s.writeFrame(frame{
+			frameType: FrameTypeChunk,
+			payload:   c.bytes(),
+		}); err != nil {
+			return errors.Wrapf(err, "write chunk at offset %d", c.offset)
+		}
 	}
 	return nil
 }
 
+func (s *writeStream) SendControl(control entity.Control) error {
+	return errors.Wrap(s.writeFrame(frame{
+		frameType: FrameTypeControl,
+		payload:   control.Bytes(),
+	}), "write control")
+}
+
+// reserveTransfer returns a new transfer ID and the current maximum
+// frame size.
+func (s *writeStream) reserveTransfer() (uint64, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextTransferID++
+	return s.nextTransferID, s.maxFrameSize
+}
+
+func (s *writeStream) writeFrame(f frame) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.timeout != 0 {
+		deadline := time.Now().Add(s.timeout)
+		s.stream.SetWriteDeadline(deadline)
+	}
+
+	return writeFrame(s.stream, f, s.maxFrameSize)
+}
+
 func (s *writeStream) SetSendMessageTimeout(timeout time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.timeout = timeout
 }
 
+func (s *writeStream) SetMaxFrameSize(size int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxFrameSize = size
+}
+
 func (s *writeStream) CloseStream() error {
 	s.stream.CancelWrite(apperr.ErrCodeClosedByClient)
 	if err := s.stream.Close(); err != nil {
@@ -1,9 +1,15 @@
 package connection
 
 import (
+	"bytes"
+	"io"
 	"testing"
 	"time"
 
+	"assignment/lib/entity"
+
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go"
 	"github.com/stretchr/testify/require"
 )
 
@@ -15,3 +21,58 @@ func TestWriteStream_SetSendMessageTimeout(t *testing.T) {
 	str.SetSendMessageTimeout(timeout)
 	require.Equal(t, timeout, str.timeout)
 }
+
+func TestWriteStream_SetMaxFrameSize(t *testing.T) {
+	str := &writeStream{}
+	require.Empty(t, str.maxFrameSize)
+
+	size := 1024
+	str.SetMaxFrameSize(size)
+	require.Equal(t, size, str.maxFrameSize)
+}
+
+func TestWriteStream_SendMessage_chunked(t *testing.T) {
+	message := entity.NewMessage("application/octet-stream",
+		bytes.Repeat([]byte("0123456789"), 100))
+	maxFrameSize := 128
+
+	t.Run("peer_supports_chunking", func(t *testing.T) {
+		stream := &bufferSendStream{}
+		str := NewWriteStream(nil, stream, CapabilityChunking)
+		str.SetMaxFrameSize(maxFrameSize)
+		require.NoError(t, str.SendMessage(message))
+
+		received := make(chan entity.Message, 1)
+		rs := newTestReadStream(t, func(message entity.Message) {
+			received <- message
+		})
+		reader := newFrameReader(&stream.buffer)
+		for {
+			f, err := reader.readFrame(maxFrameSize)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			require.Equal(t, FrameTypeChunk, f.frameType)
+			rs.handleFrame(f)
+		}
+		require.Equal(t, message, <-received)
+	})
+	t.Run("peer_does_not_support_chunking", func(t *testing.T) {
+		stream := &bufferSendStream{}
+		str := NewWriteStream(nil, stream, 0)
+		str.SetMaxFrameSize(maxFrameSize)
+		require.True(t, errors.Is(str.SendMessage(message), ErrFrameTooLarge))
+		require.Zero(t, stream.buffer.Len())
+	})
+}
+
+// bufferSendStream is a send stream writing to a buffer.
+type bufferSendStream struct {
+	quic.SendStream
+	buffer bytes.Buffer
+}
+
+func (s *bufferSendStream) Write(p []byte) (int, error) {
+	return s.buffer.Write(p)
+}
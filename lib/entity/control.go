@@ -0,0 +1,487 @@
+package entity
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ControlType identifies the kind of a control.
+type ControlType uint8
+
+const (
+	// ControlSubscriberCount informs publishers of the number of
+	// connected subscribers whenever it changes.
+	ControlSubscriberCount ControlType = iota + 1
+	// ControlWelcome greets a client once it's all set up.
+	ControlWelcome
+	// ControlGoAway informs a client that the server is about to
+	// close the connection.
+	ControlGoAway
+	// ControlSubscribe subscribes a subscriber to topic filters.
+	ControlSubscribe
+	// ControlUnsubscribe unsubscribes a subscriber from topic filters.
+	ControlUnsubscribe
+	// ControlPause pauses the delivery of messages to a subscriber.
+	ControlPause
+	// ControlResume resumes the delivery of messages to a subscriber.
+	ControlResume
+	// ControlResult reports the outcome of a command.
+	ControlResult
+	// ControlAckMode switches a subscriber to acknowledged delivery.
+	ControlAckMode
+	// ControlAck acknowledges messages received in acknowledged
+	// delivery. Acks are not answered with a result.
+	ControlAck
+	// ControlConfirm confirms that the server accepted a published
+	// message, or nacks it with the reason.
+	ControlConfirm
+	// ControlReplay requests the logged messages of the topics
+	// matching the topic filters, from an offset or a time.
+	ControlReplay
+	// ControlSession resumes the session of a subscriber, or starts
+	// it if it doesn't exist.
+	ControlSession
+	// ControlCredit grants publishers credits for publishing messages.
+	ControlCredit
+)
+
+// NackReason is the reason the server didn't accept a published message.
+type NackReason uint8
+
+const (
+	// NackRejected nacks a message the server won't ever accept, e.g.
+	// one published to an invalid topic.
+	NackRejected NackReason = iota + 1
+	// NackQueueFull nacks a message dropped because the server queue
+	// was full, publishing it again later may succeed.
+	NackQueueFull
+	// NackNoCredit nacks a message published beyond the credits
+	// granted by the server, the message doesn't use up a credit.
+	NackNoCredit
+)
+
+// MaxSessionIDLength is the maximum length of a session ID in bytes.
+const MaxSessionIDLength = 256
+
+var (
+	// ErrMalformedControl is returned when decoding a control fails due
+	// to truncated or corrupted data.
+	ErrMalformedControl = errors.New("malformed control")
+	// ErrInvalidSessionID is returned when a session ID is not valid.
+	ErrInvalidSessionID = errors.New("invalid session ID")
+)
+
+// Field tags of the binary control encoding, see the message
+// encoding for details. Tags must never be reused for a different
+// field.
+const (
+	controlFieldType            = 1
+	controlFieldSubscriberCount = 2
+	controlFieldText            = 3
+	controlFieldTopic           = 4
+	controlFieldFilter          = 5
+	controlFieldCommandID       = 6
+	controlFieldGroup           = 7
+	controlFieldGroupKey        = 8
+	controlFieldPrefetch        = 9
+	controlFieldConsumerID      = 10
+	controlFieldMessageID       = 11
+	controlFieldOffset          = 12
+	controlFieldSince           = 13
+	controlFieldSessionID       = 14
+	controlFieldDuplicate       = 15
+	controlFieldCreditLimit     = 16
+	controlFieldNackReason      = 17
+)
+
+// Control is a notice exchanged between the server and clients
+// separately from the application messages.
+type Control struct {
+	// Type is the kind of the control.
+	Type ControlType
+	// SubscriberCount is the number of connected subscribers,
+	// set for ControlSubscriberCount.
+	SubscriberCount int
+	// Text is the human readable greeting of ControlWelcome, the
+	// reason of ControlGoAway, the error of a failed command
+	// reported by ControlResult or of a nacking ControlConfirm.
+	Text string
+	// Topics are the topic filters of ControlSubscribe and
+	// ControlUnsubscribe.
+	Topics []string
+	// Filter is the header filter expression of ControlSubscribe,
+	// applied to all of its topics. Empty matches all messages.
+	Filter string
+	// Group is the subscriber group of ControlSubscribe. Each message
+	// is sent to one member of a group only.
+	Group string
+	// GroupKey is the header whose value picks the member of the
+	// group receiving a message, empty to pick them round-robin.
+	GroupKey string
+	// CommandID identifies a command sent by a client, and the
+	// ControlResult answering it.
+	CommandID uint64
+	// Prefetch is the maximum number of unacknowledged messages sent
+	// to the subscriber, set for ControlAckMode.
+	Prefetch int
+	// ConsumerID identifies the subscriber across reconnects in
+	// ControlAckMode, so that the messages it didn't acknowledge are
+	// redelivered when it reconnects.
+	ConsumerID string
+	// MessageIDs are the IDs of the messages acknowledged by
+	// ControlAck, or confirmed by ControlConfirm.
+	MessageIDs []string
+	// Offset is the log offset ControlReplay replays from in each
+	// topic, the messages logged at or after it are replayed.
+	Offset uint64
+	// Since is the time ControlReplay replays from, the messages
+	// logged at or after it are replayed. Zero replays by offset only.
+	Since time.Time
+	// SessionID identifies the session ControlSession resumes, chosen
+	// by the subscriber.
+	SessionID string
+	// Duplicate is set on ControlConfirm when the server dropped the
+	// confirmed messages as duplicates of messages it accepted before.
+	Duplicate bool
+	// NackReason is set on ControlConfirm when the server didn't accept
+	// the messages, so that clients don't need to interpret the Text.
+	NackReason NackReason
+	// CreditLimit is the total number of messages ControlCredit allows
+	// the publisher to have published since it connected. Limits are
+	// absolute, so that they can't drift from the messages in flight.
+	CreditLimit uint64
+}
+
+// NewSubscriberCountControl constructs a new subscriber count control.
+func NewSubscriberCountControl(count int) Control {
+	return Control{Type: ControlSubscriberCount, SubscriberCount: count}
+}
+
+// NewWelcomeControl constructs a new welcome control.
+func NewWelcomeControl(text string) Control {
+	return Control{Type: ControlWelcome, Text: text}
+}
+
+// NewGoAwayControl constructs a new go-away control.
+func NewGoAwayControl(reason string) Control {
+	return Control{Type: ControlGoAway, Text: reason}
+}
+
+// NewSubscribeControl constructs a new subscribe control.
+func NewSubscribeControl(topics ...string) Control {
+	return Control{Type: ControlSubscribe, Topics: topics}
+}
+
+// NewFilteredSubscribeControl constructs a new subscribe control
+// receiving only the messages whose headers match the filter.
+func NewFilteredSubscribeControl(filter string, topics ...string) Control {
+	return Control{Type: ControlSubscribe, Topics: topics, Filter: filter}
+}
+
+// NewGroupSubscribeControl constructs a new subscribe control joining
+// the subscriber group, see Control.GroupKey.
+func NewGroupSubscribeControl(group, groupKey string, topics ...string) Control {
+	return Control{Type: ControlSubscribe, Topics: topics, Group: group, GroupKey: groupKey}
+}
+
+// NewUnsubscribeControl constructs a new unsubscribe control.
+func NewUnsubscribeControl(topics ...string) Control {
+	return Control{Type: ControlUnsubscribe, Topics: topics}
+}
+
+// NewPauseControl constructs a new pause control.
+func NewPauseControl() Control {
+	return Control{Type: ControlPause}
+}
+
+// NewResumeControl constructs a new resume control.
+func NewResumeControl() Control {
+	return Control{Type: ControlResume}
+}
+
+// NewAckModeControl constructs a new control switching the subscriber
+// to acknowledged delivery.
+func NewAckModeControl(consumerID string, prefetch int) Control {
+	return Control{Type: ControlAckMode, ConsumerID: consumerID, Prefetch: prefetch}
+}
+
+// NewAckControl constructs a new control acknowledging the messages.
+func NewAckControl(messageIDs ...string) Control {
+	return Control{Type: ControlAck, MessageIDs: messageIDs}
+}
+
+// NewConfirmControl constructs a new control confirming the published
+// message.
+func NewConfirmControl(messageID string) Control {
+	return Control{Type: ControlConfirm, MessageIDs: []string{messageID}}
+}
+
+// NewNackControl constructs a new control nacking the published
+// message the server didn't accept for the reason, err describes it.
+func NewNackControl(messageID string, reason NackReason, err error) Control {
+	return Control{
+		Type:       ControlConfirm,
+		MessageIDs: []string{messageID},
+		Text:       err.Error(),
+		NackReason: reason,
+	}
+}
+
+// NewDuplicateConfirmControl constructs a new control confirming the
+// published message the server dropped as a duplicate.
+func NewDuplicateConfirmControl(messageID string) Control {
+	return Control{Type: ControlConfirm, MessageIDs: []string{messageID}, Duplicate: true}
+}
+
+// NewReplayControl constructs a new control requesting the replay of
+// the logged messages of the topics matching the topic filters, from
+// the offset and the time.
+func NewReplayControl(offset uint64, since time.Time, topicFilters ...string) Control {
+	return Control{Type: ControlReplay, Topics: topicFilters, Offset: offset, Since: since}
+}
+
+// NewSessionControl constructs a new control resuming the session.
+func NewSessionControl(sessionID string) Control {
+	return Control{Type: ControlSession, SessionID: sessionID}
+}
+
+// NewCreditControl constructs a new control granting the publisher
+// credits up to the total number of messages.
+func NewCreditControl(creditLimit uint64) Control {
+	return Control{Type: ControlCredit, CreditLimit: creditLimit}
+}
+
+// ValidateSessionID returns an error if the session ID is not valid:
+// it must not be empty nor longer than MaxSessionIDLength.
+func ValidateSessionID(sessionID string) error {
+	if sessionID == "" {
+		return errors.Wrap(ErrInvalidSessionID, "empty session ID")
+	}
+	if len(sessionID) > MaxSessionIDLength {
+		return errors.Wrapf(ErrInvalidSessionID, "session ID longer than %d bytes", MaxSessionIDLength)
+	}
+	return nil
+}
+
+// NewResultControl constructs a new result of the command, err is
+// nil if the command succeeded.
+func NewResultControl(commandID uint64, err error) Control {
+	control := Control{Type: ControlResult, CommandID: commandID}
+	if err != nil {
+		control.Text = err.Error()
+	}
+	return control
+}
+
+// String returns a human readable representation of the control.
+func (c Control) String() string {
+	switch c.Type {
+	case ControlSubscriberCount:
+		return fmt.Sprintf("subscriber count %d", c.SubscriberCount)
+	case ControlWelcome:
+		return fmt.Sprintf("welcome %q", c.Text)
+	case ControlGoAway:
+		return fmt.Sprintf("go away %q", c.Text)
+	case ControlSubscribe:
+		text := fmt.Sprintf("subscribe %q", c.Topics)
+		if c.Filter != "" {
+			text += " where " + c.Filter
+		}
+		if c.Group != "" {
+			text += fmt.Sprintf(" in group %q", c.Group)
+		}
+		if c.GroupKey != "" {
+			text += fmt.Sprintf(" by %q", c.GroupKey)
+		}
+		return text
+	case ControlUnsubscribe:
+		return fmt.Sprintf("unsubscribe %q", c.Topics)
+	case ControlPause:
+		return "pause"
+	case ControlResume:
+		return "resume"
+	case ControlAckMode:
+		return fmt.Sprintf("ack mode of consumer %q with prefetch %d", c.ConsumerID, c.Prefetch)
+	case ControlAck:
+		return fmt.Sprintf("ack %q", c.MessageIDs)
+	case ControlConfirm:
+		if c.NackReason != 0 || c.Text != "" {
+			return fmt.Sprintf("nack of messages %q: %s", c.MessageIDs, c.Text)
+		}
+		if c.Duplicate {
+			return fmt.Sprintf("confirm of duplicate messages %q", c.MessageIDs)
+		}
+		return fmt.Sprintf("confirm of messages %q", c.MessageIDs)
+	case ControlReplay:
+		if !c.Since.IsZero() {
+			return fmt.Sprintf("replay %q from offset %d since %s",
+				c.Topics, c.Offset, c.Since.Format(time.RFC3339Nano))
+		}
+		return fmt.Sprintf("replay %q from offset %d", c.Topics, c.Offset)
+	case ControlSession:
+		return fmt.Sprintf("session %q", c.SessionID)
+	case ControlCredit:
+		return fmt.Sprintf("credit limit %d", c.CreditLimit)
+	case ControlResult:
+		if c.Text != "" {
+			return fmt.Sprintf("result of command %d: %s", c.CommandID, c.Text)
+		}
+		return fmt.Sprintf("result of command %d: ok", c.CommandID)
+	default:
+		return fmt.Sprintf("unknown control %d", c.Type)
+	}
+}
+
+// Bytes converts the control to a byte slice.
+func (c Control) Bytes() []byte {
+	buffer := []byte{EncodingVersion}
+	buffer = appendField(buffer, controlFieldType, []byte{byte(c.Type)})
+	if c.SubscriberCount != 0 {
+		buffer = appendField(buffer, controlFieldSubscriberCount,
+			binary.AppendUvarint(nil, uint64(c.SubscriberCount)))
+	}
+	if c.Text != "" {
+		buffer = appendField(buffer, controlFieldText, []byte(c.Text))
+	}
+	for _, topic := range c.Topics {
+		buffer = appendField(buffer, controlFieldTopic, []byte(topic))
+	}
+	if c.Filter != "" {
+		buffer = appendField(buffer, controlFieldFilter, []byte(c.Filter))
+	}
+	if c.Group != "" {
+		buffer = appendField(buffer, controlFieldGroup, []byte(c.Group))
+	}
+	if c.GroupKey != "" {
+		buffer = appendField(buffer, controlFieldGroupKey, []byte(c.GroupKey))
+	}
+	if c.CommandID != 0 {
+		buffer = appendField(buffer, controlFieldCommandID, binary.AppendUvarint(nil, c.CommandID))
+	}
+	if c.Prefetch != 0 {
+		buffer = appendField(buffer, controlFieldPrefetch,
+			binary.AppendUvarint(nil, uint64(c.Prefetch)))
+	}
+	if c.ConsumerID != "" {
+		buffer = appendField(buffer, controlFieldConsumerID, []byte(c.ConsumerID))
+	}
+	for _, messageID := range c.MessageIDs {
+		buffer = appendField(buffer, controlFieldMessageID, []byte(messageID))
+	}
+	if c.Offset != 0 {
+		buffer = appendField(buffer, controlFieldOffset, binary.AppendUvarint(nil, c.Offset))
+	}
+	if !c.Since.IsZero() {
+		buffer = appendField(buffer, controlFieldSince, binary.AppendVarint(nil, c.Since.UnixNano()))
+	}
+	if c.SessionID != "" {
+		buffer = appendField(buffer, controlFieldSessionID, []byte(c.SessionID))
+	}
+	if c.Duplicate {
+		// The flag is set by the presence of the field.
+		buffer = appendField(buffer, controlFieldDuplicate, nil)
+	}
+	if c.CreditLimit != 0 {
+		buffer = appendField(buffer, controlFieldCreditLimit, binary.AppendUvarint(nil, c.CreditLimit))
+	}
+	if c.NackReason != 0 {
+		buffer = appendField(buffer, controlFieldNackReason, []byte{byte(c.NackReason)})
+	}
+	return buffer
+}
+
+// ControlFromBytes converts a byte slice to a control.
+func ControlFromBytes(b []byte) (Control, error) {
+	if len(b) == 0 {
+		return Control{}, errors.Wrap(ErrMalformedControl, "empty control")
+	}
+	if b[0] != EncodingVersion {
+		return Control{}, errors.Wrapf(ErrUnsupportedEncodingVersion, "version %d", b[0])
+	}
+
+	var control Control
+	for data := b[1:]; len(data) > 0; {
+		tag, value, rest, err := readField(data, ErrMalformedControl)
+		if err != nil {
+			return Control{}, err
+		}
+		data = rest
+
+		switch tag {
+		case controlFieldType:
+			if len(value) != 1 {
+				return Control{}, errors.Wrap(ErrMalformedControl, "invalid type")
+			}
+			control.Type = ControlType(value[0])
+		case controlFieldSubscriberCount:
+			count, n := binary.Uvarint(value)
+			if n <= 0 {
+				return Control{}, errors.Wrap(ErrMalformedControl, "invalid subscriber count")
+			}
+			control.SubscriberCount = int(count)
+		case controlFieldText:
+			control.Text = string(value)
+		case controlFieldTopic:
+			control.Topics = append(control.Topics, string(value))
+		case controlFieldFilter:
+			control.Filter = string(value)
+		case controlFieldGroup:
+			control.Group = string(value)
+		case controlFieldGroupKey:
+			control.GroupKey = string(value)
+		case controlFieldCommandID:
+			commandID, n := binary.Uvarint(value)
+			if n <= 0 {
+				return Control{}, errors.Wrap(ErrMalformedControl, "invalid command id")
+			}
+			control.CommandID = commandID
+		case controlFieldPrefetch:
+			prefetch, n := binary.Uvarint(value)
+			if n <= 0 {
+				return Control{}, errors.Wrap(ErrMalformedControl, "invalid prefetch")
+			}
+			control.Prefetch = int(prefetch)
+		case controlFieldConsumerID:
+			control.ConsumerID = string(value)
+		case controlFieldMessageID:
+			control.MessageIDs = append(control.MessageIDs, string(value))
+		case controlFieldOffset:
+			offset, n := binary.Uvarint(value)
+			if n <= 0 {
+				return Control{}, errors.Wrap(ErrMalformedControl, "invalid offset")
+			}
+			control.Offset = offset
+		case controlFieldSince:
+			nanos, n := binary.Varint(value)
+			if n <= 0 {
+				return Control{}, errors.Wrap(ErrMalformedControl, "invalid since")
+			}
+			control.Since = time.Unix(0, nanos).UTC()
+		case controlFieldSessionID:
+			control.SessionID = string(value)
+		case controlFieldDuplicate:
+			control.Duplicate = true
+		case controlFieldCreditLimit:
+			creditLimit, n := binary.Uvarint(value)
+			if n <= 0 {
+				return Control{}, errors.Wrap(ErrMalformedControl, "invalid credit limit")
+			}
+			control.CreditLimit = creditLimit
+		case controlFieldNackReason:
+			if len(value) != 1 {
+				return Control{}, errors.Wrap(ErrMalformedControl, "invalid nack reason")
+			}
+			control.NackReason = NackReason(value[0])
+		default:
+			// Unknown field, most likely from a newer peer. Skip it.
+		}
+	}
+
+	if control.Type == 0 {
+		return Control{}, errors.Wrap(ErrMalformedControl, "missing type")
+	}
+	return control, nil
+}
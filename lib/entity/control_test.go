@@ -0,0 +1,124 @@
+package entity
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlConversion(t *testing.T) {
+	tests := map[string]Control{
+		"subscriber_count":      NewSubscriberCountControl(3),
+		"zero_subscriber_count": NewSubscriberCountControl(0),
+		"welcome":               NewWelcomeControl("Hello!"),
+		"go_away":               NewGoAwayControl("Server shutting down"),
+		"subscribe":             NewSubscribeControl("orders", "payments"),
+		"filtered_subscribe":    NewFilteredSubscribeControl(`region == "eu"`, "orders"),
+		"group_subscribe":       NewGroupSubscribeControl("workers", "customer", "orders"),
+		"unsubscribe":           NewUnsubscribeControl("orders"),
+		"pause":                 NewPauseControl(),
+		"resume":                NewResumeControl(),
+		"result":                NewResultControl(7, nil),
+		"failed_result":         NewResultControl(1<<40, errors.New("invalid topic filter")),
+		"ack_mode":              NewAckModeControl("consumer", 10),
+		"ack":                   NewAckControl("1", "2"),
+		"confirm":               NewConfirmControl("1"),
+		"nack":                  NewNackControl("1", NackQueueFull, errors.New("queue full")),
+		"replay_from_offset":    NewReplayControl(42, time.Time{}, "orders/#"),
+		"replay_since":          NewReplayControl(0, time.Unix(0, 1700000000123456789).UTC(), "orders/#"),
+		"session":               NewSessionControl("session-1"),
+		"credit":                NewCreditControl(1 << 40),
+		"duplicate_confirm":     NewDuplicateConfirmControl("1"),
+	}
+
+	for name, control := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ControlFromBytes(control.Bytes())
+			require.NoError(t, err)
+			require.Equal(t, control, got)
+		})
+	}
+}
+
+func TestControlFromBytes_errors(t *testing.T) {
+	encoded := NewWelcomeControl("Hello!").Bytes()
+
+	tests := map[string]struct {
+		data    []byte
+		wantErr error
+	}{
+		"empty_data": {
+			data:    []byte{},
+			wantErr: ErrMalformedControl,
+		},
+		"unsupported_version": {
+			data:    []byte{EncodingVersion + 1},
+			wantErr: ErrUnsupportedEncodingVersion,
+		},
+		"truncated_data": {
+			data:    encoded[:len(encoded)-1],
+			wantErr: ErrMalformedControl,
+		},
+		"missing_type": {
+			data:    []byte{EncodingVersion},
+			wantErr: ErrMalformedControl,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ControlFromBytes(tc.data)
+			require.True(t, errors.Is(err, tc.wantErr))
+		})
+	}
+}
+
+func TestControl_String(t *testing.T) {
+	assert.Equal(t, "subscriber count 2", NewSubscriberCountControl(2).String())
+	assert.Equal(t, `go away "bye"`, NewGoAwayControl("bye").String())
+	assert.Equal(t, `subscribe ["orders"] where region == "eu"`,
+		NewFilteredSubscribeControl(`region == "eu"`, "orders").String())
+	assert.Equal(t, `subscribe ["orders"] in group "workers" by "customer"`,
+		NewGroupSubscribeControl("workers", "customer", "orders").String())
+	assert.Equal(t, `ack mode of consumer "c" with prefetch 5`, NewAckModeControl("c", 5).String())
+	assert.Equal(t, `ack ["1" "2"]`, NewAckControl("1", "2").String())
+	assert.Equal(t, `confirm of messages ["1"]`, NewConfirmControl("1").String())
+	assert.Equal(t, `nack of messages ["1"]: queue full`,
+		NewNackControl("1", NackQueueFull, errors.New("queue full")).String())
+	assert.Equal(t, `replay ["orders/#"] from offset 42`,
+		NewReplayControl(42, time.Time{}, "orders/#").String())
+	assert.Equal(t, `replay ["orders/#"] from offset 0 since 2023-11-14T22:13:20Z`,
+		NewReplayControl(0, time.Unix(1700000000, 0).UTC(), "orders/#").String())
+	assert.Equal(t, `confirm of duplicate messages ["1"]`, NewDuplicateConfirmControl("1").String())
+	assert.Equal(t, `session "s"`, NewSessionControl("s").String())
+	assert.Equal(t, "credit limit 100", NewCreditControl(100).String())
+	assert.Equal(t, "result of command 3: ok", NewResultControl(3, nil).String())
+	assert.Equal(t, "result of command 3: failed",
+		NewResultControl(3, errors.New("failed")).String())
+}
+
+func TestValidateSessionID(t *testing.T) {
+	tests := map[string]struct {
+		sessionID string
+		wantErr   bool
+	}{
+		"valid":    {sessionID: "session-1"},
+		"empty":    {sessionID: "", wantErr: true},
+		"too_long": {sessionID: strings.Repeat("s", MaxSessionIDLength+1), wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateSessionID(tc.sessionID)
+			if tc.wantErr {
+				require.True(t, errors.Is(err, ErrInvalidSessionID), err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
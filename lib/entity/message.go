@@ -1,19 +1,366 @@
 package entity
 
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EncodingVersion is the version of the binary message encoding
+// produced by Message.Bytes.
+const EncodingVersion = 1
+
+const (
+	// ContentTypeText is the content type of plain text messages.
+	ContentTypeText = "text/plain"
+	// HeaderContentEncoding is the header naming the compression
+	// algorithm the payload is compressed with, if any.
+	HeaderContentEncoding = "Content-Encoding"
+	// HeaderDeadLetterID is the header of dead-lettered messages
+	// carrying the ID of the dead letter.
+	HeaderDeadLetterID = "Dead-Letter-Id"
+	// HeaderDeadLetterReason is the header of dead-lettered messages
+	// carrying the reason the message couldn't be delivered.
+	HeaderDeadLetterReason = "Dead-Letter-Reason"
+	// HeaderDeadLetterTarget is the header of dead-lettered messages
+	// naming the client the message couldn't be delivered to.
+	HeaderDeadLetterTarget = "Dead-Letter-Target"
+	// HeaderDeadLetterTopic is the header of dead-lettered messages
+	// carrying the topic the message was published to.
+	HeaderDeadLetterTopic = "Dead-Letter-Topic"
+)
+
+var (
+	// ErrUnsupportedEncodingVersion is returned when decoding a message
+	// encoded with an unknown encoding version.
+	ErrUnsupportedEncodingVersion = errors.New("unsupported message encoding version")
+	// ErrMalformedMessage is returned when decoding a message fails
+	// due to truncated or corrupted data.
+	ErrMalformedMessage = errors.New("malformed message")
+)
+
+// Field tags of the binary message encoding. Each field is encoded as
+// a tag, followed by the length of the value and the value itself, so
+// decoders can skip fields they don't know about. Tags must never be
+// reused for a different field.
+const (
+	fieldID                = 1
+	fieldTimestamp         = 2
+	fieldHeader            = 3
+	fieldContentType       = 4
+	fieldPayload           = 5
+	fieldTopic             = 6
+	fieldReplyTo           = 7
+	fieldCorrelationID     = 8
+	fieldRetain            = 9
+	fieldExpiresAt         = 10
+	fieldPriority          = 11
+	fieldRedelivered       = 12
+	fieldOffset            = 13
+	fieldProducerID        = 14
+	fieldSequence          = 15
+	fieldPublisherID       = 16
+	fieldPublisherSequence = 17
+)
+
 // Message is the message format for communication
 // between server and clients.
 type Message struct {
-	Text string
+	// ID uniquely identifies the message.
+	ID string
+	// Topic is the name of the topic the message is published to.
+	Topic string
+	// Timestamp is the time the message was published.
+	Timestamp time.Time
+	// Headers contain arbitrary key/value metadata.
+	Headers map[string]string
+	// ContentType describes the format of the payload.
+	ContentType string
+	// Payload is the message content.
+	Payload []byte
+	// ReplyTo is the reply topic replies to the message are sent to,
+	// set for requests only.
+	ReplyTo string
+	// CorrelationID relates a reply to its request.
+	CorrelationID string
+	// Retain makes the server keep the message as the last message of
+	// the topic and send it to new subscribers of the topic. A retained
+	// message without payload clears the retained message instead.
+	Retain bool
+	// ExpiresAt is the time after which the message is discarded
+	// instead of delivered, zero if the message never expires.
+	ExpiresAt time.Time
+	// Priority is the delivery priority of the message.
+	Priority Priority
+	// Redelivered is set on messages delivered again because the
+	// subscriber didn't acknowledge them in time.
+	Redelivered bool
+	// Offset is the position of the message in the durable log of its
+	// topic, starting at 1, zero if the message is not logged.
+	Offset uint64
+	// ProducerID identifies the publisher across reconnects and
+	// restarts, so that the server drops the messages it publishes
+	// more than once. Empty if the messages are not deduplicated.
+	ProducerID string
+	// Sequence numbers the messages of the producer, the server
+	// deduplicates them by sequence if it's set and by ID otherwise.
+	Sequence uint64
+	// PublisherID identifies the publisher connection the server
+	// received the message from, set by the server.
+	PublisherID string
+	// PublisherSequence numbers the messages of the publisher the
+	// server sends to a subscriber, in the order it sends them,
+	// starting at 1, so that the subscriber detects the messages it
+	// missed. Set by the server. Messages of a higher priority are
+	// sent before the earlier ones of lower priorities, so the order
+	// of the numbers is the publish order within each priority only.
+	PublisherSequence uint64
+}
+
+// NewMessage constructs a new message with a unique ID and
+// the current time as the publish timestamp.
+func NewMessage(contentType string, payload []byte) Message {
+	return Message{
+		ID:          NewID(),
+		Timestamp:   time.Now().UTC().Round(0),
+		ContentType: contentType,
+		Payload:     payload,
+	}
+}
+
+// NewTextMessage constructs a new plain text message.
+func NewTextMessage(text string) Message {
+	return NewMessage(ContentTypeText, []byte(text))
+}
+
+// NewID generates a new random unique identifier.
+func NewID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand never fails on supported platforms.
+		panic(fmt.Sprintf("generate id: %v", err))
+	}
+	return hex.EncodeToString(id)
+}
+
+// Expired returns true if the message has expired at the given time.
+func (m Message) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// Text returns the payload as a string.
+func (m Message) Text() string {
+	return string(m.Payload)
+}
+
+// IsText returns true if the payload is plain text.
+func (m Message) IsText() bool {
+	return strings.HasPrefix(m.ContentType, ContentTypeText)
+}
+
+// String returns a human readable representation of the message
+// content that is safe to log regardless of the payload format.
+func (m Message) String() string {
+	if encoding := m.Headers[HeaderContentEncoding]; encoding != "" {
+		return fmt.Sprintf("<%d bytes of %s encoded %q>", len(m.Payload), encoding, m.ContentType)
+	}
+	if m.IsText() {
+		return strconv.Quote(m.Text())
+	}
+	return fmt.Sprintf("<%d bytes of %q>", len(m.Payload), m.ContentType)
 }
 
 // Bytes converts the message to a byte slice.
-func (m *Message) Bytes() []byte {
-	return []byte(m.Text)
+func (m Message) Bytes() []byte {
+	buffer := []byte{EncodingVersion}
+	if m.ID != "" {
+		buffer = appendField(buffer, fieldID, []byte(m.ID))
+	}
+	if !m.Timestamp.IsZero() {
+		buffer = appendField(buffer, fieldTimestamp,
+			binary.AppendVarint(nil, m.Timestamp.UnixNano()))
+	}
+	// Sort the headers to keep the encoding deterministic.
+	keys := make([]string, 0, len(m.Headers))
+	for key := range m.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// Header is encoded as the key length, the key and the value.
+		header := binary.AppendUvarint(nil, uint64(len(key)))
+		header = append(header, key...)
+		header = append(header, m.Headers[key]...)
+		buffer = appendField(buffer, fieldHeader, header)
+	}
+	if m.ContentType != "" {
+		buffer = appendField(buffer, fieldContentType, []byte(m.ContentType))
+	}
+	if len(m.Payload) > 0 {
+		buffer = appendField(buffer, fieldPayload, m.Payload)
+	}
+	if m.Topic != "" {
+		buffer = appendField(buffer, fieldTopic, []byte(m.Topic))
+	}
+	if m.ReplyTo != "" {
+		buffer = appendField(buffer, fieldReplyTo, []byte(m.ReplyTo))
+	}
+	if m.CorrelationID != "" {
+		buffer = appendField(buffer, fieldCorrelationID, []byte(m.CorrelationID))
+	}
+	if m.Retain {
+		// The flag is set by the presence of the field.
+		buffer = appendField(buffer, fieldRetain, nil)
+	}
+	if !m.ExpiresAt.IsZero() {
+		buffer = appendField(buffer, fieldExpiresAt,
+			binary.AppendVarint(nil, m.ExpiresAt.UnixNano()))
+	}
+	if m.Priority != PriorityNormal {
+		buffer = appendField(buffer, fieldPriority, []byte{byte(m.Priority)})
+	}
+	if m.Redelivered {
+		// The flag is set by the presence of the field.
+		buffer = appendField(buffer, fieldRedelivered, nil)
+	}
+	if m.Offset != 0 {
+		buffer = appendField(buffer, fieldOffset, binary.AppendUvarint(nil, m.Offset))
+	}
+	if m.ProducerID != "" {
+		buffer = appendField(buffer, fieldProducerID, []byte(m.ProducerID))
+	}
+	if m.Sequence != 0 {
+		buffer = appendField(buffer, fieldSequence, binary.AppendUvarint(nil, m.Sequence))
+	}
+	if m.PublisherID != "" {
+		buffer = appendField(buffer, fieldPublisherID, []byte(m.PublisherID))
+	}
+	if m.PublisherSequence != 0 {
+		buffer = appendField(buffer, fieldPublisherSequence,
+			binary.AppendUvarint(nil, m.PublisherSequence))
+	}
+	return buffer
 }
 
 // MessageFromBytes converts a byte slice to a message.
-func MessageFromBytes(b []byte) Message {
-	return Message{
-		Text: string(b),
+func MessageFromBytes(b []byte) (Message, error) {
+	if len(b) == 0 {
+		return Message{}, errors.Wrap(ErrMalformedMessage, "empty message")
+	}
+	if b[0] != EncodingVersion {
+		return Message{}, errors.Wrapf(ErrUnsupportedEncodingVersion, "version %d", b[0])
+	}
+
+	var message Message
+	for data := b[1:]; len(data) > 0; {
+		tag, value, rest, err := readField(data, ErrMalformedMessage)
+		if err != nil {
+			return Message{}, err
+		}
+		data = rest
+
+		switch tag {
+		case fieldID:
+			message.ID = string(value)
+		case fieldTimestamp:
+			nanos, n := binary.Varint(value)
+			if n <= 0 {
+				return Message{}, errors.Wrap(ErrMalformedMessage, "invalid timestamp")
+			}
+			message.Timestamp = time.Unix(0, nanos).UTC()
+		case fieldExpiresAt:
+			nanos, n := binary.Varint(value)
+			if n <= 0 {
+				return Message{}, errors.Wrap(ErrMalformedMessage, "invalid expiry")
+			}
+			message.ExpiresAt = time.Unix(0, nanos).UTC()
+		case fieldPriority:
+			if len(value) != 1 {
+				return Message{}, errors.Wrap(ErrMalformedMessage, "invalid priority")
+			}
+			message.Priority = Priority(value[0])
+		case fieldRedelivered:
+			message.Redelivered = true
+		case fieldOffset:
+			offset, n := binary.Uvarint(value)
+			if n <= 0 {
+				return Message{}, errors.Wrap(ErrMalformedMessage, "invalid offset")
+			}
+			message.Offset = offset
+		case fieldProducerID:
+			message.ProducerID = string(value)
+		case fieldSequence:
+			sequence, n := binary.Uvarint(value)
+			if n <= 0 {
+				return Message{}, errors.Wrap(ErrMalformedMessage, "invalid sequence")
+			}
+			message.Sequence = sequence
+		case fieldPublisherID:
+			message.PublisherID = string(value)
+		case fieldPublisherSequence:
+			sequence, n := binary.Uvarint(value)
+			if n <= 0 {
+				return Message{}, errors.Wrap(ErrMalformedMessage, "invalid publisher sequence")
+			}
+			message.PublisherSequence = sequence
+		case fieldHeader:
+			keyLength, n := binary.Uvarint(value)
+			if n <= 0 || keyLength > uint64(len(value)-n) {
+				return Message{}, errors.Wrap(ErrMalformedMessage, "invalid header")
+			}
+			if message.Headers == nil {
+				message.Headers = make(map[string]string)
+			}
+			key := string(value[n : n+int(keyLength)])
+			message.Headers[key] = string(value[n+int(keyLength):])
+		case fieldContentType:
+			message.ContentType = string(value)
+		case fieldPayload:
+			message.Payload = value
+		case fieldTopic:
+			message.Topic = string(value)
+		case fieldReplyTo:
+			message.ReplyTo = string(value)
+		case fieldCorrelationID:
+			message.CorrelationID = string(value)
+		case fieldRetain:
+			message.Retain = true
+		default:
+			// Unknown field, most likely from a newer peer. Skip it.
+		}
+	}
+
+	return message, nil
+}
+
+// appendField appends a tag, the value length and the value to the buffer.
+func appendField(buffer []byte, tag uint64, value []byte) []byte {
+	buffer = binary.AppendUvarint(buffer, tag)
+	buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+// readField reads a single field and returns its tag, value and the
+// remaining unread data. Decoding errors wrap the given malformed error.
+func readField(data []byte, malformedErr error) (uint64, []byte, []byte, error) {
+	tag, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, nil, errors.Wrap(malformedErr, "invalid field tag")
 	}
+	data = data[n:]
+
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)-n) {
+		return 0, nil, nil, errors.Wrapf(malformedErr, "invalid length of field %d", tag)
+	}
+	data = data[n:]
+
+	return tag, data[:length], data[length:], nil
 }
@@ -2,16 +2,115 @@ package entity
 
 import (
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestMessageConversion(t *testing.T) {
-	message := Message{
-		Text: "Hello, World!",
+	tests := map[string]Message{
+		"empty_message": {},
+		"text_message":  NewTextMessage("Hello, World!"),
+		"full_message": {
+			ID:        NewID(),
+			Topic:     "orders",
+			Timestamp: time.Date(2020, 1, 1, 0, 0, 0, 1, time.UTC),
+			Headers: map[string]string{
+				"region":   "eu",
+				"priority": "3",
+				"empty":    "",
+			},
+			ContentType:       "application/octet-stream",
+			Payload:           []byte{0, 1, 2, 3, 255},
+			ReplyTo:           NewReplyTopic(),
+			CorrelationID:     NewID(),
+			Retain:            true,
+			ExpiresAt:         time.Date(2020, 1, 1, 0, 0, 5, 0, time.UTC),
+			Priority:          PriorityUrgent,
+			Redelivered:       true,
+			Offset:            1 << 40,
+			ProducerID:        "producer",
+			Sequence:          42,
+			PublisherID:       "publisher",
+			PublisherSequence: 7,
+		},
 	}
-	require.Equal(t, []byte("Hello, World!"), message.Bytes())
 
-	bytes := []byte("Hello, World!")
-	require.Equal(t, message, MessageFromBytes(bytes))
+	for name, message := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := MessageFromBytes(message.Bytes())
+			require.NoError(t, err)
+			require.Equal(t, message, got)
+		})
+	}
+}
+
+func TestMessageFromBytes_errors(t *testing.T) {
+	encoded := NewTextMessage("Hello, World!").Bytes()
+
+	tests := map[string]struct {
+		data    []byte
+		wantErr error
+	}{
+		"empty_data": {
+			data:    []byte{},
+			wantErr: ErrMalformedMessage,
+		},
+		"unsupported_version": {
+			data:    []byte{EncodingVersion + 1},
+			wantErr: ErrUnsupportedEncodingVersion,
+		},
+		"truncated_data": {
+			data:    encoded[:len(encoded)-1],
+			wantErr: ErrMalformedMessage,
+		},
+		"invalid_priority": {
+			data:    appendField(encoded, fieldPriority, []byte{1, 2}),
+			wantErr: ErrMalformedMessage,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := MessageFromBytes(tc.data)
+			require.True(t, errors.Is(err, tc.wantErr))
+		})
+	}
+}
+
+func TestMessageFromBytes_skips_unknown_fields(t *testing.T) {
+	message := NewTextMessage("Hello, World!")
+	encoded := appendField(message.Bytes(), 999, []byte("from the future"))
+
+	got, err := MessageFromBytes(encoded)
+	require.NoError(t, err)
+	require.Equal(t, message, got)
+}
+
+func TestMessage_String(t *testing.T) {
+	assert.Equal(t, `"Hello, World!"`, NewTextMessage("Hello, World!").String())
+	assert.Equal(t, `<3 bytes of "image/png">`,
+		NewMessage("image/png", []byte{1, 2, 3}).String())
+
+	compressed := NewTextMessage("Hello")
+	compressed.Headers = map[string]string{HeaderContentEncoding: "gzip"}
+	assert.Equal(t, `<5 bytes of gzip encoded "text/plain">`, compressed.String())
+}
+
+func TestMessage_Expired(t *testing.T) {
+	now := time.Now()
+	message := NewTextMessage("Hello")
+	assert.False(t, message.Expired(now))
+
+	message.ExpiresAt = now.Add(time.Second)
+	assert.False(t, message.Expired(now))
+	assert.True(t, message.Expired(message.ExpiresAt))
+}
+
+func TestNewID(t *testing.T) {
+	id := NewID()
+	assert.Len(t, id, 32)
+	assert.NotEqual(t, id, NewID())
 }
@@ -0,0 +1,43 @@
+package entity
+
+import "strconv"
+
+// Priority is the delivery priority of a message. Messages with a
+// higher priority are delivered before the ones queued with a lower
+// priority.
+type Priority uint8
+
+const (
+	// PriorityNormal is the priority of messages by default.
+	PriorityNormal Priority = iota
+	// PriorityHigh is the priority of messages that should overtake
+	// the normal traffic.
+	PriorityHigh
+	// PriorityUrgent is the highest priority, e.g. for alerts.
+	PriorityUrgent
+)
+
+// PriorityLevels is the number of priority levels.
+const PriorityLevels = int(PriorityUrgent) + 1
+
+// Clamp returns the priority limited to the highest priority level.
+func (p Priority) Clamp() Priority {
+	if p > PriorityUrgent {
+		return PriorityUrgent
+	}
+	return p
+}
+
+// String returns the name of the priority.
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityUrgent:
+		return "urgent"
+	default:
+		return "priority " + strconv.Itoa(int(p))
+	}
+}
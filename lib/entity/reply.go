@@ -0,0 +1,42 @@
+package entity
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ReplyTopicPrefix is the prefix of the topics replies are sent to.
+// Messages to reply topics are routed to the client that owns the
+// topic rather than to subscribers.
+const ReplyTopicPrefix = "_reply/"
+
+// ErrNotRequest is returned when replying to a message that is not a
+// request.
+var ErrNotRequest = errors.New("message is not a request")
+
+// NewReplyTopic generates a new unique reply topic.
+func NewReplyTopic() string {
+	return ReplyTopicPrefix + NewID()
+}
+
+// IsReplyTopic returns true if the topic is a reply topic.
+func IsReplyTopic(topic string) bool {
+	return strings.HasPrefix(topic, ReplyTopicPrefix)
+}
+
+// IsRequest returns true if the message expects a reply.
+func (m Message) IsRequest() bool {
+	return m.ReplyTo != ""
+}
+
+// NewReply addresses the reply to the request, by sending it to the
+// reply topic of the request with the same correlation ID.
+func NewReply(request Message, reply Message) (Message, error) {
+	if !IsReplyTopic(request.ReplyTo) {
+		return Message{}, errors.Wrapf(ErrNotRequest, "message %s", request.ID)
+	}
+	reply.Topic = request.ReplyTo
+	reply.CorrelationID = request.CorrelationID
+	return reply, nil
+}
@@ -0,0 +1,28 @@
+package entity
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReply(t *testing.T) {
+	request := NewTextMessage("ping")
+	request.Topic = "rpc/ping"
+	request.ReplyTo = NewReplyTopic()
+	request.CorrelationID = request.ID
+	require.True(t, request.IsRequest())
+	require.True(t, IsReplyTopic(request.ReplyTo))
+
+	reply, err := NewReply(request, NewTextMessage("pong"))
+	require.NoError(t, err)
+	assert.Equal(t, request.ReplyTo, reply.Topic)
+	assert.Equal(t, request.CorrelationID, reply.CorrelationID)
+	assert.Equal(t, "pong", reply.Text())
+	assert.False(t, reply.IsRequest())
+
+	_, err = NewReply(reply, NewTextMessage("pong"))
+	require.True(t, errors.Is(err, ErrNotRequest))
+}
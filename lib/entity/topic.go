@@ -0,0 +1,95 @@
+package entity
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// TopicSeparator separates the levels of hierarchical topic names.
+	TopicSeparator = "/"
+	// SingleLevelWildcard matches exactly one topic level.
+	SingleLevelWildcard = "+"
+	// MultiLevelWildcard matches any number of topic levels, including
+	// the parent level. It must be the last level of a topic filter.
+	MultiLevelWildcard = "#"
+)
+
+var (
+	// ErrInvalidTopic is returned when a topic name is not valid.
+	ErrInvalidTopic = errors.New("invalid topic")
+	// ErrInvalidTopicFilter is returned when a topic filter is not valid.
+	ErrInvalidTopicFilter = errors.New("invalid topic filter")
+	// ErrInvalidGroup is returned when a subscriber group is not valid.
+	ErrInvalidGroup = errors.New("invalid subscriber group")
+)
+
+// ValidateTopic returns an error if the topic name messages are
+// published to is not valid. Topic names can't contain wildcards.
+func ValidateTopic(topic string) error {
+	if topic == "" {
+		return errors.Wrap(ErrInvalidTopic, "empty topic")
+	}
+	if strings.ContainsAny(topic, SingleLevelWildcard+MultiLevelWildcard) {
+		return errors.Wrapf(ErrInvalidTopic, "topic %q contains wildcards", topic)
+	}
+	return nil
+}
+
+// ValidateTopicFilter returns an error if the topic filter subscribed
+// to is not valid. Wildcards must occupy a whole level, and the
+// multi-level wildcard must be the last level.
+func ValidateTopicFilter(filter string) error {
+	if filter == "" {
+		return errors.Wrap(ErrInvalidTopicFilter, "empty topic filter")
+	}
+
+	levels := TopicLevels(filter)
+	for i, level := range levels {
+		switch {
+		case level == MultiLevelWildcard && i != len(levels)-1:
+			return errors.Wrapf(ErrInvalidTopicFilter,
+				"multi-level wildcard of %q is not the last level", filter)
+		case level != SingleLevelWildcard && level != MultiLevelWildcard &&
+			strings.ContainsAny(level, SingleLevelWildcard+MultiLevelWildcard):
+			return errors.Wrapf(ErrInvalidTopicFilter,
+				"wildcard of %q doesn't occupy a whole level", filter)
+		}
+	}
+	return nil
+}
+
+// ValidateGroup returns an error if the subscriber group or its key
+// is not valid. Groups are optional, but a key requires a group.
+func ValidateGroup(group, key string) error {
+	if group == "" && key != "" {
+		return errors.Wrapf(ErrInvalidGroup, "key %q without group", key)
+	}
+	if strings.TrimSpace(group) != group {
+		return errors.Wrapf(ErrInvalidGroup, "group %q has surrounding whitespace", group)
+	}
+	return nil
+}
+
+// MatchTopic returns true if the topic name matches the topic filter.
+func MatchTopic(filter, topic string) bool {
+	filterLevels, topicLevels := TopicLevels(filter), TopicLevels(topic)
+	for i, level := range filterLevels {
+		switch {
+		case level == MultiLevelWildcard:
+			// Also matches the parent level.
+			return true
+		case i == len(topicLevels):
+			return false
+		case level != SingleLevelWildcard && level != topicLevels[i]:
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// TopicLevels splits the topic name or filter into levels.
+func TopicLevels(topic string) []string {
+	return strings.Split(topic, TopicSeparator)
+}
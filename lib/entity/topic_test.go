@@ -0,0 +1,112 @@
+package entity
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTopic(t *testing.T) {
+	tests := map[string]struct {
+		topic   string
+		wantErr bool
+	}{
+		"single_level":          {topic: "orders"},
+		"multiple_levels":       {topic: "orders/eu/created"},
+		"empty_level":           {topic: "orders//created"},
+		"empty":                 {topic: "", wantErr: true},
+		"single_level_wildcard": {topic: "orders/+/created", wantErr: true},
+		"multi_level_wildcard":  {topic: "orders/#", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateTopic(tc.topic)
+			if tc.wantErr {
+				require.True(t, errors.Is(err, ErrInvalidTopic))
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	tests := map[string]struct {
+		filter  string
+		wantErr bool
+	}{
+		"topic_name":                      {filter: "orders/eu/created"},
+		"single_level_wildcard":           {filter: "orders/+/created"},
+		"multi_level_wildcard":            {filter: "metrics/#"},
+		"only_multi_level_wildcard":       {filter: "#"},
+		"both_wildcards":                  {filter: "+/eu/#"},
+		"empty":                           {filter: "", wantErr: true},
+		"multi_level_wildcard_not_last":   {filter: "metrics/#/cpu", wantErr: true},
+		"partial_single_level_wildcard":   {filter: "orders/eu+/created", wantErr: true},
+		"partial_multi_level_wildcard":    {filter: "metrics/cpu#", wantErr: true},
+		"repeated_single_level_wildcards": {filter: "orders/++", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateTopicFilter(tc.filter)
+			if tc.wantErr {
+				require.True(t, errors.Is(err, ErrInvalidTopicFilter))
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := map[string]struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		"same_topic":                     {filter: "orders/eu", topic: "orders/eu", want: true},
+		"other_topic":                    {filter: "orders/eu", topic: "orders/us"},
+		"single_level_wildcard":          {filter: "orders/+/created", topic: "orders/eu/created", want: true},
+		"single_level_wildcard_no_level": {filter: "orders/+", topic: "orders"},
+		"multi_level_wildcard":           {filter: "metrics/#", topic: "metrics/cpu/load", want: true},
+		"multi_level_wildcard_parent":    {filter: "metrics/#", topic: "metrics", want: true},
+		"only_multi_level_wildcard":      {filter: "#", topic: "orders/eu", want: true},
+		"longer_topic":                   {filter: "orders", topic: "orders/eu"},
+		"shorter_topic":                  {filter: "orders/eu/created", topic: "orders/eu"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, MatchTopic(tc.filter, tc.topic))
+		})
+	}
+}
+
+func TestValidateGroup(t *testing.T) {
+	tests := map[string]struct {
+		group   string
+		key     string
+		wantErr bool
+	}{
+		"no_group":          {},
+		"round_robin_group": {group: "workers"},
+		"sticky_group":      {group: "workers", key: "customer"},
+		"key_without_group": {key: "customer", wantErr: true},
+		"whitespace":        {group: " workers", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateGroup(tc.group, tc.key)
+			if tc.wantErr {
+				require.True(t, errors.Is(err, ErrInvalidGroup))
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
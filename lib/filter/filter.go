@@ -0,0 +1,322 @@
+// Package filter implements filter expressions over message headers,
+// used by subscribers to receive only the messages they're interested
+// in, e.g.:
+//
+//	region == "eu" && priority >= 3
+//
+// Expressions compare header values with string or number literals
+// using ==, !=, <, <=, > and >=, and combine the comparisons with &&,
+// || and !, grouped by parentheses. A header name alone tests whether
+// the header is set. Numbers are compared numerically, so comparisons
+// against a number literal only match headers holding numbers.
+// Comparisons of headers that are not set never match. Expressions
+// are limited to MaxLength bytes and MaxDepth levels of nesting.
+package filter
+
+import (
+	"strconv"
+
+	"assignment/lib/entity"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidFilter is returned when a filter expression can't be parsed.
+var ErrInvalidFilter = errors.New("invalid filter")
+
+const (
+	// MaxLength is the maximum length of a filter expression in bytes.
+	MaxLength = 4096
+	// MaxDepth is the maximum nesting depth of parentheses and negations,
+	// so that expressions can't exhaust the stack of the parser.
+	MaxDepth = 32
+)
+
+// Filter is a parsed filter expression.
+type Filter interface {
+	// Match returns true if the headers satisfy the filter.
+	Match(headers map[string]string) bool
+	// String returns the filter expression.
+	String() string
+}
+
+// Parse parses the filter expression.
+func Parse(expression string) (Filter, error) {
+	if len(expression) > MaxLength {
+		return nil, errors.Wrapf(ErrInvalidFilter, "expression of %d bytes longer than %d",
+			len(expression), MaxLength)
+	}
+
+	p := &parser{lexer: newLexer(expression)}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.token.kind != tokenEOF {
+		return nil, p.errorf("unexpected %s", p.token)
+	}
+
+	return &filter{expression: expression, root: node}, nil
+}
+
+// MatchMessage returns true if the message headers satisfy the filter.
+// A nil filter matches all messages.
+func MatchMessage(f Filter, message entity.Message) bool {
+	return f == nil || f.Match(message.Headers)
+}
+
+type filter struct {
+	expression string
+	root       node
+}
+
+func (f *filter) Match(headers map[string]string) bool {
+	return f.root.match(headers)
+}
+
+func (f *filter) String() string {
+	return f.expression
+}
+
+// node is a node of the expression tree.
+type node interface {
+	match(headers map[string]string) bool
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) match(headers map[string]string) bool {
+	return n.left.match(headers) || n.right.match(headers)
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) match(headers map[string]string) bool {
+	return n.left.match(headers) && n.right.match(headers)
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n notNode) match(headers map[string]string) bool {
+	return !n.operand.match(headers)
+}
+
+type existsNode struct {
+	header string
+}
+
+func (n existsNode) match(headers map[string]string) bool {
+	_, ok := headers[n.header]
+	return ok
+}
+
+type comparisonNode struct {
+	header   string
+	operator tokenKind
+	// value is the string literal, or the number literal if
+	// isNumber is set.
+	value    string
+	number   float64
+	isNumber bool
+}
+
+func (n comparisonNode) match(headers map[string]string) bool {
+	value, ok := headers[n.header]
+	if !ok {
+		return false
+	}
+
+	var comparison int
+	if n.isNumber {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		comparison = compare(number, n.number)
+	} else {
+		comparison = compare(value, n.value)
+	}
+
+	switch n.operator {
+	case tokenEqual:
+		return comparison == 0
+	case tokenNotEqual:
+		return comparison != 0
+	case tokenLess:
+		return comparison < 0
+	case tokenLessOrEqual:
+		return comparison <= 0
+	case tokenGreater:
+		return comparison > 0
+	case tokenGreaterOrEqual:
+		return comparison >= 0
+	default:
+		return false
+	}
+}
+
+func compare[T string | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// parser is a recursive descent parser of filter expressions:
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | primary
+//	primary    = "(" or ")" | header [ operator literal ]
+//	operator   = "==" | "!=" | "<" | "<=" | ">" | ">="
+//	literal    = string | number
+type parser struct {
+	lexer *lexer
+	token token
+	// depth is the nesting depth of the expression being parsed.
+	depth int
+}
+
+func (p *parser) next() error {
+	var err error
+	p.token, err = p.lexer.next()
+	return err
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return errors.Wrapf(ErrInvalidFilter, "position %d: "+format,
+		append([]interface{}{p.token.position + 1}, args...)...)
+}
+
+// nest enters a nested expression, it fails if the expression is nested
+// deeper than MaxDepth. The caller leaves it by decrementing the depth.
+func (p *parser) nest() error {
+	if p.depth >= MaxDepth {
+		return p.errorf("nested deeper than %d", MaxDepth)
+	}
+	p.depth++
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenOr {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenAnd {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.token.kind != tokenNot {
+		return p.parsePrimary()
+	}
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return notNode{operand: operand}, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	switch p.token.kind {
+	case tokenLeftParen:
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.token.kind != tokenRightParen {
+			return nil, p.errorf("expected ) but got %s", p.token)
+		}
+		return node, p.next()
+	case tokenIdentifier:
+		return p.parseComparison()
+	default:
+		return nil, p.errorf("expected header name, ! or ( but got %s", p.token)
+	}
+}
+
+func (p *parser) parseComparison() (node, error) {
+	header := p.token.value
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if !p.token.kind.isComparison() {
+		return existsNode{header: header}, nil
+	}
+
+	n := comparisonNode{header: header, operator: p.token.kind}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	switch p.token.kind {
+	case tokenString:
+		n.value = p.token.value
+	case tokenNumber:
+		number, err := strconv.ParseFloat(p.token.value, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", p.token.value)
+		}
+		n.number = number
+		n.isNumber = true
+	default:
+		return nil, p.errorf("expected string or number after %s but got %s",
+			n.operator, p.token)
+	}
+	return n, p.next()
+}
@@ -0,0 +1,130 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"assignment/lib/entity"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter_Match(t *testing.T) {
+	headers := map[string]string{
+		"region":           "eu",
+		"priority":         "3",
+		"Content-Encoding": "gzip",
+		"label":            `say "hi"`,
+	}
+
+	tests := map[string]struct {
+		expression string
+		want       bool
+	}{
+		"string_equal":              {expression: `region == "eu"`, want: true},
+		"string_not_equal":          {expression: `region != "eu"`, want: false},
+		"string_ordering":           {expression: `region < "us"`, want: true},
+		"number_greater_or_equal":   {expression: `priority >= 3`, want: true},
+		"number_greater":            {expression: `priority > 3`, want: false},
+		"number_less":               {expression: `priority < 10`, want: true},
+		"number_compared_as_number": {expression: `priority < 10.5`, want: true},
+		"number_of_non_number":      {expression: `region > 0`, want: false},
+		"and":                       {expression: `region == "eu" && priority >= 3`, want: true},
+		"and_false":                 {expression: `region == "eu" && priority >= 4`, want: false},
+		"or":                        {expression: `region == "us" || priority >= 3`, want: true},
+		"not":                       {expression: `!(region == "us")`, want: true},
+		"and_before_or":             {expression: `region == "us" && priority > 5 || region == "eu"`, want: true},
+		"parentheses":               {expression: `region == "us" && (priority > 5 || region == "eu")`, want: false},
+		"exists":                    {expression: `Content-Encoding`, want: true},
+		"not_exists":                {expression: `!missing`, want: true},
+		"missing_header":            {expression: `missing == "eu"`, want: false},
+		"missing_header_not_equal":  {expression: `missing != "eu"`, want: false},
+		"escaped_string":            {expression: `label == "say \"hi\""`, want: true},
+		"whitespace":                {expression: "\tregion==\"eu\"&&priority>=3 ", want: true},
+		"max_depth": {
+			expression: strings.Repeat("(", MaxDepth-1) + "!missing" + strings.Repeat(")", MaxDepth-1),
+			want:       true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			f, err := Parse(tc.expression)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, f.Match(headers))
+			assert.Equal(t, tc.expression, f.String())
+		})
+	}
+}
+
+func TestParse_errors(t *testing.T) {
+	tests := map[string]struct {
+		expression string
+		wantErr    string
+	}{
+		"empty": {
+			expression: "",
+			wantErr:    "position 1: expected header name, ! or ( but got end of expression",
+		},
+		"missing_literal": {
+			expression: "priority >=",
+			wantErr:    `position 12: expected string or number after >= but got end of expression`,
+		},
+		"identifier_literal": {
+			expression: "region == eu",
+			wantErr:    `position 11: expected string or number after == but got header name eu`,
+		},
+		"missing_operand": {
+			expression: `region == "eu" &&`,
+			wantErr:    "position 18: expected header name, ! or ( but got end of expression",
+		},
+		"unclosed_parenthesis": {
+			expression: `(region == "eu"`,
+			wantErr:    "position 16: expected ) but got end of expression",
+		},
+		"trailing_tokens": {
+			expression: `region == "eu" priority`,
+			wantErr:    "position 16: unexpected header name priority",
+		},
+		"unterminated_string": {
+			expression: `region == "eu`,
+			wantErr:    "position 11: unterminated string",
+		},
+		"unexpected_character": {
+			expression: `region = "eu"`,
+			wantErr:    `position 8: unexpected character '='`,
+		},
+		"invalid_number": {
+			expression: `priority > 3e`,
+			wantErr:    "position 12: invalid number 3e",
+		},
+		"too_deep": {
+			expression: strings.Repeat("(", MaxDepth) + "!region" + strings.Repeat(")", MaxDepth),
+			wantErr:    "position 33: nested deeper than 32",
+		},
+		"too_long": {
+			expression: "region == \"" + strings.Repeat("e", MaxLength) + "\"",
+			wantErr:    "expression of 4108 bytes longer than 4096",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse(tc.expression)
+			require.True(t, errors.Is(err, ErrInvalidFilter))
+			require.EqualError(t, err, tc.wantErr+": "+ErrInvalidFilter.Error())
+		})
+	}
+}
+
+func TestMatchMessage(t *testing.T) {
+	message := entity.NewTextMessage("Hello")
+	message.Headers = map[string]string{"region": "eu"}
+
+	f, err := Parse(`region == "us"`)
+	require.NoError(t, err)
+	assert.False(t, MatchMessage(f, message))
+	assert.True(t, MatchMessage(nil, message))
+}
@@ -0,0 +1,180 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdentifier
+	tokenString
+	tokenNumber
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLeftParen
+	tokenRightParen
+	tokenEqual
+	tokenNotEqual
+	tokenLess
+	tokenLessOrEqual
+	tokenGreater
+	tokenGreaterOrEqual
+)
+
+// operators are the operator tokens, longer operators first so that
+// they take precedence over their prefixes.
+var operators = []struct {
+	text string
+	kind tokenKind
+}{
+	{"&&", tokenAnd},
+	{"||", tokenOr},
+	{"==", tokenEqual},
+	{"!=", tokenNotEqual},
+	{"<=", tokenLessOrEqual},
+	{">=", tokenGreaterOrEqual},
+	{"<", tokenLess},
+	{">", tokenGreater},
+	{"!", tokenNot},
+	{"(", tokenLeftParen},
+	{")", tokenRightParen},
+}
+
+func (k tokenKind) isComparison() bool {
+	return k >= tokenEqual && k <= tokenGreaterOrEqual
+}
+
+func (k tokenKind) String() string {
+	for _, operator := range operators {
+		if operator.kind == k {
+			return operator.text
+		}
+	}
+	switch k {
+	case tokenIdentifier:
+		return "header name"
+	case tokenString:
+		return "string"
+	case tokenNumber:
+		return "number"
+	default:
+		return "end of expression"
+	}
+}
+
+type token struct {
+	kind  tokenKind
+	value string
+	// position is the byte offset of the token in the expression.
+	position int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenIdentifier, tokenNumber:
+		return fmt.Sprintf("%s %s", t.kind, t.value)
+	case tokenString:
+		return fmt.Sprintf("%s %q", t.kind, t.value)
+	case tokenEOF:
+		return t.kind.String()
+	default:
+		return strconv.Quote(t.kind.String())
+	}
+}
+
+// lexer splits a filter expression into tokens.
+type lexer struct {
+	input    string
+	position int
+}
+
+func newLexer(input string) *lexer {
+	return &lexer{input: input}
+}
+
+func (l *lexer) next() (token, error) {
+	for l.position < len(l.input) && isSpace(l.input[l.position]) {
+		l.position++
+	}
+	start := l.position
+	if start == len(l.input) {
+		return token{kind: tokenEOF, position: start}, nil
+	}
+
+	rest := l.input[start:]
+	for _, operator := range operators {
+		if strings.HasPrefix(rest, operator.text) {
+			l.position += len(operator.text)
+			return token{kind: operator.kind, position: start}, nil
+		}
+	}
+
+	switch c := rest[0]; {
+	case c == '"':
+		return l.readString()
+	case isDigit(c) || c == '-' || c == '.':
+		for l.position < len(l.input) && isNumberChar(l.input[l.position]) {
+			l.position++
+		}
+		return token{kind: tokenNumber, value: l.input[start:l.position], position: start}, nil
+	case isIdentifierStart(c):
+		for l.position < len(l.input) && isIdentifierChar(l.input[l.position]) {
+			l.position++
+		}
+		return token{kind: tokenIdentifier, value: l.input[start:l.position], position: start}, nil
+	default:
+		return token{}, errors.Wrapf(ErrInvalidFilter,
+			"position %d: unexpected character %q", start+1, c)
+	}
+}
+
+// readString reads a double quoted string literal with Go escape
+// sequences.
+func (l *lexer) readString() (token, error) {
+	start := l.position
+	for i := start + 1; i < len(l.input); i++ {
+		switch l.input[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(l.input[start : i+1])
+			if err != nil {
+				return token{}, errors.Wrapf(ErrInvalidFilter,
+					"position %d: invalid string %s", start+1, l.input[start:i+1])
+			}
+			l.position = i + 1
+			return token{kind: tokenString, value: value, position: start}, nil
+		}
+	}
+	return token{}, errors.Wrapf(ErrInvalidFilter,
+		"position %d: unterminated string", start+1)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNumberChar(c byte) bool {
+	return isDigit(c) || c == '.' || c == '-' || c == '+' || c == 'e' || c == 'E'
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isIdentifierChar returns true for the characters allowed in header
+// names after the first one, e.g. Content-Encoding.
+func isIdentifierChar(c byte) bool {
+	return isIdentifierStart(c) || isDigit(c) || c == '-' || c == '.'
+}
@@ -0,0 +1,33 @@
+package testutil
+
+import (
+	"assignment/lib/entity"
+	"sync"
+)
+
+// ControlCollector is a helper struct for collecting controls.
+type ControlCollector struct {
+	sync.RWMutex
+
+	controls []entity.Control
+}
+
+func (c *ControlCollector) Add(control entity.Control) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.controls = append(c.controls, control)
+}
+
+func (c *ControlCollector) Get() []entity.Control {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.controls
+}
+
+func NewControlCollector() *ControlCollector {
+	return &ControlCollector{
+		controls: make([]entity.Control, 0),
+	}
+}
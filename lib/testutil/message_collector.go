@@ -26,6 +26,18 @@ func (m *MessageCollector) Get() []entity.Message {
 	return m.messages
 }
 
+// GetTexts returns the payloads of collected messages as strings.
+func (m *MessageCollector) GetTexts() []string {
+	m.RLock()
+	defer m.RUnlock()
+
+	texts := make([]string, 0, len(m.messages))
+	for _, message := range m.messages {
+		texts = append(texts, message.Text())
+	}
+	return texts
+}
+
 func NewMessageCollector() *MessageCollector {
 	return &MessageCollector{
 		messages: make([]entity.Message, 0),
@@ -8,9 +8,11 @@ import (
 	"syscall"
 
 	"assignment/lib/certificate"
+	"assignment/lib/compression"
 	"assignment/lib/log"
 	"assignment/server/config"
 	"assignment/server/server"
+	"assignment/server/server/topiclog"
 )
 
 func main() {
@@ -36,6 +38,14 @@ func main() {
 		panic(fmt.Sprintf("load TLS config: %v", err))
 	}
 
+	// Open the message log, if enabled.
+	var messageLog topiclog.Log
+	if config.MessageLog.Dir != "" {
+		if messageLog, err = topiclog.Open(config.MessageLog.TopicLogConfig()); err != nil {
+			panic(fmt.Sprintf("error opening message log: %v", err))
+		}
+	}
+
 	// Start the server.
 	log.Trace("Starting server")
 	server := server.New(server.Config{
@@ -44,6 +54,24 @@ func main() {
 		TLS:                tlsConfig,
 		OpenStreamTimeout:  config.OpenStreamTimeout,
 		SendMessageTimeout: config.SendMessageTimeout,
+		Compression: compression.Config{
+			Algorithm: config.CompressionAlgorithm,
+			Threshold: config.CompressionThreshold,
+		},
+		TopicTTLs:             config.TopicTTLs,
+		DeadLetterTopic:       config.DeadLetterTopic,
+		AckTimeout:            config.AckTimeout,
+		SessionExpiry:         config.SessionExpiry,
+		SessionMaxMessages:    config.SessionMaxMessages,
+		SessionMaxBytes:       config.SessionMaxBytes,
+		DedupWindow:           config.DedupWindow,
+		PublisherCredits:      config.PublisherCredits,
+		SubscriberQueueSize:   config.SubscriberQueueSize,
+		OverflowPolicy:        config.OverflowPolicy,
+		TopicOverflowPolicies: config.TopicOverflowPolicies,
+		OverflowBlockTimeout:  config.OverflowBlockTimeout,
+		MessageLog:            messageLog,
+		AdminAddress:          config.AdminAddress,
 	})
 	if err := server.Start(); err != nil {
 		panic(fmt.Sprintf("error starting server: %v", err))
@@ -65,6 +93,11 @@ func main() {
 		if err := server.Shutdown(); err != nil {
 			panic(fmt.Sprintf("error shutting down server: %v", err))
 		}
+		if messageLog != nil {
+			if err := messageLog.Close(); err != nil {
+				log.Errorf("Error closing message log: %s", err.Error())
+			}
+		}
 		closed <- struct{}{}
 	}()
 
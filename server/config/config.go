@@ -4,6 +4,11 @@ import (
 	"os"
 	"time"
 
+	"assignment/lib/compression"
+	"assignment/lib/entity"
+	"assignment/server/server/controller"
+	"assignment/server/server/topiclog"
+
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
@@ -21,8 +26,36 @@ const (
 	DefaultSendMessageTimeout = time.Second * 5
 	// MaxSendMessageTimeout is the maximum timeout for sending a message.
 	MaxSendMessageTimeout = time.Second * 30
+	// DefaultAckTimeout is the default time subscribers in ack mode
+	// have to acknowledge a message before it's redelivered.
+	DefaultAckTimeout = time.Second * 30
+	// MaxAckTimeout is the maximum ack timeout.
+	MaxAckTimeout = time.Hour
+	// DefaultSessionExpiry is the default time the sessions of
+	// disconnected subscribers are kept.
+	DefaultSessionExpiry = time.Hour
+	// MaxSessionExpiry is the maximum session expiry.
+	MaxSessionExpiry = time.Hour * 24 * 7
+	// DefaultOverflowBlockTimeout is the default time the block
+	// overflow policy waits for a full subscriber queue.
+	DefaultOverflowBlockTimeout = time.Second
+	// MaxOverflowBlockTimeout is the maximum overflow block timeout.
+	MaxOverflowBlockTimeout = time.Second * 30
+	// DefaultOverflowPolicy is the default policy for the messages
+	// queued for subscribers with a full queue.
+	DefaultOverflowPolicy = controller.OverflowDropNewest
+	// DefaultCompressionAlgorithm is the default algorithm for compressing
+	// messages, they're not compressed by default.
+	DefaultCompressionAlgorithm = compression.None
+	// DefaultCompressionThreshold is the default payload size in bytes
+	// below which messages are not compressed.
+	DefaultCompressionThreshold = compression.DefaultThreshold
 )
 
+// ErrInvalidTopicTTL is returned when the default time-to-live of a
+// topic filter is not positive.
+var ErrInvalidTopicTTL = errors.New("invalid topic TTL")
+
 // Config contains broker server application configuration.
 type Config struct {
 	SubscriberPort          int           `yaml:"subscriberPort"`
@@ -30,6 +63,70 @@ type Config struct {
 	GracefulShutdownTimeout time.Duration `yaml:"gracefulShutdownTimeout"`
 	OpenStreamTimeout       time.Duration `yaml:"openStreamTimeout"`
 	SendMessageTimeout      time.Duration `yaml:"sendMessageTimeout"`
+	AckTimeout              time.Duration `yaml:"ackTimeout"`
+	SessionExpiry           time.Duration `yaml:"sessionExpiry"`
+	// SessionMaxMessages and SessionMaxBytes limit the messages
+	// queued for each offline session, zero for the server defaults.
+	SessionMaxMessages int `yaml:"sessionMaxMessages"`
+	SessionMaxBytes    int `yaml:"sessionMaxBytes"`
+	// DedupWindow is the number of the latest messages of each
+	// producer duplicates are detected against, zero for the server
+	// default.
+	DedupWindow int `yaml:"dedupWindow"`
+	// PublisherCredits is the number of messages each publisher can
+	// have queued in the server, zero for the server default.
+	PublisherCredits int `yaml:"publisherCredits"`
+	// SubscriberQueueSize is the number of messages queued for each
+	// subscriber, zero for the server default.
+	SubscriberQueueSize int `yaml:"subscriberQueueSize"`
+	// OverflowPolicy is either drop-newest, drop-oldest, block or
+	// disconnect. TopicOverflowPolicies map topic filters to the
+	// policies overriding it for the matching topics.
+	OverflowPolicy        controller.OverflowPolicy            `yaml:"overflowPolicy"`
+	TopicOverflowPolicies map[string]controller.OverflowPolicy `yaml:"topicOverflowPolicies,omitempty"`
+	OverflowBlockTimeout  time.Duration                        `yaml:"overflowBlockTimeout"`
+	// CompressionAlgorithm is either gzip, deflate or none.
+	CompressionAlgorithm compression.Algorithm `yaml:"compressionAlgorithm"`
+	CompressionThreshold int                   `yaml:"compressionThreshold"`
+	// TopicTTLs map topic filters to the default time-to-live of the
+	// messages published to the matching topics.
+	TopicTTLs map[string]time.Duration `yaml:"topicTTLs,omitempty"`
+	// DeadLetterTopic is the topic dead letters are published to,
+	// empty if they're only kept for inspection.
+	DeadLetterTopic string `yaml:"deadLetterTopic"`
+	// AdminAddress is the address of the admin HTTP API, e.g.
+	// localhost:8082, empty to disable it.
+	AdminAddress string `yaml:"adminAddress"`
+	// MessageLog configures the durable message log subscribers can
+	// replay messages from.
+	MessageLog MessageLogConfig `yaml:"messageLog"`
+}
+
+// MessageLogConfig contains the durable message log configuration.
+// Zero values are replaced by the topiclog defaults.
+type MessageLogConfig struct {
+	// Dir is the directory of the log, empty to disable it.
+	Dir         string `yaml:"dir"`
+	SegmentSize int64  `yaml:"segmentSize"`
+	// RetentionAge and RetentionSize bound the age and size of the
+	// log of each topic, the oldest segments are removed beyond.
+	RetentionAge  time.Duration `yaml:"retentionAge"`
+	RetentionSize int64         `yaml:"retentionSize"`
+	// Fsync is either always, interval or never.
+	Fsync         topiclog.SyncPolicy `yaml:"fsync"`
+	FsyncInterval time.Duration       `yaml:"fsyncInterval"`
+}
+
+// TopicLogConfig returns the configuration for opening the log.
+func (c MessageLogConfig) TopicLogConfig() topiclog.Config {
+	return topiclog.Config{
+		Dir:           c.Dir,
+		SegmentSize:   c.SegmentSize,
+		RetentionAge:  c.RetentionAge,
+		RetentionSize: c.RetentionSize,
+		SyncPolicy:    c.Fsync,
+		SyncInterval:  c.FsyncInterval,
+	}
 }
 
 // LoadConfig loads the configuration from the given path.
@@ -72,6 +169,69 @@ func (r *reader) readConfig(path string) (Config, error) {
 		DefaultSendMessageTimeout,
 		MaxSendMessageTimeout,
 	)
+	config.AckTimeout = clampDuration(
+		config.AckTimeout,
+		DefaultAckTimeout,
+		MaxAckTimeout,
+	)
+	config.SessionExpiry = clampDuration(
+		config.SessionExpiry,
+		DefaultSessionExpiry,
+		MaxSessionExpiry,
+	)
+	config.OverflowBlockTimeout = clampDuration(
+		config.OverflowBlockTimeout,
+		DefaultOverflowBlockTimeout,
+		MaxOverflowBlockTimeout,
+	)
+
+	if config.CompressionAlgorithm == "" {
+		config.CompressionAlgorithm = DefaultCompressionAlgorithm
+	}
+	if _, err := compression.ParseAlgorithm(string(config.CompressionAlgorithm)); err != nil {
+		return Config{}, errors.Wrap(err, "parse compression algorithm")
+	}
+	if config.CompressionThreshold <= 0 {
+		config.CompressionThreshold = DefaultCompressionThreshold
+	}
+
+	for topicFilter, ttl := range config.TopicTTLs {
+		if err := entity.ValidateTopicFilter(topicFilter); err != nil {
+			return Config{}, errors.Wrap(err, "validate topic TTLs")
+		}
+		if ttl <= 0 {
+			return Config{}, errors.Wrap(
+				errors.Wrapf(ErrInvalidTopicTTL, "%s of %q", ttl, topicFilter),
+				"validate topic TTLs")
+		}
+	}
+
+	if config.OverflowPolicy == "" {
+		config.OverflowPolicy = DefaultOverflowPolicy
+	}
+	if _, err := controller.ParseOverflowPolicy(string(config.OverflowPolicy)); err != nil {
+		return Config{}, errors.Wrap(err, "parse overflow policy")
+	}
+	for topicFilter, policy := range config.TopicOverflowPolicies {
+		if err := entity.ValidateTopicFilter(topicFilter); err != nil {
+			return Config{}, errors.Wrap(err, "validate topic overflow policies")
+		}
+		if _, err := controller.ParseOverflowPolicy(string(policy)); err != nil {
+			return Config{}, errors.Wrapf(err, "parse overflow policy of %q", topicFilter)
+		}
+	}
+
+	if config.DeadLetterTopic != "" {
+		if err := entity.ValidateTopic(config.DeadLetterTopic); err != nil {
+			return Config{}, errors.Wrap(err, "validate dead-letter topic")
+		}
+	}
+
+	if config.MessageLog.Fsync != "" {
+		if _, err := topiclog.ParseSyncPolicy(string(config.MessageLog.Fsync)); err != nil {
+			return Config{}, errors.Wrap(err, "parse message log fsync policy")
+		}
+	}
 
 	return config, nil
 }
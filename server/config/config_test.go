@@ -4,6 +4,11 @@ import (
 	"testing"
 	"time"
 
+	"assignment/lib/compression"
+	"assignment/lib/entity"
+	"assignment/server/server/controller"
+	"assignment/server/server/topiclog"
+
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -42,6 +47,12 @@ func TestLoadConfig(t *testing.T) {
 					GracefulShutdownTimeout: DefaultGracefulShutdownTimeout,
 					OpenStreamTimeout:       DefaultOpenStreamTimeout,
 					SendMessageTimeout:      DefaultSendMessageTimeout,
+					AckTimeout:              DefaultAckTimeout,
+					SessionExpiry:           DefaultSessionExpiry,
+					OverflowPolicy:          DefaultOverflowPolicy,
+					OverflowBlockTimeout:    DefaultOverflowBlockTimeout,
+					CompressionAlgorithm:    DefaultCompressionAlgorithm,
+					CompressionThreshold:    DefaultCompressionThreshold,
 				},
 			},
 			"happy_path_with_out_of_bound_durations": {
@@ -50,13 +61,93 @@ func TestLoadConfig(t *testing.T) {
 						GracefulShutdownTimeout: MaxGracefulShutdownTimeout + 1,
 						OpenStreamTimeout:       MaxOpenStreamTimeout + 1,
 						SendMessageTimeout:      MaxSendMessageTimeout + 1,
+						AckTimeout:              MaxAckTimeout + 1,
+						SessionExpiry:           MaxSessionExpiry + 1,
+						OverflowBlockTimeout:    MaxOverflowBlockTimeout + 1,
 					})
 				},
 				want: Config{
 					GracefulShutdownTimeout: MaxGracefulShutdownTimeout,
 					OpenStreamTimeout:       MaxOpenStreamTimeout,
 					SendMessageTimeout:      MaxSendMessageTimeout,
+					AckTimeout:              MaxAckTimeout,
+					SessionExpiry:           MaxSessionExpiry,
+					OverflowPolicy:          DefaultOverflowPolicy,
+					OverflowBlockTimeout:    MaxOverflowBlockTimeout,
+					CompressionAlgorithm:    DefaultCompressionAlgorithm,
+					CompressionThreshold:    DefaultCompressionThreshold,
+				},
+			},
+			"error_invalid_message_log_fsync": {
+				osReadFile: func(string) ([]byte, error) {
+					return yaml.Marshal(Config{
+						MessageLog: MessageLogConfig{Dir: "log", Fsync: "sometimes"},
+					})
+				},
+				wantErr: errors.Wrap(
+					errors.Wrapf(topiclog.ErrUnknownSyncPolicy, "%q", "sometimes"),
+					"parse message log fsync policy"),
+			},
+			"error_invalid_overflow_policy": {
+				osReadFile: func(string) ([]byte, error) {
+					return yaml.Marshal(Config{
+						OverflowPolicy: "drop-all",
+					})
+				},
+				wantErr: errors.Wrap(
+					errors.Wrapf(controller.ErrUnknownOverflowPolicy, "%q", "drop-all"),
+					"parse overflow policy"),
+			},
+			"error_invalid_topic_overflow_policy": {
+				osReadFile: func(string) ([]byte, error) {
+					return yaml.Marshal(Config{
+						TopicOverflowPolicies: map[string]controller.OverflowPolicy{"metrics/#": "drop-all"},
+					})
+				},
+				wantErr: errors.Wrapf(
+					errors.Wrapf(controller.ErrUnknownOverflowPolicy, "%q", "drop-all"),
+					"parse overflow policy of %q", "metrics/#"),
+			},
+			"error_invalid_compression_algorithm": {
+				osReadFile: func(string) ([]byte, error) {
+					return yaml.Marshal(Config{
+						CompressionAlgorithm: "brotli",
+					})
+				},
+				wantErr: errors.Wrap(
+					errors.Wrapf(compression.ErrUnknownAlgorithm, "%q", "brotli"),
+					"parse compression algorithm"),
+			},
+			"error_invalid_topic_ttl_filter": {
+				osReadFile: func(string) ([]byte, error) {
+					return yaml.Marshal(Config{
+						TopicTTLs: map[string]time.Duration{"prices/#/eu": time.Second},
+					})
+				},
+				wantErr: errors.Wrap(
+					errors.Wrapf(entity.ErrInvalidTopicFilter,
+						"multi-level wildcard of %q is not the last level", "prices/#/eu"),
+					"validate topic TTLs"),
+			},
+			"error_invalid_topic_ttl": {
+				osReadFile: func(string) ([]byte, error) {
+					return yaml.Marshal(Config{
+						TopicTTLs: map[string]time.Duration{"prices/#": -time.Second},
+					})
+				},
+				wantErr: errors.Wrap(
+					errors.Wrapf(ErrInvalidTopicTTL, "%s of %q", -time.Second, "prices/#"),
+					"validate topic TTLs"),
+			},
+			"error_invalid_dead_letter_topic": {
+				osReadFile: func(string) ([]byte, error) {
+					return yaml.Marshal(Config{
+						DeadLetterTopic: "dead-letters/#",
+					})
 				},
+				wantErr: errors.Wrap(
+					errors.Wrapf(entity.ErrInvalidTopic, "topic %q contains wildcards", "dead-letters/#"),
+					"validate dead-letter topic"),
 			},
 			"happy_path": {
 				osReadFile: func(string) ([]byte, error) {
@@ -66,6 +157,21 @@ func TestLoadConfig(t *testing.T) {
 						GracefulShutdownTimeout: time.Second,
 						OpenStreamTimeout:       time.Minute,
 						SendMessageTimeout:      time.Second * 2,
+						AckTimeout:              time.Minute,
+						SessionExpiry:           time.Minute,
+						SessionMaxMessages:      10,
+						SessionMaxBytes:         1024,
+						DedupWindow:             100,
+						PublisherCredits:        50,
+						SubscriberQueueSize:     10,
+						OverflowPolicy:          controller.OverflowBlock,
+						TopicOverflowPolicies:   map[string]controller.OverflowPolicy{"metrics/#": controller.OverflowDropOldest},
+						OverflowBlockTimeout:    time.Millisecond * 100,
+						CompressionAlgorithm:    compression.None,
+						CompressionThreshold:    100,
+						TopicTTLs:               map[string]time.Duration{"prices/#": time.Second * 5},
+						DeadLetterTopic:         "dead-letters",
+						AdminAddress:            "localhost:8082",
 					})
 				},
 				want: Config{
@@ -74,6 +180,21 @@ func TestLoadConfig(t *testing.T) {
 					GracefulShutdownTimeout: time.Second,
 					OpenStreamTimeout:       time.Minute,
 					SendMessageTimeout:      time.Second * 2,
+					AckTimeout:              time.Minute,
+					SessionExpiry:           time.Minute,
+					SessionMaxMessages:      10,
+					SessionMaxBytes:         1024,
+					DedupWindow:             100,
+					PublisherCredits:        50,
+					SubscriberQueueSize:     10,
+					OverflowPolicy:          controller.OverflowBlock,
+					TopicOverflowPolicies:   map[string]controller.OverflowPolicy{"metrics/#": controller.OverflowDropOldest},
+					OverflowBlockTimeout:    time.Millisecond * 100,
+					CompressionAlgorithm:    compression.None,
+					CompressionThreshold:    100,
+					TopicTTLs:               map[string]time.Duration{"prices/#": time.Second * 5},
+					DeadLetterTopic:         "dead-letters",
+					AdminAddress:            "localhost:8082",
 				},
 			},
 		}
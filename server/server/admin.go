@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"assignment/lib/log"
+	"assignment/server/server/controller"
+
+	"github.com/pkg/errors"
+)
+
+// adminHandler serves the admin HTTP API:
+//
+//	GET    /stats                     the message statistics
+//	GET    /deadletters               the dead letters, oldest first
+//	POST   /deadletters/replay?id=ID  replays the dead letter
+//	DELETE /deadletters?id=ID         removes the dead letter
+type adminHandler struct {
+	commsController controller.CommsController
+}
+
+func newAdminHandler(commsController controller.CommsController) http.Handler {
+	h := &adminHandler{commsController: commsController}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", h.stats)
+	mux.HandleFunc("/deadletters", h.deadLetters)
+	mux.HandleFunc("/deadletters/replay", h.replayDeadLetter)
+	return mux
+}
+
+func (h *adminHandler) stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, h.commsController.Stats())
+}
+
+func (h *adminHandler) deadLetters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, h.commsController.DeadLetters())
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "missing dead letter id", http.StatusBadRequest)
+			return
+		}
+		writeResult(w, h.commsController.RemoveDeadLetter(id))
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (h *adminHandler) replayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing dead letter id", http.StatusBadRequest)
+		return
+	}
+	writeResult(w, h.commsController.ReplayDeadLetter(id))
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Errorf("Error writing admin response: %s", err.Error())
+	}
+}
+
+func writeResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, controller.ErrUnknownDeadLetter):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	for _, method := range methods {
+		w.Header().Add("Allow", method)
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
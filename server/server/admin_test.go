@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"assignment/server/server/controller"
+	controllermocks "assignment/server/server/controller/mocks"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandler(t *testing.T) {
+	tests := map[string]struct {
+		method     string
+		target     string
+		setup      func(m *controllermocks.MockCommsController)
+		wantStatus int
+		wantBody   string
+	}{
+		"stats": {
+			method: http.MethodGet,
+			target: "/stats",
+			setup: func(m *controllermocks.MockCommsController) {
+				m.EXPECT().Stats().Return(controller.Stats{MessagesReceived: 3}).Times(1)
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"messagesReceived":3,"messagesExpired":0,"messagesDeadLettered":0,"messagesRedelivered":0,"messagesDeduplicated":0,"messagesDroppedNewest":0,"messagesDroppedOldest":0,"overflowBlocked":0,"overflowBlockTimeouts":0,"overflowBacklogged":0,"overflowDisconnects":0}`,
+		},
+		"dead_letters": {
+			method: http.MethodGet,
+			target: "/deadletters",
+			setup: func(m *controllermocks.MockCommsController) {
+				m.EXPECT().DeadLetters().Return([]controller.DeadLetter{
+					{ID: "1", Reason: controller.ReasonQueueFull, Target: "subscriber 1"},
+				}).Times(1)
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"id":"1","message":`,
+		},
+		"replay_dead_letter": {
+			method: http.MethodPost,
+			target: "/deadletters/replay?id=1",
+			setup: func(m *controllermocks.MockCommsController) {
+				m.EXPECT().ReplayDeadLetter("1").Return(nil).Times(1)
+			},
+			wantStatus: http.StatusNoContent,
+		},
+		"replay_unknown_dead_letter": {
+			method: http.MethodPost,
+			target: "/deadletters/replay?id=1",
+			setup: func(m *controllermocks.MockCommsController) {
+				m.EXPECT().ReplayDeadLetter("1").
+					Return(errors.Wrap(controller.ErrUnknownDeadLetter, "id")).Times(1)
+			},
+			wantStatus: http.StatusNotFound,
+			wantBody:   "id: unknown dead letter",
+		},
+		"replay_without_id": {
+			method:     http.MethodPost,
+			target:     "/deadletters/replay",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "missing dead letter id",
+		},
+		"remove_dead_letter": {
+			method: http.MethodDelete,
+			target: "/deadletters?id=1",
+			setup: func(m *controllermocks.MockCommsController) {
+				m.EXPECT().RemoveDeadLetter("1").Return(nil).Times(1)
+			},
+			wantStatus: http.StatusNoContent,
+		},
+		"remove_dead_letter_error": {
+			method: http.MethodDelete,
+			target: "/deadletters?id=1",
+			setup: func(m *controllermocks.MockCommsController) {
+				m.EXPECT().RemoveDeadLetter("1").Return(assert.AnError).Times(1)
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   assert.AnError.Error(),
+		},
+		"method_not_allowed": {
+			method:     http.MethodPost,
+			target:     "/stats",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBody:   "method not allowed",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			commsController := controllermocks.NewMockCommsController(ctrl)
+			if tc.setup != nil {
+				tc.setup(commsController)
+			}
+
+			recorder := httptest.NewRecorder()
+			newAdminHandler(commsController).ServeHTTP(recorder,
+				httptest.NewRequest(tc.method, tc.target, nil))
+
+			require.Equal(t, tc.wantStatus, recorder.Code)
+			assert.Contains(t, recorder.Body.String(), tc.wantBody)
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAckTimeout is the default time subscribers in ack mode
+	// have to acknowledge a message before it's redelivered.
+	DefaultAckTimeout = 30 * time.Second
+	// DefaultPrefetch is the default maximum number of unacknowledged
+	// messages sent to a subscriber in ack mode.
+	DefaultPrefetch = DefaultMessageBufferSize
+	// DefaultMaxDeliveries is the number of times a message is
+	// delivered to subscribers that don't acknowledge it before it's
+	// dead-lettered.
+	DefaultMaxDeliveries = 5
+)
+
+// ackTracker tracks the messages sent to a subscriber in ack mode
+// until they're acknowledged, and limits their number to the prefetch.
+type ackTracker struct {
+	// consumerID identifies the subscriber across reconnects, empty
+	// if its unacknowledged messages are not kept when it disconnects.
+	consumerID string
+	prefetch   int
+
+	mutex    sync.Mutex
+	inFlight map[string]inFlightMessage
+	// released is signalled when in-flight messages are acknowledged
+	// or given up.
+	released chan struct{}
+}
+
+// inFlightMessage is a message sent and not acknowledged yet.
+type inFlightMessage struct {
+	notification notification
+	sentAt       time.Time
+}
+
+func newAckTracker(consumerID string, prefetch int) *ackTracker {
+	if prefetch <= 0 {
+		prefetch = DefaultPrefetch
+	}
+	return &ackTracker{
+		consumerID: consumerID,
+		prefetch:   prefetch,
+		inFlight:   make(map[string]inFlightMessage),
+		released:   make(chan struct{}, 1),
+	}
+}
+
+// waitCapacity blocks while the prefetch is exhausted, it returns
+// false if close is closed meanwhile.
+func (t *ackTracker) waitCapacity(close <-chan struct{}) bool {
+	for {
+		t.mutex.Lock()
+		full := len(t.inFlight) >= t.prefetch
+		t.mutex.Unlock()
+		if !full {
+			return true
+		}
+
+		select {
+		case <-close:
+			return false
+		case <-t.released:
+		}
+	}
+}
+
+// track tracks the message notification sent at the time.
+func (t *ackTracker) track(notification notification, sentAt time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.inFlight[notification.message.ID] = inFlightMessage{notification: notification, sentAt: sentAt}
+}
+
+// ack releases the acknowledged messages, it returns the number of
+// messages that were in flight.
+func (t *ackTracker) ack(messageIDs []string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	acked := 0
+	for _, id := range messageIDs {
+		if _, ok := t.inFlight[id]; ok {
+			delete(t.inFlight, id)
+			acked++
+		}
+	}
+	if acked > 0 {
+		t.signalReleased()
+	}
+	return acked
+}
+
+// expired releases and returns the messages sent at least timeout
+// before now, oldest first.
+func (t *ackTracker) expired(now time.Time, timeout time.Duration) []notification {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var expired []inFlightMessage
+	for id, message := range t.inFlight {
+		if now.Sub(message.sentAt) >= timeout {
+			delete(t.inFlight, id)
+			expired = append(expired, message)
+		}
+	}
+	if len(expired) > 0 {
+		t.signalReleased()
+	}
+	return sortedNotifications(expired)
+}
+
+// drain releases and returns all in-flight messages, oldest first.
+func (t *ackTracker) drain() []notification {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	messages := make([]inFlightMessage, 0, len(t.inFlight))
+	for id, message := range t.inFlight {
+		delete(t.inFlight, id)
+		messages = append(messages, message)
+	}
+	return sortedNotifications(messages)
+}
+
+// signalReleased signals the released messages, it must be called
+// with the mutex held.
+func (t *ackTracker) signalReleased() {
+	select {
+	case t.released <- struct{}{}:
+	default:
+		// Already signalled.
+	}
+}
+
+func sortedNotifications(messages []inFlightMessage) []notification {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].sentAt.Before(messages[j].sentAt)
+	})
+	notifications := make([]notification, len(messages))
+	for i, message := range messages {
+		notifications[i] = message.notification
+	}
+	return notifications
+}
+
+// unackedMessages are the messages a disconnected subscriber in ack
+// mode didn't acknowledge, kept until it reconnects.
+type unackedMessages struct {
+	notifications []notification
+	// notifier is the notifier of the disconnected subscriber, which
+	// dead-letters the messages if it doesn't reconnect in time.
+	notifier *notifier
+	since    time.Time
+}
@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"assignment/lib/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAckTracker(t *testing.T) {
+	tracker := newAckTracker("consumer", 2)
+	close := make(chan struct{})
+
+	now := time.Now()
+	messages := []entity.Message{
+		entity.NewTextMessage("message 1"),
+		entity.NewTextMessage("message 2"),
+		entity.NewTextMessage("message 3"),
+	}
+	for i, message := range messages[:2] {
+		require.True(t, tracker.waitCapacity(close))
+		message := message
+		tracker.track(notification{message: &message}, now.Add(time.Duration(i)*time.Second))
+	}
+
+	// The prefetch is exhausted until a message is released.
+	go func() {
+		assert.Equal(t, 1, tracker.ack([]string{messages[0].ID, "unknown"}))
+	}()
+	require.True(t, tracker.waitCapacity(close))
+	tracker.track(notification{message: &messages[2]}, now.Add(time.Minute))
+
+	expired := tracker.expired(now.Add(time.Minute), time.Second)
+	require.Len(t, expired, 1)
+	assert.Equal(t, messages[1], *expired[0].message)
+
+	drained := tracker.drain()
+	require.Len(t, drained, 1)
+	assert.Equal(t, messages[2], *drained[0].message)
+
+	// Waiting stops once closed.
+	for i := 0; i < 2; i++ {
+		tracker.track(notification{message: &messages[i]}, now)
+	}
+	go func() { close <- struct{}{} }()
+	require.False(t, tracker.waitCapacity(close))
+}
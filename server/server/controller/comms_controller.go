@@ -3,23 +3,66 @@ package controller
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"assignment/lib/compression"
 	"assignment/lib/connection"
 	"assignment/lib/entity"
+	"assignment/lib/filter"
 	"assignment/lib/log"
+	"assignment/server/server/topiclog"
 
+	"github.com/pkg/errors"
 	"go.uber.org/multierr"
 )
 
 const (
 	// DefaultMessageBufferSize is the default size of the message buffer.
 	DefaultMessageBufferSize = 100
-	// MessageNoSubscribers is the message sent to publishers when there are no subscribers.
-	MessageNoSubscribers = "No subscribers are currently connected"
-	// MessageNewSubscriber is the message sent to publishers when a new subscriber connects.
-	MessageNewSubscriber = "New subscriber connected"
-	// MessageHelloSubscriber  is the message sent to subscribers when they connect.
+	// MessageHelloSubscriber is the welcome text sent to subscribers when they connect.
 	MessageHelloSubscriber = "Hello from server! You're all set."
+	// MessageGoAway is the go-away reason sent to clients when the server shuts down.
+	MessageGoAway = "Server is shutting down"
+)
+
+var (
+	// ErrUnknownSubscriber is returned for commands of subscribers
+	// that are not connected.
+	ErrUnknownSubscriber = errors.New("unknown subscriber")
+	// ErrUnsupportedCommand is returned for commands the controller
+	// doesn't support.
+	ErrUnsupportedCommand = errors.New("unsupported command")
+	// ErrGroupKeyMismatch is returned when a subscriber joins a group
+	// with a different key than its members.
+	ErrGroupKeyMismatch = errors.New("group key mismatch")
+	// ErrUnknownDeadLetter is returned for dead letters that don't
+	// exist, or were replayed or removed already.
+	ErrUnknownDeadLetter = errors.New("unknown dead letter")
+	// ErrAckModeEnabled is returned when a subscriber enables ack
+	// mode more than once.
+	ErrAckModeEnabled = errors.New("ack mode already enabled")
+	// ErrQueueFull is the reason published messages are nacked when
+	// the controller queue is full.
+	ErrQueueFull = errors.New("queue full")
+	// ErrMessageRejected is the reason published messages are nacked
+	// when they can't be published.
+	ErrMessageRejected = errors.New("message rejected")
+	// ErrMessageLogDisabled is returned for replays when the message
+	// log is disabled.
+	ErrMessageLogDisabled = errors.New("message log disabled")
+	// ErrSessionSet is returned when a subscriber declares a session
+	// more than once.
+	ErrSessionSet = errors.New("session already set")
+	// ErrSessionInUse is returned when a subscriber declares the
+	// session of another connected subscriber.
+	ErrSessionInUse = errors.New("session in use")
+	// ErrDuplicateMessage is returned for published messages the
+	// producer published before, they're confirmed as duplicates.
+	ErrDuplicateMessage = errors.New("duplicate message")
+	// ErrNoCredit is the reason published messages are nacked when
+	// the publisher exceeded its credit limit.
+	ErrNoCredit = errors.New("no credit")
 )
 
 // CommsController is the interface for the comms controller. It is responsible
@@ -27,91 +70,599 @@ const (
 type CommsController interface {
 	// AddPublisher adds a publisher to the comms controller.
 	AddPublisher(publisher connection.ReadWriteStream)
-	// AddSubscriber adds a subscriber to the comms controller.
+	// AddSubscriber adds a subscriber to the comms controller. The
+	// subscriber receives no messages until it subscribes to topics.
 	AddSubscriber(subscriber connection.WriteStream)
-	// MessageReceiver returns a message receiver function for new message handling.
-	MessageReceiver() connection.MessageReceiver
+	// RemoveSubscriber removes a subscriber from the comms controller.
+	RemoveSubscriber(subscriber connection.WriteStream)
+	// SubscriberControlReceiver returns a control receiver function
+	// for handling the commands of the given subscriber. The result
+	// of each command is sent back on the subscriber control stream.
+	SubscriberControlReceiver(subscriber connection.WriteStream) connection.ControlReceiver
+	// SetSubscriberControlStream sets the stream the results of the
+	// subscriber commands are sent on. Results of the commands
+	// received before are sent once it's set.
+	SetSubscriberControlStream(subscriber connection.WriteStream, controlStream connection.WriteStream)
+	// MessageReceiver returns a message receiver function for the
+	// messages of the given publisher. Each message is confirmed to
+	// the publisher once it's accepted, or nacked with the reason.
+	// Replies to the requests of the publisher are routed back to it.
+	MessageReceiver(publisher connection.ReadWriteStream) connection.MessageReceiver
+	// ReplyReceiver returns a message receiver function for the
+	// replies subscribers send on their control streams.
+	ReplyReceiver() connection.MessageReceiver
+	// Stats returns the message statistics.
+	Stats() Stats
+	// DeadLetters returns the messages that couldn't be delivered,
+	// oldest first.
+	DeadLetters() []DeadLetter
+	// ReplayDeadLetter removes the dead letter and delivers its
+	// message again, to the target subscriber if it's still
+	// connected, otherwise to the current subscribers of its topic
+	// without logging or retaining it again.
+	ReplayDeadLetter(id string) error
+	// RemoveDeadLetter removes the dead letter.
+	RemoveDeadLetter(id string) error
 	// Close closes the comms controller.
 	Close() error
 }
 
+// Config contains the comms controller configuration.
+type Config struct {
+	// Compression is the configuration for compressing messages
+	// before they are sent to subscribers.
+	Compression compression.Config
+	// TopicTTLs are the default time-to-live of the messages published
+	// to the topics matching the topic filters, for messages without
+	// an expiry time. The shortest one applies if several match.
+	TopicTTLs map[string]time.Duration
+	// DeadLetterTopic is the topic the dead letters are published
+	// to, empty if they're only kept for inspection.
+	DeadLetterTopic string
+	// DeadLetterCapacity is the number of dead letters kept,
+	// DefaultDeadLetterCapacity if zero.
+	DeadLetterCapacity int
+	// AckTimeout is the time subscribers in ack mode have to
+	// acknowledge a message before it's redelivered, and to reconnect
+	// before the messages they didn't acknowledge are dead-lettered.
+	// DefaultAckTimeout if zero.
+	AckTimeout time.Duration
+	// MessageLog is the durable log the published messages are
+	// appended to, so that subscribers can replay them. Nil if the
+	// messages are not logged.
+	MessageLog topiclog.Log
+	// SessionExpiry is the time the session of a disconnected
+	// subscriber is kept, DefaultSessionExpiry if zero.
+	SessionExpiry time.Duration
+	// SessionMaxMessages and SessionMaxBytes limit the number and the
+	// total payload size of the messages queued for an offline
+	// session, DefaultSessionMaxMessages and DefaultSessionMaxBytes
+	// if zero.
+	SessionMaxMessages int
+	SessionMaxBytes    int
+	// DedupWindow is the number of the latest messages of each
+	// producer that published messages are deduplicated against,
+	// DefaultDedupWindow if zero. The windows are restored from the
+	// message log on start if it's set.
+	DedupWindow int
+	// PublisherCredits is the number of messages each publisher can
+	// have queued before it has to wait for its messages to be
+	// handled, DefaultPublisherCredits if zero.
+	PublisherCredits int
+	// SubscriberQueueSize is the number of notifications queued for
+	// each subscriber, DefaultMessageBufferSize if zero.
+	SubscriberQueueSize int
+	// OverflowPolicy decides what happens to the messages queued for
+	// subscribers with a full queue, OverflowDropNewest if empty.
+	// TopicOverflowPolicies override it for the topics matching the
+	// topic filters, the longest one applies if several match.
+	OverflowPolicy        OverflowPolicy
+	TopicOverflowPolicies map[string]OverflowPolicy
+	// OverflowBlockTimeout bounds the wait of OverflowBlock,
+	// DefaultOverflowBlockTimeout if zero.
+	OverflowBlockTimeout time.Duration
+}
+
 type commsController struct {
 	sync.RWMutex
+	config      Config
 	publishers  map[connection.ReadWriteStream]*notifier
 	subscribers map[connection.WriteStream]*notifier
+	// credits are the credits of the publishers, messages of
+	// publishers without credits are only bounded by the queue.
+	credits map[connection.ReadWriteStream]*publisherCredits
+	// publisherIDs identify the publisher connections on the messages
+	// they publish.
+	publisherIDs map[connection.ReadWriteStream]string
+	// topics indexes the subscribers by the topic filters they
+	// subscribed to, subscriptions map the filters of each subscriber
+	// to their subscriber groups.
+	topics        *topicTree
+	subscriptions map[connection.WriteStream]map[string]string
+	groups        map[string]*subscriberGroup
+	// replyRoutes map the reply topics to the publishers owning them.
+	replyRoutes map[string]connection.ReadWriteStream
+	// retained are the last retained messages, keyed by their topics.
+	retained map[string]entity.Message
+	// results are the notifiers of the subscriber control streams,
+	// keyed by the subscriber streams.
+	results map[connection.WriteStream]*notifier
+	stats   stats
+	// deadLetters are the messages that couldn't be delivered,
+	// lastClientID numbers the clients they're addressed to.
+	deadLetters  *deadLetterStore
+	lastClientID atomic.Uint64
+	// unacked are the messages disconnected subscribers in ack mode
+	// didn't acknowledge, keyed by their consumer IDs.
+	unacked map[string]*unackedMessages
+	// sessionIDs are the sessions of the connected subscribers,
+	// sessions the sessions of the disconnected ones keyed by their
+	// IDs.
+	sessionIDs map[connection.WriteStream]string
+	sessions   map[string]*session
+	// dedup detects the messages producers publish more than once.
+	dedup *deduplicator
 
-	messages chan entity.Message
+	messages *priorityQueue[queuedMessage]
 	close    chan struct{}
 }
 
 // NewCommsController creates a new comms controller.
-func NewCommsController() CommsController {
+func NewCommsController(config Config) CommsController {
 	c := &commsController{
-		publishers:  make(map[connection.ReadWriteStream]*notifier),
-		subscribers: make(map[connection.WriteStream]*notifier),
-		messages:    make(chan entity.Message, DefaultMessageBufferSize),
-		close:       make(chan struct{}),
+		config:        config,
+		publishers:    make(map[connection.ReadWriteStream]*notifier),
+		subscribers:   make(map[connection.WriteStream]*notifier),
+		credits:       make(map[connection.ReadWriteStream]*publisherCredits),
+		publisherIDs:  make(map[connection.ReadWriteStream]string),
+		topics:        newTopicTree(),
+		subscriptions: make(map[connection.WriteStream]map[string]string),
+		groups:        make(map[string]*subscriberGroup),
+		replyRoutes:   make(map[string]connection.ReadWriteStream),
+		retained:      make(map[string]entity.Message),
+		results:       make(map[connection.WriteStream]*notifier),
+		deadLetters:   newDeadLetterStore(config.DeadLetterCapacity),
+		unacked:       make(map[string]*unackedMessages),
+		sessionIDs:    make(map[connection.WriteStream]string),
+		sessions:      make(map[string]*session),
+		dedup:         newDeduplicator(config.DedupWindow, DefaultDedupProducers),
+		messages:      newPriorityQueue[queuedMessage](DefaultMessageBufferSize),
+		close:         make(chan struct{}),
+	}
+	if c.config.AckTimeout <= 0 {
+		c.config.AckTimeout = DefaultAckTimeout
+	}
+	if c.config.SubscriberQueueSize <= 0 {
+		c.config.SubscriberQueueSize = DefaultMessageBufferSize
+	}
+	if c.config.OverflowPolicy == "" {
+		c.config.OverflowPolicy = OverflowDropNewest
+	}
+	if c.config.OverflowBlockTimeout <= 0 {
+		c.config.OverflowBlockTimeout = DefaultOverflowBlockTimeout
+	}
+	if c.config.SessionExpiry <= 0 {
+		c.config.SessionExpiry = DefaultSessionExpiry
+	}
+	if c.config.SessionMaxMessages <= 0 {
+		c.config.SessionMaxMessages = DefaultSessionMaxMessages
+	}
+	if c.config.SessionMaxBytes <= 0 {
+		c.config.SessionMaxBytes = DefaultSessionMaxBytes
+	}
+	if c.config.MessageLog != nil {
+		// Without its windows duplicates published across the restart
+		// are delivered again, but the controller still works.
+		if err := c.dedup.restore(c.config.MessageLog); err != nil {
+			log.Errorf("Error restoring deduplication windows: %s", err.Error())
+		}
 	}
 
 	go c.run()
+	go c.runRedelivery()
 	return c
 }
 
 func (c *commsController) AddPublisher(publisher connection.ReadWriteStream) {
-	notifier := newNotifier(publisher, nil)
+	notifier := c.startNotifier(publisher, "publisher", DefaultMessageBufferSize, nil, nil)
 	publisher.SetConnClosedCallback(func() { c.removePublisher(publisher) })
+	credits := newPublisherCredits(publisher, c.config.PublisherCredits)
 
 	c.Lock()
 	c.publishers[publisher] = notifier
+	c.credits[publisher] = credits
+	c.publisherIDs[publisher] = entity.NewID()
 	c.Unlock()
 	log.Info("New publisher successfully connected")
 
-	// Inform the publisher of the current subscriber count.
-	message := MessageNoSubscribers
-	if subscriberCount := c.subscriberCount(); subscriberCount > 0 {
-		message = fmt.Sprintf("%d subscriber(s) currently connected", subscriberCount)
-	}
-	notifier.queueMessage(entity.Message{Text: message})
+	// Inform the publisher of the current subscriber count and grant
+	// its initial credits.
+	notifier.queueControl(entity.NewSubscriberCountControl(c.subscriberCount()))
+	notifier.queueControl(credits.initial())
 }
 
 func (c *commsController) AddSubscriber(subscriber connection.WriteStream) {
-	notifier := newNotifier(subscriber, c.removeSubscriber)
+	notifier := c.startNotifier(subscriber, "subscriber",
+		c.config.SubscriberQueueSize, c.overflowPolicy, c.removeSubscriber)
 
 	// Say hello to the subscriber to establish the connection.
 	// TODO: remove this once WriteStream supports pinging the peer.
-	message := entity.Message{Text: MessageHelloSubscriber}
-	notifier.queueMessage(message)
+	notifier.queueControl(entity.NewWelcomeControl(MessageHelloSubscriber))
 
 	c.Lock()
 	c.subscribers[subscriber] = notifier
+	c.results[subscriber] = newPendingNotifier(DefaultMessageBufferSize, nil)
+	subscriberCount := len(c.subscribers)
 	c.Unlock()
 	log.Info("New subscriber successfully connected")
 
 	// Inform the publishers of the new subscriber.
-	message = entity.Message{Text: MessageNewSubscriber}
-	c.sendToPublishers(message)
+	c.sendToPublishers(entity.NewSubscriberCountControl(subscriberCount))
 }
 
-func (c *commsController) MessageReceiver() connection.MessageReceiver {
-	return func(message entity.Message) {
-		select {
-		case c.messages <- message:
+// startNotifier creates a notifier counting the expired messages in
+// the controller stats and dead-lettering the messages it fails to
+// deliver, and starts it with the client stream. Notifications queued
+// while its queue is full follow the overflow policy, or are dropped
+// if it's nil. The messages of publishers sent on the stream are
+// numbered per publisher.
+func (c *commsController) startNotifier(
+	stream connection.WriteStream,
+	kind string,
+	capacity int,
+	overflowPolicy func(topic string) OverflowPolicy,
+	connLostCallback connLostCallback,
+) *notifier {
+	target := fmt.Sprintf("%s %d", kind, c.lastClientID.Add(1))
+	notifier := newPendingNotifier(capacity, connLostCallback)
+	notifier.overflowPolicy = overflowPolicy
+	notifier.blockTimeout = c.config.OverflowBlockTimeout
+	notifier.stats = &c.stats
+	notifier.sequences = newStreamSequences()
+	notifier.deadLetterCallback = func(message entity.Message, reason string) {
+		c.deadLetter(message, reason, target, stream)
+	}
+	notifier.start(stream)
+	return notifier
+}
+
+func (c *commsController) RemoveSubscriber(subscriber connection.WriteStream) {
+	c.removeSubscriber(subscriber)
+}
+
+func (c *commsController) SubscriberControlReceiver(
+	subscriber connection.WriteStream,
+) connection.ControlReceiver {
+	return func(control entity.Control) {
+		var err error
+		switch control.Type {
+		case entity.ControlSubscribe:
+			err = c.subscribe(subscriber, control)
+		case entity.ControlUnsubscribe:
+			c.unsubscribe(subscriber, control.Topics)
+		case entity.ControlPause:
+			err = c.pause(subscriber)
+		case entity.ControlResume:
+			err = c.resume(subscriber)
+		case entity.ControlAckMode:
+			err = c.enableAcks(subscriber, control)
+		case entity.ControlAck:
+			// Acks are not answered, to keep them cheap.
+			c.ack(subscriber, control.MessageIDs)
 			return
+		case entity.ControlReplay:
+			err = c.replay(subscriber, control)
+		case entity.ControlSession:
+			err = c.resumeSession(subscriber, control)
 		default:
-			// Too many incoming messages, can't handle them all.
-			log.Warnf("Message queue is full, message %q dropped", message.Text)
+			log.Warnf("Unexpected %s received from subscriber", control)
+			err = errors.Wrapf(ErrUnsupportedCommand, "control type %d", control.Type)
+		}
+
+		if err != nil {
+			log.Warnf("Subscriber command %s failed: %s", control, err.Error())
+		}
+		c.sendResult(subscriber, entity.NewResultControl(control.CommandID, err))
+	}
+}
+
+func (c *commsController) SetSubscriberControlStream(
+	subscriber connection.WriteStream,
+	controlStream connection.WriteStream,
+) {
+	c.Lock()
+	defer c.Unlock()
+
+	results, ok := c.results[subscriber]
+	if !ok {
+		log.Warn("Control stream of unknown subscriber ignored")
+		return
+	}
+	results.start(controlStream)
+}
+
+func (c *commsController) MessageReceiver(publisher connection.ReadWriteStream) connection.MessageReceiver {
+	return func(message entity.Message) {
+		c.RLock()
+		credits := c.credits[publisher]
+		publisherID := c.publisherIDs[publisher]
+		c.RUnlock()
+
+		// Only the controller identifies the publishers, the sequence
+		// numbers are stamped by the subscriber notifiers.
+		message.PublisherID, message.PublisherSequence = publisherID, 0
+
+		var err error
+		if credits != nil && !credits.take() {
+			err = ErrNoCredit
+		} else {
+			err = c.acceptPublished(message, publisher, credits)
+			if err != nil && credits != nil {
+				// Rejected messages don't hold on to their credits.
+				c.releaseCredit(credits)
+			}
+		}
+		if errors.Is(err, ErrDuplicateMessage) {
+			log.Infof("Duplicate message %s from producer %q dropped", message.ID, message.ProducerID)
+			c.stats.messagesDeduplicated.Add(1)
+		} else if err != nil {
+			log.Warnf("Message %s from publisher dropped: %s", message.ID, err.Error())
+		}
+		c.confirm(publisher, message.ID, err)
+	}
+}
+
+// acceptPublished queues the message of the publisher, it returns the
+// reason if the message is not accepted. Messages within the credits
+// of the publisher are queued even if the queue is full.
+func (c *commsController) acceptPublished(
+	message entity.Message,
+	publisher connection.ReadWriteStream,
+	credits *publisherCredits,
+) error {
+	if entity.IsReplyTopic(message.Topic) {
+		return errors.Wrapf(ErrMessageRejected, "%q is a reply topic", message.Topic)
+	}
+	if err := entity.ValidateTopic(message.Topic); err != nil {
+		return errors.Wrap(ErrMessageRejected, err.Error())
+	}
+	if message.IsRequest() && !c.addReplyRoute(message.ReplyTo, publisher) {
+		return errors.Wrapf(ErrMessageRejected,
+			"reply topic %q can't be routed to the publisher", message.ReplyTo)
+	}
+	if !c.dedup.add(message) {
+		return ErrDuplicateMessage
+	}
+	if credits != nil {
+		c.queueCredited(message, credits)
+		return nil
+	}
+	if !c.queueMessage(message) {
+		// Accept the message when the producer publishes it again.
+		c.dedup.remove(message)
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// confirm queues the confirm of the message, or its nack if err is
+// set, to the publisher. Duplicates are confirmed as such.
+func (c *commsController) confirm(publisher connection.ReadWriteStream, messageID string, err error) {
+	c.RLock()
+	notifier, ok := c.publishers[publisher]
+	c.RUnlock()
+
+	if !ok {
+		log.Warnf("Confirm of message %s to unknown publisher dropped", messageID)
+		return
+	}
+	switch {
+	case err == nil:
+		notifier.queueControl(entity.NewConfirmControl(messageID))
+	case errors.Is(err, ErrDuplicateMessage):
+		notifier.queueControl(entity.NewDuplicateConfirmControl(messageID))
+	default:
+		notifier.queueControl(entity.NewNackControl(messageID, nackReason(err), err))
+	}
+}
+
+// nackReason returns the reason of the nack of a message the controller
+// didn't accept because of err.
+func nackReason(err error) entity.NackReason {
+	switch {
+	case errors.Is(err, ErrNoCredit):
+		return entity.NackNoCredit
+	case errors.Is(err, ErrQueueFull):
+		return entity.NackQueueFull
+	default:
+		return entity.NackRejected
+	}
+}
+
+func (c *commsController) ReplyReceiver() connection.MessageReceiver {
+	return func(message entity.Message) {
+		if !entity.IsReplyTopic(message.Topic) {
+			log.Warnf("Message %s from subscriber dropped: %q is not a reply topic",
+				message.ID, message.Topic)
+			return
 		}
+		// Replies aren't messages of publishers.
+		message.PublisherID, message.PublisherSequence = "", 0
+		c.queueMessage(message)
+	}
+}
+
+// queueMessage queues the message for handling, it returns false if
+// the queue is full and the message was dead-lettered instead.
+func (c *commsController) queueMessage(message entity.Message) bool {
+	message = c.applyTopicTTL(message)
+	if !c.messages.push(queuedMessage{message: message}, message.Priority) {
+		// Too many incoming messages, can't handle them all.
+		log.Warnf("Message queue is full, message %s dropped", message.ID)
+		c.deadLetter(message, ReasonBrokerQueueFull, TargetBroker, nil)
+		return false
+	}
+	return true
+}
+
+// queueCredited queues the message of the publisher within its
+// credits. The credits bound the messages of each publisher, so the
+// message is queued even beyond the capacity of the queue.
+func (c *commsController) queueCredited(message entity.Message, credits *publisherCredits) {
+	message = c.applyTopicTTL(message)
+	c.messages.pushAll([]queuedMessage{{message: message, credits: credits}}, queuedMessage.priority)
+}
+
+// releaseCredit releases the credit of a handled or rejected message
+// of the publisher, and grants it new credits once a batch of credits
+// was released.
+func (c *commsController) releaseCredit(credits *publisherCredits) {
+	limit, ok := credits.release()
+	if !ok {
+		return
+	}
+
+	c.RLock()
+	notifier, ok := c.publishers[credits.publisher]
+	c.RUnlock()
+	if ok {
+		notifier.queueControl(entity.NewCreditControl(limit))
+	}
+}
+
+// applyTopicTTL sets the expiry time of the message from the default
+// time-to-live of its topic, if it doesn't have one.
+func (c *commsController) applyTopicTTL(message entity.Message) entity.Message {
+	if ttl := c.topicTTL(message.Topic); ttl > 0 && message.ExpiresAt.IsZero() {
+		message.ExpiresAt = time.Now().Add(ttl).UTC()
+	}
+	return message
+}
+
+// topicTTL returns the default time-to-live of the messages published
+// to the topic, zero if they don't expire by default.
+func (c *commsController) topicTTL(topic string) time.Duration {
+	var ttl time.Duration
+	for topicFilter, topicTTL := range c.config.TopicTTLs {
+		if entity.MatchTopic(topicFilter, topic) && (ttl == 0 || topicTTL < ttl) {
+			ttl = topicTTL
+		}
+	}
+	return ttl
+}
+
+func (c *commsController) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// deadLetter keeps the message that couldn't be delivered to the
+// target, and publishes it to the dead-letter topic if configured.
+// Messages to the dead-letter topic are not published again to avoid
+// loops. It doesn't take the lock, so it can be called with the lock
+// held.
+func (c *commsController) deadLetter(
+	msg entity.Message,
+	reason string,
+	target string,
+	stream connection.WriteStream,
+) {
+	if published, err := compression.Decompress(msg, c.config.Compression.MaxSize); err == nil {
+		msg = published
+	}
+	letter := DeadLetter{
+		ID:      entity.NewID(),
+		Message: msg,
+		Reason:  reason,
+		Target:  target,
+		Time:    time.Now().UTC(),
+		stream:  stream,
+	}
+	c.deadLetters.add(letter)
+	c.stats.messagesDeadLettered.Add(1)
+	log.Warnf("Message %s to %s dead-lettered: %s", msg.ID, target, reason)
+
+	if topic := c.config.DeadLetterTopic; topic != "" && msg.Topic != topic {
+		c.queueMessage(letter.topicMessage(topic))
+	}
+}
+
+func (c *commsController) DeadLetters() []DeadLetter {
+	return c.deadLetters.list()
+}
+
+func (c *commsController) ReplayDeadLetter(id string) error {
+	letter, ok := c.deadLetters.remove(id)
+	if !ok {
+		return errors.Wrapf(ErrUnknownDeadLetter, "id %q", id)
+	}
+
+	c.RLock()
+	notifier, ok := c.subscribers[letter.stream]
+	c.RUnlock()
+
+	if ok {
+		log.Infof("Replaying dead letter %s to %s", id, letter.Target)
+		notifier.queueMessage(c.compress(letter.Message))
+		return nil
+	}
+	if letter.Reason == ReasonBrokerQueueFull {
+		// The message was never handled, so it's published now.
+		log.Infof("Publishing dead letter %s to topic %q", id, letter.Message.Topic)
+		c.queueMessage(letter.Message)
+		return nil
+	}
+	// The message was logged and retained when it was published, so
+	// it's only delivered again.
+	log.Infof("Replaying dead letter %s to topic %q", id, letter.Message.Topic)
+	if entity.IsReplyTopic(letter.Message.Topic) {
+		c.sendReply(letter.Message)
+		return nil
+	}
+	c.sendToSubscribers(letter.Message)
+	return nil
+}
+
+func (c *commsController) RemoveDeadLetter(id string) error {
+	if _, ok := c.deadLetters.remove(id); !ok {
+		return errors.Wrapf(ErrUnknownDeadLetter, "id %q", id)
+	}
+	return nil
+}
+
+// addReplyRoute routes the replies sent to the reply topic to the
+// publisher. It returns false if the topic is not a reply topic or is
+// owned by another publisher.
+func (c *commsController) addReplyRoute(replyTo string, publisher connection.ReadWriteStream) bool {
+	if !entity.IsReplyTopic(replyTo) || publisher == nil {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if owner, ok := c.replyRoutes[replyTo]; ok && owner != publisher {
+		return false
 	}
+	c.replyRoutes[replyTo] = publisher
+	return true
 }
 
 func (c *commsController) Close() error {
-	c.close <- struct{}{}
+	close(c.close)
 	c.Lock()
 	defer c.Unlock()
 
+	// Let the clients know the connection is closed on purpose. The
+	// go-away control is sent on a best effort basis.
+	goAway := entity.NewGoAwayControl(MessageGoAway)
+
 	var merr error
 	for subscriberStream, notifier := range c.subscribers {
 		notifier.stop()
+		c.closeControlStream(subscriberStream)
+		if err := subscriberStream.SendControl(goAway); err != nil {
+			log.Warnf("Error sending go-away to subscriber: %s", err.Error())
+		}
 		if err := subscriberStream.CloseStream(); err != nil {
 			log.Errorf("Error closing subscriber: %s", err.Error())
 			merr = multierr.Append(merr, err)
@@ -120,6 +671,9 @@ func (c *commsController) Close() error {
 
 	for publisherStream, notifier := range c.publishers {
 		notifier.stop()
+		if err := publisherStream.SendControl(goAway); err != nil {
+			log.Warnf("Error sending go-away to publisher: %s", err.Error())
+		}
 		if err := publisherStream.CloseStream(); err != nil {
 			log.Errorf("Error closing publisher: %s", err.Error())
 			merr = multierr.Append(merr, err)
@@ -129,35 +683,710 @@ func (c *commsController) Close() error {
 	return merr
 }
 
+// run handles the queued messages, higher priorities first.
 func (c *commsController) run() {
 	for {
 		select {
 		case <-c.close:
 			return
-		case msg := <-c.messages:
-			log.Infof("Received message from publisher: %q", msg.Text)
-			c.sendToSubscribers(msg)
+		default:
+		}
+
+		queued, ok := c.messages.pop()
+		if !ok {
+			select {
+			case <-c.close:
+				return
+			case <-c.messages.wait():
+			}
+			continue
+		}
+		c.handleMessage(queued.message)
+		if queued.credits != nil {
+			c.releaseCredit(queued.credits)
 		}
 	}
 }
 
+func (c *commsController) handleMessage(msg entity.Message) {
+	c.stats.messagesReceived.Add(1)
+	if msg.Expired(time.Now()) {
+		log.Warnf("Message %s expired, message dropped", msg.ID)
+		c.stats.messagesExpired.Add(1)
+		return
+	}
+	if err := entity.ValidateTopic(msg.Topic); err != nil {
+		log.Warnf("Message %s dropped: %s", msg.ID, err.Error())
+		return
+	}
+	if entity.IsReplyTopic(msg.Topic) {
+		log.Infof("Received reply %s to topic %q: %s", msg.ID, msg.Topic, msg)
+		c.sendReply(msg)
+		return
+	}
+	if msg.Retain && len(msg.Payload) == 0 {
+		c.clearRetained(msg.Topic)
+		return
+	}
+	log.Infof("Received message %s to topic %q from publisher: %s", msg.ID, msg.Topic, msg)
+	if c.config.MessageLog != nil {
+		// Messages that fail to be logged are still delivered live.
+		offset, err := c.config.MessageLog.Append(msg)
+		if err != nil {
+			log.Errorf("Error logging message %s: %s", msg.ID, err.Error())
+		} else {
+			msg.Offset = offset
+		}
+	}
+	if msg.Retain {
+		c.setRetained(msg)
+	}
+	c.sendToSubscribers(msg)
+}
+
+// compress compresses the message once before it's sent to all
+// subscribers. Subscribers that can't decompress the message get
+// it decompressed by their streams.
+func (c *commsController) compress(msg entity.Message) entity.Message {
+	compressed, err := compression.Compress(msg, c.config.Compression)
+	if err != nil {
+		log.Errorf("Error compressing message %s, sending uncompressed: %s", msg.ID, err.Error())
+		return msg
+	}
+	return compressed
+}
+
 func (c *commsController) sendToSubscribers(msg entity.Message) {
-	notifiers := c.getSubscriberNotifiers()
+	// Header filters are matched against the headers set by the
+	// publisher, before compression adds its own.
+	notifiers, groupNotifiers := c.getSubscriberNotifiers(msg)
+	sessions := c.matchSessions(msg)
+	if len(notifiers) == 0 && len(groupNotifiers) == 0 && len(sessions) == 0 {
+		return
+	}
+
+	msg = c.compress(msg)
 	for _, notifier := range notifiers {
-		notifier.queueMessage(msg)
+		notifier.dispatchMessage(msg)
+	}
+	for group, notifier := range groupNotifiers {
+		notifier.dispatchGroupMessage(msg, group)
+	}
+	for _, session := range sessions {
+		c.keepForSession(session, msg)
+	}
+}
+
+// setRetained keeps the message as the retained message of its topic,
+// replacing the previous one.
+func (c *commsController) setRetained(msg entity.Message) {
+	c.Lock()
+	defer c.Unlock()
+	c.retained[msg.Topic] = msg
+}
+
+func (c *commsController) clearRetained(topic string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.retained, topic)
+	log.Infof("Retained message of topic %q cleared", topic)
+}
+
+// sendRetained sends the retained messages matching the topic filters
+// and the header filter to the subscriber, each message once, and
+// removes the expired ones. It must be called with the lock held.
+func (c *commsController) sendRetained(
+	subscriber connection.WriteStream,
+	topicFilters []string,
+	headerFilter filter.Filter,
+) {
+	for topic, msg := range c.retained {
+		if msg.Expired(time.Now()) {
+			delete(c.retained, topic)
+			c.stats.messagesExpired.Add(1)
+			log.Infof("Retained message of topic %q expired", topic)
+			continue
+		}
+		if !filter.MatchMessage(headerFilter, msg) {
+			continue
+		}
+		for _, topicFilter := range topicFilters {
+			if entity.MatchTopic(topicFilter, topic) {
+				c.subscribers[subscriber].queueMessage(c.compress(msg))
+				break
+			}
+		}
 	}
 }
 
-func (c *commsController) getSubscriberNotifiers() []*notifier {
+// sendReply sends the reply to the publisher owning the reply topic.
+func (c *commsController) sendReply(msg entity.Message) {
+	c.RLock()
+	notifier, ok := c.publishers[c.replyRoutes[msg.Topic]]
+	c.RUnlock()
+
+	if !ok {
+		log.Warnf("Reply %s dropped: no publisher owns reply topic %q", msg.ID, msg.Topic)
+		c.deadLetter(msg, ReasonNoReplyRoute, TargetBroker, nil)
+		return
+	}
+	notifier.queueMessage(c.compress(msg))
+}
+
+// getSubscriberNotifiers returns the notifiers of the ungrouped
+// subscribers subscribed to the message, and the notifier of the
+// member picked by each subscriber group subscribed to it.
+func (c *commsController) getSubscriberNotifiers(
+	msg entity.Message,
+) ([]*notifier, map[string]*notifier) {
 	c.RLock()
 	defer c.RUnlock()
 
-	notifiers := make([]*notifier, 0, len(c.subscribers))
+	matches := c.topics.match(msg)
+	notifiers := make([]*notifier, 0, len(matches.subscribers))
+	for subscriber := range matches.subscribers {
+		notifiers = append(notifiers, c.subscribers[subscriber])
+	}
+
+	groupNotifiers := make(map[string]*notifier, len(matches.groups))
+	for group, members := range matches.groups {
+		if member := c.groups[group].pick(msg, members); member != nil {
+			groupNotifiers[group] = c.subscribers[member]
+		}
+	}
+
+	return notifiers, groupNotifiers
+}
+
+// redeliver sends the group message a member failed to receive to
+// another member of the group.
+func (c *commsController) redeliver(notification notification) {
+	msg, group := *notification.message, notification.group
+	// Match the headers set by the publisher, like when the message
+	// was sent first.
+	published, err := compression.Decompress(msg, c.config.Compression.MaxSize)
+	if err != nil {
+		log.Errorf("Error decompressing message %s, message dropped: %s", msg.ID, err.Error())
+		return
+	}
+
+	c.RLock()
+	var member connection.WriteStream
+	if subscriberGroup, ok := c.groups[group]; ok {
+		member = subscriberGroup.pick(published, c.topics.match(published).groups[group])
+	}
+	notifier := c.subscribers[member]
+	c.RUnlock()
+
+	if notifier == nil {
+		log.Warnf("No member of group %q left, message %s dropped", group, msg.ID)
+		c.deadLetter(msg, ReasonNoGroupMember, "group "+group, nil)
+		return
+	}
+	log.Infof("Redelivering message %s to another member of group %q", msg.ID, group)
+	notifier.queue(notification)
+}
+
+// subscribe subscribes the subscriber to the topic filters of the
+// control, either to all of them or, if any of the filters is
+// invalid, to none. Subscribing again to a topic filter replaces the
+// previous subscription.
+func (c *commsController) subscribe(subscriber connection.WriteStream, control entity.Control) error {
+	var headerFilter filter.Filter
+	if control.Filter != "" {
+		var err error
+		if headerFilter, err = filter.Parse(control.Filter); err != nil {
+			return errors.Wrap(err, "parse header filter")
+		}
+	}
+	for _, topicFilter := range control.Topics {
+		if err := entity.ValidateTopicFilter(topicFilter); err != nil {
+			return errors.Wrap(err, "validate topic filter")
+		}
+	}
+	if err := entity.ValidateGroup(control.Group, control.GroupKey); err != nil {
+		return errors.Wrap(err, "validate group")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.subscribers[subscriber]; !ok {
+		return ErrUnknownSubscriber
+	}
+	if group, ok := c.groups[control.Group]; ok && group.key != control.GroupKey {
+		return errors.Wrapf(ErrGroupKeyMismatch, "group %q is keyed by %q", control.Group, group.key)
+	}
+
+	if c.subscriptions[subscriber] == nil {
+		c.subscriptions[subscriber] = make(map[string]string)
+	}
+	for _, topicFilter := range control.Topics {
+		previousGroup, subscribed := c.subscriptions[subscriber][topicFilter]
+		c.subscriptions[subscriber][topicFilter] = control.Group
+		c.topics.add(topicFilter, subscriber, subscription{filter: headerFilter, group: control.Group})
+		if subscribed {
+			c.leaveGroupIfUnused(subscriber, previousGroup)
+		}
+	}
+
+	if control.Group != "" {
+		group, ok := c.groups[control.Group]
+		if !ok {
+			group = newSubscriberGroup(control.GroupKey)
+			c.groups[control.Group] = group
+		}
+		group.join(subscriber)
+	} else {
+		// Subscriber groups share the live messages only.
+		c.sendRetained(subscriber, control.Topics, headerFilter)
+	}
+	log.Infof("Subscriber command done: %s", control)
+	return nil
+}
+
+func (c *commsController) unsubscribe(subscriber connection.WriteStream, filters []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, topicFilter := range filters {
+		group, ok := c.subscriptions[subscriber][topicFilter]
+		if !ok {
+			continue
+		}
+		delete(c.subscriptions[subscriber], topicFilter)
+		c.topics.remove(topicFilter, subscriber)
+		c.leaveGroupIfUnused(subscriber, group)
+		log.Infof("Subscriber unsubscribed from %q", topicFilter)
+	}
+}
+
+// leaveGroupIfUnused removes the subscriber from the group unless it
+// has other subscriptions in the group, and removes the group once
+// it's left empty. It must be called with the lock held.
+func (c *commsController) leaveGroupIfUnused(subscriber connection.WriteStream, group string) {
+	if group == "" {
+		return
+	}
+	for _, subscriptionGroup := range c.subscriptions[subscriber] {
+		if subscriptionGroup == group {
+			return
+		}
+	}
+
+	subscriberGroup, ok := c.groups[group]
+	if !ok {
+		return
+	}
+	if subscriberGroup.leave(subscriber) {
+		delete(c.groups, group)
+	}
+	log.Infof("Subscriber left group %q", group)
+}
+
+// pause holds back the messages to the subscriber until it resumes.
+func (c *commsController) pause(subscriber connection.WriteStream) error {
+	c.RLock()
+	defer c.RUnlock()
+
+	notifier, ok := c.subscribers[subscriber]
+	if !ok {
+		return ErrUnknownSubscriber
+	}
+	notifier.pause()
+	log.Info("Subscriber paused")
+	return nil
+}
+
+func (c *commsController) resume(subscriber connection.WriteStream) error {
+	c.RLock()
+	defer c.RUnlock()
+
+	notifier, ok := c.subscribers[subscriber]
+	if !ok {
+		return ErrUnknownSubscriber
+	}
+	notifier.resume()
+	log.Info("Subscriber resumed")
+	return nil
+}
+
+// enableAcks switches the subscriber to ack mode, and redelivers the
+// messages it didn't acknowledge before it reconnected, if any.
+func (c *commsController) enableAcks(subscriber connection.WriteStream, control entity.Control) error {
+	c.Lock()
+	defer c.Unlock()
+
+	notifier, ok := c.subscribers[subscriber]
+	if !ok {
+		return ErrUnknownSubscriber
+	}
+	if !notifier.enableAcks(newAckTracker(control.ConsumerID, control.Prefetch)) {
+		return ErrAckModeEnabled
+	}
+	log.Infof("Subscriber command done: %s", control)
+
+	unacked, ok := c.unacked[control.ConsumerID]
+	if control.ConsumerID == "" || !ok {
+		return nil
+	}
+	delete(c.unacked, control.ConsumerID)
+	log.Infof("Redelivering %d unacknowledged messages to consumer %q",
+		len(unacked.notifications), control.ConsumerID)
+	for _, notification := range unacked.notifications {
+		notifier.queue(notification)
+	}
+	return nil
+}
+
+// replay validates the topic filters and header filter of the
+// control and starts sending the logged messages of the matching
+// topics to the subscriber, from the offset and time of the control.
+// The result of the command confirms the replay started.
+func (c *commsController) replay(subscriber connection.WriteStream, control entity.Control) error {
+	if c.config.MessageLog == nil {
+		return ErrMessageLogDisabled
+	}
+	var headerFilter filter.Filter
+	if control.Filter != "" {
+		var err error
+		if headerFilter, err = filter.Parse(control.Filter); err != nil {
+			return errors.Wrap(err, "parse header filter")
+		}
+	}
+	for _, topicFilter := range control.Topics {
+		if err := entity.ValidateTopicFilter(topicFilter); err != nil {
+			return errors.Wrap(err, "validate topic filter")
+		}
+	}
+
+	c.RLock()
+	notifier, ok := c.subscribers[subscriber]
+	c.RUnlock()
+	if !ok {
+		return ErrUnknownSubscriber
+	}
+
+	position := topiclog.Position{Offset: control.Offset, Since: control.Since}
+	go c.sendLogged(notifier, control.Topics, headerFilter, position)
+	log.Infof("Subscriber command done: %s", control)
+	return nil
+}
+
+// sendLogged sends the logged messages of the topics matching the
+// topic filters and the header filter from the position, topic by
+// topic. It waits while the queue of the notifier is full, and stops
+// once the notifier or the controller stops.
+func (c *commsController) sendLogged(
+	notifier *notifier,
+	topicFilters []string,
+	headerFilter filter.Filter,
+	position topiclog.Position,
+) {
+	var sent int
+	for _, topic := range c.config.MessageLog.Topics() {
+		if !matchAnyTopic(topicFilters, topic) {
+			continue
+		}
+		stopped := false
+		err := c.config.MessageLog.Read(topic, position, func(msg entity.Message) bool {
+			select {
+			case <-c.close:
+				stopped = true
+				return false
+			default:
+			}
+			if msg.Expired(time.Now()) || !filter.MatchMessage(headerFilter, msg) {
+				return true
+			}
+			msg = c.compress(msg)
+			if !notifier.queueWait(notification{message: &msg}) {
+				stopped = true
+				return false
+			}
+			sent++
+			return true
+		})
+		if err != nil {
+			log.Errorf("Error replaying log of topic %q: %s", topic, err.Error())
+		}
+		if stopped {
+			log.Infof("Replay stopped after %d messages", sent)
+			return
+		}
+	}
+	log.Infof("Replayed %d logged messages", sent)
+}
+
+func matchAnyTopic(topicFilters []string, topic string) bool {
+	for _, topicFilter := range topicFilters {
+		if entity.MatchTopic(topicFilter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// resumeSession declares the session of the subscriber. If the
+// session was kept since the subscriber disconnected, its
+// subscriptions are restored and the messages queued meanwhile are
+// sent before any other.
+func (c *commsController) resumeSession(subscriber connection.WriteStream, control entity.Control) error {
+	if err := entity.ValidateSessionID(control.SessionID); err != nil {
+		return errors.Wrap(err, "validate session ID")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	notifier, ok := c.subscribers[subscriber]
+	if !ok {
+		return ErrUnknownSubscriber
+	}
+	if _, ok := c.sessionIDs[subscriber]; ok {
+		return ErrSessionSet
+	}
+	for _, sessionID := range c.sessionIDs {
+		if sessionID == control.SessionID {
+			return errors.Wrapf(ErrSessionInUse, "session %q", control.SessionID)
+		}
+	}
+	c.sessionIDs[subscriber] = control.SessionID
+
+	session, ok := c.sessions[control.SessionID]
+	if !ok {
+		log.Infof("Subscriber command done: %s started", control)
+		return nil
+	}
+	delete(c.sessions, control.SessionID)
+
+	if c.subscriptions[subscriber] == nil {
+		c.subscriptions[subscriber] = make(map[string]string)
+	}
+	for topicFilter, subscription := range session.subscriptions {
+		if _, ok := c.subscriptions[subscriber][topicFilter]; ok {
+			// Subscribed again meanwhile.
+			continue
+		}
+		c.subscriptions[subscriber][topicFilter] = ""
+		c.topics.add(topicFilter, subscriber, subscription)
+	}
+	notifier.queueBacklog(session.notifications)
+	log.Infof("Subscriber command done: %s resumed with %d subscriptions and %d queued messages",
+		control, len(session.subscriptions), len(session.notifications))
+	return nil
+}
+
+// matchSessions returns the offline sessions subscribed to the
+// message.
+func (c *commsController) matchSessions(msg entity.Message) []*session {
+	c.RLock()
+	defer c.RUnlock()
+
+	var sessions []*session
+	for _, session := range c.sessions {
+		if session.match(msg) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// keepForSession queues the message for the offline session until it
+// resumes, or dead-letters it if the session queue is full.
+func (c *commsController) keepForSession(session *session, msg entity.Message) {
+	c.Lock()
+	if c.sessions[session.id] != session {
+		// Resumed or expired meanwhile.
+		c.Unlock()
+		return
+	}
+	fits := session.fits(msg, c.config.SessionMaxMessages, c.config.SessionMaxBytes)
+	if fits {
+		session.add(notification{message: &msg})
+	}
+	c.Unlock()
+
+	if !fits {
+		c.deadLetter(msg, ReasonQueueFull, sessionTarget(session.id), nil)
+	}
+}
+
+// keepSession keeps the session of the disconnected subscriber with
+// its ungrouped subscriptions. It must be called with the lock held,
+// before the subscriptions are removed.
+func (c *commsController) keepSession(subscriber connection.WriteStream, sessionID string) *session {
+	session := newSession(sessionID, time.Now())
+	for topicFilter, group := range c.subscriptions[subscriber] {
+		if group != "" {
+			continue
+		}
+		if subscription, ok := c.topics.get(topicFilter, subscriber); ok {
+			session.subscriptions[topicFilter] = subscription
+		}
+	}
+	c.sessions[sessionID] = session
+	log.Infof("Keeping session %q with %d subscriptions", sessionID, len(session.subscriptions))
+	return session
+}
+
+// keepUnsentForSession queues the messages the subscriber of the
+// session didn't receive before it disconnected ahead of the ones
+// published since, and dead-letters those exceeding the limits.
+func (c *commsController) keepUnsentForSession(session *session, notifications []notification) {
+	c.Lock()
+	var dropped []notification
+	if c.sessions[session.id] == session {
+		dropped = session.prepend(notifications, c.config.SessionMaxMessages, c.config.SessionMaxBytes)
+	} else {
+		dropped = notifications
+	}
+	c.Unlock()
+
+	for _, notification := range dropped {
+		c.deadLetter(*notification.message, ReasonQueueFull, sessionTarget(session.id), nil)
+	}
+}
+
+// expireSessions removes the sessions whose subscribers didn't
+// reconnect within the session expiry, and dead-letters their queued
+// messages.
+func (c *commsController) expireSessions(now time.Time) {
+	var expired []*session
+	c.Lock()
+	for id, session := range c.sessions {
+		if session.expired(now, c.config.SessionExpiry) {
+			delete(c.sessions, id)
+			expired = append(expired, session)
+		}
+	}
+	c.Unlock()
+
+	for _, session := range expired {
+		log.Infof("Session %q expired with %d queued messages", session.id, len(session.notifications))
+		for _, notification := range session.notifications {
+			c.deadLetter(*notification.message, ReasonSessionExpired, sessionTarget(session.id), nil)
+		}
+	}
+}
+
+func sessionTarget(sessionID string) string {
+	return fmt.Sprintf("session %q", sessionID)
+}
+
+// ack releases the messages acknowledged by the subscriber.
+func (c *commsController) ack(subscriber connection.WriteStream, messageIDs []string) {
+	c.RLock()
+	notifier, ok := c.subscribers[subscriber]
+	c.RUnlock()
+
+	if !ok {
+		log.Warn("Ack of unknown subscriber ignored")
+		return
+	}
+	acks := notifier.acks.Load()
+	if acks == nil {
+		log.Warn("Ack of subscriber not in ack mode ignored")
+		return
+	}
+	if acked := acks.ack(messageIDs); acked < len(messageIDs) {
+		log.Tracef("%d of %d acked messages were not in flight", len(messageIDs)-acked, len(messageIDs))
+	}
+}
+
+// runRedelivery periodically redelivers the messages that were not
+// acknowledged in time.
+func (c *commsController) runRedelivery() {
+	ticker := time.NewTicker(c.config.AckTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.close:
+			return
+		case now := <-ticker.C:
+			c.redeliverUnacked(now)
+			c.expireSessions(now)
+		}
+	}
+}
+
+// redeliverUnacked redelivers the messages sent at least the ack
+// timeout before now and not acknowledged, and dead-letters the
+// messages of the subscribers that didn't reconnect in time.
+func (c *commsController) redeliverUnacked(now time.Time) {
+	type expiredMessages struct {
+		notifier      *notifier
+		notifications []notification
+	}
+	var expired []expiredMessages
+
+	c.Lock()
 	for _, notifier := range c.subscribers {
-		notifiers = append(notifiers, notifier)
+		if acks := notifier.acks.Load(); acks != nil {
+			if notifications := acks.expired(now, c.config.AckTimeout); len(notifications) > 0 {
+				expired = append(expired, expiredMessages{notifier: notifier, notifications: notifications})
+			}
+		}
 	}
+	var stale []*unackedMessages
+	for consumerID, unacked := range c.unacked {
+		if now.Sub(unacked.since) >= c.config.AckTimeout {
+			delete(c.unacked, consumerID)
+			stale = append(stale, unacked)
+			log.Warnf("Consumer %q didn't reconnect in time", consumerID)
+		}
+	}
+	c.Unlock()
 
-	return notifiers
+	for _, messages := range expired {
+		for _, notification := range messages.notifications {
+			msg := notification.message
+			if notification.deliveries >= DefaultMaxDeliveries {
+				messages.notifier.deadLetter(*msg, ReasonNotAcknowledged)
+				continue
+			}
+			log.Infof("Message %s was not acknowledged in time, redelivering", msg.ID)
+			if notification.group != "" {
+				c.redeliver(notification.redelivery())
+			} else {
+				messages.notifier.queue(notification.redelivery())
+			}
+		}
+	}
+	for _, unacked := range stale {
+		for _, notification := range unacked.notifications {
+			unacked.notifier.deadLetter(*notification.message, ReasonSubscriberDisconnected)
+		}
+	}
+}
+
+// keepUnacked keeps the messages the disconnected subscriber in ack
+// mode didn't acknowledge until it reconnects with the consumer ID.
+func (c *commsController) keepUnacked(consumerID string, notifier *notifier, notifications []notification) {
+	c.Lock()
+	defer c.Unlock()
+
+	unacked, ok := c.unacked[consumerID]
+	if !ok {
+		unacked = &unackedMessages{notifier: notifier}
+		c.unacked[consumerID] = unacked
+	}
+	unacked.notifications = append(unacked.notifications, notifications...)
+	unacked.since = time.Now()
+	log.Infof("Keeping %d unacknowledged messages of consumer %q", len(notifications), consumerID)
+}
+
+// sendResult queues the command result to the subscriber control
+// stream.
+func (c *commsController) sendResult(subscriber connection.WriteStream, result entity.Control) {
+	c.RLock()
+	results, ok := c.results[subscriber]
+	c.RUnlock()
+
+	if ok {
+		results.queueControl(result)
+	}
 }
 
 func (c *commsController) subscriberCount() int {
@@ -167,10 +1396,10 @@ func (c *commsController) subscriberCount() int {
 	return len(c.subscribers)
 }
 
-func (c *commsController) sendToPublishers(msg entity.Message) {
+func (c *commsController) sendToPublishers(control entity.Control) {
 	notifiers := c.getPublisherNotifiers()
 	for _, notifier := range notifiers {
-		notifier.queueMessage(msg)
+		notifier.queueControl(control)
 	}
 }
 
@@ -192,8 +1421,6 @@ func (c *commsController) removePublisher(publisher connection.ReadWriteStream)
 	}
 
 	c.Lock()
-	defer c.Unlock()
-
 	notifier, ok := c.publishers[publisher]
 	if !ok {
 		// This should never happen.
@@ -201,9 +1428,26 @@ func (c *commsController) removePublisher(publisher connection.ReadWriteStream)
 	} else {
 		notifier.stop()
 	}
-
 	delete(c.publishers, publisher)
+	delete(c.credits, publisher)
+	delete(c.publisherIDs, publisher)
+	for replyTo, owner := range c.replyRoutes {
+		if owner == publisher {
+			delete(c.replyRoutes, replyTo)
+		}
+	}
+	c.Unlock()
 	log.Warn("Publisher disconnected")
+
+	if !ok {
+		return
+	}
+	// Dead-letter the replies the publisher didn't receive.
+	for _, notification := range notifier.drain() {
+		if notification.message != nil {
+			notifier.deadLetter(*notification.message, ReasonPublisherDisconnected)
+		}
+	}
 }
 
 func (c *commsController) removeSubscriber(sender sender) {
@@ -218,16 +1462,81 @@ func (c *commsController) removeSubscriber(sender sender) {
 	}
 
 	c.Lock()
+	notifier, ok := c.subscribers[subscriber]
+	if !ok {
+		// Already removed.
+		c.Unlock()
+		return
+	}
+	notifier.stop()
 	delete(c.subscribers, subscriber)
+	c.closeControlStream(subscriber)
+	var session *session
+	if sessionID, ok := c.sessionIDs[subscriber]; ok {
+		delete(c.sessionIDs, subscriber)
+		session = c.keepSession(subscriber, sessionID)
+	}
+	subscriptions := c.subscriptions[subscriber]
+	delete(c.subscriptions, subscriber)
+	for topicFilter, group := range subscriptions {
+		c.topics.remove(topicFilter, subscriber)
+		c.leaveGroupIfUnused(subscriber, group)
+	}
+	subscriberCount := len(c.subscribers)
+	c.Unlock()
 	log.Warn("Subscriber disconnected")
 
-	if len(c.subscribers) == 0 {
-		// Inform the publishers that there are no subscribers connected.
-		c.Unlock()
-		message := entity.Message{Text: MessageNoSubscribers}
-		c.sendToPublishers(message)
+	// Rebalance the group messages the subscriber didn't receive or
+	// acknowledge to the remaining members, keep the others until
+	// the subscriber reconnects if it has a session or is in ack mode,
+	// and dead-letter them otherwise.
+	notifications := notifier.drain()
+	acks := notifier.acks.Load()
+	if acks != nil {
+		// The in-flight messages were sent before the queued ones.
+		notifications = append(acks.drain(), notifications...)
+	}
+	var unsent, unacked []notification
+	for _, notification := range notifications {
+		switch {
+		case notification.message == nil:
+		case notification.group != "":
+			c.redeliver(notification.redelivery())
+		case session != nil:
+			unsent = append(unsent, notification.redelivery())
+		case acks != nil && acks.consumerID != "":
+			unacked = append(unacked, notification.redelivery())
+		case notification.failed:
+			notifier.deadLetter(*notification.message, ReasonSendFailed)
+		default:
+			notifier.deadLetter(*notification.message, ReasonSubscriberDisconnected)
+		}
+	}
+	if len(unsent) > 0 {
+		c.keepUnsentForSession(session, unsent)
+	}
+	if len(unacked) > 0 {
+		c.keepUnacked(acks.consumerID, notifier, unacked)
+	}
+
+	// Inform the publishers of the subscriber leaving.
+	c.sendToPublishers(entity.NewSubscriberCountControl(subscriberCount))
+}
+
+// closeControlStream stops sending command results to the subscriber
+// and closes its control stream, if set. It must be called with the
+// lock held.
+func (c *commsController) closeControlStream(subscriber connection.WriteStream) {
+	results, ok := c.results[subscriber]
+	if !ok {
 		return
 	}
+	results.stop()
+	delete(c.results, subscriber)
 
-	c.Unlock()
+	if controlStream, ok := results.sender.(connection.WriteStream); ok {
+		if err := controlStream.CloseStream(); err != nil {
+			log.Errorf("Error closing subscriber control stream: %s", err.Error())
+		}
+	}
 }
@@ -1,24 +1,31 @@
 package controller
 
 import (
+	"fmt"
 	"sync"
 	"testing"
+	"time"
 
+	"assignment/lib/connection"
 	connectionmock "assignment/lib/connection/mocks"
 	"assignment/lib/entity"
+	"assignment/server/server/topiclog"
 
 	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+var goAway = entity.NewGoAwayControl(MessageGoAway)
+
 func TestCommsController_Close(t *testing.T) {
-	c := NewCommsController()
+	c := NewCommsController(Config{})
 	require.NoError(t, c.Close())
 }
 
 func TestCommsController_MessageReceiver_and_sendToSubscribers(t *testing.T) {
-	c := NewCommsController().(*commsController)
+	c := NewCommsController(Config{}).(*commsController)
 	defer c.Close()
 
 	var wg sync.WaitGroup
@@ -26,51 +33,500 @@ func TestCommsController_MessageReceiver_and_sendToSubscribers(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	for i := 0; i < 3; i++ {
 		streamMock := connectionmock.NewMockReadWriteStream(ctrl)
+		streamMock.EXPECT().SendControl(goAway).Return(nil).Times(1)
 		streamMock.EXPECT().CloseStream().Return(nil).Times(1)
 		c.subscribers[streamMock] = newNotifier(sender, nil)
+		c.subscribe(streamMock, entity.NewSubscribeControl("news"))
 		wg.Add(1)
 	}
 	require.Len(t, c.subscribers, 3)
 
-	message := entity.Message{Text: "message"}
-	go c.MessageReceiver()(message)
+	message := entity.NewTextMessage("message")
+	message.Topic = "news"
+	go c.MessageReceiver(nil)(message)
 
 	wg.Wait()
 	// Make sure that each notifier has received and sent the message.
 	require.Equal(t, []entity.Message{message, message, message}, sender.messages)
 }
 
+func TestCommsController_MessageReceiver_and_ReplyReceiver(t *testing.T) {
+	c := NewCommsController(Config{}).(*commsController)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	requesterSender := newTestSender(func() { wg.Done() }, nil)
+	otherSender := newTestSender(func() { wg.Done() }, nil)
+
+	ctrl := gomock.NewController(t)
+	requester := connectionmock.NewMockReadWriteStream(ctrl)
+	requester.EXPECT().CloseStream().Return(nil).Times(1)
+	other := connectionmock.NewMockReadWriteStream(ctrl)
+	other.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	other.EXPECT().CloseStream().Return(nil).Times(1)
+	c.publishers[requester] = newNotifier(requesterSender, nil)
+	c.publishers[other] = newNotifier(otherSender, nil)
+
+	// The request is confirmed, the other messages of the publishers
+	// are nacked.
+	wg.Add(4)
+	request := entity.NewTextMessage("request")
+	request.Topic = "rpc"
+	request.ReplyTo = entity.NewReplyTopic()
+	request.CorrelationID = request.ID
+	c.MessageReceiver(requester)(request)
+	require.Equal(t, requester, c.replyRoutes[request.ReplyTo])
+
+	// Requests can't take over the reply topic of another publisher.
+	c.MessageReceiver(other)(request)
+	require.Equal(t, requester, c.replyRoutes[request.ReplyTo])
+
+	// Requests must reply to reply topics.
+	invalidRequest := entity.NewTextMessage("invalid request")
+	invalidRequest.Topic = "rpc"
+	invalidRequest.ReplyTo = "rpc/replies"
+	c.MessageReceiver(other)(invalidRequest)
+	require.Len(t, c.replyRoutes, 1)
+
+	// Publishers can't send replies.
+	spoofedReply, err := entity.NewReply(request, entity.NewTextMessage("spoofed reply"))
+	require.NoError(t, err)
+	c.MessageReceiver(other)(spoofedReply)
+
+	// Subscribers can only send replies.
+	notReply := entity.NewTextMessage("not a reply")
+	notReply.Topic = "rpc"
+	c.ReplyReceiver()(notReply)
+
+	unroutable, err := entity.NewReply(entity.Message{
+		ReplyTo:       entity.NewReplyTopic(),
+		CorrelationID: entity.NewID(),
+	}, entity.NewTextMessage("unroutable"))
+	require.NoError(t, err)
+	c.ReplyReceiver()(unroutable)
+
+	reply, err := entity.NewReply(request, entity.NewTextMessage("reply"))
+	require.NoError(t, err)
+	wg.Add(1)
+	c.ReplyReceiver()(reply)
+	wg.Wait()
+
+	require.Equal(t, []interface{}{entity.NewConfirmControl(request.ID), reply},
+		requesterSender.getSent())
+	require.Empty(t, otherSender.messages)
+	nacks := otherSender.getSent()
+	require.Len(t, nacks, 3)
+	for _, nack := range nacks {
+		assert.Contains(t, nack.(entity.Control).Text, ErrMessageRejected.Error())
+	}
+
+	// Removing the publisher removes its reply routes.
+	c.removePublisher(requester)
+	require.Empty(t, c.replyRoutes)
+}
+
+func TestCommsController_MessageReceiver_confirms(t *testing.T) {
+	tests := map[string]struct {
+		topic         string
+		queueCapacity int
+		wantErr       error
+		wantReason    entity.NackReason
+	}{
+		"accepted": {
+			topic:         "news",
+			queueCapacity: 1,
+		},
+		"queue_full": {
+			topic:      "news",
+			wantErr:    ErrQueueFull,
+			wantReason: entity.NackQueueFull,
+		},
+		"invalid_topic": {
+			topic:         "news/#",
+			queueCapacity: 1,
+			wantErr:       ErrMessageRejected,
+			wantReason:    entity.NackRejected,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Stop handling the queued messages.
+			c := NewCommsController(Config{}).(*commsController)
+			require.NoError(t, c.Close())
+			c.messages = newPriorityQueue[queuedMessage](tc.queueCapacity)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			sender := newTestSender(func() { wg.Done() }, nil)
+			publisher := connectionmock.NewMockReadWriteStream(gomock.NewController(t))
+			c.publishers[publisher] = newNotifier(sender, nil)
+			defer c.publishers[publisher].stop()
+
+			message := entity.NewTextMessage("message")
+			message.Topic = tc.topic
+			c.MessageReceiver(publisher)(message)
+			wg.Wait()
+
+			confirm := sender.getSent()[0].(entity.Control)
+			require.Equal(t, entity.ControlConfirm, confirm.Type)
+			require.Equal(t, []string{message.ID}, confirm.MessageIDs)
+			require.Equal(t, tc.wantReason, confirm.NackReason)
+			if tc.wantErr == nil {
+				require.Empty(t, confirm.Text)
+				return
+			}
+			require.Contains(t, confirm.Text, tc.wantErr.Error())
+		})
+	}
+}
+
+func TestCommsController_MessageReceiver_credits(t *testing.T) {
+	// Stop handling the queued messages.
+	c := NewCommsController(Config{}).(*commsController)
+	require.NoError(t, c.Close())
+	c.messages = newPriorityQueue[queuedMessage](1)
+
+	var wg sync.WaitGroup
+	sender := newTestSender(func() { wg.Done() }, nil)
+	publisher := connectionmock.NewMockReadWriteStream(gomock.NewController(t))
+	c.publishers[publisher] = newNotifier(sender, nil)
+	defer c.publishers[publisher].stop()
+	c.credits[publisher] = newPublisherCredits(publisher, 2)
+
+	// Messages within the credits are queued beyond the queue capacity.
+	wg.Add(3)
+	for i := 0; i < 3; i++ {
+		message := entity.NewTextMessage("message")
+		message.Topic = "news"
+		c.MessageReceiver(publisher)(message)
+	}
+	wg.Wait()
+	var confirms []entity.NackReason
+	for _, sent := range sender.getSent() {
+		confirms = append(confirms, sent.(entity.Control).NackReason)
+	}
+	assert.Equal(t, []entity.NackReason{0, 0, entity.NackNoCredit}, confirms)
+
+	// Credits are granted again as the messages are handled.
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		queued, ok := c.messages.pop()
+		require.True(t, ok)
+		c.releaseCredit(queued.credits)
+	}
+	wg.Wait()
+	assert.Equal(t, []interface{}{entity.NewCreditControl(3), entity.NewCreditControl(4)},
+		sender.getSent()[3:])
+}
+
+func TestCommsController_MessageReceiver_sequences(t *testing.T) {
+	tests := map[string]struct {
+		subscribe entity.Control
+		members   int
+		// want are the sequence numbers received by each member.
+		want [][]uint64
+	}{
+		"all": {
+			subscribe: entity.NewSubscribeControl("#"),
+			members:   1,
+			want:      [][]uint64{{1, 2, 3, 4}},
+		},
+		"filtered": {
+			subscribe: entity.NewFilteredSubscribeControl(`region == "eu"`, "#"),
+			members:   1,
+			want:      [][]uint64{{1, 2}},
+		},
+		"grouped": {
+			subscribe: entity.NewGroupSubscribeControl("workers", "", "#"),
+			members:   2,
+			want:      [][]uint64{{1, 2}, {1, 2}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewCommsController(Config{}).(*commsController)
+			defer c.Close()
+
+			ctrl := gomock.NewController(t)
+			var wg sync.WaitGroup
+			senders := make([]*testSender, tc.members)
+			for i := range senders {
+				senders[i] = newTestSender(func() { wg.Done() }, nil)
+				subscriber := connectionmock.NewMockReadWriteStream(ctrl)
+				subscriber.EXPECT().SendControl(goAway).Return(nil).Times(1)
+				subscriber.EXPECT().CloseStream().Return(nil).Times(1)
+				notifier := newPendingNotifier(DefaultMessageBufferSize, nil)
+				notifier.sequences = newStreamSequences()
+				notifier.start(senders[i])
+				c.subscribers[subscriber] = notifier
+				require.NoError(t, c.subscribe(subscriber, tc.subscribe))
+			}
+
+			publisher := connectionmock.NewMockReadWriteStream(ctrl)
+			publisher.EXPECT().SendControl(goAway).Return(nil).Times(1)
+			publisher.EXPECT().CloseStream().Return(nil).Times(1)
+			c.publishers[publisher] = newNotifier(newTestSender(func() {}, nil), nil)
+			c.publisherIDs[publisher] = "publisher"
+
+			for _, want := range tc.want {
+				wg.Add(len(want))
+			}
+			for i, region := range []string{"eu", "us", "eu", "us"} {
+				message := entity.NewTextMessage("message")
+				message.Topic = []string{"news", "sports"}[i%2]
+				message.Headers = map[string]string{"region": region}
+				// Publishers can't number their messages themselves.
+				message.PublisherID = "spoofed"
+				message.PublisherSequence = 42
+				c.MessageReceiver(publisher)(message)
+			}
+			wg.Wait()
+
+			// Each subscriber sees the messages it receives numbered
+			// without gaps.
+			for i, sender := range senders {
+				var sequences []uint64
+				for _, message := range sender.messages {
+					assert.Equal(t, "publisher", message.PublisherID)
+					sequences = append(sequences, message.PublisherSequence)
+				}
+				assert.Equal(t, tc.want[i], sequences)
+			}
+		})
+	}
+}
+
+func TestCommsController_MessageReceiver_duplicates(t *testing.T) {
+	messageLog, err := topiclog.Open(topiclog.Config{Dir: t.TempDir()})
+	require.NoError(t, err)
+	defer messageLog.Close()
+
+	publish := func(c *commsController, message entity.Message) entity.Control {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		sender := newTestSender(func() { wg.Done() }, nil)
+		publisher := connectionmock.NewMockReadWriteStream(gomock.NewController(t))
+		notifier := newNotifier(sender, nil)
+		c.Lock()
+		c.publishers[publisher] = notifier
+		c.Unlock()
+
+		c.MessageReceiver(publisher)(message)
+		wg.Wait()
+		notifier.stop()
+		c.Lock()
+		delete(c.publishers, publisher)
+		c.Unlock()
+		return sender.getSent()[0].(entity.Control)
+	}
+
+	message := entity.NewTextMessage("message")
+	message.Topic = "news"
+	message.ProducerID = "producer"
+	message.Sequence = 1
+
+	c := NewCommsController(Config{MessageLog: messageLog}).(*commsController)
+	assert.False(t, publish(c, message).Duplicate)
+	// Retries carry the same sequence number.
+	retry := message
+	retry.ID = entity.NewID()
+	confirm := publish(c, retry)
+	assert.Equal(t, entity.NewDuplicateConfirmControl(retry.ID), confirm)
+	assert.Equal(t, uint64(1), c.Stats().MessagesDeduplicated)
+	require.Eventually(t, func() bool {
+		return len(messageLog.Topics()) == 1
+	}, time.Second, time.Millisecond*10)
+	require.NoError(t, c.Close())
+
+	// The window is restored from the message log after a restart.
+	c = NewCommsController(Config{MessageLog: messageLog}).(*commsController)
+	defer c.Close()
+	assert.True(t, publish(c, message).Duplicate)
+	next := entity.NewTextMessage("next")
+	next.Topic = "news"
+	next.ProducerID = "producer"
+	next.Sequence = 2
+	assert.False(t, publish(c, next).Duplicate)
+}
+
+func TestCommsController_subscribe_retained(t *testing.T) {
+	c := NewCommsController(Config{}).(*commsController)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	sender := newTestSender(func() { wg.Done() }, nil)
+
+	ctrl := gomock.NewController(t)
+	stream := connectionmock.NewMockReadWriteStream(ctrl)
+	stream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	stream.EXPECT().CloseStream().Return(nil).Times(1)
+	c.subscribers[stream] = newNotifier(sender, nil)
+
+	retained := func(topic, text string) entity.Message {
+		message := entity.NewTextMessage(text)
+		message.Topic = topic
+		message.Retain = true
+		return message
+	}
+	news := retained("news/eu", "news")
+	receiver := c.MessageReceiver(nil)
+	receiver(retained("news/eu", "old news"))
+	receiver(news)
+	receiver(retained("news/us", "cleared news"))
+	receiver(retained("sports", "sports"))
+	// Retained messages without payload clear the retained message.
+	receiver(retained("news/us", ""))
+	require.Eventually(t, func() bool {
+		c.RLock()
+		defer c.RUnlock()
+		_, cleared := c.retained["news/us"]
+		return len(c.retained) == 2 && !cleared
+	}, time.Second, time.Millisecond*10)
+	require.Equal(t, news, c.retained["news/eu"])
+
+	// Subscriber groups and subscriptions with header filters not
+	// matching don't receive retained messages.
+	require.NoError(t, c.subscribe(stream, entity.NewGroupSubscribeControl("workers", "", "sports")))
+	require.NoError(t, c.subscribe(stream, entity.NewFilteredSubscribeControl(`region == "eu"`, "sports")))
+
+	// Retained messages matching several topic filters are sent once.
+	wg.Add(1)
+	require.NoError(t, c.subscribe(stream, entity.NewSubscribeControl("news/#", "news/eu")))
+	wg.Wait()
+	require.Equal(t, []entity.Message{news}, sender.messages)
+}
+
+func TestCommsController_replay(t *testing.T) {
+	messageLog, err := topiclog.Open(topiclog.Config{Dir: t.TempDir()})
+	require.NoError(t, err)
+	defer messageLog.Close()
+	c := NewCommsController(Config{MessageLog: messageLog}).(*commsController)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	sender := newTestSender(func() { wg.Done() }, nil)
+	ctrl := gomock.NewController(t)
+	stream := connectionmock.NewMockReadWriteStream(ctrl)
+	stream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	stream.EXPECT().CloseStream().Return(nil).Times(1)
+	c.subscribers[stream] = newNotifier(sender, nil)
+
+	// Messages are logged without subscribers.
+	receiver := c.MessageReceiver(nil)
+	for _, topic := range []string{"news/eu", "news/eu", "news/us", "sports"} {
+		message := entity.NewTextMessage(topic)
+		message.Topic = topic
+		receiver(message)
+	}
+	require.Eventually(t, func() bool {
+		return len(messageLog.Topics()) == 3
+	}, time.Second, time.Millisecond*10)
+
+	err = c.replay(stream, entity.NewReplayControl(0, time.Time{}, "news/#/"))
+	require.ErrorIs(t, err, entity.ErrInvalidTopicFilter)
+
+	// Offsets are counted per topic.
+	wg.Add(1)
+	require.NoError(t, c.replay(stream, entity.NewReplayControl(2, time.Time{}, "news/#")))
+	wg.Wait()
+	require.Len(t, sender.messages, 1)
+	assert.Equal(t, "news/eu", sender.messages[0].Topic)
+	assert.Equal(t, uint64(2), sender.messages[0].Offset)
+
+	wg.Add(3)
+	require.NoError(t, c.replay(stream, entity.NewReplayControl(0, time.Time{}, "news/+")))
+	wg.Wait()
+	var replayed []string
+	for _, message := range sender.messages[1:] {
+		replayed = append(replayed, fmt.Sprintf("%s@%d", message.Topic, message.Offset))
+	}
+	assert.Equal(t, []string{"news/eu@1", "news/eu@2", "news/us@1"}, replayed)
+
+	disabled := NewCommsController(Config{}).(*commsController)
+	defer disabled.Close()
+	err = disabled.replay(stream, entity.NewReplayControl(0, time.Time{}, "news/#"))
+	assert.ErrorIs(t, err, ErrMessageLogDisabled)
+}
+
+func TestCommsController_expiry(t *testing.T) {
+	c := NewCommsController(Config{
+		TopicTTLs: map[string]time.Duration{
+			"prices/#":  time.Hour,
+			"prices/eu": time.Minute,
+		},
+	}).(*commsController)
+	defer c.Close()
+
+	// The shortest default TTL of the matching topic filters applies.
+	assert.Equal(t, time.Minute, c.topicTTL("prices/eu"))
+	assert.Equal(t, time.Hour, c.topicTTL("prices/us"))
+	assert.Zero(t, c.topicTTL("news"))
+
+	var wg sync.WaitGroup
+	sender := newTestSender(func() { wg.Done() }, nil)
+	ctrl := gomock.NewController(t)
+	stream := connectionmock.NewMockReadWriteStream(ctrl)
+	stream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	stream.EXPECT().CloseStream().Return(nil).Times(1)
+	c.subscribers[stream] = newNotifier(sender, nil)
+	require.NoError(t, c.subscribe(stream, entity.NewSubscribeControl("prices/#")))
+
+	expired := entity.NewTextMessage("expired")
+	expired.Topic = "prices/eu"
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	message := entity.NewTextMessage("message")
+	message.Topic = "prices/eu"
+
+	wg.Add(1)
+	receiver := c.MessageReceiver(nil)
+	receiver(expired)
+	receiver(message)
+	wg.Wait()
+
+	// Messages without expiry time get the default TTL of the topic.
+	require.Len(t, sender.messages, 1)
+	assert.Equal(t, message.ID, sender.messages[0].ID)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), sender.messages[0].ExpiresAt, time.Second)
+	assert.Equal(t, Stats{MessagesReceived: 2, MessagesExpired: 1}, c.Stats())
+}
+
 func TestCommsController_AddPublisher_and_AddSubscriber(t *testing.T) {
-	helloSubscriberMessage := entity.Message{Text: MessageHelloSubscriber}
+	welcome := entity.NewWelcomeControl(MessageHelloSubscriber)
 	t.Run("subscriber_added_after_publisher", func(t *testing.T) {
 		var wg sync.WaitGroup
-		wg.Add(2)
+		wg.Add(3)
 
 		ctrl := gomock.NewController(t)
 		publisherStream := connectionmock.NewMockReadWriteStream(ctrl)
 		gomock.InOrder(
 			publisherStream.EXPECT().SetConnClosedCallback(gomock.Any()).Times(1),
-			publisherStream.EXPECT().SendMessage(entity.Message{
-				Text: MessageNoSubscribers,
-			}).DoAndReturn(func(_ entity.Message) error {
-				wg.Done()
-				return nil
-			}).Times(1),
-			publisherStream.EXPECT().SendMessage(entity.Message{
-				Text: MessageNewSubscriber,
-			}).DoAndReturn(func(_ entity.Message) error {
-				wg.Done()
-				return nil
-			}).Times(1),
+			publisherStream.EXPECT().SendControl(entity.NewSubscriberCountControl(0)).
+				DoAndReturn(func(_ entity.Control) error {
+					wg.Done()
+					return nil
+				}).Times(1),
+			publisherStream.EXPECT().SendControl(entity.NewCreditControl(DefaultPublisherCredits)).Return(nil).Times(1),
+			publisherStream.EXPECT().SendControl(entity.NewSubscriberCountControl(1)).
+				DoAndReturn(func(_ entity.Control) error {
+					wg.Done()
+					return nil
+				}).Times(1),
+			publisherStream.EXPECT().SendControl(goAway).Return(nil).Times(1),
 			publisherStream.EXPECT().CloseStream().Return(nil).Times(1),
 		)
 
 		subscriberStream := connectionmock.NewMockReadWriteStream(ctrl)
-		subscriberStream.EXPECT().SendMessage(helloSubscriberMessage).
-			Return(nil).Times(1)
+		subscriberStream.EXPECT().SendControl(welcome).
+			DoAndReturn(func(_ entity.Control) error {
+				wg.Done()
+				return nil
+			}).Times(1)
+		subscriberStream.EXPECT().SendControl(goAway).Return(nil).Times(1)
 		subscriberStream.EXPECT().CloseStream().Return(nil).Times(1)
 
-		c := NewCommsController().(*commsController)
+		c := NewCommsController(Config{}).(*commsController)
 		defer c.Close()
 
 		c.AddPublisher(publisherStream)
@@ -83,38 +539,46 @@ func TestCommsController_AddPublisher_and_AddSubscriber(t *testing.T) {
 	})
 	t.Run("publisher_joins_in_between_subscribers", func(t *testing.T) {
 		var wg sync.WaitGroup
-		wg.Add(2)
+		wg.Add(4)
 
 		ctrl := gomock.NewController(t)
 		publisherStream := connectionmock.NewMockReadWriteStream(ctrl)
 		gomock.InOrder(
 			publisherStream.EXPECT().SetConnClosedCallback(gomock.Any()).Times(1),
-			publisherStream.EXPECT().SendMessage(entity.Message{
-				Text: "1 subscriber(s) currently connected",
-			}).DoAndReturn(func(_ entity.Message) error {
-				wg.Done()
-				return nil
-			}).Times(1),
-			publisherStream.EXPECT().SendMessage(entity.Message{
-				Text: MessageNewSubscriber,
-			}).DoAndReturn(func(_ entity.Message) error {
-				wg.Done()
-				return nil
-			}).Times(1),
+			publisherStream.EXPECT().SendControl(entity.NewSubscriberCountControl(1)).
+				DoAndReturn(func(_ entity.Control) error {
+					wg.Done()
+					return nil
+				}).Times(1),
+			publisherStream.EXPECT().SendControl(entity.NewCreditControl(DefaultPublisherCredits)).Return(nil).Times(1),
+			publisherStream.EXPECT().SendControl(entity.NewSubscriberCountControl(2)).
+				DoAndReturn(func(_ entity.Control) error {
+					wg.Done()
+					return nil
+				}).Times(1),
+			publisherStream.EXPECT().SendControl(goAway).Return(nil).Times(1),
 			publisherStream.EXPECT().CloseStream().Return(nil).Times(1),
 		)
 
 		subscriberStream1 := connectionmock.NewMockReadWriteStream(ctrl)
-		subscriberStream1.EXPECT().SendMessage(helloSubscriberMessage).
-			Return(nil).Times(1)
+		subscriberStream1.EXPECT().SendControl(welcome).
+			DoAndReturn(func(_ entity.Control) error {
+				wg.Done()
+				return nil
+			}).Times(1)
+		subscriberStream1.EXPECT().SendControl(goAway).Return(nil).Times(1)
 		subscriberStream1.EXPECT().CloseStream().Return(nil).Times(1)
 
 		subscriberStream2 := connectionmock.NewMockReadWriteStream(ctrl)
-		subscriberStream2.EXPECT().SendMessage(helloSubscriberMessage).
-			Return(nil).Times(1)
+		subscriberStream2.EXPECT().SendControl(welcome).
+			DoAndReturn(func(_ entity.Control) error {
+				wg.Done()
+				return nil
+			}).Times(1)
+		subscriberStream2.EXPECT().SendControl(goAway).Return(nil).Times(1)
 		subscriberStream2.EXPECT().CloseStream().Return(nil).Times(1)
 
-		c := NewCommsController().(*commsController)
+		c := NewCommsController(Config{}).(*commsController)
 		defer c.Close()
 
 		c.AddSubscriber(subscriberStream1)
@@ -128,6 +592,139 @@ func TestCommsController_AddPublisher_and_AddSubscriber(t *testing.T) {
 	})
 }
 
+func TestCommsController_SubscriberControlReceiver(t *testing.T) {
+	c := NewCommsController(Config{}).(*commsController)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	newsSender := newTestSender(func() { wg.Done() }, nil)
+	sportsSender := newTestSender(func() { wg.Done() }, nil)
+
+	ctrl := gomock.NewController(t)
+	newsStream := connectionmock.NewMockReadWriteStream(ctrl)
+	newsStream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	newsStream.EXPECT().CloseStream().Return(nil).Times(1)
+	sportsStream := connectionmock.NewMockReadWriteStream(ctrl)
+	sportsStream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	sportsStream.EXPECT().CloseStream().Return(nil).Times(1)
+
+	c.subscribers[newsStream] = newNotifier(newsSender, nil)
+	c.subscribers[sportsStream] = newNotifier(sportsSender, nil)
+	c.SubscriberControlReceiver(newsStream)(entity.NewSubscribeControl("news/#", "sports/#"))
+	c.SubscriberControlReceiver(newsStream)(entity.NewUnsubscribeControl("sports/#"))
+	c.SubscriberControlReceiver(sportsStream)(entity.NewSubscribeControl("sports/+/results"))
+
+	news := entity.NewTextMessage("news")
+	news.Topic = "news/eu"
+	sports := entity.NewTextMessage("sports")
+	sports.Topic = "sports/football/results"
+	weather := entity.NewTextMessage("weather")
+	weather.Topic = "weather/eu"
+
+	wg.Add(2)
+	c.sendToSubscribers(news)
+	c.sendToSubscribers(sports)
+	c.sendToSubscribers(weather)
+	wg.Wait()
+
+	// Make sure that each subscriber only received the messages
+	// of the topics it's subscribed to.
+	require.Equal(t, []entity.Message{news}, newsSender.messages)
+	require.Equal(t, []entity.Message{sports}, sportsSender.messages)
+}
+
+func TestCommsController_SubscriberControlReceiver_filter(t *testing.T) {
+	c := NewCommsController(Config{}).(*commsController)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	sender := newTestSender(func() { wg.Done() }, nil)
+
+	ctrl := gomock.NewController(t)
+	stream := connectionmock.NewMockReadWriteStream(ctrl)
+	stream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	stream.EXPECT().CloseStream().Return(nil).Times(1)
+
+	c.subscribers[stream] = newNotifier(sender, nil)
+	receiver := c.SubscriberControlReceiver(stream)
+	receiver(entity.NewFilteredSubscribeControl(`region == "eu" && priority >= 3`, "orders/#"))
+	// Subscriptions with invalid filters are ignored.
+	receiver(entity.NewFilteredSubscribeControl(`region = "eu"`, "payments/#"))
+	require.Equal(t, map[string]string{"orders/#": ""}, c.subscriptions[stream])
+
+	matching := entity.NewTextMessage("matching")
+	matching.Topic = "orders/created"
+	matching.Headers = map[string]string{"region": "eu", "priority": "5"}
+	lowPriority := entity.NewTextMessage("low priority")
+	lowPriority.Topic = "orders/created"
+	lowPriority.Headers = map[string]string{"region": "eu", "priority": "1"}
+	payment := entity.NewTextMessage("payment")
+	payment.Topic = "payments/created"
+
+	wg.Add(1)
+	c.sendToSubscribers(lowPriority)
+	c.sendToSubscribers(payment)
+	c.sendToSubscribers(matching)
+	wg.Wait()
+
+	require.Equal(t, []entity.Message{matching}, sender.messages)
+}
+
+func TestCommsController_SubscriberControlReceiver_results(t *testing.T) {
+	c := NewCommsController(Config{}).(*commsController)
+	defer c.Close()
+
+	var messagesSent, resultsSent sync.WaitGroup
+	sender := newTestSender(func() { messagesSent.Done() }, nil)
+	resultSender := newTestSender(func() { resultsSent.Done() }, nil)
+
+	ctrl := gomock.NewController(t)
+	stream := connectionmock.NewMockReadWriteStream(ctrl)
+	stream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	stream.EXPECT().CloseStream().Return(nil).Times(1)
+
+	c.subscribers[stream] = newNotifier(sender, nil)
+	c.results[stream] = newPendingNotifier(DefaultMessageBufferSize, nil)
+	receiver := c.SubscriberControlReceiver(stream)
+
+	// Results of the commands received before the control stream is
+	// set should be sent once it is.
+	resultsSent.Add(4)
+	receiver(withCommandID(entity.NewSubscribeControl("news"), 1))
+	receiver(withCommandID(entity.NewPauseControl(), 2))
+	receiver(withCommandID(entity.NewSubscribeControl("news/#/eu"), 3))
+	receiver(withCommandID(entity.NewGoAwayControl("bye"), 4))
+	c.results[stream].start(resultSender)
+	resultsSent.Wait()
+
+	results := resultSender.getSent()
+	require.Len(t, results, 4)
+	require.Equal(t, entity.NewResultControl(1, nil), results[0])
+	require.Equal(t, entity.NewResultControl(2, nil), results[1])
+	require.Contains(t, results[2].(entity.Control).Text, "invalid topic filter")
+	require.Contains(t, results[3].(entity.Control).Text, ErrUnsupportedCommand.Error())
+
+	// Messages should be held back while the subscriber is paused.
+	message := entity.NewTextMessage("message")
+	message.Topic = "news"
+	messagesSent.Add(1)
+	c.sendToSubscribers(message)
+	require.Never(t, func() bool {
+		return len(sender.getSent()) > 0
+	}, time.Millisecond*50, time.Millisecond*10)
+
+	resultsSent.Add(1)
+	receiver(withCommandID(entity.NewResumeControl(), 5))
+	messagesSent.Wait()
+	resultsSent.Wait()
+	require.Equal(t, []entity.Message{message}, sender.messages)
+}
+
+func withCommandID(control entity.Control, commandID uint64) entity.Control {
+	control.CommandID = commandID
+	return control
+}
+
 func TestCommsController_sendToSubscribers_and_removeSubscriber(t *testing.T) {
 	t.Run("no_subscribers_left_should_notify_publishers", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
@@ -135,25 +732,28 @@ func TestCommsController_sendToSubscribers_and_removeSubscriber(t *testing.T) {
 		wg.Add(1)
 
 		publisherStream := connectionmock.NewMockReadWriteStream(ctrl)
-		publisherStream.EXPECT().SendMessage(entity.Message{
-			Text: MessageNoSubscribers,
-		}).DoAndReturn(func(_ entity.Message) error {
-			wg.Done()
-			return nil
-		}).Times(1)
+		publisherStream.EXPECT().SendControl(entity.NewSubscriberCountControl(0)).
+			DoAndReturn(func(_ entity.Control) error {
+				wg.Done()
+				return nil
+			}).Times(1)
+		publisherStream.EXPECT().SendControl(goAway).Return(nil).Times(1)
 		publisherStream.EXPECT().CloseStream().Return(nil).Times(1)
 
 		subscriberStream := connectionmock.NewMockReadWriteStream(ctrl)
 		subscriberStream.EXPECT().SendMessage(gomock.Any()).Return(assert.AnError).Times(1)
 		subscriberStream.EXPECT().CloseStream().Return(nil).Times(1)
 
-		c := NewCommsController().(*commsController)
+		c := NewCommsController(Config{}).(*commsController)
 		defer c.Close()
 
 		c.publishers[publisherStream] = newNotifier(publisherStream, nil)
 		c.subscribers[subscriberStream] = newNotifier(subscriberStream, c.removeSubscriber)
+		c.subscribe(subscriberStream, entity.NewSubscribeControl("news"))
 
-		c.sendToSubscribers(entity.Message{})
+		message := entity.NewTextMessage("message")
+		message.Topic = "news"
+		c.sendToSubscribers(message)
 		wg.Wait()
 
 		require.Len(t, c.publishers, 1)
@@ -164,35 +764,528 @@ func TestCommsController_sendToSubscribers_and_removeSubscriber(t *testing.T) {
 func TestCommsController_AddPublisher_and_removePublisher(t *testing.T) {
 	var (
 		ctrl      = gomock.NewController(t)
+		wg        sync.WaitGroup
 		callback1 func()
 		callback2 func()
+		sent      = func(_ entity.Control) error {
+			wg.Done()
+			return nil
+		}
 	)
+	wg.Add(4)
 
 	publisherStream1 := connectionmock.NewMockReadWriteStream(ctrl)
 	publisherStream1.EXPECT().SetConnClosedCallback(gomock.Any()).
 		DoAndReturn(func(cb func()) { callback1 = cb }).Times(1)
-	publisherStream1.EXPECT().SendMessage(entity.Message{
-		Text: MessageNoSubscribers,
-	}).Return(nil).Times(1)
+	publisherStream1.EXPECT().SendControl(entity.NewSubscriberCountControl(0)).
+		DoAndReturn(sent).Times(1)
+	publisherStream1.EXPECT().SendControl(entity.NewCreditControl(DefaultPublisherCredits)).
+		DoAndReturn(sent).Times(1)
 	// Closing the stream should remove the publisher regardless.
 	publisherStream1.EXPECT().CloseStream().Return(assert.AnError).Times(1)
 
 	publisherStream2 := connectionmock.NewMockReadWriteStream(ctrl)
 	publisherStream2.EXPECT().SetConnClosedCallback(gomock.Any()).
 		DoAndReturn(func(cb func()) { callback2 = cb }).Times(1)
-	publisherStream2.EXPECT().SendMessage(entity.Message{
-		Text: MessageNoSubscribers,
-	}).Return(nil).Times(1)
+	publisherStream2.EXPECT().SendControl(entity.NewSubscriberCountControl(0)).
+		DoAndReturn(sent).Times(1)
+	publisherStream2.EXPECT().SendControl(entity.NewCreditControl(DefaultPublisherCredits)).
+		DoAndReturn(sent).Times(1)
 	publisherStream2.EXPECT().CloseStream().Return(nil).Times(1)
 
-	c := NewCommsController().(*commsController)
+	c := NewCommsController(Config{}).(*commsController)
 	defer c.Close()
 
 	c.AddPublisher(publisherStream1)
 	c.AddPublisher(publisherStream2)
 	require.Len(t, c.publishers, 2)
 
+	// Wait until the publishers are informed of the subscriber count
+	// and granted their credits.
+	wg.Wait()
+
 	callback1()
 	callback2()
 	require.Len(t, c.publishers, 0)
+	require.Len(t, c.credits, 0)
+}
+
+func TestCommsController_sendToSubscribers_groups(t *testing.T) {
+	tests := map[string]struct {
+		groupKey string
+		// keys are the key header values of the messages.
+		keys []string
+		// want are the indexes of the members receiving the messages.
+		want [][]int
+	}{
+		"round_robin": {
+			keys: []string{"a", "a", "a", "a", "a", "a"},
+			want: [][]int{{0, 3}, {1, 4}, {2, 5}},
+		},
+		"sticky": {
+			groupKey: "customer",
+			keys:     []string{"a", "b", "a", "b", "a", "b"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewCommsController(Config{}).(*commsController)
+			defer c.Close()
+
+			var wg sync.WaitGroup
+			ctrl := gomock.NewController(t)
+			senders := make([]*testSender, 3)
+			for i := range senders {
+				senders[i] = newTestSender(func() { wg.Done() }, nil)
+				stream := connectionmock.NewMockReadWriteStream(ctrl)
+				stream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+				stream.EXPECT().CloseStream().Return(nil).Times(1)
+				c.subscribers[stream] = newNotifier(senders[i], nil)
+				require.NoError(t, c.subscribe(stream,
+					entity.NewGroupSubscribeControl("workers", tc.groupKey, "orders/#")))
+			}
+
+			// An ungrouped subscriber should receive all messages.
+			wg.Add(len(tc.keys))
+			broadcastSender := newTestSender(func() { wg.Done() }, nil)
+			broadcastStream := connectionmock.NewMockReadWriteStream(ctrl)
+			broadcastStream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+			broadcastStream.EXPECT().CloseStream().Return(nil).Times(1)
+			c.subscribers[broadcastStream] = newNotifier(broadcastSender, nil)
+			require.NoError(t, c.subscribe(broadcastStream, entity.NewSubscribeControl("orders/#")))
+
+			messages := make([]entity.Message, len(tc.keys))
+			for i, key := range tc.keys {
+				messages[i] = entity.NewTextMessage("message")
+				messages[i].Topic = "orders/created"
+				messages[i].Headers = map[string]string{"customer": key}
+				wg.Add(1)
+				c.sendToSubscribers(messages[i])
+			}
+			wg.Wait()
+
+			require.Equal(t, messages, broadcastSender.messages)
+			received := 0
+			members := make(map[string]int)
+			for i, sender := range senders {
+				received += len(sender.messages)
+				if tc.want != nil {
+					want := make([]entity.Message, 0, len(tc.want[i]))
+					for _, index := range tc.want[i] {
+						want = append(want, messages[index])
+					}
+					require.Equal(t, want, sender.messages)
+					continue
+				}
+				// Messages with the same key should go to the same member.
+				for _, message := range sender.messages {
+					key := message.Headers["customer"]
+					if member, ok := members[key]; ok {
+						require.Equal(t, member, i)
+					}
+					members[key] = i
+				}
+			}
+			require.Equal(t, len(messages), received)
+		})
+	}
+}
+
+func TestCommsController_subscribe_groupKeyMismatch(t *testing.T) {
+	c := NewCommsController(Config{}).(*commsController)
+	defer c.Close()
+
+	ctrl := gomock.NewController(t)
+	streams := make([]*connectionmock.MockReadWriteStream, 2)
+	for i := range streams {
+		streams[i] = connectionmock.NewMockReadWriteStream(ctrl)
+		streams[i].EXPECT().SendControl(goAway).Return(nil).Times(1)
+		streams[i].EXPECT().CloseStream().Return(nil).Times(1)
+		c.subscribers[streams[i]] = newNotifier(newTestSender(func() {}, nil), nil)
+	}
+
+	require.NoError(t, c.subscribe(streams[0],
+		entity.NewGroupSubscribeControl("workers", "customer", "orders/#")))
+	err := c.subscribe(streams[1], entity.NewGroupSubscribeControl("workers", "", "orders/#"))
+	require.True(t, errors.Is(err, ErrGroupKeyMismatch), err)
+
+	// The group should be removed once its last member leaves.
+	c.unsubscribe(streams[0], []string{"orders/#"})
+	require.Empty(t, c.groups)
+	require.NoError(t, c.subscribe(streams[1], entity.NewGroupSubscribeControl("workers", "", "orders/#")))
+}
+
+func TestCommsController_removeSubscriber_rebalancesGroup(t *testing.T) {
+	c := NewCommsController(Config{}).(*commsController)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	ctrl := gomock.NewController(t)
+
+	// The first member fails to receive the message.
+	failingStream := connectionmock.NewMockReadWriteStream(ctrl)
+	failingStream.EXPECT().SendMessage(gomock.Any()).Return(assert.AnError).Times(1)
+	failingStream.EXPECT().CloseStream().Return(nil).Times(1)
+	c.subscribers[failingStream] = newNotifier(failingStream, c.removeSubscriber)
+	require.NoError(t, c.subscribe(failingStream,
+		entity.NewGroupSubscribeControl("workers", "", "orders/#")))
+
+	sender := newTestSender(func() { wg.Done() }, nil)
+	stream := connectionmock.NewMockReadWriteStream(ctrl)
+	stream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	stream.EXPECT().CloseStream().Return(nil).Times(1)
+	c.subscribers[stream] = newNotifier(sender, nil)
+	require.NoError(t, c.subscribe(stream,
+		entity.NewGroupSubscribeControl("workers", "", "orders/#")))
+
+	message := entity.NewTextMessage("message")
+	message.Topic = "orders/created"
+	wg.Add(1)
+	c.sendToSubscribers(message)
+	wg.Wait()
+
+	// The message should be redelivered to the remaining member.
+	require.Equal(t, []entity.Message{message}, sender.messages)
+	c.RLock()
+	require.Equal(t, []connection.WriteStream{stream}, c.groups["workers"].members)
+	c.RUnlock()
+}
+
+func TestCommsController_deadLetters(t *testing.T) {
+	c := NewCommsController(Config{DeadLetterTopic: "dead-letters"}).(*commsController)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	ctrl := gomock.NewController(t)
+
+	// The operator subscribes to the dead-letter topic.
+	sender := newTestSender(func() { wg.Done() }, nil)
+	operatorStream := connectionmock.NewMockReadWriteStream(ctrl)
+	operatorStream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	operatorStream.EXPECT().CloseStream().Return(nil).Times(1)
+	c.subscribers[operatorStream] = newNotifier(sender, nil)
+	require.NoError(t, c.subscribe(operatorStream, entity.NewSubscribeControl("dead-letters")))
+
+	// The subscriber fails to receive the first message and never
+	// receives the second one.
+	failingStream := connectionmock.NewMockReadWriteStream(ctrl)
+	failingStream.EXPECT().SendMessage(gomock.Any()).Return(assert.AnError).Times(1)
+	failingStream.EXPECT().CloseStream().Return(nil).Times(1)
+	failing := c.startNotifier(failingStream, "subscriber",
+		DefaultMessageBufferSize, c.overflowPolicy, c.removeSubscriber)
+	failing.pause()
+	c.subscribers[failingStream] = failing
+	require.NoError(t, c.subscribe(failingStream, entity.NewSubscribeControl("orders/#")))
+
+	messages := []entity.Message{
+		entity.NewTextMessage("message 1"),
+		entity.NewTextMessage("message 2"),
+	}
+	for i := range messages {
+		messages[i].Topic = "orders/created"
+		c.sendToSubscribers(messages[i])
+	}
+	wg.Add(2)
+	failing.resume()
+	wg.Wait()
+
+	letters := c.DeadLetters()
+	require.Len(t, letters, 2)
+	for i, reason := range []string{ReasonSendFailed, ReasonSubscriberDisconnected} {
+		assert.Equal(t, messages[i], letters[i].Message)
+		assert.Equal(t, reason, letters[i].Reason)
+		assert.Equal(t, "subscriber 1", letters[i].Target)
+
+		// The dead letters should be published to the dead-letter topic.
+		published := sender.messages[i]
+		assert.Equal(t, "dead-letters", published.Topic)
+		assert.Equal(t, letters[i].ID, published.Headers[entity.HeaderDeadLetterID])
+		assert.Equal(t, reason, published.Headers[entity.HeaderDeadLetterReason])
+		assert.Equal(t, "orders/created", published.Headers[entity.HeaderDeadLetterTopic])
+	}
+	assert.Equal(t, uint64(2), c.Stats().MessagesDeadLettered)
+
+	// The subscriber is gone, so the replayed message is published to
+	// its topic again.
+	require.NoError(t, c.subscribe(operatorStream, entity.NewSubscribeControl("orders/#")))
+	wg.Add(1)
+	require.NoError(t, c.ReplayDeadLetter(letters[0].ID))
+	wg.Wait()
+	assert.Equal(t, messages[0], sender.messages[2])
+	require.True(t, errors.Is(c.ReplayDeadLetter(letters[0].ID), ErrUnknownDeadLetter))
+
+	require.NoError(t, c.RemoveDeadLetter(letters[1].ID))
+	require.True(t, errors.Is(c.RemoveDeadLetter(letters[1].ID), ErrUnknownDeadLetter))
+	assert.Empty(t, c.DeadLetters())
+}
+
+func TestCommsController_ReplayDeadLetter_not_republished(t *testing.T) {
+	messageLog, err := topiclog.Open(topiclog.Config{Dir: t.TempDir()})
+	require.NoError(t, err)
+	defer messageLog.Close()
+
+	c := NewCommsController(Config{MessageLog: messageLog}).(*commsController)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	sender := newTestSender(func() { wg.Done() }, nil)
+	stream := connectionmock.NewMockReadWriteStream(gomock.NewController(t))
+	stream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	stream.EXPECT().CloseStream().Return(nil).Times(1)
+	c.subscribers[stream] = newNotifier(sender, nil)
+	require.NoError(t, c.subscribe(stream, entity.NewSubscribeControl("orders/#")))
+
+	// The first retained message is replaced by the second one, and
+	// dead-lettered for a subscriber that's gone.
+	wg.Add(2)
+	messages := []entity.Message{entity.NewTextMessage("old"), entity.NewTextMessage("new")}
+	for i := range messages {
+		messages[i].Topic = "orders/created"
+		messages[i].Retain = true
+		c.handleMessage(messages[i])
+	}
+	wg.Wait()
+	c.deadLetter(sender.messages[0], ReasonSendFailed, "subscriber 2", nil)
+
+	wg.Add(1)
+	require.NoError(t, c.ReplayDeadLetter(c.DeadLetters()[0].ID))
+	wg.Wait()
+	assert.Equal(t, sender.messages[0], sender.messages[2])
+
+	// The replayed message is neither logged nor retained again.
+	var logged []string
+	require.NoError(t, messageLog.Read("orders/created", topiclog.Position{}, func(message entity.Message) bool {
+		logged = append(logged, message.Text())
+		return true
+	}))
+	assert.Equal(t, []string{"old", "new"}, logged)
+	c.RLock()
+	assert.Equal(t, "new", c.retained["orders/created"].Text())
+	c.RUnlock()
+}
+
+func TestCommsController_acks(t *testing.T) {
+	c := NewCommsController(Config{}).(*commsController)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	ctrl := gomock.NewController(t)
+	sender := newTestSender(func() { wg.Done() }, nil)
+	stream := connectionmock.NewMockReadWriteStream(ctrl)
+	stream.EXPECT().SendControl(goAway).Return(nil).Times(1)
+	stream.EXPECT().CloseStream().Return(nil).Times(1)
+	c.subscribers[stream] = newTestSubscriberNotifier(c, sender)
+	require.NoError(t, c.subscribe(stream, entity.NewSubscribeControl("orders/#")))
+	require.NoError(t, c.enableAcks(stream, entity.NewAckModeControl("", 1)))
+	err := c.enableAcks(stream, entity.NewAckModeControl("", 1))
+	require.True(t, errors.Is(err, ErrAckModeEnabled), err)
+
+	messages := []entity.Message{
+		entity.NewTextMessage("message 1"),
+		entity.NewTextMessage("message 2"),
+	}
+	wg.Add(1)
+	for i := range messages {
+		messages[i].Topic = "orders/created"
+		c.sendToSubscribers(messages[i])
+	}
+	wg.Wait()
+
+	// The second message is sent once the first one is acked.
+	wg.Add(1)
+	c.ack(stream, []string{messages[0].ID})
+	wg.Wait()
+	require.Equal(t, messages, sender.messages)
+
+	// The second message is redelivered once the ack timeout passes.
+	wg.Add(1)
+	c.redeliverUnacked(time.Now().Add(DefaultAckTimeout))
+	wg.Wait()
+	redelivered := messages[1]
+	redelivered.Redelivered = true
+	require.Equal(t, redelivered, sender.messages[2])
+	assert.Equal(t, uint64(1), c.Stats().MessagesRedelivered)
+
+	// It's dead-lettered once it was delivered too many times.
+	for i := 2; i < DefaultMaxDeliveries; i++ {
+		wg.Add(1)
+		c.redeliverUnacked(time.Now().Add(DefaultAckTimeout))
+		wg.Wait()
+	}
+	c.redeliverUnacked(time.Now().Add(DefaultAckTimeout))
+	letters := c.DeadLetters()
+	require.Len(t, letters, 1)
+	assert.Equal(t, ReasonNotAcknowledged, letters[0].Reason)
+	assert.Len(t, sender.messages, DefaultMaxDeliveries+1)
+}
+
+func TestCommsController_acks_reconnect(t *testing.T) {
+	tests := map[string]struct {
+		reconnect bool
+	}{
+		"reconnect": {
+			reconnect: true,
+		},
+		"no_reconnect": {},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewCommsController(Config{}).(*commsController)
+			defer c.Close()
+
+			var wg sync.WaitGroup
+			ctrl := gomock.NewController(t)
+			sender := newTestSender(func() { wg.Done() }, nil)
+			stream := connectionmock.NewMockReadWriteStream(ctrl)
+			stream.EXPECT().CloseStream().Return(nil).Times(1)
+			c.subscribers[stream] = newTestSubscriberNotifier(c, sender)
+			require.NoError(t, c.subscribe(stream, entity.NewSubscribeControl("orders/#")))
+			require.NoError(t, c.enableAcks(stream, entity.NewAckModeControl("consumer", 1)))
+
+			// The first message is sent and not acked, the second one
+			// is held back by the prefetch.
+			messages := []entity.Message{
+				entity.NewTextMessage("message 1"),
+				entity.NewTextMessage("message 2"),
+			}
+			wg.Add(1)
+			for i := range messages {
+				messages[i].Topic = "orders/created"
+				c.sendToSubscribers(messages[i])
+			}
+			wg.Wait()
+			c.removeSubscriber(stream)
+			assert.Empty(t, c.DeadLetters())
+
+			if !tc.reconnect {
+				c.redeliverUnacked(time.Now().Add(DefaultAckTimeout))
+				letters := c.DeadLetters()
+				require.Len(t, letters, 2)
+				for i, letter := range letters {
+					assert.Equal(t, messages[i].ID, letter.Message.ID)
+					assert.Equal(t, ReasonSubscriberDisconnected, letter.Reason)
+				}
+				return
+			}
+
+			// Only the message sent before is marked as redelivered.
+			reconnectedSender := newTestSender(func() { wg.Done() }, nil)
+			reconnected := connectionmock.NewMockReadWriteStream(ctrl)
+			reconnected.EXPECT().SendControl(goAway).Return(nil).Times(1)
+			reconnected.EXPECT().CloseStream().Return(nil).Times(1)
+			c.subscribers[reconnected] = newNotifier(reconnectedSender, nil)
+			wg.Add(2)
+			require.NoError(t, c.enableAcks(reconnected, entity.NewAckModeControl("consumer", 2)))
+			wg.Wait()
+
+			redelivered := messages[0]
+			redelivered.Redelivered = true
+			assert.Equal(t, []entity.Message{redelivered, messages[1]}, reconnectedSender.messages)
+			assert.Empty(t, c.unacked)
+		})
+	}
+}
+
+func TestCommsController_sessions(t *testing.T) {
+	tests := map[string]struct {
+		resume bool
+	}{
+		"resume": {
+			resume: true,
+		},
+		"expire": {},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := NewCommsController(Config{SessionMaxMessages: 3}).(*commsController)
+			defer c.Close()
+
+			ctrl := gomock.NewController(t)
+			stream := connectionmock.NewMockReadWriteStream(ctrl)
+			stream.EXPECT().CloseStream().Return(nil).Times(1)
+			c.subscribers[stream] = newTestSubscriberNotifier(c, newTestSender(nil, nil))
+			require.NoError(t, c.resumeSession(stream, entity.NewSessionControl("session")))
+			require.ErrorIs(t, c.resumeSession(stream, entity.NewSessionControl("other")), ErrSessionSet)
+			require.NoError(t, c.subscribe(stream, entity.NewSubscribeControl("orders/#")))
+			require.NoError(t, c.subscribe(stream, entity.NewFilteredSubscribeControl(`region == "eu"`, "news")))
+			require.NoError(t, c.subscribe(stream, entity.NewGroupSubscribeControl("workers", "", "jobs")))
+
+			newMessage := func(topic, text string) entity.Message {
+				message := entity.NewTextMessage(text)
+				message.Topic = topic
+				return message
+			}
+			// The message held back by the pause is kept too.
+			require.NoError(t, c.pause(stream))
+			messages := []entity.Message{newMessage("orders/created", "held back")}
+			c.sendToSubscribers(messages[0])
+			c.removeSubscriber(stream)
+
+			eu := newMessage("news", "eu")
+			eu.Headers = map[string]string{"region": "eu"}
+			messages = append(messages, newMessage("orders/deleted", "offline"), eu)
+			for _, message := range messages[1:] {
+				c.sendToSubscribers(message)
+			}
+			// Messages not matching the ungrouped subscriptions are
+			// not kept, messages exceeding the limit are dead-lettered.
+			c.sendToSubscribers(newMessage("news", "us"))
+			c.sendToSubscribers(newMessage("jobs", "job"))
+			overflow := newMessage("orders/created", "overflow")
+			c.sendToSubscribers(overflow)
+			letters := c.DeadLetters()
+			require.Len(t, letters, 1)
+			assert.Equal(t, overflow.ID, letters[0].Message.ID)
+			assert.Equal(t, ReasonQueueFull, letters[0].Reason)
+			assert.Equal(t, `session "session"`, letters[0].Target)
+
+			if !tc.resume {
+				c.expireSessions(time.Now().Add(DefaultSessionExpiry))
+				letters := c.DeadLetters()[1:]
+				require.Len(t, letters, len(messages))
+				for i, letter := range letters {
+					assert.Equal(t, messages[i].ID, letter.Message.ID)
+					assert.Equal(t, ReasonSessionExpired, letter.Reason)
+				}
+				assert.Empty(t, c.sessions)
+				return
+			}
+
+			// The queued messages are sent in order once the session
+			// resumes, and the subscriptions are restored.
+			var wg sync.WaitGroup
+			sender := newTestSender(func() { wg.Done() }, nil)
+			reconnected := connectionmock.NewMockReadWriteStream(ctrl)
+			reconnected.EXPECT().SendControl(goAway).Return(nil).Times(1)
+			reconnected.EXPECT().CloseStream().Return(nil).Times(1)
+			c.subscribers[reconnected] = newNotifier(sender, nil)
+			wg.Add(len(messages))
+			require.NoError(t, c.resumeSession(reconnected, entity.NewSessionControl("session")))
+			wg.Wait()
+			assert.Equal(t, messages, sender.messages)
+			assert.Equal(t, map[string]string{"orders/#": "", "news": ""}, c.subscriptions[reconnected])
+			assert.Empty(t, c.sessions)
+
+			other := connectionmock.NewMockReadWriteStream(ctrl)
+			c.subscribers[other] = newNotifier(newTestSender(nil, nil), nil)
+			defer delete(c.subscribers, other)
+			err := c.resumeSession(other, entity.NewSessionControl("session"))
+			assert.ErrorIs(t, err, ErrSessionInUse)
+		})
+	}
+}
+
+// newTestSubscriberNotifier creates a notifier sending to the test
+// sender, which counts and dead-letters messages like startNotifier.
+func newTestSubscriberNotifier(c *commsController, sender *testSender) *notifier {
+	notifier := newPendingNotifier(DefaultMessageBufferSize, nil)
+	notifier.stats = &c.stats
+	notifier.deadLetterCallback = func(message entity.Message, reason string) {
+		c.deadLetter(message, reason, "subscriber", nil)
+	}
+	notifier.start(sender)
+	return notifier
 }
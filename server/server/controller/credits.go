@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"sync"
+
+	"assignment/lib/connection"
+	"assignment/lib/entity"
+)
+
+// DefaultPublisherCredits is the default number of messages each
+// publisher can have queued in the controller before it has to wait
+// for more credits.
+const DefaultPublisherCredits = DefaultMessageBufferSize
+
+// queuedMessage is a message queued in the controller, with the
+// credits of its publisher if they're released once it's handled.
+type queuedMessage struct {
+	message entity.Message
+	credits *publisherCredits
+}
+
+func (m queuedMessage) priority() entity.Priority {
+	return m.message.Priority
+}
+
+// publisherCredits tracks the credits of a publisher. The publisher
+// is granted a credit limit, the total number of messages it may have
+// published, which is raised as its messages are handled.
+type publisherCredits struct {
+	publisher connection.ReadWriteStream
+	// credits is the number of messages the publisher can have
+	// queued, batch the number of handled messages raising the limit
+	// at once, so that credits aren't granted one by one.
+	credits uint64
+	batch   uint64
+
+	mutex sync.Mutex
+	// received counts the messages received, released those handled
+	// or rejected, granted is the last limit granted.
+	received uint64
+	released uint64
+	granted  uint64
+}
+
+func newPublisherCredits(publisher connection.ReadWriteStream, credits int) *publisherCredits {
+	if credits <= 0 {
+		credits = DefaultPublisherCredits
+	}
+	batch := credits / 4
+	if batch == 0 {
+		batch = 1
+	}
+	return &publisherCredits{
+		publisher: publisher,
+		credits:   uint64(credits),
+		batch:     uint64(batch),
+		granted:   uint64(credits),
+	}
+}
+
+// initial returns the control granting the initial credits.
+func (p *publisherCredits) initial() entity.Control {
+	return entity.NewCreditControl(p.credits)
+}
+
+// take takes the credit of a received message, it returns false if
+// the publisher exceeded its credit limit.
+func (p *publisherCredits) take() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.received >= p.granted {
+		return false
+	}
+	p.received++
+	return true
+}
+
+// release releases the credit of a handled message. It returns the
+// new credit limit to grant and true once a batch of credits was
+// released.
+func (p *publisherCredits) release() (uint64, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.released++
+	limit := p.released + p.credits
+	if limit-p.granted < p.batch {
+		return 0, false
+	}
+	p.granted = limit
+	return limit, true
+}
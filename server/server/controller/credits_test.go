@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublisherCredits(t *testing.T) {
+	p := newPublisherCredits(nil, 8)
+	assert.Equal(t, uint64(8), p.initial().CreditLimit)
+
+	for i := 0; i < 8; i++ {
+		assert.True(t, p.take())
+	}
+	assert.False(t, p.take())
+
+	// Credits are granted in batches of a quarter of the credits.
+	var limits []uint64
+	for i := 0; i < 5; i++ {
+		if limit, ok := p.release(); ok {
+			limits = append(limits, limit)
+		}
+	}
+	assert.Equal(t, []uint64{10, 12}, limits)
+	assert.True(t, p.take())
+}
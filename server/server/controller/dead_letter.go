@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"assignment/lib/connection"
+	"assignment/lib/entity"
+)
+
+// DefaultDeadLetterCapacity is the default number of dead letters
+// kept, the oldest ones are discarded first.
+const DefaultDeadLetterCapacity = 1000
+
+// Reasons messages are dead-lettered for.
+const (
+	ReasonBrokerQueueFull        = "broker queue full"
+	ReasonQueueFull              = "queue full"
+	ReasonSendFailed             = "send failed"
+	ReasonSubscriberDisconnected = "subscriber disconnected"
+	ReasonPublisherDisconnected  = "publisher disconnected"
+	ReasonNoGroupMember          = "no group member"
+	ReasonNoReplyRoute           = "no reply route"
+	ReasonNotAcknowledged        = "not acknowledged"
+	ReasonSessionExpired         = "session expired"
+)
+
+// TargetBroker is the target of the messages dead-lettered before
+// they were routed to any client.
+const TargetBroker = "broker"
+
+// DeadLetter is a message that couldn't be delivered.
+type DeadLetter struct {
+	// ID identifies the dead letter, the same message can be
+	// dead-lettered for several targets.
+	ID string `json:"id"`
+	// Message is the message, decompressed if it was compressed.
+	Message entity.Message `json:"message"`
+	// Reason is the reason the message couldn't be delivered.
+	Reason string `json:"reason"`
+	// Target is the client the message couldn't be delivered to.
+	Target string `json:"target"`
+	// Time is the time the message was dead-lettered.
+	Time time.Time `json:"time"`
+
+	// stream is the stream of the target client, nil for the broker.
+	stream connection.WriteStream
+}
+
+// topicMessage returns the dead letter as a message to the dead-letter
+// topic, with the reason, target and original topic in its headers.
+func (l DeadLetter) topicMessage(topic string) entity.Message {
+	headers := make(map[string]string, len(l.Message.Headers)+4)
+	for key, value := range l.Message.Headers {
+		headers[key] = value
+	}
+	headers[entity.HeaderDeadLetterID] = l.ID
+	headers[entity.HeaderDeadLetterReason] = l.Reason
+	headers[entity.HeaderDeadLetterTarget] = l.Target
+	headers[entity.HeaderDeadLetterTopic] = l.Message.Topic
+
+	message := l.Message
+	message.ID = entity.NewID()
+	message.Topic = topic
+	message.Headers = headers
+	message.Retain = false
+	message.Redelivered = false
+	message.ExpiresAt = time.Time{}
+	return message
+}
+
+// deadLetterStore keeps the latest dead letters.
+type deadLetterStore struct {
+	mutex    sync.Mutex
+	letters  []DeadLetter
+	capacity int
+}
+
+func newDeadLetterStore(capacity int) *deadLetterStore {
+	if capacity <= 0 {
+		capacity = DefaultDeadLetterCapacity
+	}
+	return &deadLetterStore{capacity: capacity}
+}
+
+// add adds the dead letter, discarding the oldest one if the store is
+// full.
+func (s *deadLetterStore) add(letter DeadLetter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.letters) >= s.capacity {
+		s.letters[0] = DeadLetter{}
+		s.letters = s.letters[1:]
+	}
+	s.letters = append(s.letters, letter)
+}
+
+// list returns the dead letters, oldest first.
+func (s *deadLetterStore) list() []DeadLetter {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]DeadLetter(nil), s.letters...)
+}
+
+// remove removes and returns the dead letter, it returns false if
+// there's no dead letter with the ID.
+func (s *deadLetterStore) remove(id string) (DeadLetter, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, letter := range s.letters {
+		if letter.ID == id {
+			s.letters = append(s.letters[:i:i], s.letters[i+1:]...)
+			return letter, true
+		}
+	}
+	return DeadLetter{}, false
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"testing"
+
+	"assignment/lib/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterStore(t *testing.T) {
+	store := newDeadLetterStore(2)
+	letters := []DeadLetter{
+		{ID: "1", Reason: ReasonQueueFull},
+		{ID: "2", Reason: ReasonSendFailed},
+		{ID: "3", Reason: ReasonNoGroupMember},
+	}
+	for _, letter := range letters {
+		store.add(letter)
+	}
+
+	// The oldest dead letter should be discarded.
+	require.Equal(t, letters[1:], store.list())
+
+	letter, ok := store.remove("2")
+	require.True(t, ok)
+	assert.Equal(t, letters[1], letter)
+	_, ok = store.remove("1")
+	assert.False(t, ok)
+	assert.Equal(t, letters[2:], store.list())
+}
+
+func TestDeadLetter_topicMessage(t *testing.T) {
+	message := entity.NewTextMessage("message")
+	message.Topic = "orders/created"
+	message.Headers = map[string]string{"region": "eu"}
+	message.Retain = true
+	letter := DeadLetter{
+		ID:      "letter",
+		Message: message,
+		Reason:  ReasonSendFailed,
+		Target:  "subscriber 1",
+	}
+
+	got := letter.topicMessage("dead-letters")
+	assert.Equal(t, "dead-letters", got.Topic)
+	assert.NotEqual(t, message.ID, got.ID)
+	assert.False(t, got.Retain)
+	assert.Equal(t, message.Payload, got.Payload)
+	assert.Equal(t, map[string]string{
+		"region":                      "eu",
+		entity.HeaderDeadLetterID:     "letter",
+		entity.HeaderDeadLetterReason: ReasonSendFailed,
+		entity.HeaderDeadLetterTarget: "subscriber 1",
+		entity.HeaderDeadLetterTopic:  "orders/created",
+	}, got.Headers)
+	// The original message should be left untouched.
+	assert.Equal(t, map[string]string{"region": "eu"}, message.Headers)
+}
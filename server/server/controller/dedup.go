@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"container/list"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"assignment/lib/entity"
+	"assignment/server/server/topiclog"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultDedupWindow is the default number of the latest messages
+	// of each producer that duplicates are detected against.
+	DefaultDedupWindow = 1000
+	// DefaultDedupProducers is the default number of producers with a
+	// deduplication window, the least recently active producers are
+	// forgotten first.
+	DefaultDedupProducers = 10000
+)
+
+// dedupKey returns the key the message is deduplicated by: its
+// sequence number if it's set, its ID otherwise.
+func dedupKey(message entity.Message) string {
+	if message.Sequence != 0 {
+		return "seq:" + strconv.FormatUint(message.Sequence, 10)
+	}
+	return "id:" + message.ID
+}
+
+// dedupWindow holds the keys of the latest messages of a producer.
+type dedupWindow struct {
+	producerID string
+	// keys are the keys in the order they were added, seen indexes
+	// them.
+	keys []string
+	seen map[string]struct{}
+	// element is the element of the producer in the deduplicator
+	// recency list.
+	element *list.Element
+}
+
+func (w *dedupWindow) add(key string, size int) {
+	if len(w.keys) >= size {
+		delete(w.seen, w.keys[0])
+		w.keys[0] = ""
+		w.keys = w.keys[1:]
+	}
+	w.keys = append(w.keys, key)
+	w.seen[key] = struct{}{}
+}
+
+func (w *dedupWindow) remove(key string) {
+	if _, ok := w.seen[key]; !ok {
+		return
+	}
+	delete(w.seen, key)
+	for i := len(w.keys) - 1; i >= 0; i-- {
+		if w.keys[i] == key {
+			w.keys = append(w.keys[:i], w.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// deduplicator detects the messages published more than once by the
+// same producer, within a window of the latest messages per producer.
+type deduplicator struct {
+	mutex      sync.Mutex
+	windowSize int
+	// maxProducers bounds the number of windows, recent lists the
+	// producers most recently active first.
+	maxProducers int
+	producers    map[string]*dedupWindow
+	recent       *list.List
+}
+
+func newDeduplicator(windowSize, maxProducers int) *deduplicator {
+	if windowSize <= 0 {
+		windowSize = DefaultDedupWindow
+	}
+	if maxProducers <= 0 {
+		maxProducers = DefaultDedupProducers
+	}
+	return &deduplicator{
+		windowSize:   windowSize,
+		maxProducers: maxProducers,
+		producers:    make(map[string]*dedupWindow),
+		recent:       list.New(),
+	}
+}
+
+// add records the message, it returns false if the message is a
+// duplicate of a recorded one. Messages without a producer ID are
+// never duplicates.
+func (d *deduplicator) add(message entity.Message) bool {
+	if message.ProducerID == "" {
+		return true
+	}
+	key := dedupKey(message)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	window := d.window(message.ProducerID)
+	if _, ok := window.seen[key]; ok {
+		return false
+	}
+	window.add(key, d.windowSize)
+	return true
+}
+
+// remove forgets the message, so that it's accepted when it's
+// published again.
+func (d *deduplicator) remove(message entity.Message) {
+	if message.ProducerID == "" {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if window, ok := d.producers[message.ProducerID]; ok {
+		window.remove(dedupKey(message))
+	}
+}
+
+// window returns the window of the producer and marks the producer as
+// the most recently active one, it must be called with the mutex held.
+func (d *deduplicator) window(producerID string) *dedupWindow {
+	if window, ok := d.producers[producerID]; ok {
+		d.recent.MoveToFront(window.element)
+		return window
+	}
+
+	if len(d.producers) >= d.maxProducers {
+		oldest := d.recent.Remove(d.recent.Back()).(*dedupWindow)
+		delete(d.producers, oldest.producerID)
+	}
+	window := &dedupWindow{producerID: producerID, seen: make(map[string]struct{})}
+	window.element = d.recent.PushFront(window)
+	d.producers[producerID] = window
+	return window
+}
+
+// loggedKey is the key of a logged message of a producer.
+type loggedKey struct {
+	key       string
+	timestamp time.Time
+}
+
+// restore records the latest messages of each producer in the log,
+// so that duplicates of the messages accepted before a restart are
+// detected.
+func (d *deduplicator) restore(messageLog topiclog.Log) error {
+	keys := make(map[string][]loggedKey)
+	for _, topic := range messageLog.Topics() {
+		// The latest keys of each producer in the topic, later merged
+		// with the keys in the other topics.
+		topicKeys := make(map[string][]loggedKey)
+		err := messageLog.Read(topic, topiclog.Position{}, func(message entity.Message) bool {
+			if message.ProducerID == "" {
+				return true
+			}
+			producerKeys := topicKeys[message.ProducerID]
+			if len(producerKeys) >= d.windowSize {
+				producerKeys = producerKeys[1:]
+			}
+			topicKeys[message.ProducerID] = append(producerKeys,
+				loggedKey{key: dedupKey(message), timestamp: message.Timestamp})
+			return true
+		})
+		if err != nil {
+			return errors.Wrapf(err, "read log of topic %q", topic)
+		}
+		for producerID, producerKeys := range topicKeys {
+			keys[producerID] = append(keys[producerID], producerKeys...)
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for producerID, producerKeys := range keys {
+		sort.SliceStable(producerKeys, func(i, j int) bool {
+			return producerKeys[i].timestamp.Before(producerKeys[j].timestamp)
+		})
+		if len(producerKeys) > d.windowSize {
+			producerKeys = producerKeys[len(producerKeys)-d.windowSize:]
+		}
+		window := d.window(producerID)
+		for _, key := range producerKeys {
+			if _, ok := window.seen[key.key]; !ok {
+				window.add(key.key, d.windowSize)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"testing"
+
+	"assignment/lib/entity"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicator(t *testing.T) {
+	message := func(producerID string, sequence uint64, id string) entity.Message {
+		return entity.Message{ID: id, ProducerID: producerID, Sequence: sequence}
+	}
+
+	tests := map[string]struct {
+		messages []entity.Message
+		want     []bool
+	}{
+		"no_producer": {
+			messages: []entity.Message{message("", 0, "1"), message("", 0, "1")},
+			want:     []bool{true, true},
+		},
+		"sequence": {
+			messages: []entity.Message{message("a", 1, "1"), message("a", 1, "2"), message("a", 2, "3")},
+			want:     []bool{true, false, true},
+		},
+		"id": {
+			messages: []entity.Message{message("a", 0, "1"), message("a", 0, "1"), message("a", 0, "2")},
+			want:     []bool{true, false, true},
+		},
+		"per_producer": {
+			messages: []entity.Message{message("a", 1, "1"), message("b", 1, "1")},
+			want:     []bool{true, true},
+		},
+		"window_size": {
+			// The window holds the latest two messages of a producer.
+			messages: []entity.Message{message("a", 1, "1"), message("a", 2, "2"), message("a", 3, "3"), message("a", 1, "4")},
+			want:     []bool{true, true, true, true},
+		},
+		"max_producers": {
+			// The least recently active producer is forgotten.
+			messages: []entity.Message{message("a", 1, "1"), message("b", 1, "1"), message("c", 1, "1"), message("a", 1, "1")},
+			want:     []bool{true, true, true, true},
+		},
+		"recently_active_producer": {
+			messages: []entity.Message{message("a", 1, "1"), message("b", 1, "1"), message("a", 2, "2"), message("c", 1, "1"), message("a", 1, "1")},
+			want:     []bool{true, true, true, true, false},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := newDeduplicator(2, 2)
+			var added []bool
+			for _, message := range tc.messages {
+				added = append(added, d.add(message))
+			}
+			assert.Equal(t, tc.want, added)
+		})
+	}
+}
+
+func TestDeduplicator_remove(t *testing.T) {
+	d := newDeduplicator(2, 2)
+	message := entity.Message{ID: "1", ProducerID: "a", Sequence: 1}
+	assert.True(t, d.add(message))
+	d.remove(message)
+	assert.True(t, d.add(message))
+	assert.False(t, d.add(message))
+}
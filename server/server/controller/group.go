@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	"assignment/lib/connection"
+	"assignment/lib/entity"
+)
+
+// subscriberGroup is a named group of competing subscribers. Each
+// message to the group is sent to one of its members only, picked
+// round-robin, or by the hash of a message header for sticky groups.
+type subscriberGroup struct {
+	// key is the header picking the member of sticky groups, empty
+	// for round-robin groups.
+	key string
+	// members are the subscribers in the order they joined.
+	members []connection.WriteStream
+	// next is the round-robin counter.
+	next atomic.Uint64
+}
+
+func newSubscriberGroup(key string) *subscriberGroup {
+	return &subscriberGroup{key: key}
+}
+
+// join adds the subscriber to the group if it's not a member yet.
+func (g *subscriberGroup) join(subscriber connection.WriteStream) {
+	for _, member := range g.members {
+		if member == subscriber {
+			return
+		}
+	}
+	g.members = append(g.members, subscriber)
+}
+
+// leave removes the subscriber from the group and returns true if the
+// group is left empty.
+func (g *subscriberGroup) leave(subscriber connection.WriteStream) bool {
+	for i, member := range g.members {
+		if member == subscriber {
+			g.members = append(g.members[:i:i], g.members[i+1:]...)
+			break
+		}
+	}
+	return len(g.members) == 0
+}
+
+// pick returns the member receiving the message among the candidates,
+// the members subscribed to the message, or nil if there is none.
+// Messages with the same key header value go to the same member as
+// long as the candidates don't change. Messages without the header go
+// to the member picked for an empty value.
+func (g *subscriberGroup) pick(
+	message entity.Message,
+	candidates map[connection.WriteStream]struct{},
+) connection.WriteStream {
+	eligible := make([]connection.WriteStream, 0, len(candidates))
+	for _, member := range g.members {
+		if _, ok := candidates[member]; ok {
+			eligible = append(eligible, member)
+		}
+	}
+	if len(eligible) == 0 {
+		return nil
+	}
+
+	if g.key != "" {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(message.Headers[g.key]))
+		return eligible[hash.Sum32()%uint32(len(eligible))]
+	}
+	return eligible[(g.next.Add(1)-1)%uint64(len(eligible))]
+}
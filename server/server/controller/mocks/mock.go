@@ -6,6 +6,7 @@ package mocks
 
 import (
 	connection "assignment/lib/connection"
+	controller "assignment/server/server/controller"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
@@ -72,16 +73,124 @@ func (mr *MockCommsControllerMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockCommsController)(nil).Close))
 }
 
+// DeadLetters mocks base method.
+func (m *MockCommsController) DeadLetters() []controller.DeadLetter {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeadLetters")
+	ret0, _ := ret[0].([]controller.DeadLetter)
+	return ret0
+}
+
+// DeadLetters indicates an expected call of DeadLetters.
+func (mr *MockCommsControllerMockRecorder) DeadLetters() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeadLetters", reflect.TypeOf((*MockCommsController)(nil).DeadLetters))
+}
+
 // MessageReceiver mocks base method.
-func (m *MockCommsController) MessageReceiver() connection.MessageReceiver {
+func (m *MockCommsController) MessageReceiver(arg0 connection.ReadWriteStream) connection.MessageReceiver {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "MessageReceiver")
+	ret := m.ctrl.Call(m, "MessageReceiver", arg0)
 	ret0, _ := ret[0].(connection.MessageReceiver)
 	return ret0
 }
 
 // MessageReceiver indicates an expected call of MessageReceiver.
-func (mr *MockCommsControllerMockRecorder) MessageReceiver() *gomock.Call {
+func (mr *MockCommsControllerMockRecorder) MessageReceiver(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MessageReceiver", reflect.TypeOf((*MockCommsController)(nil).MessageReceiver), arg0)
+}
+
+// RemoveDeadLetter mocks base method.
+func (m *MockCommsController) RemoveDeadLetter(arg0 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveDeadLetter", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveDeadLetter indicates an expected call of RemoveDeadLetter.
+func (mr *MockCommsControllerMockRecorder) RemoveDeadLetter(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveDeadLetter", reflect.TypeOf((*MockCommsController)(nil).RemoveDeadLetter), arg0)
+}
+
+// RemoveSubscriber mocks base method.
+func (m *MockCommsController) RemoveSubscriber(arg0 connection.WriteStream) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "RemoveSubscriber", arg0)
+}
+
+// RemoveSubscriber indicates an expected call of RemoveSubscriber.
+func (mr *MockCommsControllerMockRecorder) RemoveSubscriber(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveSubscriber", reflect.TypeOf((*MockCommsController)(nil).RemoveSubscriber), arg0)
+}
+
+// ReplayDeadLetter mocks base method.
+func (m *MockCommsController) ReplayDeadLetter(arg0 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReplayDeadLetter", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReplayDeadLetter indicates an expected call of ReplayDeadLetter.
+func (mr *MockCommsControllerMockRecorder) ReplayDeadLetter(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReplayDeadLetter", reflect.TypeOf((*MockCommsController)(nil).ReplayDeadLetter), arg0)
+}
+
+// ReplyReceiver mocks base method.
+func (m *MockCommsController) ReplyReceiver() connection.MessageReceiver {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReplyReceiver")
+	ret0, _ := ret[0].(connection.MessageReceiver)
+	return ret0
+}
+
+// ReplyReceiver indicates an expected call of ReplyReceiver.
+func (mr *MockCommsControllerMockRecorder) ReplyReceiver() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReplyReceiver", reflect.TypeOf((*MockCommsController)(nil).ReplyReceiver))
+}
+
+// SetSubscriberControlStream mocks base method.
+func (m *MockCommsController) SetSubscriberControlStream(arg0, arg1 connection.WriteStream) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetSubscriberControlStream", arg0, arg1)
+}
+
+// SetSubscriberControlStream indicates an expected call of SetSubscriberControlStream.
+func (mr *MockCommsControllerMockRecorder) SetSubscriberControlStream(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSubscriberControlStream", reflect.TypeOf((*MockCommsController)(nil).SetSubscriberControlStream), arg0, arg1)
+}
+
+// Stats mocks base method.
+func (m *MockCommsController) Stats() controller.Stats {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Stats")
+	ret0, _ := ret[0].(controller.Stats)
+	return ret0
+}
+
+// Stats indicates an expected call of Stats.
+func (mr *MockCommsControllerMockRecorder) Stats() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stats", reflect.TypeOf((*MockCommsController)(nil).Stats))
+}
+
+// SubscriberControlReceiver mocks base method.
+func (m *MockCommsController) SubscriberControlReceiver(arg0 connection.WriteStream) connection.ControlReceiver {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SubscriberControlReceiver", arg0)
+	ret0, _ := ret[0].(connection.ControlReceiver)
+	return ret0
+}
+
+// SubscriberControlReceiver indicates an expected call of SubscriberControlReceiver.
+func (mr *MockCommsControllerMockRecorder) SubscriberControlReceiver(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MessageReceiver", reflect.TypeOf((*MockCommsController)(nil).MessageReceiver))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SubscriberControlReceiver", reflect.TypeOf((*MockCommsController)(nil).SubscriberControlReceiver), arg0)
 }
@@ -1,6 +1,10 @@
 package controller
 
 import (
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"assignment/lib/entity"
 	"assignment/lib/log"
 )
@@ -9,57 +13,438 @@ import (
 // stream) with a separate message queue that handles communication
 // to that stream independently.
 type notifier struct {
-	messages         chan entity.Message
-	close            chan struct{}
+	notifications *priorityQueue[notification]
+	close         chan struct{}
+	closeOnce     sync.Once
+	// running is done once the notifier stopped sending.
+	running          sync.WaitGroup
 	sender           sender
 	connLostCallback connLostCallback
+	// paused holds back the queued notifications until resumed is
+	// signalled.
+	paused  atomic.Bool
+	resumed chan struct{}
+	// unsent is the notification that failed to be sent, or was held
+	// back when the notifier stopped.
+	unsent      *notification
+	unsentMutex sync.Mutex
+	// stats counts the expired and redelivered messages, nil if
+	// they're not counted.
+	stats *stats
+	// deadLetterCallback captures the messages the notifier fails to
+	// deliver, nil if they're only logged.
+	deadLetterCallback deadLetterCallback
+	// acks tracks the messages sent until they're acknowledged, nil
+	// unless the subscriber is in ack mode.
+	acks atomic.Pointer[ackTracker]
+	// overflowPolicy returns the policy for the notifications queued
+	// while the queue is full by the topics of their messages, nil if
+	// they're dropped. blockTimeout bounds the wait of OverflowBlock.
+	overflowPolicy func(topic string) OverflowPolicy
+	blockTimeout   time.Duration
+	disconnectOnce sync.Once
+	// sequences number the messages of the publishers as they're
+	// sent, nil if they're not numbered.
+	sequences *streamSequences
 }
 
 type sender interface {
 	SendMessage(entity.Message) error
+	SendControl(entity.Control) error
+}
+
+// notification is either a message or a control queued for sending,
+// so that both are sent in the order they were queued.
+type notification struct {
+	message *entity.Message
+	control *entity.Control
+	// group is the subscriber group the message was sent to, so
+	// that it can be sent to another member if this one fails.
+	group string
+	// failed is set if sending the notification failed.
+	failed bool
+	// deliveries counts the times the message was sent to
+	// subscribers in ack mode.
+	deliveries int
+}
+
+func (n notification) send(sender sender) error {
+	if n.control != nil {
+		return sender.SendControl(*n.control)
+	}
+	return sender.SendMessage(*n.message)
+}
+
+// priority returns the priority of the notification. Controls are
+// queued with the normal priority, so that they keep their order
+// relative to the normal messages.
+func (n notification) priority() entity.Priority {
+	if n.message != nil {
+		return n.message.Priority
+	}
+	return entity.PriorityNormal
+}
+
+// isMessage returns true if the notification is a message. Controls
+// are never dropped for messages.
+func isMessage(n notification) bool {
+	return n.message != nil
+}
+
+// redelivery returns the notification to queue again for a message
+// that was not acknowledged, marked as redelivered if it was sent.
+func (n notification) redelivery() notification {
+	if n.message != nil && n.deliveries > 0 {
+		message := *n.message
+		message.Redelivered = true
+		n.message = &message
+	}
+	return n
+}
+
+func (n notification) String() string {
+	if n.control != nil {
+		return n.control.String()
+	}
+	return "message " + n.message.ID
 }
 
 type connLostCallback func(sender sender)
 
+// deadLetterCallback is called with the messages that can't be
+// delivered and the reason.
+type deadLetterCallback func(message entity.Message, reason string)
+
 // newNotifier creates a new notifier with the given sender.
 func newNotifier(sender sender, connLostCallback connLostCallback) *notifier {
-	n := &notifier{
-		messages:         make(chan entity.Message, DefaultMessageBufferSize),
+	n := newPendingNotifier(DefaultMessageBufferSize, connLostCallback)
+	n.start(sender)
+	return n
+}
+
+// newPendingNotifier creates a new notifier that queues up to capacity
+// notifications until it's started with a sender.
+func newPendingNotifier(capacity int, connLostCallback connLostCallback) *notifier {
+	return &notifier{
+		notifications:    newPriorityQueue[notification](capacity),
 		close:            make(chan struct{}),
-		sender:           sender,
 		connLostCallback: connLostCallback,
+		resumed:          make(chan struct{}, 1),
 	}
+}
 
+// start starts sending the queued notifications with the sender, it
+// must be called once.
+func (n *notifier) start(sender sender) {
+	n.sender = sender
+	n.running.Add(1)
 	go n.run()
-	return n
 }
 
 func (n *notifier) queueMessage(message entity.Message) {
-	select {
-	case n.messages <- message:
+	n.queue(notification{message: &message})
+}
+
+// dispatchMessage queues the message dispatched by the controller run
+// loop, the only messages OverflowBlock waits for.
+func (n *notifier) dispatchMessage(message entity.Message) {
+	n.push(notification{message: &message}, true)
+}
+
+// dispatchGroupMessage is like dispatchMessage, for the message sent
+// to the subscriber group.
+func (n *notifier) dispatchGroupMessage(message entity.Message, group string) {
+	n.push(notification{message: &message, group: group}, true)
+}
+
+// queueControl queues the control, beyond the capacity of the queue
+// if it's full: controls such as confirms and credit grants are never
+// dropped.
+func (n *notifier) queueControl(control entity.Control) {
+	n.queueBacklog([]notification{{control: &control}})
+}
+
+// queue queues the notification without ever blocking, so that it's
+// safe to call with the controller lock held.
+func (n *notifier) queue(notification notification) {
+	n.push(notification, false)
+}
+
+func (n *notifier) push(notification notification, dispatched bool) {
+	if !n.notifications.push(notification, notification.priority()) {
+		n.overflow(notification, dispatched)
+	}
+}
+
+// overflow applies the overflow policy to the notification queued
+// while the queue is full. Notifications that can't be queued are
+// dropped.
+func (n *notifier) overflow(queued notification, dispatched bool) {
+	policy := OverflowDropNewest
+	if n.overflowPolicy != nil {
+		var topic string
+		if queued.message != nil {
+			topic = queued.message.Topic
+		}
+		policy = n.overflowPolicy(topic)
+	}
+
+	switch policy {
+	case OverflowDropOldest:
+		dropped, ok := n.notifications.pushEvicting(queued, queued.priority(), isMessage)
+		if ok {
+			log.Warnf("Message queue is full, oldest %s dropped for %s", dropped, queued)
+			if n.stats != nil {
+				n.stats.messagesDroppedOldest.Add(1)
+			}
+			n.skipSequence(*dropped.message)
+			n.deadLetter(*dropped.message, ReasonQueueFull)
+			return
+		}
+		// Only controls or messages of higher priorities are queued.
+	case OverflowBlock:
+		if !dispatched {
+			// Callers other than the dispatcher may hold the
+			// controller lock, so the notification is queued beyond
+			// the capacity instead of waiting.
+			n.queueBacklog([]notification{queued})
+			log.Infof("Message queue is full, %s queued beyond its capacity", queued)
+			if n.stats != nil {
+				n.stats.overflowBacklogged.Add(1)
+			}
+			return
+		}
+		if n.queueTimeout(queued, n.blockTimeout) {
+			log.Infof("Message queue was full, %s queued after waiting", queued)
+			if n.stats != nil {
+				n.stats.overflowBlocked.Add(1)
+			}
+			return
+		}
+		log.Warnf("Message queue is still full after %s", n.blockTimeout)
+		if n.stats != nil {
+			n.stats.overflowBlockTimeouts.Add(1)
+		}
+	case OverflowDisconnect:
+		if n.connLostCallback == nil {
+			break
+		}
+		// The notification is drained with the queued ones, so that
+		// it's handled like them.
+		n.queueBacklog([]notification{queued})
+		n.disconnectOnce.Do(func() {
+			log.Warnf("Message queue is full, disconnecting at %s", queued)
+			if n.stats != nil {
+				n.stats.overflowDisconnects.Add(1)
+			}
+			n.stop()
+			go n.connLostCallback(n.sender)
+		})
 		return
-	default:
-		log.Warnf("Message queue is full, message %q dropped", message.Text)
 	}
+
+	log.Warnf("Message queue is full, %s dropped", queued)
+	if n.stats != nil {
+		n.stats.messagesDroppedNewest.Add(1)
+	}
+	if queued.message != nil {
+		n.skipSequence(*queued.message)
+		n.deadLetter(*queued.message, ReasonQueueFull)
+	}
+}
+
+// skipSequence leaves a gap in the sequence numbers for the dropped
+// message, so that the subscriber detects it missed the message.
+func (n *notifier) skipSequence(message entity.Message) {
+	if n.sequences != nil {
+		n.sequences.skip(message)
+	}
+}
+
+// queueBacklog queues the notifications in order even beyond the
+// capacity of the queue, see priorityQueue.pushAll.
+func (n *notifier) queueBacklog(notifications []notification) {
+	n.notifications.pushAll(notifications, notification.priority)
+}
+
+// queueWait queues the notification, waiting while the queue is
+// full. It returns false if the notifier is stopped meanwhile.
+func (n *notifier) queueWait(notification notification) bool {
+	for !n.notifications.push(notification, notification.priority()) {
+		select {
+		case <-n.close:
+			return false
+		case <-n.notifications.waitFreed():
+		}
+	}
+	return true
+}
+
+// queueTimeout queues the notification, waiting up to the timeout
+// while the queue is full. It returns false if the timeout expires or
+// the notifier is stopped meanwhile.
+func (n *notifier) queueTimeout(notification notification, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for !n.notifications.push(notification, notification.priority()) {
+		select {
+		case <-n.close:
+			return false
+		case <-timer.C:
+			return false
+		case <-n.notifications.waitFreed():
+		}
+	}
+	return true
 }
 
+// deadLetter hands the message the notifier failed to deliver to the
+// dead-letter callback.
+func (n *notifier) deadLetter(message entity.Message, reason string) {
+	if n.deadLetterCallback != nil {
+		n.deadLetterCallback(message, reason)
+	}
+}
+
+// run sends the queued notifications, higher priorities first.
 func (n *notifier) run() {
+	defer n.running.Done()
+
 	for {
 		select {
 		case <-n.close:
 			return
-		case message := <-n.messages:
-			if err := n.sender.SendMessage(message); err != nil {
-				log.Errorf("Failed to send message %q: %s", message.Text, err.Error())
-				if n.connLostCallback != nil {
-					go n.connLostCallback(n.sender)
-				}
+		default:
+		}
+
+		notification, ok := n.notifications.pop()
+		if !ok {
+			select {
+			case <-n.close:
 				return
+			case <-n.notifications.wait():
 			}
+			continue
+		}
+
+		// Notifications held back when the notifier is stopped are
+		// kept for drain.
+		if !n.waitResumed() {
+			n.keepUnsent(notification)
+			return
+		}
+		acks := n.acks.Load()
+		if notification.message != nil && acks != nil && !acks.waitCapacity(n.close) {
+			n.keepUnsent(notification)
+			return
+		}
+		if n.expired(notification) {
+			continue
+		}
+		if notification.message != nil && n.sequences != nil {
+			message := n.sequences.stamp(*notification.message)
+			notification.message = &message
+		}
+		if err := notification.send(n.sender); err != nil {
+			log.Errorf("Failed to send %s: %s", notification, err.Error())
+			notification.failed = true
+			n.keepUnsent(notification)
+			if n.connLostCallback != nil {
+				go n.connLostCallback(n.sender)
+			}
+			return
+		}
+		if notification.message != nil && acks != nil {
+			notification.deliveries++
+			acks.track(notification, time.Now())
+		}
+		if notification.message != nil && notification.message.Redelivered && n.stats != nil {
+			n.stats.messagesRedelivered.Add(1)
+		}
+	}
+}
+
+// keepUnsent keeps the notification that was not sent for drain.
+func (n *notifier) keepUnsent(notification notification) {
+	n.unsentMutex.Lock()
+	n.unsent = &notification
+	n.unsentMutex.Unlock()
+}
+
+// enableAcks switches the notifier to ack mode, it returns false if
+// it's in ack mode already.
+func (n *notifier) enableAcks(tracker *ackTracker) bool {
+	return n.acks.CompareAndSwap(nil, tracker)
+}
+
+// expired returns true if the notification is a message that expired
+// while queued, which is discarded instead of sent.
+func (n *notifier) expired(notification notification) bool {
+	if notification.message == nil || !notification.message.Expired(time.Now()) {
+		return false
+	}
+	log.Warnf("Message %s expired, message dropped", notification.message.ID)
+	if n.stats != nil {
+		n.stats.messagesExpired.Add(1)
+	}
+	return true
+}
+
+// pause holds back the notifications until the notifier is resumed.
+// Notifications queued meanwhile are dropped once the queue is full.
+func (n *notifier) pause() {
+	n.paused.Store(true)
+}
+
+// resume resumes sending the notifications held back by pause.
+func (n *notifier) resume() {
+	n.paused.Store(false)
+	select {
+	case n.resumed <- struct{}{}:
+	default:
+		// Already signalled.
+	}
+}
+
+// waitResumed blocks while the notifier is paused, it returns false
+// if the notifier is stopped meanwhile.
+func (n *notifier) waitResumed() bool {
+	for n.paused.Load() {
+		select {
+		case <-n.close:
+			return false
+		case <-n.resumed:
+		}
+	}
+	return true
+}
+
+// drain returns the notifications that were not sent, starting with
+// the one that failed to be sent or was held back. The notifier must
+// be stopped, drain waits until it stopped sending.
+func (n *notifier) drain() []notification {
+	n.running.Wait()
+
+	var notifications []notification
+	n.unsentMutex.Lock()
+	if n.unsent != nil {
+		notifications = append(notifications, *n.unsent)
+		n.unsent = nil
+	}
+	n.unsentMutex.Unlock()
+
+	for {
+		notification, ok := n.notifications.pop()
+		if !ok {
+			return notifications
 		}
+		notifications = append(notifications, notification)
 	}
 }
 
+// stop stops the notifier, it's safe to call it more than once
+// and after the notifier stopped on its own.
 func (n *notifier) stop() {
-	n.close <- struct{}{}
+	n.closeOnce.Do(func() { close(n.close) })
 }
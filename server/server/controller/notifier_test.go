@@ -3,10 +3,12 @@ package controller
 import (
 	"sync"
 	"testing"
+	"time"
 
 	"assignment/lib/entity"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNotifier(t *testing.T) {
@@ -17,9 +19,9 @@ func TestNotifier(t *testing.T) {
 	notifier := newNotifier(sender, nil)
 
 	messages := []entity.Message{
-		{Text: "message 1"},
-		{Text: "message 2"},
-		{Text: "message 3"},
+		entity.NewTextMessage("message 1"),
+		entity.NewTextMessage("message 2"),
+		entity.NewTextMessage("message 3"),
 	}
 	for _, message := range messages {
 		wg.Add(1)
@@ -32,9 +34,261 @@ func TestNotifier(t *testing.T) {
 	notifier.stop()
 }
 
+func TestNotifier_queueControl(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(3)
+	sender := newTestSender(func() {
+		wg.Done()
+	}, nil)
+	notifier := newNotifier(sender, nil)
+
+	// Controls and messages should be sent in the order they were queued.
+	message := entity.NewTextMessage("message")
+	notifier.queueControl(entity.NewWelcomeControl("welcome"))
+	notifier.queueMessage(message)
+	notifier.queueControl(entity.NewSubscriberCountControl(1))
+
+	wg.Wait()
+	assert.Equal(t, []interface{}{
+		entity.NewWelcomeControl("welcome"),
+		message,
+		entity.NewSubscriberCountControl(1),
+	}, sender.sent)
+
+	notifier.stop()
+
+	t.Run("full_queue", func(t *testing.T) {
+		notifier := newPendingNotifier(1, nil)
+		defer notifier.stop()
+		notifier.queueMessage(entity.NewTextMessage("message"))
+		notifier.queueControl(entity.NewCreditControl(10))
+		notifier.queueMessage(entity.NewTextMessage("dropped"))
+
+		// Controls are never dropped, unlike messages.
+		drained := notifier.drain()
+		require.Len(t, drained, 2)
+		assert.Equal(t, entity.NewCreditControl(10), *drained[1].control)
+	})
+}
+
+func TestNotifier_pause_and_resume(t *testing.T) {
+	var wg sync.WaitGroup
+	sender := newTestSender(func() { wg.Done() }, nil)
+	notifier := newNotifier(sender, nil)
+	defer notifier.stop()
+
+	messages := []entity.Message{
+		entity.NewTextMessage("message 1"),
+		entity.NewTextMessage("message 2"),
+	}
+	notifier.pause()
+	wg.Add(len(messages))
+	for _, message := range messages {
+		notifier.queueMessage(message)
+	}
+
+	// Nothing should be sent while paused.
+	require.Never(t, func() bool {
+		return len(sender.getSent()) > 0
+	}, time.Millisecond*50, time.Millisecond*10)
+
+	notifier.resume()
+	wg.Wait()
+	assert.Equal(t, messages, sender.messages)
+}
+
+func TestNotifier_queueWait(t *testing.T) {
+	notifier := newPendingNotifier(DefaultMessageBufferSize, nil)
+	for i := 0; i < DefaultMessageBufferSize; i++ {
+		notifier.queueMessage(entity.NewTextMessage("message"))
+	}
+
+	// The notification should be queued once the queue has room.
+	queued := make(chan bool)
+	go func() {
+		queued <- notifier.queueWait(notification{control: &entity.Control{Type: entity.ControlWelcome}})
+	}()
+	select {
+	case <-queued:
+		t.Fatal("queued to a full queue")
+	case <-time.After(time.Millisecond * 50):
+	}
+	_, ok := notifier.notifications.pop()
+	require.True(t, ok)
+	require.True(t, <-queued)
+
+	// Waiting should stop with the notifier.
+	go func() {
+		queued <- notifier.queueWait(notification{control: &entity.Control{Type: entity.ControlWelcome}})
+	}()
+	notifier.stop()
+	assert.False(t, <-queued)
+}
+
+func TestNotifier_priority(t *testing.T) {
+	var wg sync.WaitGroup
+	sender := newTestSender(func() { wg.Done() }, nil)
+	notifier := newPendingNotifier(DefaultMessageBufferSize, nil)
+	defer notifier.stop()
+
+	normal := entity.NewTextMessage("normal")
+	urgent := entity.NewTextMessage("urgent")
+	urgent.Priority = entity.PriorityUrgent
+	wg.Add(3)
+	notifier.queueControl(entity.NewWelcomeControl("welcome"))
+	notifier.queueMessage(normal)
+	notifier.queueMessage(urgent)
+
+	// Urgent messages overtake the normal messages and controls.
+	notifier.start(sender)
+	wg.Wait()
+	assert.Equal(t, []interface{}{
+		urgent,
+		entity.NewWelcomeControl("welcome"),
+		normal,
+	}, sender.getSent())
+}
+
+func TestNotifier_sequences(t *testing.T) {
+	var wg sync.WaitGroup
+	sender := newTestSender(func() { wg.Done() }, nil)
+	notifier := newPendingNotifier(3, nil)
+	notifier.sequences = newStreamSequences()
+	defer notifier.stop()
+
+	for _, text := range []string{"a", "b", "urgent", "dropped"} {
+		message := entity.NewTextMessage(text)
+		message.PublisherID = "publisher"
+		if text == "urgent" {
+			message.Priority = entity.PriorityUrgent
+		}
+		notifier.queueMessage(message)
+	}
+
+	// Messages are numbered in the order they're sent, whatever their
+	// priorities, and the dropped message leaves a gap.
+	wg.Add(3)
+	notifier.start(sender)
+	wg.Wait()
+	var texts []string
+	var sequences []uint64
+	for _, message := range sender.messages {
+		texts = append(texts, message.Text())
+		sequences = append(sequences, message.PublisherSequence)
+	}
+	assert.Equal(t, []string{"urgent", "a", "b"}, texts)
+	assert.Equal(t, []uint64{2, 3, 4}, sequences)
+}
+
+func TestNotifier_expired(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	sender := newTestSender(func() { wg.Done() }, nil)
+	notifier := newPendingNotifier(DefaultMessageBufferSize, nil)
+	notifier.stats = &stats{}
+	defer notifier.stop()
+
+	// Messages expiring while queued should be discarded.
+	expiring := entity.NewTextMessage("expiring")
+	expiring.ExpiresAt = time.Now().Add(time.Millisecond * 10)
+	message := entity.NewTextMessage("message")
+	message.ExpiresAt = time.Now().Add(time.Hour)
+	notifier.queueMessage(expiring)
+	notifier.queueMessage(message)
+	time.Sleep(time.Millisecond * 20)
+
+	notifier.start(sender)
+	wg.Wait()
+	assert.Equal(t, []entity.Message{message}, sender.messages)
+	assert.Equal(t, Stats{MessagesExpired: 1}, notifier.stats.snapshot())
+}
+
+func TestNotifier_drain(t *testing.T) {
+	connLost := make(chan struct{})
+	notifier := newNotifier(newTestSender(func() {}, []error{assert.AnError}),
+		func(sender) { close(connLost) })
+
+	messages := []entity.Message{
+		entity.NewTextMessage("message 1"),
+		entity.NewTextMessage("message 2"),
+		entity.NewTextMessage("message 3"),
+	}
+	notifier.pause()
+	notifier.dispatchGroupMessage(messages[0], "workers")
+	notifier.queueMessage(messages[1])
+	notifier.dispatchGroupMessage(messages[2], "workers")
+	notifier.resume()
+
+	// The first message fails to be sent, the others are never sent.
+	<-connLost
+	notifier.stop()
+	notifications := notifier.drain()
+	require.Len(t, notifications, 3)
+	for i, notification := range notifications {
+		assert.Equal(t, messages[i], *notification.message)
+	}
+	assert.Equal(t, "workers", notifications[0].group)
+	assert.Empty(t, notifications[1].group)
+	assert.Empty(t, notifier.drain())
+}
+
+func TestNotifier_acks(t *testing.T) {
+	var wg sync.WaitGroup
+	sender := newTestSender(func() { wg.Done() }, nil)
+	notifier := newNotifier(sender, nil)
+	defer notifier.stop()
+	acks := newAckTracker("", 1)
+	require.True(t, notifier.enableAcks(acks))
+	require.False(t, notifier.enableAcks(newAckTracker("", 1)))
+
+	messages := []entity.Message{
+		entity.NewTextMessage("message 1"),
+		entity.NewTextMessage("message 2"),
+	}
+	wg.Add(1)
+	for _, message := range messages {
+		notifier.queueMessage(message)
+	}
+	wg.Wait()
+
+	// The second message is held back until the first one is acked.
+	require.Never(t, func() bool {
+		return len(sender.getSent()) > 1
+	}, time.Millisecond*50, time.Millisecond*10)
+	wg.Add(1)
+	acks.ack([]string{messages[0].ID})
+	wg.Wait()
+	assert.Equal(t, messages, sender.messages)
+
+	drained := acks.drain()
+	require.Len(t, drained, 1)
+	assert.Equal(t, 1, drained[0].deliveries)
+	assert.True(t, drained[0].redelivery().message.Redelivered)
+	assert.False(t, drained[0].message.Redelivered)
+}
+
+func TestNotifier_pending(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	notifier := newPendingNotifier(DefaultMessageBufferSize, nil)
+	defer notifier.stop()
+
+	// Notifications should be queued until the notifier is started.
+	control := entity.NewResultControl(1, nil)
+	notifier.queueControl(control)
+
+	sender := newTestSender(func() { wg.Done() }, nil)
+	notifier.start(sender)
+	wg.Wait()
+	assert.Equal(t, []interface{}{control}, sender.getSent())
+}
+
 type testSender struct {
 	sync.RWMutex
-	messages  []entity.Message
+	messages []entity.Message
+	// sent contains both messages and controls in the order they
+	// were sent.
+	sent      []interface{}
 	responses []error
 
 	callback func()
@@ -54,6 +308,20 @@ func (s *testSender) SendMessage(message entity.Message) error {
 	defer s.callback()
 
 	s.messages = append(s.messages, message)
+	s.sent = append(s.sent, message)
+	return s.response()
+}
+
+func (s *testSender) SendControl(control entity.Control) error {
+	s.Lock()
+	defer s.Unlock()
+	defer s.callback()
+
+	s.sent = append(s.sent, control)
+	return s.response()
+}
+
+func (s *testSender) response() error {
 	if len(s.responses) > 0 {
 		response := s.responses[0]
 		s.responses = s.responses[1:]
@@ -61,3 +329,95 @@ func (s *testSender) SendMessage(message entity.Message) error {
 	}
 	return nil
 }
+
+func (s *testSender) getSent() []interface{} {
+	s.RLock()
+	defer s.RUnlock()
+	return append([]interface{}(nil), s.sent...)
+}
+
+func TestNotifier_overflow(t *testing.T) {
+	tests := map[string]struct {
+		policy OverflowPolicy
+		// dispatched queues the message like the dispatcher, pop pops
+		// a notification while the notifier waits.
+		dispatched     bool
+		pop            bool
+		want           []string
+		wantStats      Stats
+		wantDisconnect bool
+	}{
+		"drop_newest": {
+			policy:    OverflowDropNewest,
+			want:      []string{"1", "2"},
+			wantStats: Stats{MessagesDroppedNewest: 1},
+		},
+		"drop_oldest": {
+			policy:    OverflowDropOldest,
+			want:      []string{"2", "3"},
+			wantStats: Stats{MessagesDroppedOldest: 1},
+		},
+		"block": {
+			policy:     OverflowBlock,
+			dispatched: true,
+			pop:        true,
+			want:       []string{"2", "3"},
+			wantStats:  Stats{OverflowBlocked: 1},
+		},
+		"block_timeout": {
+			policy:     OverflowBlock,
+			dispatched: true,
+			want:       []string{"1", "2"},
+			wantStats:  Stats{OverflowBlockTimeouts: 1, MessagesDroppedNewest: 1},
+		},
+		"block_not_dispatched": {
+			policy: OverflowBlock,
+			// The message is queued beyond the capacity right away.
+			want:      []string{"1", "2", "3"},
+			wantStats: Stats{OverflowBacklogged: 1},
+		},
+		"disconnect": {
+			policy: OverflowDisconnect,
+			// The message is kept for the disconnected subscriber.
+			want:           []string{"1", "2", "3"},
+			wantStats:      Stats{OverflowDisconnects: 1},
+			wantDisconnect: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			disconnected := make(chan struct{})
+			notifier := newPendingNotifier(2, func(sender) { close(disconnected) })
+			defer notifier.stop()
+			notifier.stats = &stats{}
+			notifier.overflowPolicy = func(string) OverflowPolicy { return tc.policy }
+			notifier.blockTimeout = time.Millisecond * 50
+
+			for _, text := range []string{"1", "2"} {
+				notifier.queueMessage(entity.NewTextMessage(text))
+			}
+			if tc.pop {
+				go func() {
+					time.Sleep(time.Millisecond * 10)
+					notifier.notifications.pop()
+				}()
+			}
+			if tc.dispatched {
+				notifier.dispatchMessage(entity.NewTextMessage("3"))
+			} else {
+				notifier.queueMessage(entity.NewTextMessage("3"))
+			}
+
+			if tc.wantDisconnect {
+				<-disconnected
+			}
+			var got []string
+			for _, notification := range notifier.drain() {
+				got = append(got, string(notification.message.Payload))
+			}
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.wantStats, notifier.stats.snapshot())
+		})
+	}
+}
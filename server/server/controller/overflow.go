@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"time"
+
+	"assignment/lib/entity"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultOverflowBlockTimeout is the default time OverflowBlock waits
+// for a full subscriber queue to free up.
+const DefaultOverflowBlockTimeout = time.Second
+
+// OverflowPolicy decides what happens to the messages queued for a
+// subscriber whose queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowDropNewest drops the queued message.
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	// OverflowDropOldest drops the oldest message queued with the same
+	// or a lower priority to make room for the queued message.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowBlock blocks the dispatcher until the queue frees up, up
+	// to the block timeout, and drops the queued message afterwards.
+	// Messages queued by others, e.g. retained and redelivered
+	// messages, are queued beyond the capacity instead of waiting.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDisconnect disconnects the subscriber, its queued
+	// messages are handled like those of any disconnected subscriber.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+// ErrUnknownOverflowPolicy is returned when parsing an unknown
+// overflow policy.
+var ErrUnknownOverflowPolicy = errors.New("unknown overflow policy")
+
+// ParseOverflowPolicy parses the overflow policy name.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(name); policy {
+	case OverflowDropNewest, OverflowDropOldest, OverflowBlock, OverflowDisconnect:
+		return policy, nil
+	default:
+		return "", errors.Wrapf(ErrUnknownOverflowPolicy, "%q", name)
+	}
+}
+
+// overflowPolicy returns the overflow policy of the messages to the
+// topic: the policy of the longest topic filter matching it, or the
+// default policy. Controls are queued with the default policy.
+func (c *commsController) overflowPolicy(topic string) OverflowPolicy {
+	policy, match := c.config.OverflowPolicy, ""
+	if topic == "" {
+		return policy
+	}
+	for topicFilter, topicPolicy := range c.config.TopicOverflowPolicies {
+		if !entity.MatchTopic(topicFilter, topic) {
+			continue
+		}
+		if len(topicFilter) > len(match) || (len(topicFilter) == len(match) && topicFilter < match) {
+			policy, match = topicPolicy, topicFilter
+		}
+	}
+	return policy
+}
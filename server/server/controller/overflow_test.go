@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	policy, err := ParseOverflowPolicy("drop-oldest")
+	require.NoError(t, err)
+	assert.Equal(t, OverflowDropOldest, policy)
+
+	_, err = ParseOverflowPolicy("drop-all")
+	assert.ErrorIs(t, err, ErrUnknownOverflowPolicy)
+}
+
+func TestCommsController_overflowPolicy(t *testing.T) {
+	c := NewCommsController(Config{
+		OverflowPolicy: OverflowBlock,
+		TopicOverflowPolicies: map[string]OverflowPolicy{
+			"metrics/#":    OverflowDropOldest,
+			"metrics/cpu":  OverflowDropNewest,
+			"orders/+/new": OverflowDisconnect,
+		},
+	}).(*commsController)
+	defer c.Close()
+
+	tests := map[string]struct {
+		topic string
+		want  OverflowPolicy
+	}{
+		"control":        {want: OverflowBlock},
+		"default":        {topic: "news", want: OverflowBlock},
+		"topic_filter":   {topic: "metrics/memory", want: OverflowDropOldest},
+		"longest_filter": {topic: "metrics/cpu", want: OverflowDropNewest},
+		"wildcard":       {topic: "orders/eu/new", want: OverflowDisconnect},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, c.overflowPolicy(tc.topic))
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"sync"
+
+	"assignment/lib/entity"
+)
+
+// DefaultStarvationLimit is the default number of times items of a
+// priority level can be overtaken by items of higher levels before
+// the oldest of them is served anyway.
+const DefaultStarvationLimit = 10
+
+// priorityQueue is a bounded queue with one FIFO per priority level.
+// Items of higher levels are served first, but waiting items of a
+// lower level are served once they've been overtaken starvationLimit
+// times, so that lower levels never starve. Items of higher levels
+// overtake all the earlier items of lower levels, so messages of a
+// publisher only keep their order within each level.
+type priorityQueue[T any] struct {
+	mutex    sync.Mutex
+	levels   [entity.PriorityLevels][]T
+	size     int
+	capacity int
+	// skipped counts how many times each level has been overtaken
+	// since it was last served.
+	skipped         [entity.PriorityLevels]int
+	starvationLimit int
+	// ready is signalled when an item is pushed, freed when an item
+	// is popped.
+	ready chan struct{}
+	freed chan struct{}
+}
+
+func newPriorityQueue[T any](capacity int) *priorityQueue[T] {
+	return &priorityQueue[T]{
+		capacity:        capacity,
+		starvationLimit: DefaultStarvationLimit,
+		ready:           make(chan struct{}, 1),
+		freed:           make(chan struct{}, 1),
+	}
+}
+
+// push queues the item with the priority, it returns false if the
+// queue is full.
+func (q *priorityQueue[T]) push(item T, priority entity.Priority) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.size >= q.capacity {
+		return false
+	}
+	level := priority.Clamp()
+	q.levels[level] = append(q.levels[level], item)
+	q.size++
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+		// Already signalled.
+	}
+	return true
+}
+
+// pushAll queues the items with their priorities even beyond the
+// capacity, so that a bounded backlog is taken over at once. Items
+// pushed afterwards are rejected until the queue is below its
+// capacity again.
+func (q *priorityQueue[T]) pushAll(items []T, priority func(T) entity.Priority) {
+	if len(items) == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, item := range items {
+		level := priority(item).Clamp()
+		q.levels[level] = append(q.levels[level], item)
+	}
+	q.size += len(items)
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+		// Already signalled.
+	}
+}
+
+// pushEvicting queues the item in place of the oldest evictable item
+// of the lowest level up to the priority of the item, so that the
+// queue doesn't grow beyond its capacity. It returns the evicted item,
+// or false if there's none and the item was not queued.
+func (q *priorityQueue[T]) pushEvicting(
+	item T,
+	priority entity.Priority,
+	evictable func(T) bool,
+) (T, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var evicted, zero T
+	level := priority.Clamp()
+	for l := 0; l <= int(level); l++ {
+		for i, queued := range q.levels[l] {
+			if !evictable(queued) {
+				continue
+			}
+			evicted = queued
+			last := len(q.levels[l]) - 1
+			copy(q.levels[l][i:], q.levels[l][i+1:])
+			q.levels[l][last] = zero
+			q.levels[l] = q.levels[l][:last]
+			q.levels[level] = append(q.levels[level], item)
+
+			select {
+			case q.ready <- struct{}{}:
+			default:
+				// Already signalled.
+			}
+			return evicted, true
+		}
+	}
+	return evicted, false
+}
+
+// pop returns the next item without blocking, it returns false if
+// the queue is empty.
+func (q *priorityQueue[T]) pop() (T, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var item T
+	level := -1
+	for l := len(q.levels) - 1; l >= 0; l-- {
+		if len(q.levels[l]) > 0 {
+			level = l
+			break
+		}
+	}
+	if level < 0 {
+		return item, false
+	}
+
+	// Serve the lowest starving level instead, if any.
+	for l := 0; l < level; l++ {
+		if len(q.levels[l]) > 0 && q.skipped[l] >= q.starvationLimit {
+			level = l
+			break
+		}
+	}
+	for l := 0; l < level; l++ {
+		if len(q.levels[l]) > 0 {
+			q.skipped[l]++
+		}
+	}
+	q.skipped[level] = 0
+
+	item = q.levels[level][0]
+	var zero T
+	q.levels[level][0] = zero
+	q.levels[level] = q.levels[level][1:]
+	q.size--
+
+	select {
+	case q.freed <- struct{}{}:
+	default:
+		// Already signalled.
+	}
+	return item, true
+}
+
+// wait returns a channel that receives when items may have been
+// pushed since the last pop.
+func (q *priorityQueue[T]) wait() <-chan struct{} {
+	return q.ready
+}
+
+// waitFreed returns a channel that receives when items may have been
+// popped since the last push failed.
+func (q *priorityQueue[T]) waitFreed() <-chan struct{} {
+	return q.freed
+}
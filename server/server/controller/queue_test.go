@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"testing"
+
+	"assignment/lib/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	type item struct {
+		name     string
+		priority entity.Priority
+	}
+
+	tests := map[string]struct {
+		starvationLimit int
+		items           []item
+		want            []string
+	}{
+		"fifo_per_level": {
+			starvationLimit: DefaultStarvationLimit,
+			items: []item{
+				{name: "normal 1"},
+				{name: "normal 2"},
+				{name: "normal 3"},
+			},
+			want: []string{"normal 1", "normal 2", "normal 3"},
+		},
+		"higher_priority_first": {
+			starvationLimit: DefaultStarvationLimit,
+			items: []item{
+				{name: "normal"},
+				{name: "high", priority: entity.PriorityHigh},
+				{name: "urgent 1", priority: entity.PriorityUrgent},
+				{name: "urgent 2", priority: entity.PriorityUrgent},
+			},
+			want: []string{"urgent 1", "urgent 2", "high", "normal"},
+		},
+		"out_of_range_priority_is_urgent": {
+			starvationLimit: DefaultStarvationLimit,
+			items: []item{
+				{name: "urgent", priority: entity.PriorityUrgent},
+				{name: "out of range", priority: entity.PriorityUrgent + 1},
+				{name: "high", priority: entity.PriorityHigh},
+			},
+			want: []string{"urgent", "out of range", "high"},
+		},
+		"lower_priorities_dont_starve": {
+			starvationLimit: 2,
+			items: []item{
+				{name: "normal"},
+				{name: "high", priority: entity.PriorityHigh},
+				{name: "urgent 1", priority: entity.PriorityUrgent},
+				{name: "urgent 2", priority: entity.PriorityUrgent},
+				{name: "urgent 3", priority: entity.PriorityUrgent},
+				{name: "urgent 4", priority: entity.PriorityUrgent},
+			},
+			want: []string{"urgent 1", "urgent 2", "normal", "high", "urgent 3", "urgent 4"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			q := newPriorityQueue[string](len(tc.items))
+			q.starvationLimit = tc.starvationLimit
+			for _, item := range tc.items {
+				require.True(t, q.push(item.name, item.priority))
+			}
+
+			got := make([]string, 0, len(tc.items))
+			for {
+				name, ok := q.pop()
+				if !ok {
+					break
+				}
+				got = append(got, name)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestPriorityQueue_full(t *testing.T) {
+	q := newPriorityQueue[string](1)
+	require.True(t, q.push("normal", entity.PriorityNormal))
+	require.False(t, q.push("urgent", entity.PriorityUrgent))
+
+	// The queue should signal the pushed item once.
+	<-q.wait()
+	select {
+	case <-q.wait():
+		t.Fatal("unexpected signal")
+	default:
+	}
+
+	name, ok := q.pop()
+	require.True(t, ok)
+	require.Equal(t, "normal", name)
+	// The queue should signal the popped item.
+	<-q.waitFreed()
+	require.True(t, q.push("urgent", entity.PriorityUrgent))
+}
+
+func TestPriorityQueue_pushAll(t *testing.T) {
+	q := newPriorityQueue[string](1)
+	q.pushAll([]string{"a", "b", "c"}, func(string) entity.Priority { return entity.PriorityNormal })
+
+	// The backlog exceeds the capacity, so pushes are rejected until
+	// it's drained below.
+	require.False(t, q.push("d", entity.PriorityNormal))
+	var got []string
+	for {
+		name, ok := q.pop()
+		if !ok {
+			break
+		}
+		got = append(got, name)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, got)
+	require.True(t, q.push("d", entity.PriorityNormal))
+}
+
+func TestPriorityQueue_pushEvicting(t *testing.T) {
+	q := newPriorityQueue[string](3)
+	require.True(t, q.push("control", entity.PriorityNormal))
+	require.True(t, q.push("normal", entity.PriorityNormal))
+	require.True(t, q.push("urgent", entity.PriorityUrgent))
+	evictable := func(item string) bool { return item != "control" }
+
+	// Items of higher priorities and items that can't be evicted are
+	// kept.
+	evicted, ok := q.pushEvicting("high", entity.PriorityHigh, evictable)
+	require.True(t, ok)
+	assert.Equal(t, "normal", evicted)
+	_, ok = q.pushEvicting("normal", entity.PriorityNormal, evictable)
+	require.False(t, ok)
+
+	var got []string
+	for {
+		item, ok := q.pop()
+		if !ok {
+			break
+		}
+		got = append(got, item)
+	}
+	assert.Equal(t, []string{"urgent", "high", "control"}, got)
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"sync"
+
+	"assignment/lib/entity"
+)
+
+// streamSequences numbers the messages of each publisher sent on a
+// client stream, in the order they're sent, so that the subscriber
+// detects the messages it missed. Messages dropped from the stream
+// queue use up a number, so that they leave a gap. Subscribers only
+// see the numbers of the messages queued to them, whatever their
+// filters, groups and priorities.
+type streamSequences struct {
+	mutex sync.Mutex
+	// last are the last sequence numbers, keyed by the publisher IDs.
+	last map[string]uint64
+}
+
+func newStreamSequences() *streamSequences {
+	return &streamSequences{last: make(map[string]uint64)}
+}
+
+// stamp returns the message stamped with the next sequence number of
+// its publisher. Messages without publisher aren't numbered, and
+// neither are redelivered messages, which were numbered when they were
+// first sent.
+func (s *streamSequences) stamp(message entity.Message) entity.Message {
+	message.PublisherSequence = 0
+	if message.PublisherID == "" || message.Redelivered {
+		return message
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.last[message.PublisherID]++
+	message.PublisherSequence = s.last[message.PublisherID]
+	return message
+}
+
+// skip uses up the next sequence number of the publisher of the
+// dropped message.
+func (s *streamSequences) skip(message entity.Message) {
+	if message.PublisherID == "" || message.Redelivered {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.last[message.PublisherID]++
+}
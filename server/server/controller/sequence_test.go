@@ -0,0 +1,33 @@
+package controller
+
+import (
+	"testing"
+
+	"assignment/lib/entity"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamSequences(t *testing.T) {
+	s := newStreamSequences()
+	message := func(publisherID string) entity.Message {
+		message := entity.NewTextMessage("Hello")
+		message.PublisherID = publisherID
+		return message
+	}
+	redelivered := message("a")
+	redelivered.Redelivered = true
+	redelivered.PublisherSequence = 1
+
+	var got []uint64
+	for _, m := range []entity.Message{message("a"), message("b"), message("a"), redelivered, message("")} {
+		got = append(got, s.stamp(m).PublisherSequence)
+	}
+	// Messages are numbered per publisher, redelivered messages and
+	// those without publisher aren't.
+	assert.Equal(t, []uint64{1, 1, 2, 0, 0}, got)
+
+	// Dropped messages leave a gap.
+	s.skip(message("a"))
+	assert.Equal(t, uint64(4), s.stamp(message("a")).PublisherSequence)
+}
@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"time"
+
+	"assignment/lib/entity"
+	"assignment/lib/filter"
+)
+
+const (
+	// DefaultSessionExpiry is the default time the session of a
+	// disconnected subscriber is kept.
+	DefaultSessionExpiry = time.Hour
+	// DefaultSessionMaxMessages is the default maximum number of
+	// messages queued for an offline session.
+	DefaultSessionMaxMessages = 1000
+	// DefaultSessionMaxBytes is the default maximum total payload
+	// size in bytes of the messages queued for an offline session.
+	DefaultSessionMaxBytes = 10 << 20
+)
+
+// session is the state kept for a disconnected subscriber that
+// declared a session: its ungrouped subscriptions and the messages
+// published to them while it's offline, until it reconnects with the
+// session ID or the session expires.
+type session struct {
+	id string
+	// subscriptions are keyed by the topic filters.
+	subscriptions map[string]subscription
+	// notifications are the queued messages, oldest first, bytes
+	// their total payload size.
+	notifications  []notification
+	bytes          int
+	disconnectedAt time.Time
+}
+
+func newSession(id string, disconnectedAt time.Time) *session {
+	return &session{
+		id:             id,
+		subscriptions:  make(map[string]subscription),
+		disconnectedAt: disconnectedAt,
+	}
+}
+
+// match returns true if the message matches any of the session
+// subscriptions.
+func (s *session) match(message entity.Message) bool {
+	for topicFilter, subscription := range s.subscriptions {
+		if entity.MatchTopic(topicFilter, message.Topic) &&
+			filter.MatchMessage(subscription.filter, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// fits returns true if the message can be queued without exceeding
+// the limits.
+func (s *session) fits(message entity.Message, maxMessages, maxBytes int) bool {
+	return len(s.notifications) < maxMessages && s.bytes+len(message.Payload) <= maxBytes
+}
+
+// add queues the notification of a message after the queued ones.
+func (s *session) add(notification notification) {
+	s.notifications = append(s.notifications, notification)
+	s.bytes += len(notification.message.Payload)
+}
+
+// prepend queues the notifications of messages published before the
+// queued ones, as far as the limits allow. It returns the
+// notifications that didn't fit.
+func (s *session) prepend(notifications []notification, maxMessages, maxBytes int) []notification {
+	count, bytes := len(s.notifications), s.bytes
+	kept := 0
+	for _, notification := range notifications {
+		if count >= maxMessages || bytes+len(notification.message.Payload) > maxBytes {
+			break
+		}
+		count++
+		bytes += len(notification.message.Payload)
+		kept++
+	}
+	s.notifications = append(notifications[:kept:kept], s.notifications...)
+	s.bytes = bytes
+	return notifications[kept:]
+}
+
+func (s *session) expired(now time.Time, expiry time.Duration) bool {
+	return now.Sub(s.disconnectedAt) >= expiry
+}
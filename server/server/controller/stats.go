@@ -0,0 +1,71 @@
+package controller
+
+import "sync/atomic"
+
+// Stats are the message statistics of the comms controller.
+type Stats struct {
+	// MessagesReceived is the number of messages received from
+	// publishers and subscribers.
+	MessagesReceived uint64 `json:"messagesReceived"`
+	// MessagesExpired is the number of messages discarded because
+	// they expired before being sent.
+	MessagesExpired uint64 `json:"messagesExpired"`
+	// MessagesDeadLettered is the number of messages that couldn't
+	// be delivered and were dead-lettered.
+	MessagesDeadLettered uint64 `json:"messagesDeadLettered"`
+	// MessagesRedelivered is the number of messages sent again to
+	// subscribers because they were not acknowledged.
+	MessagesRedelivered uint64 `json:"messagesRedelivered"`
+	// MessagesDeduplicated is the number of published messages
+	// dropped as duplicates of messages published before.
+	MessagesDeduplicated uint64 `json:"messagesDeduplicated"`
+	// MessagesDroppedNewest and MessagesDroppedOldest are the numbers
+	// of messages dropped because the queue of a client was full: the
+	// queued ones, or the oldest ones to make room for them.
+	MessagesDroppedNewest uint64 `json:"messagesDroppedNewest"`
+	MessagesDroppedOldest uint64 `json:"messagesDroppedOldest"`
+	// OverflowBlocked is the number of messages queued after waiting
+	// for a full subscriber queue, OverflowBlockTimeouts the number of
+	// waits that timed out.
+	OverflowBlocked       uint64 `json:"overflowBlocked"`
+	OverflowBlockTimeouts uint64 `json:"overflowBlockTimeouts"`
+	// OverflowBacklogged is the number of messages queued beyond the
+	// capacity of a full subscriber queue instead of waiting, because
+	// they were not queued by the dispatcher.
+	OverflowBacklogged uint64 `json:"overflowBacklogged"`
+	// OverflowDisconnects is the number of subscribers disconnected
+	// because their queue was full.
+	OverflowDisconnects uint64 `json:"overflowDisconnects"`
+}
+
+// stats counts the messages handled by the controller and its
+// notifiers.
+type stats struct {
+	messagesReceived      atomic.Uint64
+	messagesExpired       atomic.Uint64
+	messagesDeadLettered  atomic.Uint64
+	messagesRedelivered   atomic.Uint64
+	messagesDeduplicated  atomic.Uint64
+	messagesDroppedNewest atomic.Uint64
+	messagesDroppedOldest atomic.Uint64
+	overflowBlocked       atomic.Uint64
+	overflowBlockTimeouts atomic.Uint64
+	overflowBacklogged    atomic.Uint64
+	overflowDisconnects   atomic.Uint64
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		MessagesReceived:      s.messagesReceived.Load(),
+		MessagesExpired:       s.messagesExpired.Load(),
+		MessagesDeadLettered:  s.messagesDeadLettered.Load(),
+		MessagesRedelivered:   s.messagesRedelivered.Load(),
+		MessagesDeduplicated:  s.messagesDeduplicated.Load(),
+		MessagesDroppedNewest: s.messagesDroppedNewest.Load(),
+		MessagesDroppedOldest: s.messagesDroppedOldest.Load(),
+		OverflowBlocked:       s.overflowBlocked.Load(),
+		OverflowBlockTimeouts: s.overflowBlockTimeouts.Load(),
+		OverflowBacklogged:    s.overflowBacklogged.Load(),
+		OverflowDisconnects:   s.overflowDisconnects.Load(),
+	}
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"assignment/lib/connection"
+	"assignment/lib/entity"
+	"assignment/lib/filter"
+)
+
+// topicTree indexes subscribers by topic filters, one node per topic
+// level. Matching a topic only visits the branches that can match it,
+// so it's independent of the total number of subscriptions. Each
+// subscription may carry a header filter narrowing down the messages
+// the subscriber receives, and a subscriber group.
+type topicTree struct {
+	root *topicNode
+}
+
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[connection.WriteStream]subscription
+}
+
+type subscription struct {
+	// filter is the header filter, nil if the subscriber receives
+	// all messages.
+	filter filter.Filter
+	// group is the subscriber group, empty if the subscriber isn't
+	// competing for the messages.
+	group string
+}
+
+// matches are the subscribers matching a message. All ungrouped
+// subscribers receive the message, while the members of each group
+// compete for it.
+type matches struct {
+	subscribers map[connection.WriteStream]struct{}
+	groups      map[string]map[connection.WriteStream]struct{}
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{root: newTopicNode()}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:    make(map[string]*topicNode),
+		subscribers: make(map[connection.WriteStream]subscription),
+	}
+}
+
+// add subscribes the subscriber to topics matching the topic filter,
+// replacing an existing subscription.
+func (t *topicTree) add(
+	topicFilter string,
+	subscriber connection.WriteStream,
+	subscription subscription,
+) {
+	node := t.root
+	for _, level := range entity.TopicLevels(topicFilter) {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.subscribers[subscriber] = subscription
+}
+
+// get returns the subscription of the subscriber to the topic filter.
+func (t *topicTree) get(topicFilter string, subscriber connection.WriteStream) (subscription, bool) {
+	node := t.root
+	for _, level := range entity.TopicLevels(topicFilter) {
+		child, ok := node.children[level]
+		if !ok {
+			return subscription{}, false
+		}
+		node = child
+	}
+	subscription, ok := node.subscribers[subscriber]
+	return subscription, ok
+}
+
+// remove unsubscribes the subscriber from the topic filter and prunes
+// the branches left without subscribers.
+func (t *topicTree) remove(topicFilter string, subscriber connection.WriteStream) {
+	t.root.remove(entity.TopicLevels(topicFilter), subscriber)
+}
+
+// remove returns true if the node is left empty.
+func (n *topicNode) remove(levels []string, subscriber connection.WriteStream) bool {
+	if len(levels) == 0 {
+		delete(n.subscribers, subscriber)
+	} else if child, ok := n.children[levels[0]]; ok && child.remove(levels[1:], subscriber) {
+		delete(n.children, levels[0])
+	}
+	return len(n.children) == 0 && len(n.subscribers) == 0
+}
+
+// match returns the subscribers of all topic filters matching the
+// message topic whose header filters match the message headers.
+// Subscribers matching through several filters are returned once.
+func (t *topicTree) match(message entity.Message) matches {
+	subscribers := matches{
+		subscribers: make(map[connection.WriteStream]struct{}),
+		groups:      make(map[string]map[connection.WriteStream]struct{}),
+	}
+	t.root.match(entity.TopicLevels(message.Topic), message, subscribers)
+	return subscribers
+}
+
+func (n *topicNode) match(levels []string, message entity.Message, subscribers matches) {
+	// The multi-level wildcard matches the rest of the topic,
+	// including the parent level.
+	if child, ok := n.children[entity.MultiLevelWildcard]; ok {
+		child.collect(message, subscribers)
+	}
+	if len(levels) == 0 {
+		n.collect(message, subscribers)
+		return
+	}
+
+	if child, ok := n.children[entity.SingleLevelWildcard]; ok {
+		child.match(levels[1:], message, subscribers)
+	}
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], message, subscribers)
+	}
+}
+
+func (n *topicNode) collect(message entity.Message, subscribers matches) {
+	for subscriber, subscription := range n.subscribers {
+		if !filter.MatchMessage(subscription.filter, message) {
+			continue
+		}
+		if subscription.group == "" {
+			subscribers.subscribers[subscriber] = struct{}{}
+			continue
+		}
+		if subscribers.groups[subscription.group] == nil {
+			subscribers.groups[subscription.group] = make(map[connection.WriteStream]struct{})
+		}
+		subscribers.groups[subscription.group][subscriber] = struct{}{}
+	}
+}
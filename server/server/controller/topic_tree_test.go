@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"testing"
+
+	"assignment/lib/connection"
+	connectionmock "assignment/lib/connection/mocks"
+	"assignment/lib/entity"
+	"assignment/lib/filter"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicTree_match(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	filters := []string{
+		"orders/eu/created",
+		"orders/+/created",
+		"orders/#",
+		"+/eu/#",
+		"#",
+		"metrics/+",
+		"metrics/+/+",
+	}
+	subscribers := make(map[string]connection.WriteStream)
+	tree := newTopicTree()
+	for _, topicFilter := range filters {
+		subscribers[topicFilter] = connectionmock.NewMockReadWriteStream(ctrl)
+		tree.add(topicFilter, subscribers[topicFilter], subscription{})
+	}
+
+	tests := map[string][]string{
+		"orders/eu/created": {"orders/eu/created", "orders/+/created", "orders/#", "+/eu/#", "#"},
+		"orders/us/created": {"orders/+/created", "orders/#", "#"},
+		"orders/us/deleted": {"orders/#", "#"},
+		"orders":            {"orders/#", "#"},
+		"payments/eu":       {"+/eu/#", "#"},
+		"metrics/cpu":       {"metrics/+", "#"},
+		"metrics/cpu/0":     {"metrics/+/+", "#"},
+		"metrics//0":        {"metrics/+/+", "#"},
+		"metrics/cpu/0/1":   {"#"},
+	}
+
+	for topic, wantFilters := range tests {
+		t.Run(topic, func(t *testing.T) {
+			want := make(map[connection.WriteStream]struct{})
+			for _, topicFilter := range wantFilters {
+				want[subscribers[topicFilter]] = struct{}{}
+			}
+			assert.Equal(t, want, tree.match(topicMessage(topic, nil)).subscribers)
+		})
+	}
+}
+
+func TestTopicTree_match_deduplicates(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	subscriber := connectionmock.NewMockReadWriteStream(ctrl)
+
+	tree := newTopicTree()
+	tree.add("orders/#", subscriber, subscription{})
+	tree.add("orders/+/created", subscriber, subscription{})
+
+	require.Len(t, tree.match(topicMessage("orders/eu/created", nil)).subscribers, 1)
+}
+
+func TestTopicTree_remove(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	subscriber1 := connectionmock.NewMockReadWriteStream(ctrl)
+	subscriber2 := connectionmock.NewMockReadWriteStream(ctrl)
+
+	tree := newTopicTree()
+	tree.add("orders/+/created", subscriber1, subscription{})
+	tree.add("orders/+/created", subscriber2, subscription{})
+	tree.add("orders/#", subscriber1, subscription{})
+
+	tree.remove("orders/+/created", subscriber1)
+	require.Equal(t, map[connection.WriteStream]struct{}{
+		subscriber1: {},
+		subscriber2: {},
+	}, tree.match(topicMessage("orders/eu/created", nil)).subscribers)
+
+	tree.remove("orders/#", subscriber1)
+	tree.remove("orders/+/created", subscriber2)
+	require.Empty(t, tree.match(topicMessage("orders/eu/created", nil)).subscribers)
+
+	// Branches without subscribers should be pruned.
+	require.Empty(t, tree.root.children)
+}
+
+func TestTopicTree_match_headerFilter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	subscriber1 := connectionmock.NewMockReadWriteStream(ctrl)
+	subscriber2 := connectionmock.NewMockReadWriteStream(ctrl)
+
+	euFilter, err := filter.Parse(`region == "eu"`)
+	require.NoError(t, err)
+	usFilter, err := filter.Parse(`region == "us"`)
+	require.NoError(t, err)
+
+	tree := newTopicTree()
+	tree.add("orders/#", subscriber1, subscription{filter: euFilter})
+	tree.add("orders/+/created", subscriber1, subscription{filter: usFilter})
+	tree.add("orders/+/created", subscriber2, subscription{})
+
+	eu := map[string]string{"region": "eu"}
+	us := map[string]string{"region": "us"}
+	require.Equal(t, map[connection.WriteStream]struct{}{
+		subscriber1: {},
+		subscriber2: {},
+	}, tree.match(topicMessage("orders/eu/created", eu)).subscribers)
+	require.Equal(t, map[connection.WriteStream]struct{}{
+		subscriber2: {},
+	}, tree.match(topicMessage("orders/eu/created", nil)).subscribers)
+	require.Equal(t, map[connection.WriteStream]struct{}{
+		subscriber1: {},
+	}, tree.match(topicMessage("orders/us/deleted", eu)).subscribers)
+	require.Empty(t, tree.match(topicMessage("orders/us/deleted", us)).subscribers)
+
+	// Subscribing again replaces the header filter.
+	tree.add("orders/#", subscriber1, subscription{filter: usFilter})
+	require.Empty(t, tree.match(topicMessage("orders/us/deleted", eu)).subscribers)
+}
+
+func TestTopicTree_match_groups(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	subscriber1 := connectionmock.NewMockReadWriteStream(ctrl)
+	subscriber2 := connectionmock.NewMockReadWriteStream(ctrl)
+	subscriber3 := connectionmock.NewMockReadWriteStream(ctrl)
+
+	tree := newTopicTree()
+	tree.add("orders/#", subscriber1, subscription{group: "workers"})
+	tree.add("orders/+/created", subscriber2, subscription{group: "workers"})
+	tree.add("orders/eu/created", subscriber3, subscription{group: "auditors"})
+	tree.add("orders/#", subscriber3, subscription{})
+
+	matches := tree.match(topicMessage("orders/eu/created", nil))
+	require.Equal(t, map[connection.WriteStream]struct{}{
+		subscriber3: {},
+	}, matches.subscribers)
+	require.Equal(t, map[string]map[connection.WriteStream]struct{}{
+		"workers":  {subscriber1: {}, subscriber2: {}},
+		"auditors": {subscriber3: {}},
+	}, matches.groups)
+}
+
+func topicMessage(topic string, headers map[string]string) entity.Message {
+	message := entity.NewTextMessage("Hello")
+	message.Topic = topic
+	message.Headers = headers
+	return message
+}
@@ -3,12 +3,16 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"net"
+	"net/http"
 	"time"
 
+	"assignment/lib/compression"
 	"assignment/lib/connection"
 	"assignment/lib/log"
 	"assignment/server/server/controller"
 	"assignment/server/server/listener"
+	"assignment/server/server/topiclog"
 
 	"github.com/pkg/errors"
 )
@@ -26,6 +30,43 @@ type Config struct {
 	TLS                *tls.Config
 	OpenStreamTimeout  time.Duration
 	SendMessageTimeout time.Duration
+	Compression        compression.Config
+	// TopicTTLs are the default time-to-live of the messages
+	// published to the topics matching the topic filters.
+	TopicTTLs map[string]time.Duration
+	// DeadLetterTopic is the topic dead letters are published to,
+	// empty if they're only kept for inspection.
+	DeadLetterTopic string
+	// AckTimeout is the time subscribers in ack mode have to
+	// acknowledge a message before it's redelivered.
+	AckTimeout time.Duration
+	// SessionExpiry is the time the sessions of disconnected
+	// subscribers are kept, SessionMaxMessages and SessionMaxBytes
+	// limit the messages queued for them meanwhile.
+	SessionExpiry      time.Duration
+	SessionMaxMessages int
+	SessionMaxBytes    int
+	// DedupWindow is the number of the latest messages of each
+	// producer duplicates are detected against.
+	DedupWindow int
+	// PublisherCredits is the number of messages each publisher can
+	// have queued before it has to wait for credits.
+	PublisherCredits int
+	// SubscriberQueueSize is the number of messages queued for each
+	// subscriber, OverflowPolicy and TopicOverflowPolicies decide
+	// what happens to the messages queued while it's full.
+	SubscriberQueueSize   int
+	OverflowPolicy        controller.OverflowPolicy
+	TopicOverflowPolicies map[string]controller.OverflowPolicy
+	OverflowBlockTimeout  time.Duration
+	// MessageLog is the durable log published messages are appended
+	// to for replays, nil to disable it. It's closed by its owner
+	// after the server shut down.
+	MessageLog topiclog.Log
+	// AdminAddress is the address the admin HTTP API listens on,
+	// empty to disable it. The API is not authenticated, so it
+	// should only be reachable by operators.
+	AdminAddress string
 }
 
 // Server is an interface for the broker server.
@@ -40,9 +81,24 @@ type Server interface {
 // New creates a new broker server.
 func New(config Config) Server {
 	return &server{
-		config:          config,
-		newListener:     listener.New,
-		commsController: controller.NewCommsController(),
+		config:      config,
+		newListener: listener.New,
+		commsController: controller.NewCommsController(controller.Config{
+			Compression:           config.Compression,
+			TopicTTLs:             config.TopicTTLs,
+			DeadLetterTopic:       config.DeadLetterTopic,
+			AckTimeout:            config.AckTimeout,
+			MessageLog:            config.MessageLog,
+			SessionExpiry:         config.SessionExpiry,
+			SessionMaxMessages:    config.SessionMaxMessages,
+			SessionMaxBytes:       config.SessionMaxBytes,
+			DedupWindow:           config.DedupWindow,
+			PublisherCredits:      config.PublisherCredits,
+			SubscriberQueueSize:   config.SubscriberQueueSize,
+			OverflowPolicy:        config.OverflowPolicy,
+			TopicOverflowPolicies: config.TopicOverflowPolicies,
+			OverflowBlockTimeout:  config.OverflowBlockTimeout,
+		}),
 	}
 }
 
@@ -52,6 +108,7 @@ type server struct {
 	publisherListener  listener.Listener
 	subscriberListener listener.Listener
 	commsController    controller.CommsController
+	adminServer        *http.Server
 
 	// listener constructor delegate used for mocks
 	newListener func(cb listener.NewConnectionCallback) listener.Listener
@@ -74,6 +131,13 @@ func (s *server) Start() error {
 	}
 	log.Tracef("Started subscriber listener on port %d", s.config.SubscriberPort)
 
+	if s.config.AdminAddress != "" {
+		if err := s.startAdminServer(); err != nil {
+			return errors.Wrap(err, "start admin server")
+		}
+		log.Tracef("Started admin server on %s", s.config.AdminAddress)
+	}
+
 	s.started = true
 	return nil
 }
@@ -83,6 +147,13 @@ func (s *server) Shutdown() error {
 		return nil
 	}
 
+	if s.adminServer != nil {
+		if err := s.adminServer.Close(); err != nil {
+			return errors.Wrap(err, "close admin server")
+		}
+		s.adminServer = nil
+	}
+
 	if err := s.publisherListener.Shutdown(); err != nil {
 		return errors.Wrap(err, "shutdown publisher listener")
 	}
@@ -99,18 +170,47 @@ func (s *server) Shutdown() error {
 	return nil
 }
 
+func (s *server) startAdminServer() error {
+	adminListener, err := net.Listen("tcp", s.config.AdminAddress)
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+
+	s.adminServer = &http.Server{
+		Handler:           newAdminHandler(s.commsController),
+		ReadHeaderTimeout: s.config.OpenStreamTimeout,
+	}
+	go func(adminServer *http.Server) {
+		if err := adminServer.Serve(adminListener); !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("Error serving admin API: %s", err.Error())
+		}
+	}(s.adminServer)
+	return nil
+}
+
 func (s *server) addPublisher(conn connection.Connection) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.config.OpenStreamTimeout)
 	defer cancel()
 
+	// Make sure the publisher speaks the same protocol.
+	if err := conn.AcceptHandshake(ctx); err != nil {
+		log.Errorf("Error negotiating protocol with publisher: %s", err.Error())
+		return
+	}
+
 	// Open a stream with the publisher and wait until they accept.
 	log.Trace("Publisher connected, opening read write stream")
-	readWriteStream, err := conn.OpenReadWriteStream(ctx, s.commsController.MessageReceiver())
+	// Publishers don't send controls.
+	readWriteStream, err := conn.OpenReadWriteStream(ctx, nil, nil)
 	if err != nil {
 		log.Errorf("Error opening publisher stream: %s", err.Error())
 		return
 	}
 	readWriteStream.SetSendMessageTimeout(s.config.SendMessageTimeout)
+	// The publisher accepts the stream once the controller sends it
+	// the subscriber count, so no message can arrive before the
+	// receiver is set.
+	readWriteStream.SetMessageReceiver(s.commsController.MessageReceiver(readWriteStream))
 
 	// Add the publisher to the communication controller.
 	s.commsController.AddPublisher(readWriteStream)
@@ -120,6 +220,12 @@ func (s *server) addSubscriber(conn connection.Connection) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.config.OpenStreamTimeout)
 	defer cancel()
 
+	// Make sure the subscriber speaks the same protocol.
+	if err := conn.AcceptHandshake(ctx); err != nil {
+		log.Errorf("Error negotiating protocol with subscriber: %s", err.Error())
+		return
+	}
+
 	// Open a uni directional stream with the subscriber and wait until they accept.
 	log.Trace("Subscriber connected, opening write stream")
 	writeStream, err := conn.OpenWriteStream(ctx)
@@ -131,4 +237,18 @@ func (s *server) addSubscriber(conn connection.Connection) {
 
 	// Add the subscriber to the communication controller.
 	s.commsController.AddSubscriber(writeStream)
+
+	// Accept the control stream the subscriber sends its commands and
+	// replies on and receives the command results on, the subscriber
+	// declares its initial topics right after connecting.
+	log.Trace("Accepting subscriber control stream")
+	controlStream, err := conn.AcceptReadWriteStream(ctx, s.commsController.ReplyReceiver(),
+		s.commsController.SubscriberControlReceiver(writeStream))
+	if err != nil {
+		log.Errorf("Error accepting subscriber control stream: %s", err.Error())
+		s.commsController.RemoveSubscriber(writeStream)
+		return
+	}
+	controlStream.SetSendMessageTimeout(s.config.SendMessageTimeout)
+	s.commsController.SetSubscriberControlStream(writeStream, controlStream)
 }
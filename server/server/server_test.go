@@ -3,6 +3,8 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"net/http"
 	"testing"
 	"time"
 
@@ -33,6 +35,7 @@ func TestServer(t *testing.T) {
 		TLS:                tlsConfig,
 		OpenStreamTimeout:  time.Second,
 		SendMessageTimeout: time.Second,
+		AdminAddress:       "localhost:8088",
 	}
 	server := New(config)
 
@@ -43,8 +46,9 @@ func TestServer(t *testing.T) {
 		context.Background(), config.PublisherPort)
 	require.NoError(t, err)
 	publisherMessageCollector := testutil.NewMessageCollector()
-	publisherStream, err := publisherConn.AcceptReadWriteStream(
-		context.Background(), publisherMessageCollector.Add)
+	publisherControlCollector := testutil.NewControlCollector()
+	publisherStream, err := publisherConn.AcceptReadWriteStream(context.Background(),
+		publisherMessageCollector.Add, publisherControlCollector.Add)
 	require.NoError(t, err)
 
 	// TODO: do not use time.Sleep() in tests, find a better way
@@ -54,21 +58,45 @@ func TestServer(t *testing.T) {
 	subscriberConn, err := connection.Connect(
 		context.Background(), config.SubscriberPort)
 	require.NoError(t, err)
+	subscriberResultCollector := testutil.NewControlCollector()
+	subscriberControlStream, err := subscriberConn.OpenReadWriteStream(context.Background(),
+		nil, subscriberResultCollector.Add)
+	require.NoError(t, err)
+	subscribe := entity.NewSubscribeControl("news")
+	subscribe.CommandID = 1
+	require.NoError(t, subscriberControlStream.SendControl(subscribe))
+	invalidSubscribe := entity.NewSubscribeControl("news/#/eu")
+	invalidSubscribe.CommandID = 2
+	require.NoError(t, subscriberControlStream.SendControl(invalidSubscribe))
 	subscriberMessageCollector := testutil.NewMessageCollector()
-	subscriberStream, err := subscriberConn.AcceptReadStream(
-		context.Background(), subscriberMessageCollector.Add)
+	subscriberControlCollector := testutil.NewControlCollector()
+	subscriberStream, err := subscriberConn.AcceptReadStream(context.Background(),
+		subscriberMessageCollector.Add, subscriberControlCollector.Add)
 	require.NoError(t, err)
 
 	// TODO: do not use time.Sleep() in tests, find a better way
 	time.Sleep(time.Millisecond * 100)
 
-	// Send a message from the publisher to the subscriber.
-	publisherMessage := entity.Message{Text: "New message from publisher"}
+	// Send messages from the publisher, only the one to the topic
+	// the subscriber subscribed to should reach the subscriber.
+	publisherMessage := entity.NewTextMessage("New message from publisher")
+	publisherMessage.Topic = "news"
+	otherMessage := entity.NewTextMessage("Message to another topic")
+	otherMessage.Topic = "sports"
+	require.NoError(t, publisherStream.SendMessage(otherMessage))
 	require.NoError(t, publisherStream.SendMessage(publisherMessage))
 
 	// TODO: do not use time.Sleep() in tests, find a better way
 	time.Sleep(time.Millisecond * 100)
 
+	// Make sure that the admin API reports the received messages.
+	response, err := http.Get("http://localhost:8088/stats")
+	require.NoError(t, err)
+	var stats controller.Stats
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&stats))
+	require.NoError(t, response.Body.Close())
+	require.Equal(t, uint64(2), stats.MessagesReceived)
+
 	require.NoError(t, publisherStream.CloseStream())
 	require.NoError(t, subscriberStream.CloseStream())
 	require.NoError(t, server.Shutdown())
@@ -76,17 +104,42 @@ func TestServer(t *testing.T) {
 	// TODO: do not use time.Sleep() in tests, find a better way
 	time.Sleep(time.Millisecond * 100)
 
-	// Make sure that the subscriber has received the messages.
-	require.Equal(t, []entity.Message{
-		{Text: controller.MessageHelloSubscriber},
-		publisherMessage,
-	}, subscriberMessageCollector.Get())
-
-	// Make sure that the publisher has received the messages.
-	require.Equal(t, []entity.Message{
-		{Text: controller.MessageNoSubscribers},
-		{Text: controller.MessageNewSubscriber},
-	}, publisherMessageCollector.Get())
+	// Make sure that the subscriber has been welcomed and has
+	// received the message.
+	require.Equal(t, []entity.Control{
+		entity.NewWelcomeControl(controller.MessageHelloSubscriber),
+	}, subscriberControlCollector.Get())
+	received := subscriberMessageCollector.Get()
+	require.Len(t, received, 1)
+	require.NotEmpty(t, received[0].PublisherID)
+	require.Equal(t, uint64(1), received[0].PublisherSequence)
+	received[0].PublisherID, received[0].PublisherSequence = "", 0
+	require.Equal(t, publisherMessage, received[0])
+
+	// Make sure that the subscriber has received the results of its
+	// commands.
+	results := subscriberResultCollector.Get()
+	require.Len(t, results, 2)
+	require.Equal(t, entity.NewResultControl(1, nil), results[0])
+	require.Equal(t, entity.ControlResult, results[1].Type)
+	require.Equal(t, uint64(2), results[1].CommandID)
+	require.Contains(t, results[1].Text, "invalid topic filter")
+
+	// Make sure that the publisher has been informed of the
+	// subscriber count, granted its credits, got its messages
+	// confirmed and hasn't received any messages.
+	publisherControls := publisherControlCollector.Get()
+	require.Len(t, publisherControls, 5)
+	require.Equal(t, []entity.Control{
+		entity.NewSubscriberCountControl(0),
+		entity.NewCreditControl(controller.DefaultPublisherCredits),
+		entity.NewSubscriberCountControl(1),
+	}, publisherControls[:3])
+	require.ElementsMatch(t, []entity.Control{
+		entity.NewConfirmControl(otherMessage.ID),
+		entity.NewConfirmControl(publisherMessage.ID),
+	}, publisherControls[3:])
+	require.Empty(t, publisherMessageCollector.Get())
 }
 
 func TestServer_Lifecycle(t *testing.T) {
@@ -284,25 +337,31 @@ func TestServer_addPublisher(t *testing.T) {
 		tests           = map[string]struct {
 			setup func(m mocks)
 		}{
+			"error_accepting_handshake": {
+				setup: func(m mocks) {
+					m.conn.EXPECT().AcceptHandshake(gomock.Any()).
+						Return(assert.AnError).Times(1)
+				},
+			},
 			"error_opening_stream": {
 				setup: func(m mocks) {
-					m.controller.EXPECT().MessageReceiver().
-						Return(messageReceiver).Times(1)
-					m.conn.EXPECT().OpenReadWriteStream(gomock.Any(), gomock.Any()).
+					m.conn.EXPECT().AcceptHandshake(gomock.Any()).Return(nil).Times(1)
+					m.conn.EXPECT().OpenReadWriteStream(gomock.Any(), gomock.Any(), gomock.Any()).
 						Return(nil, assert.AnError).Times(1)
 				},
 			},
 			"happy_path": {
 				setup: func(m mocks) {
-					m.controller.EXPECT().MessageReceiver().
-						Return(messageReceiver).Times(1)
-					m.conn.EXPECT().OpenReadWriteStream(gomock.Any(), gomock.Any()).
-						DoAndReturn(
-							func(_ context.Context, mr connection.MessageReceiver) (connection.ReadWriteStream, error) {
-								require.NotNil(t, mr)
-								return m.stream, nil
-							}).Times(1)
+					m.conn.EXPECT().AcceptHandshake(gomock.Any()).Return(nil).Times(1)
+					m.conn.EXPECT().OpenReadWriteStream(gomock.Any(), gomock.Any(), gomock.Any()).
+						Return(m.stream, nil).Times(1)
 					m.stream.EXPECT().SetSendMessageTimeout(config.SendMessageTimeout).Times(1)
+					m.controller.EXPECT().MessageReceiver(m.stream).
+						Return(messageReceiver).Times(1)
+					m.stream.EXPECT().SetMessageReceiver(gomock.Any()).
+						Do(func(mr connection.MessageReceiver) {
+							require.NotNil(t, mr)
+						}).Times(1)
 					m.controller.EXPECT().AddPublisher(m.stream).Times(1)
 				},
 			},
@@ -335,9 +394,10 @@ func TestServer_addPublisher(t *testing.T) {
 
 func TestServer_addSubscriber(t *testing.T) {
 	type mocks struct {
-		conn       *connectionmocks.MockConnection
-		stream     *connectionmocks.MockReadWriteStream
-		controller *controllermocks.MockCommsController
+		conn          *connectionmocks.MockConnection
+		stream        *connectionmocks.MockReadWriteStream
+		controlStream *connectionmocks.MockReadWriteStream
+		controller    *controllermocks.MockCommsController
 	}
 
 	var (
@@ -348,18 +408,59 @@ func TestServer_addSubscriber(t *testing.T) {
 		tests = map[string]struct {
 			setup func(m mocks)
 		}{
+			"error_accepting_handshake": {
+				setup: func(m mocks) {
+					m.conn.EXPECT().AcceptHandshake(gomock.Any()).
+						Return(assert.AnError).Times(1)
+				},
+			},
 			"error_opening_stream": {
 				setup: func(m mocks) {
+					m.conn.EXPECT().AcceptHandshake(gomock.Any()).Return(nil).Times(1)
+					m.conn.EXPECT().OpenWriteStream(gomock.Any()).
+						Return(nil, assert.AnError).Times(1)
+				},
+			},
+			"error_accepting_control_stream": {
+				setup: func(m mocks) {
+					m.conn.EXPECT().AcceptHandshake(gomock.Any()).Return(nil).Times(1)
 					m.conn.EXPECT().OpenWriteStream(gomock.Any()).
+						Return(m.stream, nil).Times(1)
+					m.stream.EXPECT().SetSendMessageTimeout(config.SendMessageTimeout).Times(1)
+					m.controller.EXPECT().AddSubscriber(m.stream).Times(1)
+					m.controller.EXPECT().ReplyReceiver().
+						Return(func(entity.Message) {}).Times(1)
+					m.controller.EXPECT().SubscriberControlReceiver(m.stream).
+						Return(func(entity.Control) {}).Times(1)
+					m.conn.EXPECT().AcceptReadWriteStream(gomock.Any(), gomock.Any(), gomock.Any()).
 						Return(nil, assert.AnError).Times(1)
+					m.controller.EXPECT().RemoveSubscriber(m.stream).Times(1)
 				},
 			},
 			"happy_path": {
 				setup: func(m mocks) {
+					m.conn.EXPECT().AcceptHandshake(gomock.Any()).Return(nil).Times(1)
 					m.conn.EXPECT().OpenWriteStream(gomock.Any()).
 						Return(m.stream, nil).Times(1)
 					m.stream.EXPECT().SetSendMessageTimeout(config.SendMessageTimeout).Times(1)
 					m.controller.EXPECT().AddSubscriber(m.stream).Times(1)
+					m.controller.EXPECT().ReplyReceiver().
+						Return(func(entity.Message) {}).Times(1)
+					m.controller.EXPECT().SubscriberControlReceiver(m.stream).
+						Return(func(entity.Control) {}).Times(1)
+					m.conn.EXPECT().AcceptReadWriteStream(gomock.Any(), gomock.Any(), gomock.Any()).
+						DoAndReturn(
+							func(
+								_ context.Context,
+								mr connection.MessageReceiver,
+								cr connection.ControlReceiver,
+							) (connection.ReadWriteStream, error) {
+								require.NotNil(t, mr)
+								require.NotNil(t, cr)
+								return m.controlStream, nil
+							}).Times(1)
+					m.controlStream.EXPECT().SetSendMessageTimeout(config.SendMessageTimeout).Times(1)
+					m.controller.EXPECT().SetSubscriberControlStream(m.stream, m.controlStream).Times(1)
 				},
 			},
 		}
@@ -368,16 +469,18 @@ func TestServer_addSubscriber(t *testing.T) {
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
 			var (
-				ctrl           = gomock.NewController(t)
-				connectionMock = connectionmocks.NewMockConnection(ctrl)
-				streamMock     = connectionmocks.NewMockReadWriteStream(ctrl)
-				controllerMock = controllermocks.NewMockCommsController(ctrl)
+				ctrl              = gomock.NewController(t)
+				connectionMock    = connectionmocks.NewMockConnection(ctrl)
+				streamMock        = connectionmocks.NewMockReadWriteStream(ctrl)
+				controlStreamMock = connectionmocks.NewMockReadWriteStream(ctrl)
+				controllerMock    = controllermocks.NewMockCommsController(ctrl)
 			)
 
 			tc.setup(mocks{
-				conn:       connectionMock,
-				stream:     streamMock,
-				controller: controllerMock,
+				conn:          connectionMock,
+				stream:        streamMock,
+				controlStream: controlStreamMock,
+				controller:    controllerMock,
 			})
 			s := &server{
 				config:          config,
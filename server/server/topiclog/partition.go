@@ -0,0 +1,183 @@
+package topiclog
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"assignment/lib/entity"
+	"assignment/lib/log"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+// partition is the log of a topic: its segments, oldest first. Only
+// the last segment is active and appended to.
+type partition struct {
+	mutex    sync.Mutex
+	dir      string
+	segments []*segment
+	// dirty is set when records were appended since the last sync.
+	dirty bool
+}
+
+// openPartition opens the segments in the directory, or creates the
+// first segment if there are none.
+func openPartition(dir string) (*partition, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read topic directory")
+	}
+	var baseOffsets []uint64
+	for _, entry := range entries {
+		if baseOffset, ok := parseSegmentName(entry.Name()); ok && !entry.IsDir() {
+			baseOffsets = append(baseOffsets, baseOffset)
+		}
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+	if len(baseOffsets) == 0 {
+		baseOffsets = append(baseOffsets, 1)
+	}
+
+	p := &partition{dir: dir}
+	for i, baseOffset := range baseOffsets {
+		s, err := openSegment(segmentPath(dir, baseOffset), baseOffset)
+		if err != nil {
+			return nil, multierr.Append(err, p.close())
+		}
+		p.segments = append(p.segments, s)
+		if i < len(baseOffsets)-1 {
+			if err := s.close(); err != nil {
+				return nil, multierr.Append(err, p.close())
+			}
+		}
+	}
+	return p, nil
+}
+
+func (p *partition) active() *segment {
+	return p.segments[len(p.segments)-1]
+}
+
+// append appends the message with the next offset, starting a new
+// segment first if the active one is full.
+func (p *partition) append(message entity.Message, config Config) (uint64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if active := p.active(); active.size >= config.SegmentSize {
+		if err := p.roll(); err != nil {
+			return 0, errors.Wrap(err, "start segment")
+		}
+	}
+
+	active := p.active()
+	message.Offset = active.nextOffset
+	record := record{offset: message.Offset, time: time.Now().UTC(), message: message.Bytes()}
+	if err := active.append(record); err != nil {
+		return 0, err
+	}
+
+	if config.SyncPolicy == SyncAlways {
+		if err := active.file.Sync(); err != nil {
+			return 0, errors.Wrap(err, "sync segment")
+		}
+	} else {
+		p.dirty = true
+	}
+	return message.Offset, nil
+}
+
+// roll syncs and closes the active segment and starts a new one, it
+// must be called with the mutex held.
+func (p *partition) roll() error {
+	active := p.active()
+	if err := active.file.Sync(); err != nil {
+		return errors.Wrap(err, "sync segment")
+	}
+	if err := active.close(); err != nil {
+		return err
+	}
+
+	s, err := openSegment(segmentPath(p.dir, active.nextOffset), active.nextOffset)
+	if err != nil {
+		return err
+	}
+	p.segments = append(p.segments, s)
+	return nil
+}
+
+// snapshots returns the snapshots of the segments, oldest first.
+func (p *partition) snapshots() []segmentSnapshot {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	snapshots := make([]segmentSnapshot, len(p.segments))
+	for i, s := range p.segments {
+		snapshots[i] = s.snapshot()
+	}
+	return snapshots
+}
+
+// sync syncs the active segment if records were appended since the
+// last sync.
+func (p *partition) sync() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.dirty || p.active().file == nil {
+		return nil
+	}
+	if err := p.active().file.Sync(); err != nil {
+		return errors.Wrap(err, "sync segment")
+	}
+	p.dirty = false
+	return nil
+}
+
+// enforceRetention removes the oldest segments while their last
+// message is older than the retention age or the partition is larger
+// than the retention size. The active segment is never removed.
+func (p *partition) enforceRetention(now time.Time, config Config) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var size int64
+	for _, s := range p.segments {
+		size += s.size
+	}
+
+	for len(p.segments) > 1 {
+		oldest := p.segments[0]
+		if now.Sub(oldest.lastTime) < config.RetentionAge && size <= config.RetentionSize {
+			return nil
+		}
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove segment")
+		}
+		log.Infof("Removed segment %s of %d bytes", oldest.path, oldest.size)
+		size -= oldest.size
+		p.segments[0] = nil
+		p.segments = p.segments[1:]
+	}
+	return nil
+}
+
+func (p *partition) close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var merr error
+	for _, s := range p.segments {
+		if s.file == nil {
+			continue
+		}
+		if err := s.file.Sync(); err != nil {
+			merr = multierr.Append(merr, errors.Wrap(err, "sync segment"))
+		}
+		merr = multierr.Append(merr, s.close())
+	}
+	return merr
+}
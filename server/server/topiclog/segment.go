@@ -0,0 +1,230 @@
+package topiclog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"assignment/lib/log"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// segmentExtension is the file extension of the segments, named
+	// by the offset of their first record.
+	segmentExtension = ".log"
+	// recordHeaderSize is the size of the record header: the length
+	// of the message, the checksum, the offset and the append time.
+	recordHeaderSize = 4 + 4 + 8 + 8
+	// maxRecordSize bounds the length of a record, longer lengths
+	// can only be read from corrupted segments.
+	maxRecordSize = 1 << 30
+)
+
+// errCorruptRecord is returned when reading a record that's truncated
+// or doesn't match its checksum.
+var errCorruptRecord = errors.New("corrupt record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// record is a logged message with its offset and append time.
+type record struct {
+	offset  uint64
+	time    time.Time
+	message []byte
+}
+
+// bytes encodes the record as its header followed by the message. The
+// checksum covers the offset, the time and the message.
+func (r record) bytes() []byte {
+	buffer := make([]byte, recordHeaderSize, recordHeaderSize+len(r.message))
+	binary.BigEndian.PutUint32(buffer[0:4], uint32(len(r.message)))
+	binary.BigEndian.PutUint64(buffer[8:16], r.offset)
+	binary.BigEndian.PutUint64(buffer[16:24], uint64(r.time.UnixNano()))
+	buffer = append(buffer, r.message...)
+	binary.BigEndian.PutUint32(buffer[4:8], crc32.Checksum(buffer[8:], crcTable))
+	return buffer
+}
+
+// readRecord reads the next record, it returns io.EOF at the end of
+// the reader and errCorruptRecord if the record is truncated or
+// corrupted.
+func readRecord(reader io.Reader) (record, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return record{}, io.EOF
+		}
+		return record{}, errors.Wrap(errCorruptRecord, err.Error())
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return record{}, errors.Wrapf(errCorruptRecord, "length %d", length)
+	}
+	data := make([]byte, recordHeaderSize-8+int(length))
+	copy(data, header[8:])
+	if _, err := io.ReadFull(reader, data[recordHeaderSize-8:]); err != nil {
+		return record{}, errors.Wrap(errCorruptRecord, err.Error())
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return record{}, errors.Wrap(errCorruptRecord, "checksum mismatch")
+	}
+
+	return record{
+		offset:  binary.BigEndian.Uint64(data[0:8]),
+		time:    time.Unix(0, int64(binary.BigEndian.Uint64(data[8:16]))).UTC(),
+		message: data[16:],
+	}, nil
+}
+
+// segment is a file of consecutive records of a topic.
+type segment struct {
+	path string
+	// baseOffset is the offset of the first record, nextOffset the
+	// offset of the record appended next.
+	baseOffset uint64
+	nextOffset uint64
+	size       int64
+	// lastTime is the append time of the last record, zero if the
+	// segment is empty.
+	lastTime time.Time
+	// file is open for appending while the segment is active.
+	file *os.File
+}
+
+func segmentPath(dir string, baseOffset uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", baseOffset, segmentExtension))
+}
+
+// parseSegmentName returns the base offset of the segment file name,
+// it returns false if the name is not a segment name.
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, segmentExtension) {
+		return 0, false
+	}
+	baseOffset, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExtension), 10, 64)
+	return baseOffset, err == nil
+}
+
+// openSegment opens the segment for appending, creating it if it
+// doesn't exist. The records after the first truncated, corrupted or
+// out of sequence record are lost in a crash, so they're truncated.
+func openSegment(path string, baseOffset uint64) (*segment, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open segment")
+	}
+
+	s := &segment{path: path, baseOffset: baseOffset, nextOffset: baseOffset, file: file}
+	reader := bufio.NewReader(file)
+	for {
+		record, err := readRecord(reader)
+		if err == nil && record.offset != s.nextOffset {
+			err = errors.Wrapf(errCorruptRecord, "offset %d, expected %d", record.offset, s.nextOffset)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Warnf("Truncating segment %s at %d bytes: %s", path, s.size, err.Error())
+			if err := file.Truncate(s.size); err != nil {
+				file.Close()
+				return nil, errors.Wrap(err, "truncate segment")
+			}
+			break
+		}
+		s.nextOffset++
+		s.size += int64(recordHeaderSize + len(record.message))
+		s.lastTime = record.time
+	}
+
+	if _, err := file.Seek(s.size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "seek segment end")
+	}
+	return s, nil
+}
+
+// append appends the record to the segment.
+func (s *segment) append(r record) error {
+	data := r.bytes()
+	if _, err := s.file.Write(data); err != nil {
+		// Drop the partially written record.
+		if err := s.file.Truncate(s.size); err != nil {
+			log.Errorf("Error truncating segment %s: %s", s.path, err.Error())
+		}
+		if _, err := s.file.Seek(s.size, io.SeekStart); err != nil {
+			log.Errorf("Error seeking segment %s: %s", s.path, err.Error())
+		}
+		return errors.Wrap(err, "write record")
+	}
+	s.size += int64(len(data))
+	s.nextOffset = r.offset + 1
+	s.lastTime = r.time
+	return nil
+}
+
+// close closes the segment file, the segment can be read but not
+// appended to afterwards.
+func (s *segment) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return errors.Wrap(err, "close segment")
+}
+
+// segmentSnapshot is the state of a segment at a point in time, so
+// that it can be read while records are appended.
+type segmentSnapshot struct {
+	path       string
+	nextOffset uint64
+	size       int64
+	lastTime   time.Time
+}
+
+func (s *segment) snapshot() segmentSnapshot {
+	return segmentSnapshot{path: s.path, nextOffset: s.nextOffset, size: s.size, lastTime: s.lastTime}
+}
+
+// read calls fn with the records of the snapshot at or after the
+// position, until fn returns false. It returns false if reading was
+// stopped by fn.
+func (s segmentSnapshot) read(position Position, fn func(record) bool) (bool, error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		// Removed by the retention meanwhile.
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "open segment")
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(io.LimitReader(file, s.size))
+	for {
+		record, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "read segment %s", s.path)
+		}
+		if record.offset < position.Offset || record.time.Before(position.Since) {
+			continue
+		}
+		if !fn(record) {
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,333 @@
+// Package topiclog implements the durable message log of the broker:
+// an append-only log per topic on local disk, split into segment files
+// that are removed once they exceed the retention.
+package topiclog
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"assignment/lib/entity"
+	"assignment/lib/log"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+const (
+	// DefaultSegmentSize is the default size in bytes after which a
+	// new segment is started.
+	DefaultSegmentSize = 16 << 20
+	// DefaultRetentionAge is the default age after which segments
+	// are removed.
+	DefaultRetentionAge = time.Hour * 24 * 7
+	// DefaultRetentionSize is the default size in bytes of the log of
+	// a topic above which the oldest segments are removed.
+	DefaultRetentionSize = 1 << 30
+	// DefaultSyncInterval is the default interval logs are synced to
+	// disk at with SyncInterval.
+	DefaultSyncInterval = time.Second
+	// RetentionCheckInterval is the interval the retention is
+	// enforced at.
+	RetentionCheckInterval = time.Minute
+)
+
+// SyncPolicy is the policy for syncing appended messages to disk.
+type SyncPolicy string
+
+const (
+	// SyncAlways syncs every appended message before Append returns.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval syncs the appended messages periodically, messages
+	// appended since the last sync can be lost in a crash.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves syncing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+// ErrUnknownSyncPolicy is returned when parsing an unknown sync policy.
+var ErrUnknownSyncPolicy = errors.New("unknown sync policy")
+
+// ParseSyncPolicy parses the sync policy name.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch policy := SyncPolicy(name); policy {
+	case SyncAlways, SyncInterval, SyncNever:
+		return policy, nil
+	default:
+		return "", errors.Wrapf(ErrUnknownSyncPolicy, "%q", name)
+	}
+}
+
+// Config contains the log configuration. Zero values are replaced by
+// the defaults.
+type Config struct {
+	// Dir is the directory of the log, with one sub-directory of
+	// segments per topic.
+	Dir         string
+	SegmentSize int64
+	// RetentionAge is the age of the last message of a segment after
+	// which the segment is removed.
+	RetentionAge time.Duration
+	// RetentionSize is the size of the log of a topic above which
+	// its oldest segments are removed.
+	RetentionSize int64
+	SyncPolicy    SyncPolicy
+	// SyncInterval is the interval of SyncInterval.
+	SyncInterval time.Duration
+}
+
+// Position is the position in the log of a topic reads start at: the
+// messages at or after the offset and appended at or after the time.
+type Position struct {
+	Offset uint64
+	Since  time.Time
+}
+
+// Log is the durable message log, with a log of messages per topic.
+type Log interface {
+	// Append appends the message to the log of its topic, and returns
+	// the offset of the message. Offsets of a topic start at 1. The
+	// logged message carries its offset.
+	Append(message entity.Message) (uint64, error)
+	// Topics returns the topics with a log, in lexical order.
+	Topics() []string
+	// Read calls fn with the logged messages of the topic from the
+	// position, in the order they were appended, until fn returns
+	// false. Messages appended meanwhile may not be read.
+	Read(topic string, position Position, fn func(entity.Message) bool) error
+	// Close syncs and closes the log.
+	Close() error
+}
+
+type topicLog struct {
+	config Config
+
+	mutex      sync.RWMutex
+	partitions map[string]*partition
+
+	close chan struct{}
+	done  sync.WaitGroup
+}
+
+// Open opens the log in the configured directory, creating it if it
+// doesn't exist. The records lost in a crash are truncated.
+func Open(config Config) (Log, error) {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = DefaultSegmentSize
+	}
+	if config.RetentionAge <= 0 {
+		config.RetentionAge = DefaultRetentionAge
+	}
+	if config.RetentionSize <= 0 {
+		config.RetentionSize = DefaultRetentionSize
+	}
+	if config.SyncPolicy == "" {
+		config.SyncPolicy = SyncInterval
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = DefaultSyncInterval
+	}
+
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "create log directory")
+	}
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read log directory")
+	}
+
+	l := &topicLog{
+		config:     config,
+		partitions: make(map[string]*partition),
+		close:      make(chan struct{}),
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		topic, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			log.Warnf("Skipping log directory %q: %s", entry.Name(), err.Error())
+			continue
+		}
+		partition, err := openPartition(filepath.Join(config.Dir, entry.Name()))
+		if err != nil {
+			l.closePartitions()
+			return nil, errors.Wrapf(err, "open log of topic %q", topic)
+		}
+		l.partitions[topic] = partition
+	}
+	log.Infof("Opened message log of %d topics in %s", len(l.partitions), config.Dir)
+
+	l.done.Add(1)
+	go l.run()
+	return l, nil
+}
+
+// topicDir returns the directory of the topic log. Topics are escaped
+// so that their levels and dots can't escape the log directory.
+func (l *topicLog) topicDir(topic string) string {
+	return filepath.Join(l.config.Dir, strings.ReplaceAll(url.PathEscape(topic), ".", "%2E"))
+}
+
+func (l *topicLog) Append(message entity.Message) (uint64, error) {
+	partition, err := l.partition(message.Topic)
+	if err != nil {
+		return 0, errors.Wrapf(err, "open log of topic %q", message.Topic)
+	}
+	offset, err := partition.append(message, l.config)
+	if err != nil {
+		return 0, errors.Wrapf(err, "append to log of topic %q", message.Topic)
+	}
+	return offset, nil
+}
+
+// partition returns the log of the topic, creating it if it doesn't
+// exist.
+func (l *topicLog) partition(topic string) (*partition, error) {
+	l.mutex.RLock()
+	p, ok := l.partitions[topic]
+	l.mutex.RUnlock()
+	if ok {
+		return p, nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if p, ok := l.partitions[topic]; ok {
+		return p, nil
+	}
+	dir := l.topicDir(topic)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "create topic directory")
+	}
+	p, err := openPartition(dir)
+	if err != nil {
+		return nil, err
+	}
+	l.partitions[topic] = p
+	return p, nil
+}
+
+func (l *topicLog) Topics() []string {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	topics := make([]string, 0, len(l.partitions))
+	for topic := range l.partitions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func (l *topicLog) Read(topic string, position Position, fn func(entity.Message) bool) error {
+	l.mutex.RLock()
+	p, ok := l.partitions[topic]
+	l.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	for _, snapshot := range p.snapshots() {
+		if snapshot.nextOffset <= position.Offset || snapshot.lastTime.Before(position.Since) {
+			continue
+		}
+
+		var decodeErr error
+		more, err := snapshot.read(position, func(record record) bool {
+			message, err := entity.MessageFromBytes(record.message)
+			if err != nil {
+				decodeErr = errors.Wrapf(err, "decode message at offset %d", record.offset)
+				return false
+			}
+			return fn(message)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "read log of topic %q", topic)
+		}
+		if decodeErr != nil {
+			return errors.Wrapf(decodeErr, "read log of topic %q", topic)
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// run syncs the logs at the sync interval and enforces the retention
+// until the log is closed.
+func (l *topicLog) run() {
+	defer l.done.Done()
+
+	syncTicker := time.NewTicker(l.config.SyncInterval)
+	defer syncTicker.Stop()
+	retentionTicker := time.NewTicker(RetentionCheckInterval)
+	defer retentionTicker.Stop()
+
+	for {
+		select {
+		case <-l.close:
+			return
+		case <-syncTicker.C:
+			if l.config.SyncPolicy == SyncInterval {
+				l.sync()
+			}
+		case now := <-retentionTicker.C:
+			l.enforceRetention(now)
+		}
+	}
+}
+
+func (l *topicLog) sync() {
+	for topic, p := range l.snapshotPartitions() {
+		if err := p.sync(); err != nil {
+			log.Errorf("Error syncing log of topic %q: %s", topic, err.Error())
+		}
+	}
+}
+
+func (l *topicLog) enforceRetention(now time.Time) {
+	for topic, p := range l.snapshotPartitions() {
+		if err := p.enforceRetention(now, l.config); err != nil {
+			log.Errorf("Error enforcing retention of topic %q: %s", topic, err.Error())
+		}
+	}
+}
+
+func (l *topicLog) snapshotPartitions() map[string]*partition {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	partitions := make(map[string]*partition, len(l.partitions))
+	for topic, p := range l.partitions {
+		partitions[topic] = p
+	}
+	return partitions
+}
+
+func (l *topicLog) Close() error {
+	close(l.close)
+	l.done.Wait()
+	return l.closePartitions()
+}
+
+func (l *topicLog) closePartitions() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var merr error
+	for topic, p := range l.partitions {
+		if err := p.close(); err != nil {
+			merr = multierr.Append(merr, errors.Wrapf(err, "close log of topic %q", topic))
+		}
+	}
+	return merr
+}
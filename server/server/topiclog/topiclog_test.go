@@ -0,0 +1,164 @@
+package topiclog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"assignment/lib/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMessage(topic, text string) entity.Message {
+	message := entity.NewTextMessage(text)
+	message.Topic = topic
+	return message
+}
+
+func readTopic(t *testing.T, l Log, topic string, position Position) []string {
+	var payloads []string
+	require.NoError(t, l.Read(topic, position, func(message entity.Message) bool {
+		payloads = append(payloads, string(message.Payload))
+		return true
+	}))
+	return payloads
+}
+
+func TestLog_Append_and_Read(t *testing.T) {
+	l, err := Open(Config{Dir: t.TempDir(), SegmentSize: 100, SyncPolicy: SyncAlways})
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i, text := range []string{"a", "b", "c", "d"} {
+		offset, err := l.Append(newTestMessage("orders/created", text))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i+1), offset)
+	}
+	offset, err := l.Append(newTestMessage("../escape", "e"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), offset)
+
+	assert.Equal(t, []string{"../escape", "orders/created"}, l.Topics())
+
+	tests := map[string]struct {
+		topic    string
+		position Position
+		want     []string
+	}{
+		"from_start":    {topic: "orders/created", want: []string{"a", "b", "c", "d"}},
+		"from_offset":   {topic: "orders/created", position: Position{Offset: 3}, want: []string{"c", "d"}},
+		"past_end":      {topic: "orders/created", position: Position{Offset: 5}},
+		"since_future":  {topic: "orders/created", position: Position{Since: time.Now().Add(time.Hour)}},
+		"since_past":    {topic: "orders/created", position: Position{Since: time.Now().Add(-time.Hour)}, want: []string{"a", "b", "c", "d"}},
+		"escaped_topic": {topic: "../escape", want: []string{"e"}},
+		"unknown_topic": {topic: "orders/deleted"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, readTopic(t, l, tc.topic, tc.position))
+		})
+	}
+
+	var offsets []uint64
+	require.NoError(t, l.Read("orders/created", Position{}, func(message entity.Message) bool {
+		offsets = append(offsets, message.Offset)
+		return len(offsets) < 2
+	}))
+	assert.Equal(t, []uint64{1, 2}, offsets)
+}
+
+func TestLog_recovery(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(Config{Dir: dir, SegmentSize: 100})
+	require.NoError(t, err)
+	for _, text := range []string{"a", "b", "c"} {
+		_, err := l.Append(newTestMessage("orders", text))
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// Simulate a crash in the middle of writing the last record.
+	segments, err := filepath.Glob(filepath.Join(dir, "orders", "*"+segmentExtension))
+	require.NoError(t, err)
+	require.NotEmpty(t, segments)
+	last := segments[len(segments)-1]
+	info, err := os.Stat(last)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(last, info.Size()-1))
+
+	l, err = Open(Config{Dir: dir, SegmentSize: 100})
+	require.NoError(t, err)
+	defer l.Close()
+
+	assert.Equal(t, []string{"a", "b"}, readTopic(t, l, "orders", Position{}))
+	offset, err := l.Append(newTestMessage("orders", "d"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), offset)
+	assert.Equal(t, []string{"a", "b", "d"}, readTopic(t, l, "orders", Position{}))
+}
+
+func TestPartition_enforceRetention(t *testing.T) {
+	tests := map[string]struct {
+		config Config
+		now    time.Time
+		want   []string
+	}{
+		"retained": {
+			config: Config{RetentionAge: time.Hour, RetentionSize: 1 << 20},
+			now:    time.Now(),
+			want:   []string{"a", "b", "c"},
+		},
+		"age": {
+			config: Config{RetentionAge: time.Hour, RetentionSize: 1 << 20},
+			now:    time.Now().Add(2 * time.Hour),
+			// The active segment is never removed.
+			want: []string{"c"},
+		},
+		"size": {
+			config: Config{RetentionAge: time.Hour, RetentionSize: 1},
+			now:    time.Now(),
+			want:   []string{"c"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := openPartition(t.TempDir())
+			require.NoError(t, err)
+			defer p.close()
+
+			// Every message starts a new segment.
+			tc.config.SegmentSize = 1
+			for _, text := range []string{"a", "b", "c"} {
+				_, err := p.append(newTestMessage("orders", text), tc.config)
+				require.NoError(t, err)
+			}
+			require.Len(t, p.segments, 3)
+
+			require.NoError(t, p.enforceRetention(tc.now, tc.config))
+			var payloads []string
+			for _, snapshot := range p.snapshots() {
+				_, err := snapshot.read(Position{}, func(r record) bool {
+					message, err := entity.MessageFromBytes(r.message)
+					require.NoError(t, err)
+					payloads = append(payloads, string(message.Payload))
+					return true
+				})
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tc.want, payloads)
+		})
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	policy, err := ParseSyncPolicy("always")
+	require.NoError(t, err)
+	assert.Equal(t, SyncAlways, policy)
+
+	_, err = ParseSyncPolicy("sometimes")
+	assert.ErrorIs(t, err, ErrUnknownSyncPolicy)
+}